@@ -0,0 +1,389 @@
+// Package client is a Go client for the key-value store's HTTP API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"keyvaluestore/storage"
+	"math"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRetries      = 3
+	defaultBackoff      = 100 * time.Millisecond
+	defaultMaxBackoff   = 5 * time.Second
+	defaultIdleConns    = 32
+	defaultIdleTimeout  = 90 * time.Second
+	defaultRequestLimit = 64 << 20
+)
+
+// Client talks to a key-value store server. It is safe for concurrent use
+// and reuses connections, so create one and share it.
+type Client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+	transport  *http.Transport
+
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// Option configures the Client returned by New.
+type Option func(*Client) error
+
+// WithTLSConfig sets the TLS configuration used to reach the server.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(c *Client) error {
+		c.transport.TLSClientConfig = cfg
+		return nil
+	}
+}
+
+// WithRootCAFile trusts the PEM certificates in path, in addition to the
+// system roots. This is how to reach a server using a self-signed
+// certificate such as the dev-cert.pem the server generates.
+func WithRootCAFile(path string) Option {
+	return func(c *Client) error {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("cannot read CA file: %w", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", path)
+		}
+
+		if c.transport.TLSClientConfig == nil {
+			c.transport.TLSClientConfig = &tls.Config{}
+		}
+		c.transport.TLSClientConfig.RootCAs = pool
+		return nil
+	}
+}
+
+// WithClientCertificate presents the given certificate to servers that
+// require mutual TLS.
+func WithClientCertificate(certFile, keyFile string) Option {
+	return func(c *Client) error {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("cannot load client certificate: %w", err)
+		}
+
+		if c.transport.TLSClientConfig == nil {
+			c.transport.TLSClientConfig = &tls.Config{}
+		}
+		c.transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+		return nil
+	}
+}
+
+// WithRetries sets how many times a failed request is retried, and the
+// initial and maximum delay between attempts. Delays double after each
+// attempt and are jittered; a server's Retry-After is honored up to the
+// maximum delay.
+func WithRetries(retries int, backoff, maxBackoff time.Duration) Option {
+	return func(c *Client) error {
+		c.retries = retries
+		c.backoff = backoff
+		c.maxBackoff = maxBackoff
+		return nil
+	}
+}
+
+// WithMaxIdleConns sets how many idle connections to the server are kept
+// open for reuse.
+func WithMaxIdleConns(n int) Option {
+	return func(c *Client) error {
+		c.transport.MaxIdleConns = n
+		c.transport.MaxIdleConnsPerHost = n
+		return nil
+	}
+}
+
+// WithTimeout bounds each attempt of a request, excluding Watch. Use the
+// context to bound a call including its retries.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) error {
+		c.httpClient.Timeout = d
+		return nil
+	}
+}
+
+// New returns a Client for the server at baseURL, such as
+// "https://localhost:8080".
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base URL: %w", err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = defaultIdleConns
+	transport.MaxIdleConnsPerHost = defaultIdleConns
+	transport.IdleConnTimeout = defaultIdleTimeout
+
+	c := &Client{
+		baseURL:    u,
+		transport:  transport,
+		httpClient: &http.Client{Transport: transport},
+		retries:    defaultRetries,
+		backoff:    defaultBackoff,
+		maxBackoff: defaultMaxBackoff,
+	}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Close releases idle connections.
+func (c *Client) Close() {
+	c.transport.CloseIdleConnections()
+}
+
+// Get returns the current value of key. A missing key is reported as an
+// error matching storage.ErrorNoSuchKey.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	body, err := c.do(ctx, http.MethodGet, keyPath(key), nil, nil)
+	return string(body), err
+}
+
+// GetAt returns the value key had just after the event with sequence seq.
+func (c *Client) GetAt(ctx context.Context, key string, seq uint64) (string, error) {
+	q := url.Values{"at": {strconv.FormatUint(seq, 10)}}
+	body, err := c.do(ctx, http.MethodGet, keyPath(key), q, nil)
+	return string(body), err
+}
+
+// Put sets key to value.
+func (c *Client) Put(ctx context.Context, key, value string) error {
+	_, err := c.do(ctx, http.MethodPut, keyPath(key), nil, []byte(value))
+	return err
+}
+
+// Delete removes key. Deleting a missing key is reported as an error
+// matching storage.ErrorNoSuchKey.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	_, err := c.do(ctx, http.MethodDelete, keyPath(key), nil, nil)
+	return err
+}
+
+// List returns every key with the given prefix and its value. An empty
+// prefix lists the whole store.
+func (c *Client) List(ctx context.Context, prefix string) (map[string]string, error) {
+	var q url.Values
+	if prefix != "" {
+		q = url.Values{"prefix": {prefix}}
+	}
+
+	body, err := c.do(ctx, http.MethodGet, "/v1/key", q, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var all map[string]string
+	if err := json.Unmarshal(body, &all); err != nil {
+		return nil, fmt.Errorf("invalid list response: %w", err)
+	}
+	return all, nil
+}
+
+// url resolves an API path, which may contain escaped segments, against the
+// base URL.
+func (c *Client) url(path string, query url.Values) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSuffix(c.baseURL.String(), "/") + path)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = query.Encode()
+	return u, nil
+}
+
+func keyPath(key string) string {
+	return "/v1/key/" + url.PathEscape(key)
+}
+
+// do sends a request, retrying transport failures and responses that say
+// the server is temporarily unable to serve it. Writes carry an
+// idempotency key that stays the same across retries, so a write the
+// server applied but could not acknowledge is not applied twice.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body []byte) ([]byte, error) {
+	u, err := c.url(path, query)
+	if err != nil {
+		return nil, err
+	}
+
+	var idempotencyKey string
+	if method != http.MethodGet {
+		idempotencyKey = newIdempotencyKey()
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+		if idempotencyKey != "" {
+			req.Header.Set(storage.IdempotencyKeyHeader, idempotencyKey)
+		}
+
+		respBody, retryAfter, err := c.roundTrip(req)
+		if err == nil || attempt >= c.retries || !retryable(err) {
+			return respBody, err
+		}
+
+		// A retry the context would not live to see is not worth waiting
+		// for; the caller gets the server's error instead.
+		delay := c.delay(attempt, retryAfter)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return nil, err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *Client) roundTrip(req *http.Request) ([]byte, time.Duration, error) {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, 0, &transportError{err: err}
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, defaultRequestLimit))
+	if err != nil {
+		return nil, 0, &transportError{err: err}
+	}
+
+	if resp.StatusCode >= 300 {
+		retryAfter, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return nil, time.Duration(retryAfter) * time.Second, newError(resp, body)
+	}
+	return body, 0, nil
+}
+
+// delay returns how long to wait before retry attempt+1: the server's
+// Retry-After, if it gave one, up to the maximum backoff, or otherwise
+// an exponential backoff with jitter.
+func (c *Client) delay(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return min(retryAfter, c.maxBackoff)
+	}
+
+	d := time.Duration(float64(c.backoff) * math.Pow(2, float64(attempt)))
+	if d > c.maxBackoff || d <= 0 {
+		d = c.maxBackoff
+	}
+	// Full jitter keeps clients that failed together from retrying together.
+	return time.Duration(mathrand.Int63n(int64(d) + 1))
+}
+
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Error is returned for requests the server answered with an error. It
+// matches the storage sentinel for its code with errors.Is, for example
+// storage.ErrorNoSuchKey for a missing key.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	RequestID  string
+}
+
+func (e *Error) Error() string {
+	if e.RequestID != "" {
+		return fmt.Sprintf("%s (%d %s, request %s)", e.Message, e.StatusCode, e.Code, e.RequestID)
+	}
+	return fmt.Sprintf("%s (%d %s)", e.Message, e.StatusCode, e.Code)
+}
+
+func (e *Error) Unwrap() error {
+	return storage.ErrorForCode(e.Code)
+}
+
+func newError(resp *http.Response, body []byte) *Error {
+	e := &Error{StatusCode: resp.StatusCode, RequestID: resp.Header.Get(storage.RequestIDHeader)}
+
+	var er storage.ErrorResponse
+	if json.Unmarshal(body, &er) == nil && er.Code != "" {
+		e.Code = er.Code
+		e.Message = er.Message
+		if er.RequestID != "" {
+			e.RequestID = er.RequestID
+		}
+		return e
+	}
+
+	// Not one of the server's JSON errors, e.g. from a proxy.
+	code := storage.CodeInternal
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		code = storage.CodeUnavailable
+	}
+	e.Code = code
+	e.Message = http.StatusText(resp.StatusCode)
+	return e
+}
+
+// transportError is a failure to get any response from the server.
+type transportError struct {
+	err error
+}
+
+func (e *transportError) Error() string { return e.err.Error() }
+func (e *transportError) Unwrap() error { return e.err }
+
+// retryable reports whether a request that failed with err may succeed if
+// sent again.
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var te *transportError
+	if errors.As(err, &te) {
+		return true
+	}
+
+	var e *Error
+	if errors.As(err, &e) {
+		switch e.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,276 @@
+package client
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"keyvaluestore/storage"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestServer starts a TLS server running the real storage.Handler on a
+// temporary transaction log, and returns a Client that trusts its
+// self-signed certificate the way it would trust cert.pem.
+func newTestServer(t *testing.T, wrap func(http.Handler) http.Handler) (*httptest.Server, *Client) {
+	t.Helper()
+
+	dir := t.TempDir()
+	broker := storage.NewBroker()
+	db, err := storage.NewInMemoryDB(storage.WithBroker(broker))
+	if err != nil {
+		t.Fatalf("Failed to create DB: %v", err)
+	}
+	logger, err := storage.InitializeFileTransactionLogger(db, filepath.Join(dir, "transaction.log"))
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	handler, err := storage.NewHandler(db, logger, storage.WithWatch(broker))
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+
+	var h http.Handler = storage.NewRouter(&handler)
+	if wrap != nil {
+		h = wrap(h)
+	}
+	ts := httptest.NewTLSServer(h)
+	t.Cleanup(ts.Close)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+
+	c, err := New(ts.URL, WithRootCAFile(certFile), WithRetries(3, time.Millisecond, 10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+	t.Cleanup(c.Close)
+	return ts, c
+}
+
+func TestClient_CRUD(t *testing.T) {
+	_, c := newTestServer(t, nil)
+	ctx := context.Background()
+
+	if err := c.Put(ctx, "app/a", "value with spaces"); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+	if err := c.Put(ctx, "app/b", "2"); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+	if err := c.Put(ctx, "other", "3"); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+
+	value, err := c.Get(ctx, "app/a")
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	if value != "value with spaces" {
+		t.Errorf("Expected 'value with spaces', got %q", value)
+	}
+
+	all, err := c.List(ctx, "app/")
+	if err != nil {
+		t.Fatalf("List returned error: %v", err)
+	}
+	expected := map[string]string{"app/a": "value with spaces", "app/b": "2"}
+	if !reflect.DeepEqual(all, expected) {
+		t.Errorf("List mismatch.\nGot:      %#v\nExpected: %#v", all, expected)
+	}
+
+	if err := c.Delete(ctx, "app/a"); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+
+	// Errors map back to the server's error types
+	if _, err := c.Get(ctx, "app/a"); !errors.Is(err, storage.ErrorNoSuchKey) {
+		t.Errorf("Expected ErrorNoSuchKey from Get, got %v", err)
+	}
+	err = c.Delete(ctx, "app/a")
+	if !errors.Is(err, storage.ErrorNoSuchKey) {
+		t.Errorf("Expected ErrorNoSuchKey from Delete, got %v", err)
+	}
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound || apiErr.RequestID == "" {
+		t.Errorf("Expected a 404 *Error with a request ID, got %#v", err)
+	}
+
+	// Point-in-time reads: app/a was written by the first event
+	value, err = c.GetAt(ctx, "app/a", 1)
+	if err != nil {
+		t.Fatalf("GetAt returned error: %v", err)
+	}
+	if value != "value with spaces" {
+		t.Errorf("Expected 'value with spaces' at sequence 1, got %q", value)
+	}
+}
+
+func TestClient_RetriesWithSameIdempotencyKey(t *testing.T) {
+	var mu sync.Mutex
+	var keys []string
+	failures := 2
+
+	// Fail the first attempts after the write has been applied, as a
+	// server would if the connection dropped before it could respond.
+	flaky := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodDelete {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			mu.Lock()
+			keys = append(keys, r.Header.Get(storage.IdempotencyKeyHeader))
+			fail := failures > 0
+			failures--
+			mu.Unlock()
+
+			if fail {
+				next.ServeHTTP(httptest.NewRecorder(), r)
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	_, c := newTestServer(t, flaky)
+	ctx := context.Background()
+
+	if err := c.Put(ctx, "k", "v"); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+
+	// Without the idempotency key the retries would see a 404, because the
+	// first attempt already deleted the key.
+	if err := c.Delete(ctx, "k"); err != nil {
+		t.Fatalf("Delete returned error after retries: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(keys) != 3 {
+		t.Fatalf("Expected 3 attempts, got %d", len(keys))
+	}
+	if keys[0] == "" || keys[0] != keys[1] || keys[1] != keys[2] {
+		t.Errorf("Expected one idempotency key across attempts, got %q", keys)
+	}
+}
+
+func TestClient_RetryAfter(t *testing.T) {
+	var mu sync.Mutex
+	failures := 1
+
+	// Ask for a retry far later than the client is willing to wait.
+	busy := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			fail := failures != 0
+			failures--
+			mu.Unlock()
+
+			if fail {
+				w.Header().Set("Retry-After", "3600")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	_, c := newTestServer(t, busy)
+
+	// 1. Retry-After is capped at the maximum backoff
+	start := time.Now()
+	if _, err := c.Get(context.Background(), "k"); !errors.Is(err, storage.ErrorNoSuchKey) {
+		t.Fatalf("Expected ErrorNoSuchKey after a retry, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the retry within the maximum backoff, took %v", elapsed)
+	}
+
+	// 2. A retry after the context's deadline is not waited for
+	mu.Lock()
+	failures = -1
+	mu.Unlock()
+	c.maxBackoff = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	start = time.Now()
+	var e *Error
+	if _, err := c.Get(ctx, "k"); !errors.As(err, &e) || e.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Expected the server's error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected no wait for a retry after the deadline, took %v", elapsed)
+	}
+}
+
+func TestClient_Watch(t *testing.T) {
+	_, c := newTestServer(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Written before the watch starts; replayed from the log
+	if err := c.Put(ctx, "app/old", "1"); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+
+	events, errs := c.Watch(ctx, "app/", 0)
+
+	// Give the watch time to subscribe, then make live changes.
+	time.Sleep(100 * time.Millisecond)
+	if err := c.Put(ctx, "other", "ignored"); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+	if err := c.Put(ctx, "app/new", "2"); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+	if err := c.Delete(ctx, "app/old"); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+
+	var got []Event
+	for len(got) < 2 {
+		select {
+		case e := <-events:
+			got = append(got, e)
+		case err := <-errs:
+			t.Fatalf("Watch stopped: %v", err)
+		case <-ctx.Done():
+			t.Fatalf("Timed out waiting for events, got %#v", got)
+		}
+	}
+
+	if got[0].Key != "app/new" || got[0].Type != "put" || got[0].Value != "2" || got[0].Sequence != 3 {
+		t.Errorf("Unexpected first event: %#v", got[0])
+	}
+	if got[1].Key != "app/old" || got[1].Type != "delete" || got[1].Sequence != 4 {
+		t.Errorf("Unexpected second event: %#v", got[1])
+	}
+
+	// Resuming from a sequence replays what was missed
+	cancel()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	events, _ = c.Watch(ctx, "app/", 1)
+	select {
+	case e := <-events:
+		if e.Sequence != 3 || e.Key != "app/new" {
+			t.Errorf("Expected to resume at sequence 3, got %#v", e)
+		}
+	case <-ctx.Done():
+		t.Fatal("Timed out waiting for replayed event")
+	}
+}
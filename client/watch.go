@@ -0,0 +1,129 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Event is a change delivered by Watch.
+type Event struct {
+	Sequence  uint64     `json:"sequence"`
+	Type      string     `json:"type"` // "put", "delete", "increment", "append" or "evict"
+	Key       string     `json:"key"`
+	Value     string     `json:"value,omitempty"`
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	RequestID string     `json:"request_id,omitempty"`
+	Principal string     `json:"principal,omitempty"`
+}
+
+// Watch streams changes to keys with the given prefix until ctx is done.
+// With since > 0 it starts with the logged changes after that sequence
+// number; otherwise it starts with the next change. When the connection
+// drops, Watch reconnects with backoff and resumes after the last event it
+// delivered, so no change is missed or repeated. The event channel is
+// closed when Watch stops; the error channel then carries the reason,
+// which is ctx.Err() for a cancelled watch.
+func (c *Client) Watch(ctx context.Context, prefix string, since uint64) (<-chan Event, <-chan error) {
+	events := make(chan Event)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(events)
+		defer close(errs)
+
+		resume := since > 0
+		failures := 0
+
+		for {
+			delivered, err := c.watchOnce(ctx, prefix, since, resume, events)
+			if delivered > since {
+				since = delivered
+				resume = true
+				failures = 0
+			}
+			if ctx.Err() != nil {
+				errs <- ctx.Err()
+				return
+			}
+			if err != nil && !retryable(err) {
+				errs <- err
+				return
+			}
+
+			failures++
+			select {
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			case <-time.After(c.delay(min(failures, 10), 0)):
+			}
+		}
+	}()
+
+	return events, errs
+}
+
+// watchOnce runs a single watch request and returns the sequence number of
+// the last event it delivered.
+func (c *Client) watchOnce(ctx context.Context, prefix string, since uint64, resume bool, out chan<- Event) (uint64, error) {
+	q := url.Values{}
+	if prefix != "" {
+		q.Set("prefix", prefix)
+	}
+	if resume {
+		q.Set("since", strconv.FormatUint(since, 10))
+	}
+
+	u, err := c.url("/v1/watch", q)
+	if err != nil {
+		return since, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return since, err
+	}
+
+	// Watches are long-lived, so they bypass the per-request timeout.
+	resp, err := (&http.Client{Transport: c.transport}).Do(req)
+	if err != nil {
+		return since, &transportError{err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body := make([]byte, 4096)
+		n, _ := resp.Body.Read(body)
+		return since, newError(resp, body[:n])
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), defaultRequestLimit)
+
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return since, fmt.Errorf("invalid watch event: %w", err)
+		}
+		if e.Sequence <= since && resume {
+			continue
+		}
+
+		select {
+		case out <- e:
+			since = e.Sequence
+			resume = true
+		case <-ctx.Done():
+			return since, ctx.Err()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return since, &transportError{err: err}
+	}
+	return since, &transportError{err: fmt.Errorf("watch stream ended")}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// record is a key and value read by import or written by export.
+type record struct {
+	Key   string
+	Value string
+}
+
+func runExport(a *app, args []string) error {
+	fs := newFlagSet("export", "[flags] [prefix]")
+	format := fs.String("format", "", "json or csv (default from -o, otherwise json)")
+	out := fs.String("o", "", "file to write (default stdout)")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return errors.New("expected at most one prefix")
+	}
+
+	f, err := bulkFormat(*format, *out)
+	if err != nil {
+		return err
+	}
+
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	all, err := c.List(context.Background(), fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		return writeRecords(a.stdout, f, all)
+	}
+
+	file, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err := writeRecords(file, f, all); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func runImport(a *app, args []string) error {
+	fs := newFlagSet("import", "[flags] [file]")
+	format := fs.String("format", "", "json or csv (default from the file name, otherwise json)")
+	workers := fs.Int("workers", 8, "number of concurrent writes")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return errors.New("expected at most one file")
+	}
+
+	f, err := bulkFormat(*format, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	r := a.stdin
+	if name := fs.Arg(0); name != "" && name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	records, err := readRecords(r, f)
+	if err != nil {
+		return err
+	}
+
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	jobs := make(chan record)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+
+	for i := 0; i < max(*workers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rec := range jobs {
+				if err := c.Put(ctx, rec.Key, rec.Value); err != nil {
+					once.Do(func() {
+						firstErr = fmt.Errorf("cannot put %q: %w", rec.Key, err)
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, rec := range records {
+		select {
+		case jobs <- rec:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	fmt.Fprintf(os.Stderr, "imported %d keys\n", len(records))
+	return nil
+}
+
+// bulkFormat returns the format to use for import or export: format if
+// given, otherwise the extension of filename, otherwise json.
+func bulkFormat(format, filename string) (string, error) {
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), ".")
+		if format != "csv" {
+			format = "json"
+		}
+	}
+	switch format {
+	case "json", "csv":
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown format %q; use json or csv", format)
+}
+
+// writeRecords writes all, sorted by key, as a JSON object or as CSV with
+// a key,value header.
+func writeRecords(w io.Writer, format string, all map[string]string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(all)
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"key", "value"})
+	for _, k := range sortedKeys(all) {
+		cw.Write([]string{k, all[k]})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// readRecords reads records written by writeRecords. JSON records come
+// back sorted by key; CSV records in file order, with an optional
+// key,value header.
+func readRecords(r io.Reader, format string) ([]record, error) {
+	if format == "json" {
+		var all map[string]string
+		if err := json.NewDecoder(r).Decode(&all); err != nil {
+			return nil, fmt.Errorf("invalid JSON import: expected an object of string values: %w", err)
+		}
+		records := make([]record, 0, len(all))
+		for _, k := range sortedKeys(all) {
+			records = append(records, record{Key: k, Value: all[k]})
+		}
+		return records, nil
+	}
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 2
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV import: %w", err)
+	}
+	if len(rows) > 0 && rows[0][0] == "key" && rows[0][1] == "value" {
+		rows = rows[1:]
+	}
+
+	records := make([]record, 0, len(rows))
+	for _, row := range rows {
+		records = append(records, record{Key: row[0], Value: row[1]})
+	}
+	return records, nil
+}
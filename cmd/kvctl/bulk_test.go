@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestRecords_RoundTrip(t *testing.T) {
+	all := map[string]string{
+		"app/a":     "plain",
+		"app/b":     "with, comma and \"quotes\"",
+		"app/c":     "multi\nline",
+		"key":       "",
+		"unicode/é": "ü",
+	}
+
+	for _, format := range []string{"json", "csv"} {
+		var buf bytes.Buffer
+		if err := writeRecords(&buf, format, all); err != nil {
+			t.Fatalf("%s: writeRecords returned error: %v", format, err)
+		}
+
+		records, err := readRecords(&buf, format)
+		if err != nil {
+			t.Fatalf("%s: readRecords returned error: %v", format, err)
+		}
+
+		got := make(map[string]string)
+		for _, rec := range records {
+			got[rec.Key] = rec.Value
+		}
+		if !reflect.DeepEqual(got, all) {
+			t.Errorf("%s: round trip mismatch.\nGot:      %#v\nExpected: %#v", format, got, all)
+		}
+	}
+}
+
+func TestBulkFormat(t *testing.T) {
+	tests := []struct {
+		format, filename, expected string
+	}{
+		{"", "", "json"},
+		{"", "keys.CSV", "csv"},
+		{"", "keys.txt", "json"},
+		{"csv", "keys.json", "csv"},
+	}
+	for _, tt := range tests {
+		got, err := bulkFormat(tt.format, tt.filename)
+		if err != nil || got != tt.expected {
+			t.Errorf("bulkFormat(%q, %q) = %q, %v; expected %q", tt.format, tt.filename, got, err, tt.expected)
+		}
+	}
+	if _, err := bulkFormat("xml", ""); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+)
+
+func runGet(a *app, args []string) error {
+	fs := newFlagSet("get", "[flags] <key>")
+	at := fs.Uint64("at", 0, "print the value as of this sequence number")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected one key")
+	}
+
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	var value string
+	if *at > 0 {
+		value, err = c.GetAt(context.Background(), fs.Arg(0), *at)
+	} else {
+		value, err = c.Get(context.Background(), fs.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(a.stdout, value)
+	return err
+}
+
+func runPut(a *app, args []string) error {
+	fs := newFlagSet("put", "[flags] <key> [value]")
+	file := fs.String("f", "", "read the value from this file ('-' for stdin)")
+	fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 || (fs.NArg() == 2 && *file != "") {
+		fs.Usage()
+		return errors.New("expected a key and either a value or -f")
+	}
+
+	var value string
+	switch {
+	case fs.NArg() == 2:
+		value = fs.Arg(1)
+	case *file != "" && *file != "-":
+		b, err := os.ReadFile(*file)
+		if err != nil {
+			return err
+		}
+		value = string(b)
+	default:
+		b, err := io.ReadAll(a.stdin)
+		if err != nil {
+			return fmt.Errorf("cannot read value from stdin: %w", err)
+		}
+		value = string(b)
+	}
+
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	return c.Put(context.Background(), fs.Arg(0), value)
+}
+
+func runDelete(a *app, args []string) error {
+	fs := newFlagSet("delete", "<key>")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected one key")
+	}
+
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	return c.Delete(context.Background(), fs.Arg(0))
+}
+
+func runList(a *app, args []string) error {
+	fs := newFlagSet("list", "[flags] [prefix]")
+	keysOnly := fs.Bool("keys", false, "print only the keys")
+	asJSON := fs.Bool("json", false, "print a JSON object")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return errors.New("expected at most one prefix")
+	}
+
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	all, err := c.List(context.Background(), fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(a.stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(all)
+	}
+
+	for _, k := range sortedKeys(all) {
+		if *keysOnly {
+			fmt.Fprintln(a.stdout, k)
+		} else {
+			fmt.Fprintf(a.stdout, "%s\t%s\n", k, quoteValue(all[k]))
+		}
+	}
+	return nil
+}
+
+// quoteValue keeps one key per line of list output by quoting values
+// holding line breaks or tabs.
+func quoteValue(v string) string {
+	if strings.ContainsAny(v, "\t\n\r") {
+		return fmt.Sprintf("%q", v)
+	}
+	return v
+}
+
+func runWatch(a *app, args []string) error {
+	fs := newFlagSet("watch", "[flags] [prefix]")
+	since := fs.Uint64("since", 0, "start with the changes after this sequence number")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return errors.New("expected at most one prefix")
+	}
+
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	events, errs := c.Watch(ctx, fs.Arg(0), *since)
+
+	enc := json.NewEncoder(a.stdout)
+	for e := range events {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"keyvaluestore/storage"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const logUsage = `usage: kvctl log <inspect|verify|compact|dump> [flags]
+
+Works on the transaction log in the data directory of a server. The log
+is only read, except by compact, which must not be run while a server is
+using the log.
+`
+
+var logCommands = map[string]func(a *app, args []string) error{
+	"inspect": runLogInspect,
+	"verify":  runLogVerify,
+	"compact": runLogCompact,
+	"dump":    runLogDump,
+}
+
+func runLog(a *app, args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, logUsage)
+		return errors.New("expected a log command")
+	}
+	run, ok := logCommands[args[0]]
+	if !ok {
+		fmt.Fprint(os.Stderr, logUsage)
+		return fmt.Errorf("unknown log command %q", args[0])
+	}
+	return run(a, args[1:])
+}
+
+// logFlags are the flags that locate the transaction log and the key file
+// it is encrypted with, if any.
+type logFlags struct {
+	dataDir string
+	log     string
+	keyFile string
+}
+
+func registerLogFlags(fs *flag.FlagSet) *logFlags {
+	f := &logFlags{}
+	fs.StringVar(&f.dataDir, "data-dir", ".", "data directory of the server")
+	fs.StringVar(&f.log, "log", "transaction.log", "transaction log, relative to -data-dir")
+	fs.StringVar(&f.keyFile, "keyfile", "", "key file of an encrypted log")
+	return f
+}
+
+// options returns the options that read, and write, the log.
+func (f *logFlags) options() ([]storage.LogOption, error) {
+	if f.keyFile == "" {
+		return nil, nil
+	}
+	keys, err := storage.LoadKeyFile(f.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return []storage.LogOption{storage.WithEncryption(keys)}, nil
+}
+
+func (f *logFlags) path() string {
+	if filepath.IsAbs(f.log) {
+		return f.log
+	}
+	return filepath.Join(f.dataDir, f.log)
+}
+
+func runLogInspect(a *app, args []string) error {
+	fs := newFlagSet("log inspect", "[flags]")
+	lf := registerLogFlags(fs)
+	asJSON := fs.Bool("json", false, "print the summary as JSON")
+	fs.Parse(args)
+
+	opts, err := lf.options()
+	if err != nil {
+		return err
+	}
+	stats, err := storage.InspectTransactionLog(lf.path(), opts...)
+	var logErr *storage.LogError
+	if err != nil && !errors.As(err, &logErr) {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(a.stdout)
+		enc.SetIndent("", "  ")
+		if encErr := enc.Encode(stats); encErr != nil {
+			return encErr
+		}
+	} else {
+		fmt.Fprintf(a.stdout, "file:            %s\n", lf.path())
+		fmt.Fprintf(a.stdout, "size:            %d bytes\n", stats.Size)
+		fmt.Fprintf(a.stdout, "records:         %d (%d puts, %d deletes, %d evictions, %d updates, %d lock operations, %d index operations)\n",
+			stats.Records, stats.Puts, stats.Deletes, stats.Evictions, stats.Updates, stats.LockOps, stats.IndexOps)
+		fmt.Fprintf(a.stdout, "sequences:       %d to %d\n", stats.FirstSequence, stats.LastSequence)
+		fmt.Fprintf(a.stdout, "timestamps:      %s to %s\n", formatTime(stats.FirstTimestamp), formatTime(stats.LastTimestamp))
+		fmt.Fprintf(a.stdout, "live keys:       %d (%d bytes)\n", stats.LiveKeys, stats.LiveBytes)
+		if stats.Records > 0 {
+			fmt.Fprintf(a.stdout, "compactable:     %d records\n", stats.Records-stats.LiveKeys)
+		}
+	}
+
+	if logErr != nil {
+		return fmt.Errorf("log is damaged, summary stops at %w", logErr)
+	}
+	return nil
+}
+
+func runLogVerify(a *app, args []string) error {
+	fs := newFlagSet("log verify", "[flags]")
+	lf := registerLogFlags(fs)
+	fs.Parse(args)
+
+	opts, err := lf.options()
+	if err != nil {
+		return err
+	}
+
+	report, err := storage.ValidateTransactionLog(lf.path(), opts...)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range report.Problems {
+		fmt.Fprintf(a.stdout, "bad record: %v\n", p)
+	}
+	if len(report.Problems) > 0 {
+		return fmt.Errorf("log is damaged: %d good records, last sequence %d, %d bad records; see 'keyvaluestore logtool salvage'",
+			report.Records, report.LastSequence, len(report.Problems))
+	}
+	fmt.Fprintf(a.stdout, "ok: %d records, last sequence %d\n", report.Records, report.LastSequence)
+	return nil
+}
+
+func runLogCompact(a *app, args []string) error {
+	fs := newFlagSet("log compact", "[flags]")
+	lf := registerLogFlags(fs)
+	out := fs.String("out", "", "write the compacted log here instead of replacing the log")
+	backup := fs.Bool("backup", true, "when replacing the log, keep the original as <log>.bak")
+	compression := fs.String("compression", "", "compress values of 1 KiB or more in the compacted log: gzip or zstd")
+	fs.Parse(args)
+
+	opts, err := lf.options()
+	if err != nil {
+		return err
+	}
+	if *compression != "" {
+		c, err := storage.NewCompressor(*compression, 0)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, storage.WithLogCompression(c))
+	}
+
+	src := lf.path()
+	before, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("cannot open transaction log file: %w", err)
+	}
+
+	dst := *out
+	if dst == "" {
+		dst = src
+		if *backup {
+			if err := copyFile(src, src+".bak"); err != nil {
+				return fmt.Errorf("cannot back up the log: %w", err)
+			}
+		}
+	}
+
+	if err := storage.CompactTransactionLog(src, dst, opts...); err != nil {
+		return err
+	}
+
+	after, err := os.Stat(dst)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(a.stdout, "compacted %s: %d to %d bytes\n", dst, before.Size(), after.Size())
+	return nil
+}
+
+func runLogDump(a *app, args []string) error {
+	fs := newFlagSet("log dump", "[flags]")
+	lf := registerLogFlags(fs)
+	from := fs.Uint64("from", 0, "first sequence number to print")
+	to := fs.Uint64("to", 0, "last sequence number to print (0 for the end of the log)")
+	prefix := fs.String("prefix", "", "only print events for keys with this prefix")
+	fs.Parse(args)
+
+	if *to != 0 && *to < *from {
+		return errors.New("-to must not be less than -from")
+	}
+
+	opts, err := lf.options()
+	if err != nil {
+		return err
+	}
+
+	errDone := errors.New("done")
+	enc := json.NewEncoder(a.stdout)
+
+	err = storage.ScanTransactionLog(lf.path(), func(rec storage.LogRecord) error {
+		e := rec.Event
+		switch {
+		case e.Sequence < *from:
+			return nil
+		case *to != 0 && e.Sequence > *to:
+			return errDone
+		case !strings.HasPrefix(e.Key, *prefix):
+			return nil
+		}
+		return enc.Encode(storage.NewAuditRecord(e))
+	}, opts...)
+	if errors.Is(err, errDone) {
+		return nil
+	}
+	return err
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// copyFile copies src to dst, which is only readable by its owner, and
+// syncs it, so that a log of any size can be backed up.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,132 @@
+// Command kvctl reads and writes keys on a key-value store server, and
+// inspects and maintains the transaction log of a stopped one.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"keyvaluestore/client"
+	"os"
+	"sort"
+	"time"
+)
+
+const usage = `usage: kvctl [flags] <command> [args]
+
+Commands against a running server:
+  get <key>              print the value of key
+  put <key> [value]      set key to value, read from -f or stdin if omitted
+  delete <key>           delete key
+  list [prefix]          print the keys with prefix and their values
+  watch [prefix]         print changes to keys with prefix as they happen
+  export [prefix]        write the keys with prefix as JSON or CSV
+  import [file]          write the keys in a JSON or CSV file
+
+Commands against the transaction log of a stopped server:
+  log inspect            summarise the log
+  log verify             check the log for damage
+  log compact            rewrite the log with one record per live key
+  log dump               print the events between two sequence numbers
+
+Run 'kvctl <command> -h' for the flags of a command.
+
+Flags:
+`
+
+// app holds the global flags and the streams commands read and write.
+type app struct {
+	server   string
+	caFile   string
+	certFile string
+	keyFile  string
+	timeout  time.Duration
+
+	stdin  io.Reader
+	stdout io.Writer
+}
+
+type command func(a *app, args []string) error
+
+var commands = map[string]command{
+	"get":    runGet,
+	"put":    runPut,
+	"delete": runDelete,
+	"list":   runList,
+	"watch":  runWatch,
+	"export": runExport,
+	"import": runImport,
+	"log":    runLog,
+}
+
+func main() {
+	a := &app{stdin: os.Stdin, stdout: os.Stdout}
+
+	fs := flag.NewFlagSet("kvctl", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&a.server, "server", envOr("KVCTL_SERVER", "https://localhost:8080"), "server URL (or $KVCTL_SERVER)")
+	fs.StringVar(&a.caFile, "ca", os.Getenv("KVCTL_CA"), "PEM file of certificates to trust, such as the server's dev-cert.pem (or $KVCTL_CA)")
+	fs.StringVar(&a.certFile, "cert", "", "client certificate for mutual TLS")
+	fs.StringVar(&a.keyFile, "key", "", "client certificate key for mutual TLS")
+	fs.DurationVar(&a.timeout, "timeout", 30*time.Second, "timeout for each request, excluding watch")
+	fs.Parse(os.Args[1:])
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	run, ok := commands[fs.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "kvctl: unknown command %q\n\n", fs.Arg(0))
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(a, fs.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "kvctl %s: %v\n", fs.Arg(0), err)
+		os.Exit(1)
+	}
+}
+
+// client returns a client for the configured server.
+func (a *app) client() (*client.Client, error) {
+	opts := []client.Option{client.WithTimeout(a.timeout)}
+	if a.caFile != "" {
+		opts = append(opts, client.WithRootCAFile(a.caFile))
+	}
+	if a.certFile != "" || a.keyFile != "" {
+		opts = append(opts, client.WithClientCertificate(a.certFile, a.keyFile))
+	}
+	return client.New(a.server, opts...)
+}
+
+// newFlagSet returns the flag set of a command, whose usage line is
+// "kvctl name synopsis".
+func newFlagSet(name, synopsis string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: kvctl %s %s\n", name, synopsis)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
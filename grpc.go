@@ -0,0 +1,30 @@
+package main
+
+import (
+	"crypto/tls"
+	"keyvaluestore/grpcapi"
+	"keyvaluestore/storage"
+	"log"
+	"net"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// serveGRPC serves the gRPC API of svc on addr, with the TLS configuration
+// the HTTP API uses, or without TLS if tlsConfig is nil.
+func serveGRPC(addr string, svc *storage.Service, tlsConfig *tls.Config) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	var opts []grpc.ServerOption
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	server := grpcapi.NewGRPCServer(svc, opts...)
+
+	log.Printf("serving gRPC on %s", lis.Addr())
+	return server.Serve(lis)
+}
@@ -0,0 +1,102 @@
+package grpcapi
+
+import (
+	"context"
+	"crypto/tls"
+	"keyvaluestore/storage"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// requestIDMetadata carries the request ID in both directions, like the
+// X-Request-ID header of the HTTP API.
+var requestIDMetadata = strings.ToLower(storage.RequestIDHeader)
+
+// ErrorDomain is the domain of the errdetails.ErrorInfo attached to every
+// error status. Its reason is the storage error code, such as "not_found".
+const ErrorDomain = "keyvaluestore"
+
+type requestIDKey struct{}
+
+// withRequestID stores the request ID sent by the client, or a new one, in
+// ctx and sends it back in the response header.
+func withRequestID(ctx context.Context) context.Context {
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(requestIDMetadata); len(ids) > 0 {
+			id = ids[0]
+		}
+	}
+	if id == "" {
+		id = storage.NewRequestID()
+	}
+
+	grpc.SetHeader(ctx, metadata.Pairs(requestIDMetadata, id))
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func unaryRequestID(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	return handler(withRequestID(ctx), req)
+}
+
+func streamRequestID(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &requestIDStream{ServerStream: ss, ctx: withRequestID(ss.Context())})
+}
+
+// requestIDStream is a grpc.ServerStream whose context holds the request ID.
+type requestIDStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *requestIDStream) Context() context.Context { return s.ctx }
+
+// caller identifies who made the call in ctx, for the events it causes.
+func caller(ctx context.Context) storage.Caller {
+	c := storage.Caller{}
+	c.RequestID, _ = ctx.Value(requestIDKey{}).(string)
+
+	if p, ok := peer.FromContext(ctx); ok {
+		var state *tls.ConnectionState
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			state = &info.State
+		}
+		c.Principal = storage.Principal(state, p.Addr.String())
+	}
+	return c
+}
+
+// statusError converts a storage error to a gRPC status with the matching
+// code, and the storage error code as the reason of an ErrorInfo detail.
+func statusError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	code, _ := storage.ErrorCode(err)
+	st := status.New(grpcCodes[code], err.Error())
+	if detailed, derr := st.WithDetails(&errdetails.ErrorInfo{Reason: code, Domain: ErrorDomain}); derr == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+var grpcCodes = map[string]codes.Code{
+	storage.CodeNotFound:           codes.NotFound,
+	storage.CodeHistoryUnavailable: codes.OutOfRange,
+	storage.CodeConflict:           codes.Aborted,
+	storage.CodePreconditionFailed: codes.FailedPrecondition,
+	storage.CodeTooLarge:           codes.ResourceExhausted,
+	storage.CodeReadOnly:           codes.PermissionDenied,
+	storage.CodeUnavailable:        codes.Unavailable,
+	storage.CodeInvalidArgument:    codes.InvalidArgument,
+	storage.CodeRateLimited:        codes.ResourceExhausted,
+	storage.CodeInternal:           codes.Internal,
+}
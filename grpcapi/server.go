@@ -0,0 +1,157 @@
+// Package grpcapi serves the gRPC API of the key-value store, defined in
+// proto/kvstore/v1/kvstore.proto, on top of the storage.Service shared
+// with the HTTP API.
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"keyvaluestore/kvpb"
+	"keyvaluestore/storage"
+	"sort"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Server implements kvpb.KeyValueServer.
+type Server struct {
+	kvpb.UnimplementedKeyValueServer
+
+	svc *storage.Service
+}
+
+// NewServer returns a Server for svc.
+func NewServer(svc *storage.Service) *Server {
+	return &Server{svc: svc}
+}
+
+// NewGRPCServer returns a gRPC server serving svc, with the interceptors
+// that give every call a request ID. opts are passed to grpc.NewServer;
+// use them for the TLS credentials.
+func NewGRPCServer(svc *storage.Service, opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(unaryRequestID),
+		grpc.ChainStreamInterceptor(streamRequestID),
+	)
+	s := grpc.NewServer(opts...)
+	kvpb.RegisterKeyValueServer(s, NewServer(svc))
+	return s
+}
+
+func (s *Server) Get(ctx context.Context, req *kvpb.GetRequest) (*kvpb.GetResponse, error) {
+	var value string
+	var err error
+
+	switch {
+	case req.AtSequence != 0 && req.AtTime != nil:
+		err = fmt.Errorf("%w: set at most one of at_sequence and at_time", storage.ErrorInvalidArgument)
+	case req.AtSequence != 0:
+		value, err = s.svc.GetAt(req.Key, req.AtSequence)
+	case req.AtTime != nil:
+		value, err = s.svc.GetAtTime(req.Key, req.AtTime.AsTime())
+	default:
+		value, err = s.svc.Get(req.Key)
+	}
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &kvpb.GetResponse{Value: []byte(value)}, nil
+}
+
+func (s *Server) Put(ctx context.Context, req *kvpb.PutRequest) (*kvpb.PutResponse, error) {
+	seq, err := s.svc.Put(caller(ctx), req.Key, string(req.Value))
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &kvpb.PutResponse{Sequence: seq}, nil
+}
+
+func (s *Server) Delete(ctx context.Context, req *kvpb.DeleteRequest) (*kvpb.DeleteResponse, error) {
+	seq, err := s.svc.Delete(caller(ctx), req.Key)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &kvpb.DeleteResponse{Sequence: seq}, nil
+}
+
+func (s *Server) Scan(ctx context.Context, req *kvpb.ScanRequest) (*kvpb.ScanResponse, error) {
+	entries, _, err := s.svc.Snapshot(req.Prefix)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].Key > req.StartAfter })
+	entries = entries[i:]
+
+	resp := &kvpb.ScanResponse{}
+	if req.Limit > 0 && len(entries) > int(req.Limit) {
+		entries = entries[:req.Limit]
+		resp.More = true
+	}
+	for _, e := range entries {
+		resp.Pairs = append(resp.Pairs, &kvpb.KeyValuePair{Key: e.Key, Value: []byte(e.Value)})
+	}
+	return resp, nil
+}
+
+func (s *Server) Txn(ctx context.Context, req *kvpb.TxnRequest) (*kvpb.TxnResponse, error) {
+	ops := make([]storage.Op, len(req.Ops))
+	for i, op := range req.Ops {
+		switch o := op.Op.(type) {
+		case *kvpb.Op_Put:
+			ops[i] = storage.Op{Type: storage.EventPut, Key: o.Put.Key, Value: string(o.Put.Value)}
+		case *kvpb.Op_Delete:
+			ops[i] = storage.Op{Type: storage.EventDelete, Key: o.Delete.Key}
+		default:
+			return nil, statusError(fmt.Errorf("%w: operation %d is empty", storage.ErrorInvalidArgument, i))
+		}
+	}
+
+	seq, err := s.svc.Txn(caller(ctx), ops)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &kvpb.TxnResponse{Sequence: seq}, nil
+}
+
+func (s *Server) Watch(req *kvpb.WatchRequest, stream kvpb.KeyValue_WatchServer) error {
+	send := func(e storage.Event) error {
+		return stream.Send(newEvent(e))
+	}
+
+	err := s.svc.Watch(stream.Context(), req.Prefix, req.GetSince(), req.Since != nil, send, nil)
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return statusError(err)
+}
+
+func newEvent(e storage.Event) *kvpb.Event {
+	pe := &kvpb.Event{
+		Sequence:  e.Sequence,
+		Key:       e.Key,
+		Value:     []byte(e.Value),
+		Result:    []byte(e.Result),
+		RequestId: e.RequestID,
+		Principal: e.Principal,
+	}
+	switch e.EventType {
+	case storage.EventPut:
+		pe.Type = kvpb.Event_TYPE_PUT
+	case storage.EventDelete, storage.EventEvict:
+		pe.Type = kvpb.Event_TYPE_DELETE
+	case storage.EventIncrement:
+		pe.Type = kvpb.Event_TYPE_INCREMENT
+	case storage.EventAppend:
+		pe.Type = kvpb.Event_TYPE_APPEND
+	case storage.EventMergePatch:
+		pe.Type = kvpb.Event_TYPE_MERGE_PATCH
+	case storage.EventJSONPatch:
+		pe.Type = kvpb.Event_TYPE_JSON_PATCH
+	}
+	if !e.Timestamp.IsZero() {
+		pe.Timestamp = timestamppb.New(e.Timestamp)
+	}
+	return pe
+}
@@ -0,0 +1,252 @@
+package grpcapi
+
+import (
+	"context"
+	"keyvaluestore/kvpb"
+	"keyvaluestore/storage"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestClient serves the real storage.Service, on a temporary transaction
+// log, over an in-memory connection.
+func newTestClient(t *testing.T) kvpb.KeyValueClient {
+	t.Helper()
+	c, _ := newTestService(t)
+	return c
+}
+
+// newTestService is newTestClient, also returning the Service, for the
+// writes the gRPC API does not offer.
+func newTestService(t *testing.T) (kvpb.KeyValueClient, *storage.Service) {
+	t.Helper()
+
+	broker := storage.NewBroker()
+	db, err := storage.NewInMemoryDB(storage.WithBroker(broker))
+	if err != nil {
+		t.Fatalf("Failed to create DB: %v", err)
+	}
+	logger, err := storage.InitializeFileTransactionLogger(db, filepath.Join(t.TempDir(), "transaction.log"))
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	svc := storage.NewService(db, logger, storage.WithWatch(broker), storage.WithMaxValueSize(16))
+
+	lis := bufconn.Listen(1 << 20)
+	server := NewGRPCServer(svc)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return kvpb.NewKeyValueClient(conn), svc
+}
+
+// expectCode checks err is a status with code and the storage error code
+// reason.
+func expectCode(t *testing.T, err error, code codes.Code, reason string) {
+	t.Helper()
+
+	st := status.Convert(err)
+	if st.Code() != code {
+		t.Fatalf("Expected code %v, got %v", code, err)
+	}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.Reason == reason && info.Domain == ErrorDomain {
+			return
+		}
+	}
+	t.Errorf("Expected an ErrorInfo with reason %q, got %v", reason, st.Details())
+}
+
+func TestServer_GetPutDelete(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	var header metadata.MD
+	ctx2 := metadata.AppendToOutgoingContext(ctx, "x-request-id", "req-42")
+	put, err := c.Put(ctx2, &kvpb.PutRequest{Key: "a", Value: []byte("1")}, grpc.Header(&header))
+	if err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+	if put.Sequence != 1 {
+		t.Errorf("Expected sequence 1, got %d", put.Sequence)
+	}
+	if ids := header.Get("x-request-id"); len(ids) != 1 || ids[0] != "req-42" {
+		t.Errorf("Expected the request ID to be echoed, got %v", ids)
+	}
+
+	if _, err := c.Put(ctx, &kvpb.PutRequest{Key: "a", Value: []byte("2")}); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+
+	get, err := c.Get(ctx, &kvpb.GetRequest{Key: "a"})
+	if err != nil || string(get.Value) != "2" {
+		t.Fatalf("Get returned %v, %v; expected 2", get, err)
+	}
+	get, err = c.Get(ctx, &kvpb.GetRequest{Key: "a", AtSequence: 1})
+	if err != nil || string(get.Value) != "1" {
+		t.Fatalf("Get at sequence 1 returned %v, %v; expected 1", get, err)
+	}
+
+	if _, err := c.Delete(ctx, &kvpb.DeleteRequest{Key: "a"}); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+
+	// Errors carry the same codes as the HTTP API
+	_, err = c.Get(ctx, &kvpb.GetRequest{Key: "a"})
+	expectCode(t, err, codes.NotFound, storage.CodeNotFound)
+	_, err = c.Delete(ctx, &kvpb.DeleteRequest{Key: "a"})
+	expectCode(t, err, codes.NotFound, storage.CodeNotFound)
+	_, err = c.Put(ctx, &kvpb.PutRequest{Key: "big", Value: make([]byte, 17)})
+	expectCode(t, err, codes.ResourceExhausted, storage.CodeTooLarge)
+	_, err = c.Put(ctx, &kvpb.PutRequest{Key: "", Value: []byte("x")})
+	expectCode(t, err, codes.InvalidArgument, storage.CodeInvalidArgument)
+}
+
+func TestServer_TxnIsAtomic(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	txn := &kvpb.TxnRequest{Ops: []*kvpb.Op{
+		{Op: &kvpb.Op_Put{Put: &kvpb.PutRequest{Key: "a", Value: []byte("1")}}},
+		{Op: &kvpb.Op_Put{Put: &kvpb.PutRequest{Key: "b", Value: []byte("2")}}},
+	}}
+	resp, err := c.Txn(ctx, txn)
+	if err != nil || resp.Sequence != 2 {
+		t.Fatalf("Txn returned %v, %v; expected sequence 2", resp, err)
+	}
+
+	// The delete of a missing key fails the whole transaction
+	txn = &kvpb.TxnRequest{Ops: []*kvpb.Op{
+		{Op: &kvpb.Op_Delete{Delete: &kvpb.DeleteRequest{Key: "a"}}},
+		{Op: &kvpb.Op_Delete{Delete: &kvpb.DeleteRequest{Key: "missing"}}},
+	}}
+	_, err = c.Txn(ctx, txn)
+	expectCode(t, err, codes.NotFound, storage.CodeNotFound)
+
+	if _, err := c.Get(ctx, &kvpb.GetRequest{Key: "a"}); err != nil {
+		t.Errorf("Expected a to survive the failed transaction, got %v", err)
+	}
+}
+
+func TestServer_ScanPages(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	for _, k := range []string{"app/c", "app/a", "other", "app/b"} {
+		if _, err := c.Put(ctx, &kvpb.PutRequest{Key: k, Value: []byte(k)}); err != nil {
+			t.Fatalf("Put returned error: %v", err)
+		}
+	}
+
+	var keys []string
+	req := &kvpb.ScanRequest{Prefix: "app/", Limit: 2}
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("Scan did not finish")
+		}
+		resp, err := c.Scan(ctx, req)
+		if err != nil {
+			t.Fatalf("Scan returned error: %v", err)
+		}
+		for _, p := range resp.Pairs {
+			keys = append(keys, p.Key)
+		}
+		if !resp.More {
+			break
+		}
+		req.StartAfter = resp.Pairs[len(resp.Pairs)-1].Key
+	}
+
+	if len(keys) != 3 || keys[0] != "app/a" || keys[1] != "app/b" || keys[2] != "app/c" {
+		t.Errorf("Expected app/a, app/b and app/c in order, got %v", keys)
+	}
+}
+
+func TestServer_Watch(t *testing.T) {
+	c := newTestClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := c.Put(ctx, &kvpb.PutRequest{Key: "app/old", Value: []byte("1")}); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+
+	since := uint64(0)
+	stream, err := c.Watch(ctx, &kvpb.WatchRequest{Prefix: "app/", Since: &since})
+	if err != nil {
+		t.Fatalf("Watch returned error: %v", err)
+	}
+
+	// The logged change is replayed first
+	e, err := stream.Recv()
+	if err != nil || e.Key != "app/old" || e.Sequence != 1 || e.Type != kvpb.Event_TYPE_PUT {
+		t.Fatalf("Expected the logged put of app/old, got %v, %v", e, err)
+	}
+
+	// Then live changes, filtered by prefix
+	if _, err := c.Put(ctx, &kvpb.PutRequest{Key: "other", Value: []byte("x")}); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+	if _, err := c.Delete(ctx, &kvpb.DeleteRequest{Key: "app/old"}); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+
+	e, err = stream.Recv()
+	if err != nil || e.Key != "app/old" || e.Sequence != 3 || e.Type != kvpb.Event_TYPE_DELETE {
+		t.Fatalf("Expected the delete of app/old, got %v, %v", e, err)
+	}
+	if e.Timestamp == nil || e.RequestId == "" {
+		t.Errorf("Expected the event metadata, got %v", e)
+	}
+}
+
+func TestServer_WatchPatch(t *testing.T) {
+	c, svc := newTestService(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := c.Put(ctx, &kvpb.PutRequest{Key: "job", Value: []byte(`{"n":1}`)}); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+	if _, err := svc.Patch(storage.Caller{}, "job", storage.ContentTypeMergePatch, `{"s":"ok"}`); err != nil {
+		t.Fatalf("Patch returned error: %v", err)
+	}
+	if _, err := svc.Patch(storage.Caller{}, "job", storage.ContentTypeJSONPatch, `[{"op":"remove","path":"/n"}]`); err != nil {
+		t.Fatalf("Patch returned error: %v", err)
+	}
+
+	since := uint64(1)
+	stream, err := c.Watch(ctx, &kvpb.WatchRequest{Prefix: "job", Since: &since})
+	if err != nil {
+		t.Fatalf("Watch returned error: %v", err)
+	}
+	for _, want := range []struct {
+		typ           kvpb.Event_Type
+		value, result string
+	}{
+		{kvpb.Event_TYPE_MERGE_PATCH, `{"s":"ok"}`, `{"n":1,"s":"ok"}`},
+		{kvpb.Event_TYPE_JSON_PATCH, `[{"op":"remove","path":"/n"}]`, `{"s":"ok"}`},
+	} {
+		e, err := stream.Recv()
+		if err != nil || e.Type != want.typ || string(e.Value) != want.value || string(e.Result) != want.result {
+			t.Errorf("Expected a %v of %s giving %s, got %v, %v", want.typ, want.value, want.result, e, err)
+		}
+	}
+}
@@ -0,0 +1,3 @@
+package kvpb
+
+//go:generate protoc -I ../proto --go_out=.. --go_opt=module=keyvaluestore --go-grpc_out=.. --go-grpc_opt=module=keyvaluestore kvstore/v1/kvstore.proto
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"keyvaluestore/storage"
+	"os"
+)
+
+const logtoolUsage = `usage: keyvaluestore logtool <command> [flags]
+
+Offline tools for the transaction log. Stop the server before salvaging
+or converting a log it uses.
+
+Commands:
+  validate   report every record that would stop the server from starting
+  salvage    write a repaired copy of a damaged log
+  convert    copy a log between the file and the Postgres table
+  newkey     add an encryption key to a key file, making it current
+
+Run 'keyvaluestore logtool <command> -h' for the flags of a command.
+`
+
+// maxShownText bounds how much of a bad record is printed.
+const maxShownText = 120
+
+func runLogtool(args []string) error {
+	commands := map[string]func([]string) error{
+		"validate": runValidate,
+		"salvage":  runSalvage,
+		"convert":  runConvert,
+		"newkey":   runNewKey,
+	}
+
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, logtoolUsage)
+		return errors.New("expected a logtool command")
+	}
+	run, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprint(os.Stderr, logtoolUsage)
+		return fmt.Errorf("unknown logtool command %q", args[0])
+	}
+	return run(args[1:])
+}
+
+func newLogtoolFlagSet(name, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet("logtool "+name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func runValidate(args []string) error {
+	fs := newLogtoolFlagSet("validate", `usage: keyvaluestore logtool validate [flags]
+
+Reads the whole transaction log and reports the line number and byte
+offset of every record that cannot be parsed, is out of sequence, or
+could not be replayed.
+
+`)
+	logFile := fs.String("log", "transaction.log", "transaction log to validate")
+	keyFile := fs.String("keyfile", "", "key file of an encrypted log")
+	fs.Parse(args)
+
+	keys, err := loadKeys(*keyFile)
+	if err != nil {
+		return err
+	}
+	report, err := storage.ValidateTransactionLog(*logFile, storage.WithEncryption(keys))
+	if err != nil {
+		return err
+	}
+
+	for _, p := range report.Problems {
+		printProblem(p)
+	}
+	fmt.Printf("%s: %d good records, last sequence %d, %d bad records\n",
+		*logFile, report.Records, report.LastSequence, len(report.Problems))
+
+	if len(report.Problems) > 0 {
+		return errors.New("transaction log is damaged; see 'keyvaluestore logtool salvage'")
+	}
+	return nil
+}
+
+func runSalvage(args []string) error {
+	fs := newLogtoolFlagSet("salvage", `usage: keyvaluestore logtool salvage [flags] -out <file>
+
+Writes the good records of a damaged transaction log to a new log the
+server can start from. With -mode truncate, the default, the new log
+stops before the first bad record, giving the store as it was just
+before the damage. With -mode skip, every good record is kept.
+
+`)
+	logFile := fs.String("log", "transaction.log", "damaged transaction log")
+	out := fs.String("out", "", "repaired transaction log to write")
+	mode := fs.String("mode", "truncate", "truncate or skip")
+	force := fs.Bool("force", false, "overwrite -out if it exists")
+	keyFile := fs.String("keyfile", "", "key file of an encrypted log; the repaired log is encrypted with its current key")
+	fs.Parse(args)
+
+	var salvageMode storage.SalvageMode
+	switch *mode {
+	case "truncate":
+		salvageMode = storage.SalvageTruncate
+	case "skip":
+		salvageMode = storage.SalvageSkip
+	default:
+		return fmt.Errorf("unknown -mode %q; use truncate or skip", *mode)
+	}
+
+	if *out == "" {
+		fs.Usage()
+		return errors.New("-out is required")
+	}
+	if err := checkOutput(*out, *force); err != nil {
+		return err
+	}
+
+	keys, err := loadKeys(*keyFile)
+	if err != nil {
+		return err
+	}
+	report, err := storage.SalvageTransactionLog(*logFile, *out, salvageMode, storage.WithEncryption(keys))
+	if err != nil {
+		return err
+	}
+
+	for _, p := range report.Problems {
+		printProblem(p)
+	}
+	fmt.Printf("wrote %d records to %s, last sequence %d; dropped %d lines\n",
+		report.Records, *out, report.LastSequence, report.Dropped)
+	return nil
+}
+
+func runConvert(args []string) error {
+	fs := newLogtoolFlagSet("convert", `usage: keyvaluestore logtool convert -from <file|postgres> -to <file|postgres> [flags]
+
+Copies every event, with its sequence number and metadata, from the file
+transaction log to the Postgres table or back. A file is written under a
+temporary name and renamed into place; Postgres rows are inserted in a
+single transaction and must follow the rows already in the table.
+
+`)
+	from := fs.String("from", "", "source: file or postgres")
+	to := fs.String("to", "", "destination: file or postgres")
+	logFile := fs.String("log", "transaction.log", "transaction log file to read or write")
+	pg := registerPostgresFlags(fs)
+	force := fs.Bool("force", false, "overwrite -log if it exists")
+	keyFile := fs.String("keyfile", "", "key file of the encrypted log file or table values")
+	fs.Parse(args)
+
+	if !pg.enabled() {
+		fs.Usage()
+		return errors.New("the postgres flags are required")
+	}
+	keys, err := loadKeys(*keyFile)
+	if err != nil {
+		return err
+	}
+	logOpt := storage.WithEncryption(keys)
+	pgConfig := pg.config().WithEncryption(keys)
+
+	var n int
+	switch {
+	case *from == "file" && *to == "postgres":
+		src, err := storage.OpenFileTransactionLogger(*logFile, logOpt)
+		if err != nil {
+			return err
+		}
+		dst, err := storage.NewPostgresTransactionLogger(pgConfig)
+		if err != nil {
+			return err
+		}
+		if n, err = dst.(*storage.PostgresTransactionLogger).ImportEvents(src); err != nil {
+			return err
+		}
+
+	case *from == "postgres" && *to == "file":
+		if err := checkOutput(*logFile, *force); err != nil {
+			return err
+		}
+		src, err := storage.NewPostgresTransactionLogger(pgConfig)
+		if err != nil {
+			return err
+		}
+		if n, err = storage.WriteTransactionLog(*logFile, src, logOpt); err != nil {
+			return err
+		}
+
+	default:
+		fs.Usage()
+		return errors.New("use -from file -to postgres or -from postgres -to file")
+	}
+
+	fmt.Printf("copied %d events from %s to %s\n", n, *from, *to)
+	return nil
+}
+
+func runNewKey(args []string) error {
+	fs := newLogtoolFlagSet("newkey", `usage: keyvaluestore logtool newkey -keyfile <file> -id <id>
+
+Appends a new random key to a key file, creating it if needed. The new
+key becomes the current key: new records are encrypted with it, and
+compacting the log re-encrypts the older ones. Keep the older keys in
+the file until no log or table still uses them.
+
+`)
+	keyFile := fs.String("keyfile", "", "key file to add the key to")
+	id := fs.String("id", "", "ID of the new key, such as the date it was made")
+	fs.Parse(args)
+
+	if *keyFile == "" || *id == "" {
+		fs.Usage()
+		return errors.New("-keyfile and -id are required")
+	}
+	if err := storage.AddKey(*keyFile, *id); err != nil {
+		return err
+	}
+
+	fmt.Printf("added key %s to %s\n", *id, *keyFile)
+	return nil
+}
+
+// loadKeys loads the key file filename, or returns nil if it is empty.
+func loadKeys(filename string) (storage.KeyProvider, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	return storage.LoadKeyFile(filename)
+}
+
+func checkOutput(filename string, force bool) error {
+	if _, err := os.Stat(filename); err == nil && !force {
+		return fmt.Errorf("%s already exists; use -force to overwrite it", filename)
+	}
+	return nil
+}
+
+func printProblem(p *storage.LogError) {
+	text := p.Text
+	if len(text) > maxShownText {
+		text = text[:maxShownText] + "..."
+	}
+	fmt.Printf("line %d, offset %d: %v\n\t%q\n", p.Line, p.Offset, p.Err, text)
+}
@@ -1,45 +1,213 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"keyvaluestore/storage"
 	"log"
 	"net/http"
-
-	"github.com/gorilla/mux"
+	"os"
+	"strings"
 )
 
 func main() {
+	subcommands := map[string]func([]string) error{
+		"restore": runRestore,
+		"logtool": runLogtool,
+	}
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
+	historyVersions := flag.Int("history-versions", 10, "number of versions of each key to keep for history and point-in-time reads")
+	historyAge := flag.Duration("history-age", 0, "drop superseded versions older than this (0 keeps them)")
+	logFile := flag.String("log", "transaction.log", "transaction log to replay and append to")
+	keyFile := flag.String("keyfile", "", "key file to encrypt the transaction log, or the values in the Postgres table, with (see 'logtool newkey')")
+	readOnly := flag.Bool("read-only", false, "refuse all writes")
+	maxValueSize := flag.Int64("max-value-size", 0, "largest value accepted, in bytes (0 for no limit)")
+	grpcAddr := flag.String("grpc-addr", ":9090", "address of the gRPC API, served with the same certificate (empty to disable)")
+	redisAddr := flag.String("redis-addr", "", "address of the Redis protocol listener, served without TLS (empty to disable)")
+	memcacheAddr := flag.String("memcache-addr", "", "address of the memcached protocol listener, served without TLS (empty to disable)")
+	compression := flag.String("compression", "", "compress large values in memory and in the log file: gzip or zstd (empty to disable)")
+	compressionThreshold := flag.Int("compression-threshold", 1024, "smallest value compressed, in bytes")
+	maxKeys := flag.Int("max-keys", 0, "evict keys once more than this many are held in memory (0 for no limit)")
+	maxBytes := flag.Int64("max-bytes", 0, "evict keys once their keys, values and history take more than this many bytes (0 for no limit)")
+	evictionPolicy := flag.String("eviction", storage.EvictionLRU, "which keys to evict: lru, lfu or random")
+	shards := flag.Int("shards", 32, "number of lock stripes the in-memory keys are split into")
+	webhookFile := flag.String("webhooks", "", "file to keep webhooks and their delivery progress in (empty to disable webhooks)")
+	cdcTarget := flag.String("cdc", "", "ship logged changes, at least once, to this http(s) URL or append them to this file, as newline-delimited JSON (empty to disable)")
+	cdcCheckpoint := flag.String("cdc-checkpoint", "cdc.checkpoint", "file to keep the sequence number of the last change shipped with -cdc in")
+	cdcPrefix := flag.String("cdc-prefix", "", "ship only the changes to keys with this prefix with -cdc")
+	var rateLimits []storage.RateLimit
+	flag.Func("rate-limit", "per-client request budget, such as 'read=100,write=10,burst=20'; add prefix=<p> to budget keys with that prefix separately (repeatable)", func(spec string) error {
+		l, err := storage.ParseRateLimit(spec)
+		rateLimits = append(rateLimits, l)
+		return err
+	})
+	schemas := make(map[string]*storage.Schema)
+	flag.Func("schema", "'<prefix>=<file>': refuse writes that leave a key with the prefix not holding a JSON document matching the JSON Schema in the file (repeatable)", func(spec string) error {
+		prefix, filename, ok := strings.Cut(spec, "=")
+		if !ok {
+			return fmt.Errorf("expected <prefix>=<file>, got %q", spec)
+		}
+		schema, err := storage.LoadSchema(filename)
+		schemas[prefix] = schema
+		return err
+	})
+	pg := registerPostgresFlags(flag.CommandLine)
+	tlsOpts := registerTLSFlags(flag.CommandLine)
+	flag.Parse()
+
+	tlsConfig, err := tlsOpts.serverConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	metrics := storage.NewMetrics()
 
-	db, err := storage.NewInMemoryDB()
+	var compressor *storage.Compressor
+	if *compression != "" {
+		if compressor, err = storage.NewCompressor(*compression, *compressionThreshold); err != nil {
+			log.Fatal(err)
+		}
+		metrics.Register(compressor)
+	}
+
+	broker := storage.NewBroker()
+	db, err := storage.NewInMemoryDB(
+		storage.WithHistoryRetention(*historyVersions, *historyAge),
+		storage.WithBroker(broker),
+		storage.WithCompression(compressor),
+		storage.WithShards(*shards),
+		storage.WithEviction(storage.Eviction{
+			Policy:   *evictionPolicy,
+			MaxKeys:  *maxKeys,
+			MaxBytes: *maxBytes,
+		}),
+	)
 
 	if err != nil {
 		log.Fatal(err)
 	} else {
 		log.Printf("DB successfully initialized")
 	}
+	if mc, ok := db.(storage.MetricsCollector); ok {
+		metrics.Register(mc)
+	}
 
-	logger, err := storage.InitializeTransactionLogger(db)
+	keys, err := loadKeys(*keyFile)
 	if err != nil {
 		log.Fatal(err)
-	} else {
-		log.Printf("TransactionLogger successfully initialized")
 	}
 
-	handler, err := storage.NewHandler(db, logger)
+	var logger storage.TransactionLogger
+	if pg.enabled() {
+		logger, err = storage.InitializePostgresTransactionLogger(db, pg.config().WithEncryption(keys))
+	} else {
+		logger, err = storage.InitializeFileTransactionLogger(db, *logFile,
+			storage.WithEncryption(keys), storage.WithLogCompression(compressor))
+		if err != nil {
+			log.Fatalf("%v\nrun 'keyvaluestore logtool validate -log %s' for details", err, *logFile)
+		}
+	}
 	if err != nil {
 		log.Fatal(err)
 	} else {
-		log.Printf("Handler successfully initialized")
+		log.Printf("TransactionLogger successfully initialized")
+	}
+
+	go func() {
+		for err := range logger.Err() {
+			log.Printf("transaction log failure, refusing further writes: %v", err)
+		}
+	}()
+
+	serviceOpts := []storage.ServiceOption{
+		storage.WithMaxValueSize(*maxValueSize),
+		storage.WithWatch(broker),
+		storage.WithMetrics(metrics),
+	}
+	if *readOnly {
+		serviceOpts = append(serviceOpts, storage.WithReadOnly())
+	}
+	for prefix, schema := range schemas {
+		serviceOpts = append(serviceOpts, storage.WithSchema(prefix, schema))
+	}
+	var webhooks *storage.Webhooks
+	if *webhookFile != "" {
+		if webhooks, err = storage.OpenWebhooks(*webhookFile); err != nil {
+			log.Fatal(err)
+		}
+		metrics.Register(webhooks)
+		serviceOpts = append(serviceOpts, storage.WithWebhooks(webhooks))
+	}
+	if len(rateLimits) > 0 {
+		limiter, err := storage.NewRateLimiter(rateLimits...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		metrics.Register(limiter)
+		serviceOpts = append(serviceOpts, storage.WithRateLimiter(limiter))
+	}
+
+	svc := storage.NewService(db, logger, serviceOpts...)
+	if webhooks != nil {
+		if err := webhooks.Start(svc); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *cdcTarget != "" {
+		var sink storage.Sink
+		if strings.HasPrefix(*cdcTarget, "http://") || strings.HasPrefix(*cdcTarget, "https://") {
+			sink = storage.NewHTTPSink(*cdcTarget, nil)
+		} else if sink, err = storage.NewFileSink(*cdcTarget); err != nil {
+			log.Fatal(err)
+		}
+		cdc, err := storage.NewCDC(logger, sink, *cdcCheckpoint, storage.WithCDCPrefix(*cdcPrefix))
+		if err != nil {
+			log.Fatal(err)
+		}
+		metrics.Register(cdc)
+		cdc.Start()
 	}
+	handler := storage.NewServiceHandler(svc)
+	log.Printf("Handler successfully initialized")
 
-	router := mux.NewRouter()
-	router.HandleFunc("/v1/key", handler.GetAllHandler).Methods("GET")
-	router.HandleFunc("/v1/key/{key}", handler.GetHandler).Methods("GET")
-	router.HandleFunc("/v1/key/{key}", handler.UpsertHandler).Methods("PUT")
-	router.HandleFunc("/v1/key/{key}", handler.DeleteHandler).Methods("DELETE")
+	if *grpcAddr != "" {
+		go func() {
+			log.Fatal(serveGRPC(*grpcAddr, svc, tlsConfig))
+		}()
+	}
+
+	if *redisAddr != "" {
+		go func() {
+			log.Fatal(serveRedis(*redisAddr, svc))
+		}()
+	}
+
+	if *memcacheAddr != "" {
+		go func() {
+			log.Fatal(serveMemcache(*memcacheAddr, svc))
+		}()
+	}
+
+	server := &http.Server{
+		Addr:      ":8080",
+		Handler:   storage.NewRouter(&handler),
+		TLSConfig: tlsConfig,
+	}
 
 	log.Printf("serving on port 8080")
 
-	err = http.ListenAndServeTLS(":8080", "cert.pem", "key.pem", router)
+	if tlsConfig == nil {
+		err = server.ListenAndServe()
+	} else {
+		err = server.ListenAndServeTLS("", "")
+	}
 	log.Fatal(err)
 }
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"keyvaluestore/memcache"
+	"keyvaluestore/storage"
+	"log"
+	"net"
+)
+
+// serveMemcache serves the memcached text protocol for svc on addr. Like
+// memcached itself, it is served without TLS, so bind it to a trusted
+// network.
+func serveMemcache(addr string, svc *storage.Service) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("serving the memcached protocol on %s", lis.Addr())
+	return memcache.NewServer(svc).Serve(lis)
+}
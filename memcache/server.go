@@ -0,0 +1,524 @@
+// Package memcache serves the memcached text protocol on top of the
+// storage.Service shared with the other APIs, so that services using a
+// memcached client can move onto the store unchanged. Writes are logged
+// like any other, with the item's flags and expiry.
+//
+// The commands served are get, gets, set, add, replace, cas, delete, incr,
+// decr, version and quit. The cas unique of an item is the sequence number
+// of the event that wrote its value.
+package memcache
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"keyvaluestore/storage"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxKeyLen is the longest key memcached accepts.
+	maxKeyLen = 250
+	// maxLineLen bounds a command line, which for get holds every key.
+	maxLineLen = 64 << 10
+	// maxItemSize bounds the data of a storage command, so that a client
+	// cannot make the server allocate without bound.
+	maxItemSize = 64 << 20
+	// maxRelativeExptime is the largest exptime that is taken as a number
+	// of seconds from now; larger ones are Unix times.
+	maxRelativeExptime = 60 * 60 * 24 * 30
+)
+
+// ErrServerClosed is returned by Serve after Close.
+var ErrServerClosed = errors.New("memcache: server closed")
+
+// errLineTooLong is a command line longer than maxLineLen. The server
+// replies with an error and closes the connection.
+var errLineTooLong = errors.New("line too long")
+
+// Server serves the memcached text protocol for a storage.Service.
+type Server struct {
+	svc *storage.Service
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// NewServer returns a Server for svc.
+func NewServer(svc *storage.Service) *Server {
+	return &Server{
+		svc:       svc,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve accepts connections on lis and serves each in its own goroutine,
+// until lis fails or Close is called.
+func (s *Server) Serve(lis net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.listeners[lis] = struct{}{}
+	s.mu.Unlock()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			delete(s.listeners, lis)
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(conn)
+
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close stops the listeners, closes every connection and waits for their
+// goroutines to finish. A command being run completes first.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for lis := range s.listeners {
+		lis.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+// session is the state of a connection.
+type session struct {
+	principal string
+	r         *bufio.Reader
+	w         *bufio.Writer
+	quit      bool
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	var state *tls.ConnectionState
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			return
+		}
+		cs := tc.ConnectionState()
+		state = &cs
+	}
+
+	sess := &session{
+		principal: storage.Principal(state, conn.RemoteAddr().String()),
+		r:         bufio.NewReader(conn),
+		w:         bufio.NewWriter(conn),
+	}
+
+	for !sess.quit {
+		line, err := sess.readLine()
+		if err != nil {
+			if err == errLineTooLong {
+				sess.reply("CLIENT_ERROR line too long")
+				sess.w.Flush()
+			} else if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Printf("memcache: %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if err := s.run(sess, strings.Fields(line)); err != nil {
+			return
+		}
+
+		// Replies to pipelined commands are sent together, once the
+		// commands read so far have all been run.
+		if sess.r.Buffered() == 0 || sess.quit {
+			if err := sess.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readLine reads a command line ending in CRLF, or LF alone, and returns it
+// without the line ending.
+func (sess *session) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := sess.r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxLineLen {
+			return "", errLineTooLong
+		}
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err == io.EOF && len(line) > 0:
+			return "", io.ErrUnexpectedEOF
+		case err != nil:
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+// reply writes a reply line.
+func (sess *session) reply(line string) {
+	sess.w.WriteString(line + "\r\n")
+}
+
+// caller identifies a command of sess to the Service. Every command gets
+// its own request ID.
+func (sess *session) caller() storage.Caller {
+	return storage.Caller{RequestID: storage.NewRequestID(), Principal: sess.principal}
+}
+
+// storageError writes err, returned by the Service, as an error reply.
+func (sess *session) storageError(err error) {
+	sess.reply(errorReply(err))
+}
+
+func errorReply(err error) string {
+	if errors.Is(err, storage.ErrorTooLarge) {
+		return "SERVER_ERROR object too large for cache"
+	}
+	return "SERVER_ERROR " + strings.NewReplacer("\r", " ", "\n", " ").Replace(err.Error())
+}
+
+// run runs the command with the words of a command line. It only returns
+// an error if the connection cannot be used any more.
+func (s *Server) run(sess *session, args []string) error {
+	if len(args) == 0 {
+		sess.reply("ERROR")
+		return nil
+	}
+
+	switch args[0] {
+	case "get", "gets":
+		s.get(sess, args)
+	case "set", "add", "replace", "cas":
+		return s.store(sess, args)
+	case "delete":
+		s.delete(sess, args)
+	case "incr", "decr":
+		s.incr(sess, args)
+	case "version":
+		sess.reply("VERSION keyvaluestore")
+	case "quit":
+		sess.quit = true
+	default:
+		sess.reply("ERROR")
+	}
+	return nil
+}
+
+func validKey(key string) bool {
+	if len(key) > maxKeyLen {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x21 || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// noreply reports whether the last of args is noreply, and returns args
+// without it.
+func noreply(args []string) ([]string, bool) {
+	if n := len(args); n > 0 && args[n-1] == "noreply" {
+		return args[:n-1], true
+	}
+	return args, false
+}
+
+// get runs get and gets, which reply with the items that exist among the
+// keys, followed by END.
+func (s *Server) get(sess *session, args []string) {
+	if len(args) < 2 {
+		sess.reply("ERROR")
+		return
+	}
+	for _, key := range args[1:] {
+		if !validKey(key) {
+			sess.reply("CLIENT_ERROR bad command line format")
+			return
+		}
+	}
+
+	for _, key := range args[1:] {
+		v, err := s.svc.Lookup(key)
+		if errors.Is(err, storage.ErrorNoSuchKey) {
+			continue
+		}
+		if err != nil {
+			sess.storageError(err)
+			return
+		}
+
+		header := fmt.Sprintf("VALUE %s %d %d", key, v.Flags, len(v.Value))
+		if args[0] == "gets" {
+			header += " " + strconv.FormatUint(v.Sequence, 10)
+		}
+		sess.reply(header)
+		sess.reply(v.Value)
+	}
+	sess.reply("END")
+}
+
+// store runs the storage commands:
+//
+//	<command> <key> <flags> <exptime> <bytes> [noreply]
+//	cas <key> <flags> <exptime> <bytes> <cas unique> [noreply]
+//
+// each followed by a line of data.
+func (s *Server) store(sess *session, args []string) error {
+	args, quiet := noreply(args)
+
+	words := 5
+	if args[0] == "cas" {
+		words = 6
+	}
+	if len(args) != words {
+		sess.reply("ERROR")
+		return nil
+	}
+
+	key := args[1]
+	flags, flagsErr := strconv.ParseUint(args[2], 10, 32)
+	exptime, exptimeErr := strconv.ParseInt(args[3], 10, 64)
+	size, sizeErr := strconv.Atoi(args[4])
+	var unique uint64
+	var uniqueErr error
+	if args[0] == "cas" {
+		unique, uniqueErr = strconv.ParseUint(args[5], 10, 64)
+	}
+
+	// Without a valid size the data cannot be told from the next command,
+	// and is left to be rejected as one.
+	if sizeErr != nil || size < 0 {
+		sess.reply("CLIENT_ERROR bad command line format")
+		return nil
+	}
+	if size > maxItemSize {
+		if _, err := sess.r.Discard(size + 2); err != nil {
+			return err
+		}
+		sess.reply("SERVER_ERROR object too large for cache")
+		return nil
+	}
+
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(sess.r, data); err != nil {
+		return err
+	}
+	if data[size] != '\r' || data[size+1] != '\n' {
+		// Skip the rest of an overlong data line, so that it is not taken
+		// for a command.
+		if data[size+1] != '\n' {
+			if _, err := sess.readLine(); err != nil {
+				return err
+			}
+		}
+		sess.reply("CLIENT_ERROR bad data chunk")
+		return nil
+	}
+
+	if !validKey(key) || flagsErr != nil || exptimeErr != nil || uniqueErr != nil {
+		sess.reply("CLIENT_ERROR bad command line format")
+		return nil
+	}
+
+	op := storage.Op{
+		Type:      storage.EventPut,
+		Key:       key,
+		Value:     string(data[:size]),
+		ExpiresAt: expiresAt(exptime, time.Now()),
+		Flags:     uint32(flags),
+	}
+	switch args[0] {
+	case "add":
+		op.If.Missing = true
+	case "replace":
+		op.If.Exists = true
+	case "cas":
+		op.If.Sequence = unique
+	}
+
+	// No event has sequence number 0, so no item has that cas unique.
+	reply := s.storeOp(sess, op, args[0] == "cas" && unique == 0)
+	if !quiet {
+		sess.reply(reply)
+	}
+	return nil
+}
+
+// storeOp applies the put of a storage command and returns the reply. With
+// never the command is a cas that cannot succeed.
+func (s *Server) storeOp(sess *session, op storage.Op, never bool) string {
+	if never {
+		if _, err := s.svc.Lookup(op.Key); errors.Is(err, storage.ErrorNoSuchKey) {
+			return "NOT_FOUND"
+		}
+		return "EXISTS"
+	}
+
+	_, err := s.svc.Txn(sess.caller(), []storage.Op{op})
+	switch {
+	case err == nil:
+		return "STORED"
+	case op.If.Sequence != 0 && errors.Is(err, storage.ErrorNoSuchKey):
+		return "NOT_FOUND"
+	case op.If.Sequence != 0 && errors.Is(err, storage.ErrorPreconditionFailed):
+		return "EXISTS"
+	case errors.Is(err, storage.ErrorNoSuchKey), errors.Is(err, storage.ErrorPreconditionFailed):
+		return "NOT_STORED"
+	}
+	return errorReply(err)
+}
+
+// expiresAt converts a memcached exptime: 0 for never, up to 30 days a
+// number of seconds from now, and otherwise a Unix time. A negative
+// exptime has already passed.
+func expiresAt(exptime int64, now time.Time) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime < 0:
+		return now.UTC()
+	case exptime <= maxRelativeExptime:
+		return now.Add(time.Duration(exptime) * time.Second).UTC()
+	}
+	return time.Unix(exptime, 0).UTC()
+}
+
+// delete runs delete <key> [0] [noreply]. The 0 is a hold time older
+// clients send; no other is accepted.
+func (s *Server) delete(sess *session, args []string) {
+	args, quiet := noreply(args)
+	if len(args) == 3 && args[2] == "0" {
+		args = args[:2]
+	}
+	if len(args) != 2 {
+		sess.reply("CLIENT_ERROR bad command line format.  Usage: delete <key> [noreply]")
+		return
+	}
+
+	var reply string
+	_, err := s.svc.Delete(sess.caller(), args[1])
+	switch {
+	case err == nil:
+		reply = "DELETED"
+	case errors.Is(err, storage.ErrorNoSuchKey):
+		reply = "NOT_FOUND"
+	default:
+		sess.storageError(err)
+		return
+	}
+	if !quiet {
+		sess.reply(reply)
+	}
+}
+
+// incr runs incr and decr <key> <delta> [noreply]. Values are unsigned
+// 64-bit integers: incr wraps around and decr stops at 0. The item keeps
+// its flags and expiry.
+func (s *Server) incr(sess *session, args []string) {
+	args, quiet := noreply(args)
+	if len(args) != 3 || !validKey(args[1]) {
+		sess.reply("ERROR")
+		return
+	}
+	delta, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		sess.reply("CLIENT_ERROR invalid numeric delta argument")
+		return
+	}
+
+	// Retry if another write gets in between the read and the write.
+	for {
+		cur, err := s.svc.Lookup(args[1])
+		if errors.Is(err, storage.ErrorNoSuchKey) {
+			if !quiet {
+				sess.reply("NOT_FOUND")
+			}
+			return
+		}
+		if err != nil {
+			sess.storageError(err)
+			return
+		}
+
+		n, err := strconv.ParseUint(strings.TrimRight(cur.Value, " "), 10, 64)
+		if err != nil {
+			sess.reply("CLIENT_ERROR cannot increment or decrement non-numeric value")
+			return
+		}
+		switch {
+		case args[0] == "incr":
+			n += delta
+		case delta > n:
+			n = 0
+		default:
+			n -= delta
+		}
+
+		value := strconv.FormatUint(n, 10)
+		_, err = s.svc.Txn(sess.caller(), []storage.Op{{
+			Type:      storage.EventPut,
+			Key:       args[1],
+			Value:     value,
+			ExpiresAt: cur.ExpiresAt,
+			Flags:     cur.Flags,
+			If:        storage.Condition{Sequence: cur.Sequence},
+		}})
+		switch {
+		case errors.Is(err, storage.ErrorPreconditionFailed), errors.Is(err, storage.ErrorNoSuchKey):
+			continue
+		case err != nil:
+			sess.storageError(err)
+			return
+		}
+		if !quiet {
+			sess.reply(value)
+		}
+		return
+	}
+}
@@ -0,0 +1,236 @@
+package memcache
+
+import (
+	"bufio"
+	"io"
+	"keyvaluestore/storage"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClient speaks the memcached text protocol by hand, a line at a time.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// send writes raw protocol text without waiting for a reply.
+func (c *testClient) send(text string) {
+	c.t.Helper()
+	if _, err := io.WriteString(c.conn, text); err != nil {
+		c.t.Fatalf("Failed to send %q: %v", text, err)
+	}
+}
+
+// readLine reads a reply line without its CRLF.
+func (c *testClient) readLine() string {
+	c.t.Helper()
+
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("Failed to read reply: %v", err)
+	}
+	if !strings.HasSuffix(line, "\r\n") {
+		c.t.Fatalf("Reply %q does not end in CRLF", line)
+	}
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+// expect sends text and checks the reply lines, up to and including the
+// last of want.
+func (c *testClient) expect(text string, want ...string) {
+	c.t.Helper()
+
+	c.send(text)
+	got := make([]string, len(want))
+	for i := range want {
+		got[i] = c.readLine()
+	}
+	if !reflect.DeepEqual(got, want) {
+		c.t.Errorf("%q: expected %q, got %q", text, want, got)
+	}
+}
+
+// gets returns the cas unique of key.
+func (c *testClient) gets(key string) string {
+	c.t.Helper()
+
+	c.send("gets " + key + "\r\n")
+	fields := strings.Fields(c.readLine())
+	if len(fields) != 5 || fields[0] != "VALUE" {
+		c.t.Fatalf("Expected a VALUE line for %s, got %q", key, fields)
+	}
+	c.readLine()
+	if end := c.readLine(); end != "END" {
+		c.t.Fatalf("Expected END, got %q", end)
+	}
+	return fields[4]
+}
+
+// newTestServer serves the real storage.Service, on a temporary
+// transaction log, on a localhost port, and returns a function that
+// connects new clients to it.
+func newTestServer(t *testing.T) (connect func() *testClient, logFile string) {
+	t.Helper()
+
+	db, err := storage.NewInMemoryDB()
+	if err != nil {
+		t.Fatalf("Failed to create DB: %v", err)
+	}
+	logFile = filepath.Join(t.TempDir(), "transaction.log")
+	logger, err := storage.InitializeFileTransactionLogger(db, logFile)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := NewServer(storage.NewService(db, logger, storage.WithMaxValueSize(1024)))
+	go server.Serve(lis)
+	t.Cleanup(func() { server.Close() })
+
+	connect = func() *testClient {
+		conn, err := net.Dial("tcp", lis.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	}
+	return connect, logFile
+}
+
+func TestServer_StorageCommands(t *testing.T) {
+	connect, logFile := newTestServer(t)
+	c := connect()
+
+	c.expect("get a\r\n", "END")
+	c.expect("set a 42 0 5\r\nhello\r\n", "STORED")
+	c.expect("get a b\r\n", "VALUE a 42 5", "hello", "END")
+	c.expect("set b 0 0 4\r\nx\r\ny\r\n", "STORED")
+	c.expect("get b a\r\n", "VALUE b 0 4", "x", "y", "VALUE a 42 5", "hello", "END")
+
+	c.expect("add a 0 0 1\r\nz\r\n", "NOT_STORED")
+	c.expect("add c 0 0 1\r\nz\r\n", "STORED")
+	c.expect("replace d 0 0 1\r\nz\r\n", "NOT_STORED")
+	c.expect("replace c 7 0 2\r\nzz\r\n", "STORED")
+	c.expect("get c\r\n", "VALUE c 7 2", "zz", "END")
+
+	c.expect("delete c\r\n", "DELETED")
+	c.expect("delete c\r\n", "NOT_FOUND")
+	c.expect("delete b 0\r\n", "DELETED")
+
+	c.expect("set big 0 0 2000\r\n"+strings.Repeat("x", 2000)+"\r\n", "SERVER_ERROR object too large for cache")
+	c.expect("set a 0 0 2\r\nabc\r\n", "CLIENT_ERROR bad data chunk")
+	c.expect("set a x 0 1\r\nz\r\n", "CLIENT_ERROR bad command line format")
+	c.expect("flush_all\r\n", "ERROR")
+	c.expect("version\r\n", "VERSION keyvaluestore")
+
+	// The writes reached the transaction log, with their flags.
+	logger, err := storage.OpenFileTransactionLogger(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := storage.Restore(logger, storage.RestoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := restored.Lookup("a")
+	if err != nil || v.Value != "hello" || v.Flags != 42 {
+		t.Errorf("Expected the log to restore a with flags 42, got %+v, %v", v, err)
+	}
+}
+
+func TestServer_Cas(t *testing.T) {
+	connect, _ := newTestServer(t)
+	c := connect()
+
+	c.expect("cas a 0 0 1 1\r\nx\r\n", "NOT_FOUND")
+	c.expect("set a 0 0 1\r\nx\r\n", "STORED")
+	unique := c.gets("a")
+
+	c.expect("set a 0 0 1\r\ny\r\n", "STORED")
+	c.expect("cas a 0 0 1 "+unique+"\r\nz\r\n", "EXISTS")
+	c.expect("cas a 0 0 1 0\r\nz\r\n", "EXISTS")
+
+	unique = c.gets("a")
+	c.expect("cas a 3 0 1 "+unique+"\r\nz\r\n", "STORED")
+	c.expect("get a\r\n", "VALUE a 3 1", "z", "END")
+	if c.gets("a") == unique {
+		t.Error("Expected a new cas unique after a cas")
+	}
+}
+
+func TestServer_IncrDecr(t *testing.T) {
+	connect, _ := newTestServer(t)
+	c := connect()
+
+	c.expect("incr n 1\r\n", "NOT_FOUND")
+	c.expect("set n 5 0 2\r\n10\r\n", "STORED")
+	c.expect("incr n 5\r\n", "15")
+	c.expect("decr n 20\r\n", "0")
+	c.expect("set n 5 0 20\r\n18446744073709551615\r\n", "STORED")
+	c.expect("incr n 2\r\n", "1")
+	c.expect("get n\r\n", "VALUE n 5 1", "1", "END")
+
+	c.expect("incr n x\r\n", "CLIENT_ERROR invalid numeric delta argument")
+	c.expect("set s 0 0 1\r\nx\r\n", "STORED")
+	c.expect("incr s 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value")
+}
+
+func TestServer_ConcurrentIncr(t *testing.T) {
+	connect, _ := newTestServer(t)
+	connect().expect("set ctr 0 0 1\r\n0\r\n", "STORED")
+
+	const clients, incrs = 8, 50
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		c := connect()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.send(strings.Repeat("incr ctr 1\r\n", incrs))
+			for j := 0; j < incrs; j++ {
+				c.readLine()
+			}
+		}()
+	}
+	wg.Wait()
+
+	want := strconv.Itoa(clients * incrs)
+	connect().expect("get ctr\r\n", "VALUE ctr 0 "+strconv.Itoa(len(want)), want, "END")
+}
+
+func TestServer_Exptime(t *testing.T) {
+	connect, _ := newTestServer(t)
+	c := connect()
+
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	c.expect("set a 0 "+future+" 1\r\nx\r\n", "STORED")
+	c.expect("set b 0 3600 1\r\nx\r\n", "STORED")
+	c.expect("get a b\r\n", "VALUE a 0 1", "x", "VALUE b 0 1", "x", "END")
+
+	c.expect("set a 0 -1 1\r\nx\r\n", "STORED")
+	c.expect("set b 0 1000000000 1\r\nx\r\n", "STORED") // a Unix time long past
+	c.expect("get a b\r\n", "END")
+	c.expect("add a 0 0 1\r\ny\r\n", "STORED")
+}
+
+func TestServer_Noreply(t *testing.T) {
+	connect, _ := newTestServer(t)
+	c := connect()
+
+	// Only the get replies.
+	c.expect("set a 0 0 1 noreply\r\n1\r\nincr a 2 noreply\r\ndelete b noreply\r\nget a\r\n",
+		"VALUE a 0 1", "3", "END")
+}
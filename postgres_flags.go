@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"keyvaluestore/storage"
+)
+
+// postgresFlags are the flags that select a Postgres transactions table.
+type postgresFlags struct {
+	host     *string
+	dbName   *string
+	user     *string
+	password *string
+	schema   *string
+	table    *string
+}
+
+func registerPostgresFlags(fs *flag.FlagSet) postgresFlags {
+	return postgresFlags{
+		host:     fs.String("postgres-host", "", "Postgres host; when set, the transactions table is used instead of a log file"),
+		dbName:   fs.String("postgres-db", "", "Postgres database name"),
+		user:     fs.String("postgres-user", "", "Postgres user"),
+		password: fs.String("postgres-password", "", "Postgres password"),
+		schema:   fs.String("postgres-schema", "public", "schema of the transactions table"),
+		table:    fs.String("postgres-table", "transactions", "name of the transactions table"),
+	}
+}
+
+func (f postgresFlags) enabled() bool {
+	return *f.host != ""
+}
+
+func (f postgresFlags) config() storage.PostgresConfig {
+	return storage.NewPostgresConfig(*f.host, *f.dbName, *f.user, *f.password).
+		WithSchema(*f.schema).
+		WithTable(*f.table)
+}
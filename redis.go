@@ -0,0 +1,20 @@
+package main
+
+import (
+	"keyvaluestore/resp"
+	"keyvaluestore/storage"
+	"log"
+	"net"
+)
+
+// serveRedis serves the Redis protocol for svc on addr. Like Redis itself,
+// it is served without TLS, so bind it to a trusted network.
+func serveRedis(addr string, svc *storage.Service) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("serving the Redis protocol on %s", lis.Addr())
+	return resp.NewServer(svc).Serve(lis)
+}
@@ -0,0 +1,99 @@
+package resp
+
+// match reports whether s matches the Redis glob pattern: * matches any
+// run of bytes, ? any one byte, [abc], [a-z] and [^abc] a byte in or out
+// of a class, and \ makes the next byte literal. Star backtracking only
+// ever resumes from the last star, so a match takes O(len(pattern) *
+// len(s)) time however many stars the pattern has.
+func match(pattern, s string) bool {
+	p, i := 0, 0
+	starP, starI := -1, 0
+
+	for i < len(s) {
+		if p < len(pattern) {
+			switch c := pattern[p]; {
+			case c == '*':
+				starP, starI = p, i
+				p++
+				continue
+			case c == '?':
+				p++
+				i++
+				continue
+			case c == '[':
+				if ok, n := matchClass(pattern[p+1:], s[i]); ok {
+					p += 1 + n
+					i++
+					continue
+				}
+			case c == '\\' && p+1 < len(pattern):
+				if pattern[p+1] == s[i] {
+					p += 2
+					i++
+					continue
+				}
+			case c == s[i]:
+				p++
+				i++
+				continue
+			}
+		}
+
+		// Mismatch: let the last star swallow one more byte, if there is one.
+		if starP < 0 {
+			return false
+		}
+		starI++
+		p, i = starP+1, starI
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchClass reports whether c is matched by the character class at the
+// start of class, which follows its opening '[', and how many bytes of
+// class the class takes up, including its closing ']'. An unterminated
+// class runs to the end of the pattern.
+func matchClass(class string, c byte) (matched bool, n int) {
+	negate := len(class) > 0 && class[0] == '^'
+	if negate {
+		n = 1
+	}
+
+	for n < len(class) && class[n] != ']' {
+		switch {
+		case class[n] == '\\' && n+1 < len(class):
+			matched = matched || class[n+1] == c
+			n += 2
+		case n+2 < len(class) && class[n+1] == '-':
+			lo, hi := class[n], class[n+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || (lo <= c && c <= hi)
+			n += 3
+		default:
+			matched = matched || class[n] == c
+			n++
+		}
+	}
+	if n < len(class) {
+		n++ // the closing ']'
+	}
+	return matched != negate, n
+}
+
+// literalPrefix returns the part of pattern before its first special byte,
+// which every key matching pattern starts with.
+func literalPrefix(pattern string) string {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*', '?', '[', '\\':
+			return pattern[:i]
+		}
+	}
+	return pattern
+}
@@ -0,0 +1,179 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Limits on a single command, so that a client cannot make the server
+// allocate without bound before a command is even run.
+const (
+	maxArgs      = 1 << 20
+	maxBulkLen   = 512 << 20
+	maxInlineLen = 64 << 10
+)
+
+// protocolError is a malformed request. The server replies with it and
+// closes the connection, as it cannot find the start of the next command.
+type protocolError string
+
+func (e protocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+// reader reads commands sent by a client, either as RESP arrays of bulk
+// strings or as inline commands, which are what a person typing into
+// telnet sends.
+type reader struct {
+	r *bufio.Reader
+}
+
+func newReader(r io.Reader) *reader {
+	return &reader{r: bufio.NewReader(r)}
+}
+
+// buffered reports whether more of the client's input has already been
+// read, in which case a pipelining client is still sending.
+func (r *reader) buffered() bool {
+	return r.r.Buffered() > 0
+}
+
+// readCommand returns the arguments of the next command, the first being
+// the command name. An empty inline command returns no arguments.
+func (r *reader) readCommand() ([]string, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > maxArgs {
+		return nil, protocolError("invalid multibulk length")
+	}
+
+	args := make([]string, 0, min(n, 64))
+	for i := 0; i < n; i++ {
+		arg, err := r.readBulk()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+func (r *reader) readBulk() (string, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(line, "$") {
+		return "", protocolError(fmt.Sprintf("expected '$', got %q", line))
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > maxBulkLen {
+		return "", protocolError("invalid bulk length")
+	}
+
+	buf := make([]byte, n+2)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		return "", unexpectedEOF(err)
+	}
+	if buf[n] != '\r' || buf[n+1] != '\n' {
+		return "", protocolError("bulk string not terminated by CRLF")
+	}
+	return string(buf[:n]), nil
+}
+
+// readLine reads a line ending in CRLF, or in LF alone as inline commands
+// may, and returns it without the line ending.
+func (r *reader) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxInlineLen {
+			return "", protocolError("too big inline request")
+		}
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err == io.EOF && len(line) > 0:
+			return "", io.ErrUnexpectedEOF
+		case err != nil:
+			return "", err
+		}
+
+		line = line[:len(line)-1]
+		if n := len(line); n > 0 && line[n-1] == '\r' {
+			line = line[:n-1]
+		}
+		return string(line), nil
+	}
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// writer writes RESP2 replies. Nothing is sent until flush.
+type writer struct {
+	w *bufio.Writer
+}
+
+func newWriter(w io.Writer) *writer {
+	return &writer{w: bufio.NewWriter(w)}
+}
+
+func (w *writer) flush() error {
+	return w.w.Flush()
+}
+
+// status writes a simple string, which must not contain CR or LF.
+func (w *writer) status(s string) {
+	w.w.WriteString("+" + s + "\r\n")
+}
+
+// error writes an error reply. msg starts with the error kind, such as
+// ERR; line breaks in it are replaced by spaces.
+func (w *writer) error(msg string) {
+	w.w.WriteString("-" + strings.NewReplacer("\r", " ", "\n", " ").Replace(msg) + "\r\n")
+}
+
+func (w *writer) integer(n int64) {
+	w.w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w *writer) bulk(s string) {
+	w.w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n")
+	w.w.WriteString(s)
+	w.w.WriteString("\r\n")
+}
+
+// null writes the null bulk string, the reply for a missing value.
+func (w *writer) null() {
+	w.w.WriteString("$-1\r\n")
+}
+
+// array writes the header of an array of n replies, which must follow.
+func (w *writer) array(n int) {
+	w.w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+func (w *writer) bulks(values []string) {
+	w.array(len(values))
+	for _, v := range values {
+		w.bulk(v)
+	}
+}
@@ -0,0 +1,549 @@
+// Package resp serves a subset of the Redis protocol (RESP2) on top of the
+// storage.Service shared with the HTTP and gRPC APIs, so that tools which
+// speak Redis can use the store. Writes are logged like any other.
+//
+// The commands served are PING, ECHO, SELECT 0, QUIT, GET, SET with EX or
+// PX, DEL, EXISTS, KEYS, SCAN, MGET, MSET, INCR, INCRBY, DECR and DECRBY.
+// Commands may be pipelined, and each connection is served concurrently.
+package resp
+
+import (
+	"container/heap"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"keyvaluestore/storage"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed is returned by Serve after Close.
+var ErrServerClosed = errors.New("resp: server closed")
+
+// Server serves the Redis protocol for a storage.Service.
+type Server struct {
+	svc *storage.Service
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// NewServer returns a Server for svc.
+func NewServer(svc *storage.Service) *Server {
+	return &Server{
+		svc:       svc,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve accepts connections on lis and serves each in its own goroutine,
+// until lis fails or Close is called.
+func (s *Server) Serve(lis net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.listeners[lis] = struct{}{}
+	s.mu.Unlock()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			delete(s.listeners, lis)
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(conn)
+
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close stops the listeners, closes every connection and waits for their
+// goroutines to finish. A command being run completes first.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for lis := range s.listeners {
+		lis.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+// session is the state of a connection.
+type session struct {
+	principal string
+	w         *writer
+	quit      bool
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	var state *tls.ConnectionState
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			return
+		}
+		cs := tc.ConnectionState()
+		state = &cs
+	}
+
+	r := newReader(conn)
+	sess := &session{
+		principal: storage.Principal(state, conn.RemoteAddr().String()),
+		w:         newWriter(conn),
+	}
+
+	for !sess.quit {
+		args, err := r.readCommand()
+		if err != nil {
+			var perr protocolError
+			if errors.As(err, &perr) {
+				sess.w.error("ERR " + perr.Error())
+				sess.w.flush()
+			} else if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Printf("resp: %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if len(args) > 0 {
+			s.run(sess, args)
+		}
+
+		// Replies to pipelined commands are sent together, once the
+		// commands read so far have all been run.
+		if !r.buffered() || sess.quit {
+			if err := sess.w.flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// command is a command the server runs. arity counts the command name, as
+// Redis does: a negative arity -n means at least n arguments.
+type command struct {
+	arity int
+	run   func(s *Server, sess *session, args []string)
+}
+
+var commands = map[string]command{
+	"PING":   {-1, (*Server).ping},
+	"ECHO":   {2, (*Server).echo},
+	"SELECT": {2, (*Server).selectDB},
+	"QUIT":   {1, (*Server).quit},
+	"GET":    {2, (*Server).get},
+	"SET":    {-3, (*Server).set},
+	"DEL":    {-2, (*Server).del},
+	"EXISTS": {-2, (*Server).exists},
+	"KEYS":   {2, (*Server).keys},
+	"SCAN":   {-2, (*Server).scan},
+	"MGET":   {-2, (*Server).mget},
+	"MSET":   {-3, (*Server).mset},
+	"INCR":   {2, (*Server).incr},
+	"INCRBY": {3, (*Server).incr},
+	"DECR":   {2, (*Server).incr},
+	"DECRBY": {3, (*Server).incr},
+}
+
+func (s *Server) run(sess *session, args []string) {
+	name := strings.ToUpper(args[0])
+	cmd, ok := commands[name]
+	if !ok {
+		sess.w.error(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		sess.w.error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return
+	}
+	cmd.run(s, sess, args)
+}
+
+// caller identifies a command of sess to the Service. Every command gets
+// its own request ID.
+func (sess *session) caller() storage.Caller {
+	return storage.Caller{RequestID: storage.NewRequestID(), Principal: sess.principal}
+}
+
+// storageError writes err, returned by the Service, as an error reply.
+func (sess *session) storageError(err error) {
+	if errors.Is(err, storage.ErrorReadOnly) {
+		sess.w.error("READONLY " + err.Error())
+		return
+	}
+	sess.w.error("ERR " + err.Error())
+}
+
+func (s *Server) ping(sess *session, args []string) {
+	switch len(args) {
+	case 1:
+		sess.w.status("PONG")
+	case 2:
+		sess.w.bulk(args[1])
+	default:
+		sess.w.error("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func (s *Server) echo(sess *session, args []string) {
+	sess.w.bulk(args[1])
+}
+
+// selectDB accepts database 0, the only one there is, for clients that
+// select it when they connect.
+func (s *Server) selectDB(sess *session, args []string) {
+	if args[1] != "0" {
+		sess.w.error("ERR DB index is out of range")
+		return
+	}
+	sess.w.status("OK")
+}
+
+func (s *Server) quit(sess *session, args []string) {
+	sess.w.status("OK")
+	sess.quit = true
+}
+
+func (s *Server) get(sess *session, args []string) {
+	value, err := s.svc.Get(args[1])
+	switch {
+	case errors.Is(err, storage.ErrorNoSuchKey):
+		sess.w.null()
+	case err != nil:
+		sess.storageError(err)
+	default:
+		sess.w.bulk(value)
+	}
+}
+
+// set runs SET key value [EX seconds | PX milliseconds].
+func (s *Server) set(sess *session, args []string) {
+	op := storage.Op{Type: storage.EventPut, Key: args[1], Value: args[2]}
+
+	opts := args[3:]
+	for len(opts) > 0 {
+		unit := time.Second
+		switch strings.ToUpper(opts[0]) {
+		case "EX":
+		case "PX":
+			unit = time.Millisecond
+		default:
+			sess.w.error("ERR syntax error")
+			return
+		}
+		if len(opts) < 2 || !op.ExpiresAt.IsZero() {
+			sess.w.error("ERR syntax error")
+			return
+		}
+
+		n, err := strconv.ParseInt(opts[1], 10, 64)
+		if err != nil {
+			sess.w.error("ERR value is not an integer or out of range")
+			return
+		}
+		if n <= 0 || n > int64(time.Duration(1<<63-1)/unit) {
+			sess.w.error("ERR invalid expire time in 'set' command")
+			return
+		}
+		op.ExpiresAt = time.Now().Add(time.Duration(n) * unit).UTC()
+		opts = opts[2:]
+	}
+
+	if _, err := s.svc.Txn(sess.caller(), []storage.Op{op}); err != nil {
+		sess.storageError(err)
+		return
+	}
+	sess.w.status("OK")
+}
+
+// del deletes the keys that exist in a single transaction, and replies
+// with how many did. If one is deleted by another client meanwhile, the
+// transaction fails as a whole and is tried again.
+func (s *Server) del(sess *session, args []string) {
+	for {
+		versions, err := s.svc.LookupMany(args[1:])
+		if err != nil {
+			sess.storageError(err)
+			return
+		}
+		if len(versions) == 0 {
+			sess.w.integer(0)
+			return
+		}
+
+		ops := make([]storage.Op, 0, len(versions))
+		for key := range versions {
+			ops = append(ops, storage.Op{Type: storage.EventDelete, Key: key})
+		}
+		_, err = s.svc.Txn(sess.caller(), ops)
+		switch {
+		case err == nil:
+			sess.w.integer(int64(len(ops)))
+			return
+		case !errors.Is(err, storage.ErrorNoSuchKey):
+			sess.storageError(err)
+			return
+		}
+	}
+}
+
+// exists replies with how many of the keys exist, counting a key named
+// twice twice.
+func (s *Server) exists(sess *session, args []string) {
+	var n int64
+	for _, key := range args[1:] {
+		_, err := s.svc.Get(key)
+		switch {
+		case err == nil:
+			n++
+		case !errors.Is(err, storage.ErrorNoSuchKey):
+			sess.storageError(err)
+			return
+		}
+	}
+	sess.w.integer(n)
+}
+
+func (s *Server) keys(sess *session, args []string) {
+	pattern := args[1]
+	entries, _, err := s.svc.Snapshot(literalPrefix(pattern))
+	if err != nil {
+		sess.storageError(err)
+		return
+	}
+
+	keys := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if match(pattern, e.Key) {
+			keys = append(keys, e.Key)
+		}
+	}
+	sess.w.bulks(keys)
+}
+
+// scan runs SCAN cursor [MATCH pattern] [COUNT count]. Keys are visited in
+// order of a hash of the key, and the cursor is one more than the hash to
+// resume from, or 0 at the start and end. Keys sharing a hash are returned
+// together, so a key present for the whole scan is returned exactly once,
+// whatever else is written meanwhile.
+func (s *Server) scan(sess *session, args []string) {
+	cursor, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil || cursor > 1<<32 {
+		sess.w.error("ERR invalid cursor")
+		return
+	}
+
+	pattern, count := "*", 10
+	for opts := args[2:]; len(opts) > 0; opts = opts[2:] {
+		if len(opts) < 2 {
+			sess.w.error("ERR syntax error")
+			return
+		}
+		switch strings.ToUpper(opts[0]) {
+		case "MATCH":
+			pattern = opts[1]
+		case "COUNT":
+			if count, err = strconv.Atoi(opts[1]); err != nil || count < 1 {
+				sess.w.error("ERR value is not an integer or out of range")
+				return
+			}
+		default:
+			sess.w.error("ERR syntax error")
+			return
+		}
+	}
+
+	entries, _, err := s.svc.Snapshot(literalPrefix(pattern))
+	if err != nil {
+		sess.storageError(err)
+		return
+	}
+
+	var from uint64
+	if cursor > 0 {
+		from = cursor - 1
+	}
+
+	// Find the hash of the count-th key from the cursor on, keeping the
+	// smallest count hashes in a heap rather than sorting every key.
+	hashes := make([]uint64, len(entries))
+	smallest := &hashHeap{}
+	for i, e := range entries {
+		h := keyHash(e.Key)
+		hashes[i] = h
+		switch {
+		case h < from:
+		case smallest.Len() < count:
+			heap.Push(smallest, h)
+		case h < (*smallest)[0]:
+			(*smallest)[0] = h
+			heap.Fix(smallest, 0)
+		}
+	}
+	last := uint64(math.MaxUint64)
+	if smallest.Len() == count {
+		last = (*smallest)[0]
+	}
+
+	// Take the keys up to that hash, including the rest of the keys
+	// sharing it, since the cursor cannot point between them, and resume
+	// from the next hash after it. The snapshot is in key order, which a
+	// stable sort by hash keeps for ties.
+	type hashedKey struct {
+		hash uint64
+		key  string
+	}
+	var next uint64
+	var page []hashedKey
+	for i, e := range entries {
+		switch h := hashes[i]; {
+		case h < from:
+		case h > last:
+			if next == 0 || h+1 < next {
+				next = h + 1
+			}
+		case match(pattern, e.Key):
+			page = append(page, hashedKey{h, e.Key})
+		}
+	}
+	sort.SliceStable(page, func(i, j int) bool { return page[i].hash < page[j].hash })
+
+	keys := make([]string, len(page))
+	for i, hk := range page {
+		keys[i] = hk.key
+	}
+
+	sess.w.array(2)
+	sess.w.bulk(strconv.FormatUint(next, 10))
+	sess.w.bulks(keys)
+}
+
+func keyHash(key string) uint64 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return uint64(h.Sum32())
+}
+
+// hashHeap is a max-heap of key hashes.
+type hashHeap []uint64
+
+func (h hashHeap) Len() int           { return len(h) }
+func (h hashHeap) Less(i, j int) bool { return h[i] > h[j] }
+func (h hashHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *hashHeap) Push(x any)        { *h = append(*h, x.(uint64)) }
+func (h *hashHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// mget replies with the values of the keys as of a single moment, with
+// null for those that have none.
+func (s *Server) mget(sess *session, args []string) {
+	versions, err := s.svc.LookupMany(args[1:])
+	if err != nil {
+		sess.storageError(err)
+		return
+	}
+
+	sess.w.array(len(args) - 1)
+	for _, key := range args[1:] {
+		if v, ok := versions[key]; ok {
+			sess.w.bulk(v.Value)
+		} else {
+			sess.w.null()
+		}
+	}
+}
+
+// mset sets every key in a single transaction.
+func (s *Server) mset(sess *session, args []string) {
+	if len(args)%2 != 1 {
+		sess.w.error("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+
+	ops := make([]storage.Op, 0, len(args)/2)
+	for i := 1; i < len(args); i += 2 {
+		ops = append(ops, storage.Op{Type: storage.EventPut, Key: args[i], Value: args[i+1]})
+	}
+	if _, err := s.svc.Txn(sess.caller(), ops); err != nil {
+		sess.storageError(err)
+		return
+	}
+	sess.w.status("OK")
+}
+
+// incr runs INCR, INCRBY, DECR and DECRBY.
+func (s *Server) incr(sess *session, args []string) {
+	name := strings.ToUpper(args[0])
+
+	delta := int64(1)
+	if len(args) == 3 {
+		var err error
+		if delta, err = strconv.ParseInt(args[2], 10, 64); err != nil {
+			sess.w.error("ERR value is not an integer or out of range")
+			return
+		}
+	}
+	if name == "DECR" || name == "DECRBY" {
+		if delta == -1<<63 {
+			sess.w.error("ERR decrement would overflow")
+			return
+		}
+		delta = -delta
+	}
+
+	n, err := s.svc.Increment(sess.caller(), args[1], delta)
+	switch {
+	case errors.Is(err, storage.ErrorInvalidArgument):
+		sess.w.error("ERR value is not an integer or out of range")
+	case err != nil:
+		sess.storageError(err)
+	default:
+		sess.w.integer(n)
+	}
+}
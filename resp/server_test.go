@@ -0,0 +1,337 @@
+package resp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"keyvaluestore/storage"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClient is a minimal RESP client, written independently of the
+// server's own reader and writer so that each checks the other.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// replyError is an error reply.
+type replyError string
+
+// send writes a command without waiting for its reply.
+func (c *testClient) send(args ...string) {
+	c.t.Helper()
+
+	cmd := fmt.Sprintf("*%d\r\n", len(args))
+	for _, a := range args {
+		cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(c.conn, cmd); err != nil {
+		c.t.Fatalf("Failed to send %q: %v", args, err)
+	}
+}
+
+// read reads a reply: a string for a simple or bulk string, nil for a null,
+// an int64, a replyError or a []any.
+func (c *testClient) read() any {
+	c.t.Helper()
+
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("Failed to read reply: %v", err)
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return line[1:]
+	case '-':
+		return replyError(line[1:])
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			c.t.Fatalf("Invalid integer reply %q", line)
+		}
+		return n
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			c.t.Fatalf("Failed to read bulk reply: %v", err)
+		}
+		return string(buf[:n])
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		items := make([]any, n)
+		for i := range items {
+			items[i] = c.read()
+		}
+		return items
+	}
+	c.t.Fatalf("Invalid reply %q", line)
+	return nil
+}
+
+// do sends a command and returns its reply.
+func (c *testClient) do(args ...string) any {
+	c.t.Helper()
+	c.send(args...)
+	return c.read()
+}
+
+// expect sends a command and checks its reply.
+func (c *testClient) expect(want any, args ...string) {
+	c.t.Helper()
+	if got := c.do(args...); !reflect.DeepEqual(got, want) {
+		c.t.Errorf("%q: expected %#v, got %#v", args, want, got)
+	}
+}
+
+// newTestServer serves the real storage.Service, on a temporary
+// transaction log, on a localhost port, and returns a function that
+// connects new clients to it.
+func newTestServer(t *testing.T, opts ...storage.ServiceOption) (connect func() *testClient, logFile string) {
+	t.Helper()
+
+	db, err := storage.NewInMemoryDB()
+	if err != nil {
+		t.Fatalf("Failed to create DB: %v", err)
+	}
+	logFile = filepath.Join(t.TempDir(), "transaction.log")
+	logger, err := storage.InitializeFileTransactionLogger(db, logFile)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := NewServer(storage.NewService(db, logger, opts...))
+	go server.Serve(lis)
+	t.Cleanup(func() { server.Close() })
+
+	connect = func() *testClient {
+		conn, err := net.Dial("tcp", lis.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	}
+	return connect, logFile
+}
+
+func TestServer_Commands(t *testing.T) {
+	connect, logFile := newTestServer(t)
+	c := connect()
+
+	c.expect("PONG", "PING")
+	c.expect("hi", "ping", "hi")
+	c.expect(nil, "GET", "a")
+	c.expect("OK", "SET", "a", "line\r\nbreak")
+	c.expect("line\r\nbreak", "GET", "a")
+	c.expect("OK", "MSET", "b", "2", "c", "3")
+	c.expect([]any{"line\r\nbreak", nil, "2"}, "MGET", "a", "x", "b")
+	c.expect(int64(3), "EXISTS", "a", "b", "a", "x")
+	c.expect(int64(2), "DEL", "a", "x", "c")
+	c.expect("OK", "SET", "d", "4")
+	c.expect(int64(1), "DEL", "d", "d")
+	c.expect(int64(3), "INCR", "b")
+	c.expect(int64(1), "INCR", "n")
+	c.expect(int64(-9), "DECRBY", "n", "10")
+	c.expect(replyError("ERR wrong number of arguments for 'get' command"), "GET")
+	c.expect(replyError("ERR unknown command 'FLUSHALL'"), "FLUSHALL")
+	c.expect(replyError("ERR syntax error"), "SET", "a", "1", "NX")
+
+	c.expect("OK", "SET", "s", "x")
+	c.expect(replyError("ERR value is not an integer or out of range"), "INCR", "s")
+
+	// The writes reached the transaction log.
+	logger, err := storage.OpenFileTransactionLogger(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := storage.Restore(logger, storage.RestoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all, _ := restored.GetAll(); !reflect.DeepEqual(all, map[string]string{"b": "3", "n": "-9", "s": "x"}) {
+		t.Errorf("Expected the log to restore the writes, got %v", all)
+	}
+}
+
+func TestServer_InlineCommands(t *testing.T) {
+	connect, _ := newTestServer(t)
+	c := connect()
+
+	io.WriteString(c.conn, "SET a 1\r\nGET a\n\r\nPING\r\n")
+	for _, want := range []any{"OK", "1", "PONG"} {
+		if got := c.read(); got != want {
+			t.Errorf("Expected %#v, got %#v", want, got)
+		}
+	}
+}
+
+func TestServer_SetExpiry(t *testing.T) {
+	connect, _ := newTestServer(t)
+	c := connect()
+
+	c.expect("OK", "SET", "a", "1", "PX", "50")
+	c.expect("OK", "SET", "b", "2", "EX", "100")
+	c.expect(replyError("ERR invalid expire time in 'set' command"), "SET", "a", "1", "EX", "0")
+	c.expect("1", "GET", "a")
+	c.expect(int64(2), "INCR", "a") // keeps the expiry
+
+	time.Sleep(100 * time.Millisecond)
+	c.expect(nil, "GET", "a")
+	c.expect(int64(0), "EXISTS", "a")
+	c.expect(int64(0), "DEL", "a")
+	c.expect([]any{"b"}, "KEYS", "*")
+	c.expect(int64(1), "INCR", "a")
+}
+
+func TestServer_Pipelining(t *testing.T) {
+	connect, _ := newTestServer(t)
+	c := connect()
+
+	// Send everything before reading anything, so the server sees the
+	// commands together.
+	const n = 500
+	var batch string
+	for i := 0; i < n; i++ {
+		batch += "*2\r\n$4\r\nINCR\r\n$3\r\nctr\r\n"
+	}
+	go io.WriteString(c.conn, batch)
+
+	for i := 1; i <= n; i++ {
+		if got := c.read(); got != int64(i) {
+			t.Fatalf("Expected reply %d, got %#v", i, got)
+		}
+	}
+}
+
+func TestServer_ConcurrentConnections(t *testing.T) {
+	connect, _ := newTestServer(t)
+
+	const clients, incrs = 8, 50
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		c := connect()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < incrs; j++ {
+				c.send("INCR", "ctr")
+			}
+			for j := 0; j < incrs; j++ {
+				if _, ok := c.read().(int64); !ok {
+					t.Error("Expected an integer reply")
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	connect().expect(strconv.Itoa(clients*incrs), "GET", "ctr")
+}
+
+func TestServer_KeysAndScan(t *testing.T) {
+	connect, _ := newTestServer(t)
+	c := connect()
+
+	var args []string
+	for i := 0; i < 25; i++ {
+		args = append(args, fmt.Sprintf("user:%02d", i), "x")
+	}
+	c.expect("OK", append([]string{"MSET", "other", "x"}, args...)...)
+
+	c.expect([]any{"user:10", "user:11", "user:12"}, "KEYS", "user:1[0-2]")
+	c.expect([]any{"other"}, "KEYS", "o*")
+
+	seen := make(map[string]int)
+	cursor := "0"
+	for calls := 0; ; calls++ {
+		if calls > 25 {
+			t.Fatal("SCAN did not finish")
+		}
+		reply := c.do("SCAN", cursor, "MATCH", "user:*", "COUNT", "7").([]any)
+		cursor = reply[0].(string)
+		for _, k := range reply[1].([]any) {
+			seen[k.(string)]++
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	if len(seen) != 25 {
+		t.Errorf("Expected SCAN to return 25 keys, got %d", len(seen))
+	}
+	for k, n := range seen {
+		if n != 1 {
+			t.Errorf("Expected %s once, got %d times", k, n)
+		}
+	}
+}
+
+func TestServer_ReadOnly(t *testing.T) {
+	connect, _ := newTestServer(t, storage.WithReadOnly())
+	c := connect()
+
+	reply, ok := c.do("SET", "a", "1").(replyError)
+	if !ok || reply[:8] != "READONLY" {
+		t.Errorf("Expected a READONLY error, got %#v", reply)
+	}
+	c.expect(nil, "GET", "a")
+}
+
+func TestServer_ProtocolError(t *testing.T) {
+	connect, _ := newTestServer(t)
+	c := connect()
+
+	io.WriteString(c.conn, "*1\r\n+PING\r\n")
+	if _, ok := c.read().(replyError); !ok {
+		t.Error("Expected a protocol error")
+	}
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.r.ReadByte(); err != io.EOF {
+		t.Errorf("Expected the server to close the connection, got %v", err)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b*c", "aXbYbZ", false},
+	}
+	for _, tt := range tests {
+		if got := match(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("match(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// AuditRecord is the JSON form of a logged change returned by AuditHandler.
+type AuditRecord struct {
+	Sequence  uint64     `json:"sequence"`
+	Type      string     `json:"type"`
+	Key       string     `json:"key"`
+	Value     string     `json:"value,omitempty"`
+	Result    string     `json:"result,omitempty"` // the new value after an update
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	RequestID string     `json:"request_id,omitempty"`
+	Principal string     `json:"principal,omitempty"`
+}
+
+// auditFilter selects the events returned by AuditHandler. Zero fields
+// match everything.
+type auditFilter struct {
+	key       string
+	prefix    string
+	principal string
+	since     uint64
+	from      time.Time
+	to        time.Time
+	limit     int
+}
+
+// keyLimit returns how many events of the key the logger need read: limit,
+// unless a filter the logger does not apply could reject some of them.
+func (f auditFilter) keyLimit() int {
+	if f.principal != "" || !f.from.IsZero() || !f.to.IsZero() {
+		return 0
+	}
+	return f.limit
+}
+
+func (f auditFilter) matches(e Event) bool {
+	switch {
+	case e.EventType == EventMark:
+		return false
+	case f.key != "" && e.Key != f.key:
+		return false
+	case f.prefix != "" && !strings.HasPrefix(e.Key, f.prefix):
+		return false
+	case f.principal != "" && e.Principal != f.principal:
+		return false
+	case !f.from.IsZero() && e.Timestamp.Before(f.from):
+		return false
+	case !f.to.IsZero() && !e.Timestamp.Before(f.to):
+		return false
+	}
+	return true
+}
+
+// AuditHandler answers "when did this key change and who changed it?" from
+// the transaction log. It accepts the query parameters key, prefix,
+// principal, since (a sequence number), from and to (RFC 3339 times) and
+// limit, and returns the matching events oldest first. The log is read
+// until limit events match, or the request is cancelled; the events of a
+// single key are read by key, and limited, by the logger.
+func (h *Handler) AuditHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("%w: %v", ErrorInvalidArgument, err))
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel() // stops the reader once limit events match
+	var events <-chan Event
+	var errs <-chan error
+	if filter.key != "" {
+		events, errs = h.svc.KeyEvents(ctx, filter.key, filter.since, filter.keyLimit())
+	} else {
+		events, errs = h.svc.Events(ctx, filter.since)
+	}
+
+	records := make([]AuditRecord, 0)
+	for e := range events {
+		if !filter.matches(e) {
+			continue
+		}
+		if records = append(records, NewAuditRecord(e)); len(records) == filter.limit {
+			break
+		}
+	}
+	if len(records) < filter.limit {
+		if err := <-errs; err != nil {
+			if r.Context().Err() != nil {
+				return // the client has gone
+			}
+			writeError(w, r, fmt.Errorf("%w: %v", ErrorUnavailable, err))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(records)
+}
+
+// NewAuditRecord returns the AuditRecord of e.
+func NewAuditRecord(e Event) AuditRecord {
+	rec := AuditRecord{
+		Sequence:  e.Sequence,
+		Type:      e.EventType.String(),
+		Key:       e.Key,
+		Value:     e.Value,
+		Result:    e.Result,
+		RequestID: e.RequestID,
+		Principal: e.Principal,
+	}
+	if !e.Timestamp.IsZero() {
+		ts := e.Timestamp
+		rec.Timestamp = &ts
+	}
+	return rec
+}
+
+func parseAuditFilter(r *http.Request) (auditFilter, error) {
+	q := r.URL.Query()
+	f := auditFilter{
+		key:       q.Get("key"),
+		prefix:    q.Get("prefix"),
+		principal: q.Get("principal"),
+		limit:     defaultAuditLimit,
+	}
+
+	var err error
+	if s := q.Get("since"); s != "" {
+		if f.since, err = strconv.ParseUint(s, 10, 64); err != nil {
+			return f, fmt.Errorf("invalid since: %w", err)
+		}
+	}
+	if s := q.Get("from"); s != "" {
+		if f.from, err = time.Parse(time.RFC3339, s); err != nil {
+			return f, fmt.Errorf("invalid from: %w", err)
+		}
+	}
+	if s := q.Get("to"); s != "" {
+		if f.to, err = time.Parse(time.RFC3339, s); err != nil {
+			return f, fmt.Errorf("invalid to: %w", err)
+		}
+	}
+	if s := q.Get("limit"); s != "" {
+		if f.limit, err = strconv.Atoi(s); err != nil || f.limit <= 0 {
+			return f, fmt.Errorf("invalid limit: %q", s)
+		}
+		if f.limit > maxAuditLimit {
+			f.limit = maxAuditLimit
+		}
+	}
+	return f, nil
+}
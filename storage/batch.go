@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// maxBatchItems bounds the keys of a batch get or put.
+	maxBatchItems = 10000
+	// maxBatchBody bounds the request body of a batch get or put.
+	maxBatchBody = 64 << 20
+	// importBatchSize is how many records an import writes to the
+	// transaction log in each batch record.
+	importBatchSize = 1000
+
+	// SnapshotSequenceHeader carries the sequence number of the last
+	// change reflected by an export.
+	SnapshotSequenceHeader = "X-Snapshot-Sequence"
+)
+
+// Record is a key and its value, as exchanged by the batch, export and
+// import endpoints. ExpiresAt and Flags are those set through the Redis
+// and memcached listeners.
+type Record struct {
+	Key       string     `json:"key"`
+	Value     string     `json:"value"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Flags     uint32     `json:"flags,omitempty"`
+}
+
+func newRecord(key string, v Version) Record {
+	rec := Record{Key: key, Value: v.Value, Flags: v.Flags}
+	if !v.ExpiresAt.IsZero() {
+		expiresAt := v.ExpiresAt
+		rec.ExpiresAt = &expiresAt
+	}
+	return rec
+}
+
+func (rec Record) op() Op {
+	op := Op{Type: EventPut, Key: rec.Key, Value: rec.Value, Flags: rec.Flags}
+	if rec.ExpiresAt != nil {
+		op.ExpiresAt = rec.ExpiresAt.UTC()
+	}
+	return op
+}
+
+// BatchGetRequest is the body of POST /v1/batch/get.
+type BatchGetRequest struct {
+	Keys []string `json:"keys"`
+}
+
+// BatchGetResponse holds the values of the keys that exist, and lists
+// those that do not, in request order.
+type BatchGetResponse struct {
+	Values  map[string]string `json:"values"`
+	Missing []string          `json:"missing"`
+}
+
+// BatchPutRequest is the body of POST /v1/batch/put.
+type BatchPutRequest struct {
+	Items []Record `json:"items"`
+}
+
+// BatchPutResponse is the reply to a batch put or an import. Sequence is
+// the sequence number of the last write, or 0 if there was none.
+type BatchPutResponse struct {
+	Count    int    `json:"count"`
+	Sequence uint64 `json:"sequence"`
+}
+
+// BatchGetHandler returns the values of up to maxBatchItems keys, all as of
+// a single moment.
+func (h *Handler) BatchGetHandler(w http.ResponseWriter, r *http.Request) {
+	var req BatchGetRequest
+	if err := decodeBatch(w, r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if len(req.Keys) > maxBatchItems {
+		writeError(w, r, fmt.Errorf("%w: a batch is limited to %d keys", ErrorTooLarge, maxBatchItems))
+		return
+	}
+
+	versions, err := h.svc.LookupMany(req.Keys)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	resp := BatchGetResponse{Values: make(map[string]string, len(versions)), Missing: []string{}}
+	for _, key := range req.Keys {
+		if v, ok := versions[key]; ok {
+			resp.Values[key] = v.Value
+		} else {
+			resp.Missing = append(resp.Missing, key)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// BatchPutHandler writes up to maxBatchItems keys as a single transaction,
+// logged as one batch record.
+func (h *Handler) BatchPutHandler(w http.ResponseWriter, r *http.Request) {
+	var req BatchPutRequest
+	if err := decodeBatch(w, r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if len(req.Items) > maxBatchItems {
+		writeError(w, r, fmt.Errorf("%w: a batch is limited to %d keys", ErrorTooLarge, maxBatchItems))
+		return
+	}
+
+	ops := make([]Op, len(req.Items))
+	for i, rec := range req.Items {
+		ops[i] = rec.op()
+	}
+	seq, err := h.svc.Txn(caller(r), ops)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(BatchPutResponse{Count: len(ops), Sequence: seq})
+}
+
+// decodeBatch decodes the JSON body of a batch request into v.
+func decodeBatch(w http.ResponseWriter, r *http.Request, v any) error {
+	body := http.MaxBytesReader(w, r.Body, maxBatchBody)
+	defer body.Close()
+
+	err := json.NewDecoder(body).Decode(v)
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return fmt.Errorf("%w: batch requests are limited to %d bytes", ErrorTooLarge, maxErr.Limit)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: invalid batch request: %v", ErrorInvalidArgument, err)
+	}
+	return nil
+}
+
+// ExportHandler streams the keys with ?prefix= as newline-delimited JSON
+// Records, sorted by key. The export is a consistent snapshot; its
+// sequence number is sent in the X-Snapshot-Sequence header, so that a
+// watch from it picks up exactly the later changes.
+func (h *Handler) ExportHandler(w http.ResponseWriter, r *http.Request) {
+	entries, seq, err := h.svc.Snapshot(r.URL.Query().Get("prefix"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set(SnapshotSequenceHeader, strconv.FormatUint(seq, 10))
+
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(newRecord(e.Key, e.Version)); err != nil {
+			return
+		}
+	}
+}
+
+// ImportHandler writes the newline-delimited JSON Records of the request
+// body, as written by ExportHandler. The body is streamed, and written to
+// the transaction log in batch records of importBatchSize keys, each
+// applied atomically. If a record is invalid, the batches before it stay
+// written and the error says how many records they held.
+func (h *Handler) ImportHandler(w http.ResponseWriter, r *http.Request) {
+	dec := json.NewDecoder(r.Body)
+	c := caller(r)
+
+	var resp BatchPutResponse
+	ops := make([]Op, 0, importBatchSize)
+	flush := func() error {
+		if len(ops) == 0 {
+			return nil
+		}
+		seq, err := h.svc.Txn(c, ops)
+		if err != nil {
+			return err
+		}
+		resp.Count += len(ops)
+		resp.Sequence = seq
+		ops = ops[:0]
+		return nil
+	}
+
+	fail := func(err error) {
+		writeError(w, r, fmt.Errorf("%w (%d records were imported before it)", err, resp.Count))
+	}
+
+	for n := 1; ; n++ {
+		var rec Record
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+
+		switch {
+		case err != nil:
+			err = fmt.Errorf("%w: record %d: %v", ErrorInvalidArgument, n, err)
+		case rec.Key == "":
+			err = fmt.Errorf("%w: record %d: key must not be empty", ErrorInvalidArgument, n)
+		default:
+			if ops = append(ops, rec.op()); len(ops) == importBatchSize {
+				err = flush()
+			}
+		}
+		if err != nil {
+			fail(err)
+			return
+		}
+	}
+	if err := flush(); err != nil {
+		fail(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
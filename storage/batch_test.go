@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHandler_BatchGetAndPut(t *testing.T) {
+	router := newTestRouter(t, WithMaxValueSize(8))
+
+	do := func(path, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		return rr
+	}
+
+	rr := do("/v1/batch/put", `{"items": [{"key": "a", "value": "1"}, {"key": "b", "value": "2"}]}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body)
+	}
+	var put BatchPutResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &put); err != nil || put != (BatchPutResponse{Count: 2, Sequence: 2}) {
+		t.Errorf("Expected count 2 at sequence 2, got %s", rr.Body)
+	}
+
+	// A batch with a bad item writes nothing.
+	rr = do("/v1/batch/put", `{"items": [{"key": "c", "value": "3"}, {"key": "d", "value": "too large"}]}`)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status 413, got %d", rr.Code)
+	}
+
+	rr = do("/v1/batch/get", `{"keys": ["b", "c", "a"]}`)
+	var get BatchGetResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &get); err != nil {
+		t.Fatalf("Invalid response %s: %v", rr.Body, err)
+	}
+	expected := BatchGetResponse{Values: map[string]string{"a": "1", "b": "2"}, Missing: []string{"c"}}
+	if !reflect.DeepEqual(get, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, get)
+	}
+
+	if rr = do("/v1/batch/get", `{"keys": `); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a malformed request, got %d", rr.Code)
+	}
+}
+
+func TestHandler_ImportExport(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "transaction.log")
+	db, err := NewInMemoryDB()
+	if err != nil {
+		t.Fatalf("Failed to create inMemoryDB: %v", err)
+	}
+	logger, err := InitializeFileTransactionLogger(db, filename)
+	if err != nil {
+		t.Fatalf("InitializeFileTransactionLogger returned an error: %v", err)
+	}
+	handler, _ := NewHandler(db, logger)
+	router := NewRouter(&handler)
+
+	const n = 2*importBatchSize + 1
+	var body strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&body, "{\"key\": \"k%05d\", \"value\": \"v%d\"}\n", i, i)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/v1/import", strings.NewReader(body.String())))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body)
+	}
+	var resp BatchPutResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || resp != (BatchPutResponse{Count: n, Sequence: n}) {
+		t.Errorf("Expected %d records imported, got %s", n, rr.Body)
+	}
+
+	// The import was logged as one record per batch.
+	fileLogger := logger.(*FileTransactionLogger)
+	close(fileLogger.events)
+	for writeErr := range fileLogger.errors {
+		t.Fatalf("Got an error from the transaction logger: %v", writeErr)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Failed to read log: %v", err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 3 {
+		t.Errorf("Expected 3 log records, got %d", lines)
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/export?prefix=k0000", nil))
+	if got := rr.Header().Get(SnapshotSequenceHeader); got != fmt.Sprint(n) {
+		t.Errorf("Expected snapshot sequence %d, got %q", n, got)
+	}
+
+	var keys []string
+	scanner := bufio.NewScanner(rr.Body)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("Invalid export line %q: %v", scanner.Text(), err)
+		}
+		keys = append(keys, rec.Key)
+	}
+	expected := []string{"k00000", "k00001", "k00002", "k00003", "k00004", "k00005", "k00006", "k00007", "k00008", "k00009"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected keys %v, got %v", expected, keys)
+	}
+}
+
+func TestHandler_ImportReportsBadRecord(t *testing.T) {
+	router := newTestRouter(t)
+
+	body := strings.Repeat("{\"key\": \"a\", \"value\": \"1\"}\n", importBatchSize) + "{\"key\": \"\"}\n"
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/v1/import", strings.NewReader(body)))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status 400, got %d", rr.Code)
+	}
+	want := fmt.Sprintf("record %d: key must not be empty (%d records were imported before it)", importBatchSize+1, importBatchSize)
+	if !strings.Contains(rr.Body.String(), want) {
+		t.Errorf("Expected the error to say %q, got %s", want, rr.Body)
+	}
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"strings"
+	"sync"
+)
+
+const defaultSubscriptionBuffer = 256
+
+// Broker fans out applied events to watchers. The DB publishes to it from
+// Apply, so subscribers see every change in sequence order, whichever
+// front-end made it.
+type Broker struct {
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+func NewBroker() *Broker {
+	return &Broker{subs: make(map[*Subscription]struct{})}
+}
+
+// Subscription receives the events published after it was created for
+// keys with its prefix. C is closed when the subscription is closed, or
+// when the subscriber falls so far behind that its buffer fills up; in the
+// latter case Overflowed reports true and the subscriber should resume
+// from the transaction log.
+type Subscription struct {
+	C <-chan Event
+
+	c          chan Event
+	prefix     string
+	broker     *Broker
+	overflowed bool
+}
+
+// Subscribe returns a subscription to events for keys with the given
+// prefix. An empty prefix matches every key.
+func (b *Broker) Subscribe(prefix string) *Subscription {
+	c := make(chan Event, defaultSubscriptionBuffer)
+	s := &Subscription{C: c, c: c, prefix: prefix, broker: b}
+
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+	return s
+}
+
+// Publish delivers e to every matching subscriber without blocking.
+func (b *Broker) Publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for s := range b.subs {
+		if !strings.HasPrefix(e.Key, s.prefix) {
+			continue
+		}
+		select {
+		case s.c <- e:
+		default:
+			s.overflowed = true
+			b.remove(s)
+		}
+	}
+}
+
+// Close stops delivery and closes C. It is safe to call more than once.
+func (s *Subscription) Close() {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	s.broker.remove(s)
+}
+
+// Overflowed reports whether the subscription was dropped for falling
+// behind. It is only meaningful once C has been closed.
+func (s *Subscription) Overflowed() bool {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	return s.overflowed
+}
+
+// remove must be called with b.mu held.
+func (b *Broker) remove(s *Subscription) {
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		close(s.c)
+	}
+}
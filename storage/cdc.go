@@ -0,0 +1,453 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCDCBatchSize  = 500
+	defaultCDCInterval   = time.Second
+	defaultCDCBackoff    = time.Second
+	defaultCDCMaxBackoff = time.Minute
+	defaultCDCTimeout    = 30 * time.Second
+)
+
+// Sink ships the changes to the store to another system, for change data
+// capture. Ship is called with one batch at a time, each in sequence order
+// and after the batch before it, and must return only once the sink has
+// durably accepted every record in it. A batch that fails is shipped
+// again, and the batches after a checkpoint are shipped again after a
+// restart, so a sink may see a record more than once: its consumers should
+// skip the sequence numbers they have seen.
+type Sink interface {
+	Ship(ctx context.Context, records []AuditRecord) error
+	Close() error
+}
+
+// CDCOption configures the CDC returned by NewCDC.
+type CDCOption func(*CDC)
+
+// WithCDCPrefix ships only the changes to keys with prefix.
+func WithCDCPrefix(prefix string) CDCOption {
+	return func(c *CDC) {
+		c.prefix = prefix
+	}
+}
+
+// WithCDCBatch ships up to size records at a time, and looks for new
+// changes in the log every interval once it has shipped them all.
+func WithCDCBatch(size int, interval time.Duration) CDCOption {
+	return func(c *CDC) {
+		c.batchSize, c.interval = size, interval
+	}
+}
+
+// WithCDCBackoff retries a batch that failed after a random delay of up to
+// backoff, doubled after each failure up to maxBackoff.
+func WithCDCBackoff(backoff, maxBackoff time.Duration) CDCOption {
+	return func(c *CDC) {
+		c.backoff, c.maxBackoff = backoff, maxBackoff
+	}
+}
+
+// CDC ships the changes logged by a TransactionLogger to a Sink, in
+// sequence order and at least once. After each batch the sink accepts, the
+// sequence number of the last event it covers is written to a checkpoint
+// file, so that after a restart shipping resumes with the first change
+// after it.
+type CDC struct {
+	logger     TransactionLogger
+	sink       Sink
+	filename   string
+	prefix     string
+	batchSize  int
+	interval   time.Duration
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	mu         sync.Mutex
+	checkpoint uint64
+	shipped    uint64
+	failures   uint64
+	stop       context.CancelFunc
+	done       chan struct{}
+}
+
+// cdcCheckpoint is the content of a checkpoint file.
+type cdcCheckpoint struct {
+	Sequence  uint64    `json:"sequence"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// NewCDC returns a CDC that ships the changes logged by logger to sink,
+// starting after the sequence number in the checkpoint file, or with the
+// first logged change if there is none yet. Nothing is shipped until
+// Start is called.
+func NewCDC(logger TransactionLogger, sink Sink, checkpoint string, opts ...CDCOption) (*CDC, error) {
+	c := &CDC{
+		logger:     logger,
+		sink:       sink,
+		filename:   checkpoint,
+		batchSize:  defaultCDCBatchSize,
+		interval:   defaultCDCInterval,
+		backoff:    defaultCDCBackoff,
+		maxBackoff: defaultCDCMaxBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.batchSize < 1 || c.interval <= 0 {
+		return nil, fmt.Errorf("%w: CDC needs a positive batch size and interval", ErrorInvalidArgument)
+	}
+
+	data, err := os.ReadFile(checkpoint)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CDC checkpoint: %w", err)
+	}
+	var cp cdcCheckpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("cannot read CDC checkpoint from %s: %w", checkpoint, err)
+	}
+	c.checkpoint = cp.Sequence
+	return c, nil
+}
+
+// Start ships changes until Close is called.
+func (c *CDC) Start() {
+	ctx, stop := context.WithCancel(context.Background())
+	c.mu.Lock()
+	c.stop, c.done = stop, make(chan struct{})
+	c.mu.Unlock()
+
+	go func() {
+		defer close(c.done)
+		failures := 0
+		for {
+			n, err := c.shipPending(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			wait := c.interval
+			switch {
+			case err != nil:
+				log.Printf("CDC: %v", err)
+				c.mu.Lock()
+				c.failures++
+				c.mu.Unlock()
+				wait = backoffDelay(failures, c.backoff, c.maxBackoff)
+				failures++
+			case n > 0:
+				failures = 0
+				continue // more may have been logged while shipping
+			default:
+				failures = 0
+			}
+			if !sleepContext(ctx, wait) {
+				return
+			}
+		}
+	}()
+}
+
+// Close stops shipping, waits for a batch in progress to stop, and closes
+// the sink. Changes not yet shipped are shipped after a restart.
+func (c *CDC) Close() error {
+	c.mu.Lock()
+	stop, done := c.stop, c.done
+	c.mu.Unlock()
+	if stop != nil {
+		stop()
+		<-done
+	}
+	return c.sink.Close()
+}
+
+// Checkpoint returns the sequence number of the last logged event the
+// sink has been shipped, or skipped as not a change to a key with the
+// prefix.
+func (c *CDC) Checkpoint() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.checkpoint
+}
+
+// shipPending ships the changes logged after the checkpoint, a batch at a
+// time, checkpointing after each. It returns how many were shipped.
+func (c *CDC) shipPending(ctx context.Context) (int, error) {
+	from := c.Checkpoint()
+	readCtx, cancel := context.WithCancel(ctx)
+	defer cancel() // stops the reader after a failed flush
+	events, errs := c.logger.ReadEventsSince(readCtx, from)
+
+	shipped := 0
+	last := from // the last event the batch covers
+	var batch []AuditRecord
+	flush := func() error {
+		if last == c.Checkpoint() {
+			return nil
+		}
+		if len(batch) > 0 {
+			if err := c.sink.Ship(ctx, batch); err != nil {
+				return fmt.Errorf("cannot ship changes after event %d: %w", c.Checkpoint(), err)
+			}
+		}
+		if err := c.save(last, len(batch)); err != nil {
+			return err
+		}
+		shipped += len(batch)
+		batch = nil
+		return nil
+	}
+
+	for e := range events {
+		if e.EventType.keyed() && strings.HasPrefix(e.Key, c.prefix) {
+			batch = append(batch, NewAuditRecord(e))
+		}
+		last = e.Sequence
+		if len(batch) == c.batchSize {
+			if err := flush(); err != nil {
+				return shipped, err
+			}
+		}
+	}
+	if err := <-errs; err != nil {
+		return shipped, fmt.Errorf("cannot read the transaction log: %w", err)
+	}
+	return shipped, flush()
+}
+
+// save records that the events up to seq, of which shipped were changes
+// shipped to the sink, have been dealt with, and writes the checkpoint
+// file atomically.
+func (c *CDC) save(seq uint64, shipped int) error {
+	data, err := json.Marshal(cdcCheckpoint{Sequence: seq, UpdatedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(c.filename, data); err != nil {
+		return fmt.Errorf("cannot save CDC checkpoint: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checkpoint = seq
+	c.shipped += uint64(shipped)
+	return nil
+}
+
+func (c *CDC) CollectMetrics(mw *MetricWriter) {
+	c.mu.Lock()
+	checkpoint, shipped, failures := c.checkpoint, c.shipped, c.failures
+	c.mu.Unlock()
+
+	mw.Gauge("cdc_checkpoint_sequence", "Sequence number of the last logged event shipped to the CDC sink.",
+		Sample{Value: float64(checkpoint)})
+	mw.Counter("cdc_records_shipped_total", "Changes shipped to the CDC sink.",
+		Sample{Value: float64(shipped)})
+	mw.Counter("cdc_failures_total", "Attempts to ship changes to the CDC sink that failed and will be retried.",
+		Sample{Value: float64(failures)})
+}
+
+// encodeRecords returns records as newline-delimited JSON.
+func encodeRecords(records []AuditRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, rec := range records {
+		if err := enc.Encode(rec); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// FileSink is a Sink that appends records to a file as newline-delimited
+// JSON, syncing it after each batch.
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileSink returns a FileSink appending to filename, which is created
+// if it does not exist.
+func NewFileSink(filename string) (*FileSink, error) {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open CDC file: %w", err)
+	}
+	return &FileSink{file: file}, nil
+}
+
+// Ship appends records to the file. If it fails, it cuts off what it
+// wrote, so that the file only holds whole lines.
+func (s *FileSink) Ship(ctx context.Context, records []AuditRecord) error {
+	data, err := encodeRecords(records)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err = s.file.Write(data); err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		s.file.Truncate(info.Size())
+		return err
+	}
+	return nil
+}
+
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
+
+// HTTPSink is a Sink that POSTs each batch of records to a URL as
+// newline-delimited JSON. The receiver must respond with a 2xx status once
+// it has durably accepted the batch.
+type HTTPSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPSink returns an HTTPSink posting to url with client, or with a
+// client with a timeout of 30 seconds if client is nil.
+func NewHTTPSink(url string, client *http.Client) *HTTPSink {
+	if client == nil {
+		client = &http.Client{Timeout: defaultCDCTimeout}
+	}
+	return &HTTPSink{url: url, client: client}
+}
+
+func (s *HTTPSink) Ship(ctx context.Context, records []AuditRecord) error {
+	data, err := encodeRecords(records)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("receiver responded %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *HTTPSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// Message is a change as a message for a Kafka-compatible or
+// NATS-compatible broker. Value is the AuditRecord of the change, as JSON.
+type Message struct {
+	Subject string // the Kafka topic or NATS subject
+	Key     []byte // the Kafka partitioning key: the key that changed
+	Value   []byte
+	Headers map[string]string
+}
+
+// Producer publishes messages to a Kafka-compatible or NATS-compatible
+// broker. It adapts the broker's client library to a ProducerSink. Publish
+// must keep the order of messages with the same Key, and return only once
+// the broker has acknowledged every message, such as with acks=all for
+// Kafka or from JetStream for NATS.
+type Producer interface {
+	Publish(ctx context.Context, msgs []Message) error
+	Close() error
+}
+
+// ProducerSink is a Sink that publishes each record as a Message through
+// a Producer.
+type ProducerSink struct {
+	producer Producer
+	message  func(rec AuditRecord) Message
+}
+
+// NewKafkaSink returns a ProducerSink publishing each record to topic,
+// keyed by the key that changed, so that the changes to a key land in one
+// partition, in order.
+func NewKafkaSink(p Producer, topic string) *ProducerSink {
+	return &ProducerSink{producer: p, message: func(rec AuditRecord) Message {
+		return Message{Subject: topic, Key: []byte(rec.Key)}
+	}}
+}
+
+// NewNATSSink returns a ProducerSink publishing each record to the subject
+// made of prefix, a dot and the key that changed, with the characters not
+// allowed in a subject token percent-encoded. The Nats-Msg-Id header, the
+// sequence number of the change, lets JetStream drop records shipped
+// again.
+func NewNATSSink(p Producer, prefix string) *ProducerSink {
+	return &ProducerSink{producer: p, message: func(rec AuditRecord) Message {
+		return Message{
+			Subject: prefix + "." + natsToken(rec.Key),
+			Headers: map[string]string{"Nats-Msg-Id": strconv.FormatUint(rec.Sequence, 10)},
+		}
+	}}
+}
+
+func (s *ProducerSink) Ship(ctx context.Context, records []AuditRecord) error {
+	msgs := make([]Message, len(records))
+	for i, rec := range records {
+		value, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		msg := s.message(rec)
+		msg.Value = value
+		if msg.Headers == nil {
+			msg.Headers = make(map[string]string)
+		}
+		msg.Headers["Kv-Sequence"] = strconv.FormatUint(rec.Sequence, 10)
+		msg.Headers["Kv-Type"] = rec.Type
+		msgs[i] = msg
+	}
+	return s.producer.Publish(ctx, msgs)
+}
+
+func (s *ProducerSink) Close() error {
+	return s.producer.Close()
+}
+
+// natsToken returns key as a NATS subject token, percent-encoding the
+// separator, the wildcards, whitespace, control characters and '%'.
+func natsToken(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		switch c := key[i]; {
+		case c <= ' ' || c == 0x7f || c == '.' || c == '*' || c == '>' || c == '%':
+			fmt.Fprintf(&b, "%%%02X", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newCDCService returns a Service writing to a log in dir.
+func newCDCService(t *testing.T, dir string) *Service {
+	t.Helper()
+	db, _ := NewInMemoryDB()
+	logger, err := InitializeFileTransactionLogger(db, filepath.Join(dir, "transaction.log"))
+	if err != nil {
+		t.Fatalf("InitializeFileTransactionLogger returned error: %v", err)
+	}
+	return NewService(db, logger)
+}
+
+// startCDC starts shipping the changes logged by svc to sink, checkpointed
+// in dir, quickly.
+func startCDC(t *testing.T, svc *Service, sink Sink, dir string, opts ...CDCOption) *CDC {
+	t.Helper()
+	opts = append([]CDCOption{
+		WithCDCBatch(2, time.Millisecond),
+		WithCDCBackoff(time.Millisecond, time.Millisecond),
+	}, opts...)
+	cdc, err := NewCDC(svc.logger, sink, filepath.Join(dir, "cdc.checkpoint"), opts...)
+	if err != nil {
+		t.Fatalf("NewCDC returned error: %v", err)
+	}
+	cdc.Start()
+	return cdc
+}
+
+func readNDJSON(t *testing.T, r io.Reader) []AuditRecord {
+	t.Helper()
+	var records []AuditRecord
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("Invalid line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func recordKeys(records []AuditRecord) string {
+	var keys []string
+	for _, rec := range records {
+		keys = append(keys, rec.Key)
+	}
+	return strings.Join(keys, " ")
+}
+
+func TestCDC_FileSink(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "changes.ndjson")
+	svc := newCDCService(t, dir)
+	svc.Put(Caller{Principal: "alice"}, "app/a", "1")
+	svc.Put(Caller{}, "other/b", "2")
+	svc.Increment(Caller{}, "app/n", 5)
+	svc.Delete(Caller{}, "app/a")
+
+	sink, err := NewFileSink(out)
+	if err != nil {
+		t.Fatalf("NewFileSink returned error: %v", err)
+	}
+	cdc := startCDC(t, svc, sink, dir, WithCDCPrefix("app/"))
+	waitFor(t, "the checkpoint", func() bool { return cdc.Checkpoint() == 4 })
+
+	svc.Put(Caller{}, "app/c", "3")
+	waitFor(t, "a change made while running", func() bool { return cdc.Checkpoint() == 5 })
+	if err := cdc.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	// A restart resumes after the checkpoint.
+	svc.Put(Caller{}, "app/d", "4")
+	sink, _ = NewFileSink(out)
+	cdc = startCDC(t, svc, sink, dir, WithCDCPrefix("app/"))
+	waitFor(t, "the checkpoint after a restart", func() bool { return cdc.Checkpoint() == 6 })
+	cdc.Close()
+
+	f, _ := os.Open(out)
+	defer f.Close()
+	records := readNDJSON(t, f)
+	if keys := recordKeys(records); keys != "app/a app/n app/a app/c app/d" {
+		t.Errorf("Expected each change under app/ once, in order, got %s", keys)
+	}
+	if rec := records[0]; rec.Sequence != 1 || rec.Type != "put" || rec.Value != "1" || rec.Principal != "alice" {
+		t.Errorf("Unexpected change %+v", rec)
+	}
+}
+
+func TestCDC_Results(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "changes.ndjson")
+	svc := newCDCService(t, dir)
+	svc.Put(Caller{}, "n", "10")
+	svc.Increment(Caller{}, "n", 5)
+	svc.Append(Caller{}, "n", "0")
+
+	// The results are read from the log, without a DB to look them up in.
+	logger, err := OpenFileTransactionLogger(filepath.Join(dir, "transaction.log"))
+	if err != nil {
+		t.Fatalf("OpenFileTransactionLogger returned error: %v", err)
+	}
+	sink, err := NewFileSink(out)
+	if err != nil {
+		t.Fatalf("NewFileSink returned error: %v", err)
+	}
+	cdc, err := NewCDC(logger, sink, filepath.Join(dir, "cdc.checkpoint"), WithCDCBatch(2, time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewCDC returned error: %v", err)
+	}
+	cdc.Start()
+	waitFor(t, "the checkpoint", func() bool { return cdc.Checkpoint() == 3 })
+	cdc.Close()
+
+	f, _ := os.Open(out)
+	defer f.Close()
+	records := readNDJSON(t, f)
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 changes, got %+v", records)
+	}
+	if rec := records[1]; rec.Value != "5" || rec.Result != "15" {
+		t.Errorf("Expected the increment with its delta and result, got %+v", rec)
+	}
+	if rec := records[2]; rec.Value != "0" || rec.Result != "150" {
+		t.Errorf("Expected the append with its suffix and result, got %+v", rec)
+	}
+}
+
+func TestCDC_HTTPSink(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests int
+		records  []AuditRecord
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if requests == 2 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+			t.Errorf("Expected newline-delimited JSON, got %s", ct)
+		}
+		records = append(records, readNDJSON(t, r.Body)...)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	svc := newCDCService(t, dir)
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		svc.Put(Caller{}, key, "x")
+	}
+	cdc := startCDC(t, svc, NewHTTPSink(server.URL, nil), dir)
+	defer cdc.Close()
+	waitFor(t, "the checkpoint", func() bool { return cdc.Checkpoint() == 5 })
+
+	mu.Lock()
+	defer mu.Unlock()
+	if keys := recordKeys(records); keys != "a b c d e" || requests != 4 {
+		t.Errorf("Expected the refused batch to be shipped again, got %s after %d requests", keys, requests)
+	}
+}
+
+// testProducer is a local stand-in for a Kafka or NATS client that fails
+// the first failures publishes.
+type testProducer struct {
+	mu       sync.Mutex
+	failures int
+	msgs     []Message
+	closed   bool
+}
+
+func (p *testProducer) Publish(ctx context.Context, msgs []Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failures > 0 {
+		p.failures--
+		return errors.New("not enough in-sync replicas")
+	}
+	p.msgs = append(p.msgs, msgs...)
+	return nil
+}
+
+func (p *testProducer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	return nil
+}
+
+func TestCDC_ProducerSinks(t *testing.T) {
+	dir := t.TempDir()
+	svc := newCDCService(t, dir)
+	svc.Put(Caller{}, "jobs/1", "queued")
+	svc.Put(Caller{}, "jobs.2 *>%", "done")
+	svc.Delete(Caller{}, "jobs/1")
+
+	for _, tc := range []struct {
+		name     string
+		sink     func(p Producer) *ProducerSink
+		subjects string
+	}{
+		{"kafka", func(p Producer) *ProducerSink { return NewKafkaSink(p, "changes") },
+			"changes changes changes"},
+		{"nats", func(p Producer) *ProducerSink { return NewNATSSink(p, "kv") },
+			"kv.jobs/1 kv.jobs%2E2%20%2A%3E%25 kv.jobs/1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &testProducer{failures: 1}
+			cdc := startCDC(t, svc, tc.sink(p), t.TempDir())
+			waitFor(t, "the checkpoint", func() bool { return cdc.Checkpoint() == 3 })
+			cdc.Close()
+
+			var subjects []string
+			for _, msg := range p.msgs {
+				subjects = append(subjects, msg.Subject)
+			}
+			if s := strings.Join(subjects, " "); s != tc.subjects || !p.closed {
+				t.Errorf("Expected subjects %s and the producer closed, got %s", tc.subjects, s)
+			}
+			msg := p.msgs[2]
+			var rec AuditRecord
+			json.Unmarshal(msg.Value, &rec)
+			if rec.Sequence != 3 || rec.Type != "delete" || msg.Headers["Kv-Sequence"] != "3" || msg.Headers["Kv-Type"] != "delete" {
+				t.Errorf("Unexpected message %+v", msg)
+			}
+			if tc.name == "kafka" && string(msg.Key) != "jobs/1" {
+				t.Errorf("Expected the message keyed by the key that changed, got %q", msg.Key)
+			}
+			if tc.name == "nats" && msg.Headers["Nats-Msg-Id"] != "3" {
+				t.Errorf("Expected the sequence number as the message ID, got %+v", msg.Headers)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Value encodings, named as in the Content-Encoding HTTP header.
+const (
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+// defaultCompressionThreshold is the size from which values are compressed
+// unless another threshold is given.
+const defaultCompressionThreshold = 1024
+
+// Where a Compressor compresses values, for its metrics.
+const (
+	compressedInMemory = iota
+	compressedInLog
+)
+
+var (
+	zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+		enc, _ := zstd.NewWriter(nil)
+		return enc
+	})
+	zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+		dec, _ := zstd.NewReader(nil)
+		return dec
+	})
+)
+
+// Compressor compresses values of at least a threshold size, keeping the
+// compressed form only if it is smaller. It is shared by the in-memory DB
+// and the file transaction log, so that both store large values
+// compressed, and reports how well they compress as metrics.
+type Compressor struct {
+	encoding  string
+	threshold int
+	stats     [2]compressionStats
+}
+
+type compressionStats struct {
+	values   atomic.Uint64
+	rawBytes atomic.Uint64
+	stored   atomic.Uint64
+}
+
+// NewCompressor returns a Compressor using encoding, EncodingGzip or
+// EncodingZstd, for values of at least threshold bytes; a threshold of
+// zero means the default of 1 KiB.
+func NewCompressor(encoding string, threshold int) (*Compressor, error) {
+	if encoding != EncodingGzip && encoding != EncodingZstd {
+		return nil, fmt.Errorf("%w: unknown compression %q; use gzip or zstd", ErrorInvalidArgument, encoding)
+	}
+	if threshold <= 0 {
+		threshold = defaultCompressionThreshold
+	}
+	return &Compressor{encoding: encoding, threshold: threshold}, nil
+}
+
+// compress returns value as it should be stored, and the encoding it is
+// compressed with, or an empty encoding if it is stored as it is. A nil
+// Compressor stores every value as it is.
+func (c *Compressor) compress(value string, where int) (string, string) {
+	if c == nil || len(value) < c.threshold {
+		return value, ""
+	}
+
+	var compressed []byte
+	switch c.encoding {
+	case EncodingZstd:
+		compressed = zstdEncoder().EncodeAll([]byte(value), nil)
+	case EncodingGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(value))
+		zw.Close()
+		compressed = buf.Bytes()
+	}
+
+	st := &c.stats[where]
+	st.values.Add(1)
+	st.rawBytes.Add(uint64(len(value)))
+	if len(compressed) >= len(value) {
+		st.stored.Add(uint64(len(value)))
+		return value, ""
+	}
+	st.stored.Add(uint64(len(compressed)))
+	return string(compressed), c.encoding
+}
+
+// decompress returns value, compressed with encoding, as it was. An empty
+// encoding returns value as it is.
+func decompress(value, encoding string) (string, error) {
+	switch encoding {
+	case "":
+		return value, nil
+	case EncodingZstd:
+		raw, err := zstdDecoder().DecodeAll([]byte(value), nil)
+		if err != nil {
+			return "", fmt.Errorf("cannot decompress value: %w", err)
+		}
+		return string(raw), nil
+	case EncodingGzip:
+		zr, err := gzip.NewReader(bytes.NewReader([]byte(value)))
+		if err != nil {
+			return "", fmt.Errorf("cannot decompress value: %w", err)
+		}
+		raw, err := io.ReadAll(zr)
+		if err != nil {
+			return "", fmt.Errorf("cannot decompress value: %w", err)
+		}
+		return string(raw), nil
+	default:
+		return "", fmt.Errorf("unknown value encoding %q", encoding)
+	}
+}
+
+func (c *Compressor) CollectMetrics(mw *MetricWriter) {
+	var values, rawBytes, stored, ratios []Sample
+	for where, name := range []string{"memory", "log"} {
+		st := &c.stats[where]
+		labels := []string{"store", name, "encoding", c.encoding}
+		raw, out := st.rawBytes.Load(), st.stored.Load()
+		values = append(values, Sample{Labels: labels, Value: float64(st.values.Load())})
+		rawBytes = append(rawBytes, Sample{Labels: labels, Value: float64(raw)})
+		stored = append(stored, Sample{Labels: labels, Value: float64(out)})
+		ratio := 1.0
+		if out > 0 {
+			ratio = float64(raw) / float64(out)
+		}
+		ratios = append(ratios, Sample{Labels: labels, Value: ratio})
+	}
+
+	mw.Counter("compression_values_total", "Values large enough to be compressed.", values...)
+	mw.Counter("compression_raw_bytes_total", "Size of the values large enough to be compressed.", rawBytes...)
+	mw.Counter("compression_stored_bytes_total", "Size of those values as stored, compressed if that made them smaller.", stored...)
+	mw.Gauge("compression_ratio", "Raw size over stored size of the values large enough to be compressed.", ratios...)
+}
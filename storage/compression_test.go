@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// largeJSON returns a compressible JSON document of about n bytes.
+func largeJSON(n int) string {
+	var b strings.Builder
+	b.WriteString(`{"items": [`)
+	for i := 0; b.Len() < n; i++ {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(`{"name": "item", "tags": ["a", "b"], "enabled": true}`)
+	}
+	b.WriteString("]}")
+	return b.String()
+}
+
+func TestInMemoryDB_Compression(t *testing.T) {
+	for _, encoding := range []string{EncodingGzip, EncodingZstd} {
+		t.Run(encoding, func(t *testing.T) {
+			c, err := NewCompressor(encoding, 100)
+			if err != nil {
+				t.Fatalf("NewCompressor returned error: %v", err)
+			}
+			db, _ := NewInMemoryDB(WithCompression(c))
+
+			value := largeJSON(10000)
+			db.Upsert("big", value)
+			db.Upsert("small", "tiny")
+
+			raw, err := db.LookupRaw("big")
+			if err != nil || raw.Encoding != encoding || len(raw.Value) >= len(value)/4 {
+				t.Fatalf("Expected big to be stored compressed, got %q encoding, %d bytes, %v", raw.Encoding, len(raw.Value), err)
+			}
+			if raw, _ := db.LookupRaw("small"); raw.Encoding != "" {
+				t.Errorf("Expected a value under the threshold to be stored as it is, got %q", raw.Encoding)
+			}
+
+			if v, err := db.Get("big"); err != nil || *v != value {
+				t.Errorf("Expected Get to decompress big, got %d bytes, %v", len(*v), err)
+			}
+			if v, err := db.Append("big", " "); err != nil || v != value+" " {
+				t.Errorf("Expected Append to extend the decompressed value, got %d bytes, %v", len(v), err)
+			}
+			history, _ := db.History("big")
+			if len(history) != 2 || history[0].Value != value || history[0].Encoding != "" {
+				t.Errorf("Expected the history to be decompressed, got %d versions", len(history))
+			}
+			entries, _, _ := db.Snapshot("")
+			if len(entries) != 2 || entries[0].Value != value+" " {
+				t.Errorf("Expected the snapshot to be decompressed, got %d entries", len(entries))
+			}
+
+			m := NewMetrics()
+			m.Register(c)
+			rr := httptest.NewRecorder()
+			m.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+			if !strings.Contains(rr.Body.String(), `keyvaluestore_compression_values_total{store="memory",encoding="`+encoding+`"} 2`) {
+				t.Errorf("Expected two compressed values in the metrics, got:\n%s", rr.Body)
+			}
+		})
+	}
+
+	if _, err := NewCompressor("brotli", 0); err == nil {
+		t.Error("Expected an error for an unknown encoding")
+	}
+}
+
+func TestFileTransactionLogger_Compression(t *testing.T) {
+	c, _ := NewCompressor(EncodingZstd, 100)
+	filename := filepath.Join(t.TempDir(), "transaction.log")
+	value := largeJSON(10000)
+
+	db, _ := NewInMemoryDB(WithCompression(c))
+	logger, err := InitializeFileTransactionLogger(db, filename, WithLogCompression(c))
+	if err != nil {
+		t.Fatalf("InitializeFileTransactionLogger returned error: %v", err)
+	}
+	logger.WritePut("big", value)
+	logger.WriteEvents([]Event{
+		{EventType: EventPut, Key: "a", Value: value},
+		{EventType: EventPut, Key: "b", Value: "small"},
+	})
+	fileLogger := logger.(*FileTransactionLogger)
+	close(fileLogger.events)
+	for writeErr := range fileLogger.errors {
+		t.Fatalf("Got an error from the transaction logger: %v", writeErr)
+	}
+
+	data, _ := os.ReadFile(filename)
+	if len(data) > len(value) || !strings.Contains(string(data), "\tzstd\n") {
+		t.Errorf("Expected compressed values in the log, got %d bytes", len(data))
+	}
+
+	// The log is read back without being told it is compressed.
+	replayed, _ := NewInMemoryDB()
+	if _, err := InitializeFileTransactionLogger(replayed, filename); err != nil {
+		t.Fatalf("Replay returned error: %v", err)
+	}
+	for key, want := range map[string]string{"big": value, "a": value, "b": "small"} {
+		if v, err := replayed.Get(key); err != nil || *v != want {
+			t.Errorf("Expected %s to be replayed, got %v", key, err)
+		}
+	}
+}
+
+func TestHandler_AcceptEncoding(t *testing.T) {
+	c, _ := NewCompressor(EncodingGzip, 100)
+	filename := filepath.Join(t.TempDir(), "transaction.log")
+	db, _ := NewInMemoryDB(WithCompression(c))
+	logger, err := InitializeFileTransactionLogger(db, filename)
+	if err != nil {
+		t.Fatalf("InitializeFileTransactionLogger returned error: %v", err)
+	}
+	handler, _ := NewHandler(db, logger)
+	router := NewRouter(&handler)
+
+	value := largeJSON(5000)
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/v1/key/doc", strings.NewReader(value)))
+
+	get := func(acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/v1/key/doc", nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := get("br, gzip;q=0.8")
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected the gzip value as it is, got %d, %q", rr.Code, rr.Header().Get("Content-Encoding"))
+	}
+	zr, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatalf("Expected a gzip body: %v", err)
+	}
+	if body, _ := io.ReadAll(zr); string(body) != value {
+		t.Errorf("Expected the gzip body to hold the value, got %d bytes", len(body))
+	}
+
+	for _, accept := range []string{"", "zstd", "gzip;q=0"} {
+		rr := get(accept)
+		if rr.Header().Get("Content-Encoding") != "" || rr.Body.String() != value {
+			t.Errorf("Accept-Encoding %q: expected the decompressed value, got %q encoding", accept, rr.Header().Get("Content-Encoding"))
+		}
+	}
+}
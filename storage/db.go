@@ -1,8 +1,58 @@
 package storage
 
+import "time"
+
 type DB interface {
 	GetAll() (map[string]string, error)
 	Get(key string) (*string, error)
+	// Lookup returns the current version of key, if it has a value.
+	Lookup(key string) (Version, error)
+	// LookupRaw is Lookup, but returns the value as it is stored: if the
+	// version's Encoding is set, compressed with it.
+	LookupRaw(key string) (Version, error)
+	// Peek is Lookup, but does not count as a use of key for eviction.
+	Peek(key string) (Version, error)
+	// LookupMany returns the current versions of those keys that have a
+	// value, all as of a single moment.
+	LookupMany(keys []string) (map[string]Version, error)
+	// Snapshot returns the current versions of the keys with prefix,
+	// sorted by key, and the sequence number of the last event applied,
+	// all as of a single moment.
+	Snapshot(prefix string) ([]Entry, uint64, error)
 	Upsert(key string, value string) error
 	Delete(key string) error
+	// Increment atomically adds delta to the integer value of key and
+	// returns the new value.
+	Increment(key string, delta int64) (int64, error)
+	// Append atomically adds suffix to the end of the value of key and
+	// returns the new value.
+	Append(key, suffix string) (string, error)
+	// MergePatch atomically applies an RFC 7386 merge patch to the JSON
+	// value of key and returns the new value.
+	MergePatch(key, patch string) (string, error)
+	// JSONPatch atomically applies an RFC 6902 JSON Patch to the JSON
+	// value of key and returns the new value.
+	JSONPatch(key, patch string) (string, error)
+
+	// Apply records a logged event as the newest version of its key.
+	Apply(e Event) error
+	// ApplyBatch applies events atomically: all of them, or none if any
+	// cannot be applied.
+	ApplyBatch(events []Event) error
+	// GetAt returns the value of key as of the event with sequence seq.
+	GetAt(key string, seq uint64) (*string, error)
+	// GetAtTime returns the value of key as of time t.
+	GetAtTime(key string, t time.Time) (*string, error)
+	// History returns the retained versions of key, oldest first.
+	History(key string) ([]Version, error)
+	// LookupLease returns the lease called name, if it is held.
+	LookupLease(name string) (Lease, error)
+	// Leases returns the leases that are held, sorted by name.
+	Leases() ([]Lease, error)
+	// Indexes returns the definitions of the secondary indexes, sorted by
+	// name.
+	Indexes() ([]IndexDefinition, error)
+	// IndexLookup returns the keys the index called name maps value to,
+	// sorted.
+	IndexLookup(name, value string) ([]string, error)
 }
@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// keySize is the size of an encryption key: AES-256.
+const keySize = 32
+
+// KeyProvider supplies the keys that encrypt transaction log records and
+// values. Every key has an ID, stored with what it encrypted, so that
+// records written with an older key can still be read after the current
+// key is rotated.
+type KeyProvider interface {
+	// CurrentKey returns the key new records are encrypted with, and its
+	// ID.
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key with the given ID.
+	Key(id string) ([]byte, error)
+}
+
+// KeyFile is a KeyProvider that reads its keys from a local file. Each
+// line of the file holds a key ID and the base64 of a 32-byte key,
+// separated by a space; blank lines and lines starting with # are
+// ignored. The last key is the current one, so a key is rotated by
+// appending a new one, with AddKey, and compacting the log, which
+// re-encrypts every record with it. The older key can be removed once no
+// log still uses it.
+type KeyFile struct {
+	current string
+	keys    map[string][]byte
+}
+
+// LoadKeyFile reads the keys in filename. The file must not be readable
+// by other users.
+func LoadKeyFile(filename string) (*KeyFile, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open key file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("cannot stat key file: %w", err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("key file %s is accessible by other users; restrict it with chmod 600", filename)
+	}
+
+	kf := &KeyFile{keys: make(map[string][]byte)}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		id, encoded, ok := strings.Cut(text, " ")
+		if !ok {
+			return nil, fmt.Errorf("key file %s, line %d: expected a key ID and a key", filename, line)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil || len(key) != keySize {
+			return nil, fmt.Errorf("key file %s, line %d: expected the base64 of a %d-byte key", filename, line, keySize)
+		}
+		if _, dup := kf.keys[id]; dup {
+			return nil, fmt.Errorf("key file %s, line %d: duplicate key ID %q", filename, line, id)
+		}
+		kf.keys[id] = key
+		kf.current = id
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read key file: %w", err)
+	}
+	if kf.current == "" {
+		return nil, fmt.Errorf("key file %s holds no keys", filename)
+	}
+	return kf, nil
+}
+
+// AddKey appends a new random key with the given ID to filename, creating
+// the file if needed, which makes it the current key.
+func AddKey(filename, id string) error {
+	if id == "" || strings.ContainsAny(id, " \t\r\n#") || strings.HasPrefix(id, encryptedRecordPrefix) {
+		return fmt.Errorf("%w: invalid key ID %q", ErrorInvalidArgument, id)
+	}
+	if _, err := os.Stat(filename); err == nil {
+		kf, err := LoadKeyFile(filename)
+		if err != nil {
+			return err
+		}
+		if _, dup := kf.keys[id]; dup {
+			return fmt.Errorf("%w: key file already holds key ID %q", ErrorConflict, id)
+		}
+	}
+
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("cannot generate key: %w", err)
+	}
+
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot open key file: %w", err)
+	}
+	_, err = fmt.Fprintf(file, "%s %s\n", id, base64.StdEncoding.EncodeToString(key))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("cannot write key file: %w", err)
+	}
+	return nil
+}
+
+func (kf *KeyFile) CurrentKey() (string, []byte, error) {
+	return kf.current, kf.keys[kf.current], nil
+}
+
+func (kf *KeyFile) Key(id string) ([]byte, error) {
+	key, ok := kf.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("no key with ID %q", id)
+	}
+	return key, nil
+}
+
+// seal encrypts plaintext with key using AES-GCM, authenticating aad with
+// it, and returns the nonce followed by the ciphertext.
+func seal(key, plaintext, aad []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("cannot generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// unseal decrypts what seal returned.
+func unseal(key, sealed, aad []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted data is truncated")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, aad)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
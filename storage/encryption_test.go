@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestKeyFile(t *testing.T, ids ...string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "keys")
+	for _, id := range ids {
+		if err := AddKey(filename, id); err != nil {
+			t.Fatalf("AddKey(%q) returned error: %v", id, err)
+		}
+	}
+	return filename
+}
+
+func loadTestKeyFile(t *testing.T, filename string) *KeyFile {
+	t.Helper()
+	kf, err := LoadKeyFile(filename)
+	if err != nil {
+		t.Fatalf("LoadKeyFile returned error: %v", err)
+	}
+	return kf
+}
+
+func TestKeyFile(t *testing.T) {
+	filename := newTestKeyFile(t, "2025-01", "2025-02")
+
+	kf := loadTestKeyFile(t, filename)
+	if id, key, err := kf.CurrentKey(); err != nil || id != "2025-02" || len(key) != keySize {
+		t.Errorf("Expected the last key to be current, got %q, %d bytes, %v", id, len(key), err)
+	}
+	if _, err := kf.Key("2025-01"); err != nil {
+		t.Errorf("Expected the older key to be kept, got %v", err)
+	}
+	if _, err := kf.Key("missing"); err == nil {
+		t.Error("Expected an error for an unknown key ID")
+	}
+
+	if err := AddKey(filename, "2025-02"); !errors.Is(err, ErrorConflict) {
+		t.Errorf("Expected ErrorConflict adding a duplicate key ID, got %v", err)
+	}
+	if err := AddKey(filename, "bad id"); !errors.Is(err, ErrorInvalidArgument) {
+		t.Errorf("Expected ErrorInvalidArgument for an ID with a space, got %v", err)
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected the key file to be created with mode 0600, got %v, %v", info.Mode(), err)
+	}
+	os.Chmod(filename, 0644)
+	if _, err := LoadKeyFile(filename); err == nil {
+		t.Error("Expected a key file readable by other users to be refused")
+	}
+}
+
+func TestFileTransactionLogger_Encrypted(t *testing.T) {
+	keyFile := newTestKeyFile(t, "k1")
+	keys := loadTestKeyFile(t, keyFile)
+	filename := filepath.Join(t.TempDir(), "transaction.log")
+
+	db, _ := NewInMemoryDB()
+	logger, err := InitializeFileTransactionLogger(db, filename, WithEncryption(keys))
+	if err != nil {
+		t.Fatalf("InitializeFileTransactionLogger returned error: %v", err)
+	}
+	logger.WriteEvents([]Event{{EventType: EventPut, Key: "secret-key", Value: "secret-value"}})
+	logger.WriteEvents([]Event{
+		{EventType: EventPut, Key: "a", Value: "1"},
+		{EventType: EventPut, Key: "b", Value: "2"},
+	})
+	fileLogger := logger.(*FileTransactionLogger)
+	close(fileLogger.events)
+	for writeErr := range fileLogger.errors {
+		t.Fatalf("Got an error from the transaction logger: %v", writeErr)
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Failed reading log: %v", err)
+	}
+	if strings.Contains(string(data), "secret") {
+		t.Errorf("Expected no plaintext in the log, got %q", data)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if !strings.HasPrefix(line, "!k1\t") {
+			t.Errorf("Expected a record encrypted with k1, got %q", line)
+		}
+	}
+	if info, _ := os.Stat(filename); info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the log to have mode 0600, got %v", info.Mode())
+	}
+
+	replayed, _ := NewInMemoryDB()
+	if _, err := InitializeFileTransactionLogger(replayed, filename, WithEncryption(keys)); err != nil {
+		t.Fatalf("Replay returned error: %v", err)
+	}
+	if v, err := replayed.Get("secret-key"); err != nil || *v != "secret-value" {
+		t.Errorf("Expected secret-key to be replayed, got %v, %v", v, err)
+	}
+	if v, err := replayed.Get("b"); err != nil || *v != "2" {
+		t.Errorf("Expected the batch to be replayed, got %v, %v", v, err)
+	}
+
+	if report, _ := ValidateTransactionLog(filename); len(report.Problems) == 0 {
+		t.Error("Expected records to be reported when no keys are given")
+	}
+	other := loadTestKeyFile(t, newTestKeyFile(t, "k1"))
+	if report, _ := ValidateTransactionLog(filename, WithEncryption(other)); len(report.Problems) == 0 {
+		t.Error("Expected records encrypted with another key to be reported")
+	}
+}
+
+func TestCompactTransactionLog_RotatesKey(t *testing.T) {
+	keyFile := newTestKeyFile(t, "old")
+	filename := filepath.Join(t.TempDir(), "transaction.log")
+
+	db, _ := NewInMemoryDB()
+	logger, err := InitializeFileTransactionLogger(db, filename, WithEncryption(loadTestKeyFile(t, keyFile)))
+	if err != nil {
+		t.Fatalf("InitializeFileTransactionLogger returned error: %v", err)
+	}
+	logger.WritePut("a", "1")
+	logger.WritePut("a", "2")
+	logger.WritePut("b", "3")
+	fileLogger := logger.(*FileTransactionLogger)
+	close(fileLogger.events)
+	for writeErr := range fileLogger.errors {
+		t.Fatalf("Got an error from the transaction logger: %v", writeErr)
+	}
+
+	if err := AddKey(keyFile, "new"); err != nil {
+		t.Fatalf("AddKey returned error: %v", err)
+	}
+	if err := CompactTransactionLog(filename, filename, WithEncryption(loadTestKeyFile(t, keyFile))); err != nil {
+		t.Fatalf("CompactTransactionLog returned error: %v", err)
+	}
+
+	data, _ := os.ReadFile(filename)
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[0], "!new\t") {
+		t.Errorf("Expected two records encrypted with the new key, got %q", data)
+	}
+
+	// The old key is no longer needed.
+	onlyNew, err := LoadKeyFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(onlyNew.keys, "old")
+	stats, err := InspectTransactionLog(filename, WithEncryption(onlyNew))
+	if err != nil || stats.LiveKeys != 2 {
+		t.Errorf("Expected two live keys readable with the new key alone, got %+v, %v", stats, err)
+	}
+}
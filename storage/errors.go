@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// Errors returned by DB, TransactionLogger and Handler. Callers should test
+// for them with errors.Is, since they are usually wrapped with context.
+var (
+	// ErrorNoSuchKey means the key does not exist.
+	ErrorNoSuchKey = errors.New("no such key")
+	// ErrorHistoryUnavailable is returned for point-in-time reads older
+	// than the history retained for a key.
+	ErrorHistoryUnavailable = errors.New("history no longer retained")
+	// ErrorConflict means the change conflicts with the current state.
+	ErrorConflict = errors.New("conflict")
+	// ErrorPreconditionFailed means a condition attached to the change,
+	// such as an expected version, did not hold.
+	ErrorPreconditionFailed = errors.New("precondition failed")
+	// ErrorTooLarge means the request or value exceeds a configured limit.
+	ErrorTooLarge = errors.New("value too large")
+	// ErrorReadOnly means the store is not accepting writes.
+	ErrorReadOnly = errors.New("store is read-only")
+	// ErrorUnavailable means the transaction log cannot accept writes, or
+	// has failed to write one, after which reads are refused too.
+	ErrorUnavailable = errors.New("backend unavailable")
+	// ErrorInvalidArgument means the request itself is malformed.
+	ErrorInvalidArgument = errors.New("invalid argument")
+	// ErrorRateLimited means the client has used up its request budget
+	// for now.
+	ErrorRateLimited = errors.New("rate limit exceeded")
+)
+
+// Error codes used in JSON error bodies.
+const (
+	CodeNotFound           = "not_found"
+	CodeHistoryUnavailable = "history_unavailable"
+	CodeConflict           = "conflict"
+	CodePreconditionFailed = "precondition_failed"
+	CodeTooLarge           = "too_large"
+	CodeReadOnly           = "read_only"
+	CodeUnavailable        = "unavailable"
+	CodeInvalidArgument    = "invalid_argument"
+	CodeRateLimited        = "rate_limited"
+	CodeInternal           = "internal"
+)
+
+type errorKind struct {
+	err    error
+	code   string
+	status int
+}
+
+var errorKinds = []errorKind{
+	{ErrorNoSuchKey, CodeNotFound, http.StatusNotFound},
+	{ErrorHistoryUnavailable, CodeHistoryUnavailable, http.StatusGone},
+	{ErrorConflict, CodeConflict, http.StatusConflict},
+	{ErrorPreconditionFailed, CodePreconditionFailed, http.StatusPreconditionFailed},
+	{ErrorTooLarge, CodeTooLarge, http.StatusRequestEntityTooLarge},
+	{ErrorReadOnly, CodeReadOnly, http.StatusForbidden},
+	{ErrorUnavailable, CodeUnavailable, http.StatusServiceUnavailable},
+	{ErrorInvalidArgument, CodeInvalidArgument, http.StatusBadRequest},
+	{ErrorRateLimited, CodeRateLimited, http.StatusTooManyRequests},
+}
+
+// ErrorCode returns the code and HTTP status for err. Errors outside the
+// taxonomy are internal errors.
+func ErrorCode(err error) (string, int) {
+	for _, k := range errorKinds {
+		if errors.Is(err, k.err) {
+			return k.code, k.status
+		}
+	}
+	return CodeInternal, http.StatusInternalServerError
+}
+
+// ErrorForCode returns the sentinel error for a code, or nil if the code is
+// unknown or internal.
+func ErrorForCode(code string) error {
+	for _, k := range errorKinds {
+		if k.code == code {
+			return k.err
+		}
+	}
+	return nil
+}
+
+// ErrorResponse is the JSON body of every error returned by Handler.
+type ErrorResponse struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// writeError is the single place Handler turns an error into a response.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	code, status := ErrorCode(err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Code:      code,
+		Message:   err.Error(),
+		RequestID: RequestID(r),
+	})
+}
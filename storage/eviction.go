@@ -0,0 +1,289 @@
+package storage
+
+import (
+	"container/list"
+	"fmt"
+	"math/rand/v2"
+)
+
+// Eviction policies, which choose the keys an in-memory DB evicts.
+const (
+	EvictionLRU    = "lru"    // the least recently used key
+	EvictionLFU    = "lfu"    // the least frequently used key, the oldest of those
+	EvictionRandom = "random" // any key
+)
+
+// Eviction bounds the memory of an in-memory DB. Once a write takes the DB
+// over MaxKeys keys or MaxBytes bytes, keys chosen by Policy are evicted,
+// with all their history, until it is back within both. A zero bound is no
+// bound.
+//
+// The bytes of a key are its length and that of the values and lease names
+// of its retained versions, as stored, so compressed values count at their
+// compressed size. Keys that are deleted but still have history count too.
+//
+// The DB never evicts on its own; instead, the transaction logger evicts
+// after each write and logs an EventEvict for each key. Replay cannot
+// choose the same keys itself, since reads move keys in the eviction order
+// and are not logged, and an update or a conditional write replayed after
+// a key should have been evicted would then see its old value.
+type Eviction struct {
+	Policy   string
+	MaxKeys  int
+	MaxBytes int64
+}
+
+// WithEviction bounds the memory of the DB as e describes.
+func WithEviction(e Eviction) InMemoryOption {
+	return func(db *inMemoryDB) {
+		db.eviction = e
+	}
+}
+
+func newEvictionPolicy(name string) (evictionPolicy, error) {
+	switch name {
+	case EvictionLRU:
+		return newLRUPolicy(), nil
+	case EvictionLFU:
+		return newLFUPolicy(), nil
+	case EvictionRandom:
+		return newRandomPolicy(), nil
+	}
+	return nil, fmt.Errorf("%w: unknown eviction policy %q; use lru, lfu or random", ErrorInvalidArgument, name)
+}
+
+// evictionPolicy tracks the keys of a DB to choose which to evict. Every
+// method is O(1), except walk, which is O(1) per key visited.
+type evictionPolicy interface {
+	// add starts tracking key, which was just written for the first time.
+	add(key string)
+	// touch records a read or write of key, if it is tracked.
+	touch(key string)
+	// remove stops tracking key, if it is tracked.
+	remove(key string)
+	// walk calls fn with the tracked keys in the order they should be
+	// evicted, until fn returns false.
+	walk(fn func(key string) bool)
+}
+
+// lruPolicy keeps the keys in a list, most recently used first.
+type lruPolicy struct {
+	order *list.List
+	elems map[string]*list.Element
+}
+
+func newLRUPolicy() *lruPolicy {
+	return &lruPolicy{order: list.New(), elems: make(map[string]*list.Element)}
+}
+
+func (p *lruPolicy) add(key string) {
+	p.elems[key] = p.order.PushFront(key)
+}
+
+func (p *lruPolicy) touch(key string) {
+	if el, ok := p.elems[key]; ok {
+		p.order.MoveToFront(el)
+	}
+}
+
+func (p *lruPolicy) remove(key string) {
+	if el, ok := p.elems[key]; ok {
+		p.order.Remove(el)
+		delete(p.elems, key)
+	}
+}
+
+func (p *lruPolicy) walk(fn func(string) bool) {
+	for el := p.order.Back(); el != nil && fn(el.Value.(string)); el = el.Prev() {
+	}
+}
+
+// lfuPolicy keeps the keys in buckets of the same use count, in a list of
+// buckets by increasing count, so that a use moves a key to the next
+// bucket without searching. Within a bucket, keys are in the order they
+// reached its count.
+type lfuPolicy struct {
+	buckets *list.List // of *lfuBucket
+	entries map[string]lfuEntry
+}
+
+type lfuBucket struct {
+	count uint64
+	keys  *list.List // of string
+}
+
+type lfuEntry struct {
+	bucket *list.Element
+	elem   *list.Element
+}
+
+func newLFUPolicy() *lfuPolicy {
+	return &lfuPolicy{buckets: list.New(), entries: make(map[string]lfuEntry)}
+}
+
+func (p *lfuPolicy) add(key string) {
+	first := p.buckets.Front()
+	if first == nil || first.Value.(*lfuBucket).count != 1 {
+		first = p.buckets.PushFront(&lfuBucket{count: 1, keys: list.New()})
+	}
+	p.entries[key] = lfuEntry{bucket: first, elem: first.Value.(*lfuBucket).keys.PushBack(key)}
+}
+
+func (p *lfuPolicy) touch(key string) {
+	entry, ok := p.entries[key]
+	if !ok {
+		return
+	}
+	cur := entry.bucket.Value.(*lfuBucket)
+	next := entry.bucket.Next()
+	if next == nil || next.Value.(*lfuBucket).count != cur.count+1 {
+		next = p.buckets.InsertAfter(&lfuBucket{count: cur.count + 1, keys: list.New()}, entry.bucket)
+	}
+	p.unlink(entry)
+	p.entries[key] = lfuEntry{bucket: next, elem: next.Value.(*lfuBucket).keys.PushBack(key)}
+}
+
+func (p *lfuPolicy) remove(key string) {
+	if entry, ok := p.entries[key]; ok {
+		p.unlink(entry)
+		delete(p.entries, key)
+	}
+}
+
+// unlink takes the key of entry out of its bucket, dropping the bucket if
+// that empties it.
+func (p *lfuPolicy) unlink(entry lfuEntry) {
+	b := entry.bucket.Value.(*lfuBucket)
+	b.keys.Remove(entry.elem)
+	if b.keys.Len() == 0 {
+		p.buckets.Remove(entry.bucket)
+	}
+}
+
+func (p *lfuPolicy) walk(fn func(string) bool) {
+	for b := p.buckets.Front(); b != nil; b = b.Next() {
+		for el := b.Value.(*lfuBucket).keys.Front(); el != nil; el = el.Next() {
+			if !fn(el.Value.(string)) {
+				return
+			}
+		}
+	}
+}
+
+// randomPolicy keeps the keys in a slice, with the index of each, so that
+// a key is removed by moving the last one into its place.
+type randomPolicy struct {
+	keys  []string
+	index map[string]int
+}
+
+func newRandomPolicy() *randomPolicy {
+	return &randomPolicy{index: make(map[string]int)}
+}
+
+func (p *randomPolicy) add(key string) {
+	p.index[key] = len(p.keys)
+	p.keys = append(p.keys, key)
+}
+
+func (p *randomPolicy) touch(string) {}
+
+func (p *randomPolicy) remove(key string) {
+	i, ok := p.index[key]
+	if !ok {
+		return
+	}
+	last := p.keys[len(p.keys)-1]
+	p.keys[i] = last
+	p.index[last] = i
+	p.keys = p.keys[:len(p.keys)-1]
+	delete(p.index, key)
+}
+
+// walk visits the keys from a random one onwards. As removals reorder the
+// keys, the keys visited by successive walks are spread over the whole DB.
+func (p *randomPolicy) walk(fn func(string) bool) {
+	if len(p.keys) == 0 {
+		return
+	}
+	start := rand.IntN(len(p.keys))
+	for i := range p.keys {
+		if !fn(p.keys[(start+i)%len(p.keys)]) {
+			return
+		}
+	}
+}
+
+// versionSize returns the bytes v counts for in the size of its key.
+func versionSize(v Version) int64 {
+	return int64(len(v.Value) + len(v.Lease))
+}
+
+// overBounds reports whether the DB would exceed its eviction bounds with
+// keys keys of bytes bytes.
+func (db *inMemoryDB) overBounds(keys int, bytes int64) bool {
+	e := db.eviction
+	return (e.MaxKeys > 0 && keys > e.MaxKeys) || (e.MaxBytes > 0 && bytes > e.MaxBytes)
+}
+
+// victims returns the keys to evict, in order, to bring the DB back within
+// its bounds. The caller must hold writeMu.
+func (db *inMemoryDB) victims() []string {
+	keys, bytes := int(db.keys.Load()), db.bytes.Load()
+	if db.policy == nil || !db.overBounds(keys, bytes) {
+		return nil
+	}
+	var victims []string
+	db.policyMu.Lock()
+	db.policy.walk(func(key string) bool {
+		c, _ := db.chain(key)
+		victims = append(victims, key)
+		keys--
+		bytes -= c.size
+		return db.overBounds(keys, bytes)
+	})
+	db.policyMu.Unlock()
+	return victims
+}
+
+// evict drops key with all its history, for an eviction. The caller must
+// hold writeMu and the write lock of the key's shard.
+func (db *inMemoryDB) evict(key string) {
+	if c, ok := db.chain(key); ok {
+		db.forget(key, c)
+		db.evicted.Add(1)
+	}
+}
+
+// evictions returns the keys the DB must evict after a write, for the
+// logger to apply and log an EventEvict for each.
+func (db *inMemoryDB) evictions() []string {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	return db.victims()
+}
+
+// touch records a use of key for the eviction policy. It is called under
+// the read or the write lock of the key's shard.
+func (db *inMemoryDB) touch(key string) {
+	if db.policy == nil {
+		return
+	}
+	db.policyMu.Lock()
+	db.policy.touch(key)
+	db.policyMu.Unlock()
+}
+
+func (db *inMemoryDB) CollectMetrics(mw *MetricWriter) {
+	keys, bytes, evicted := db.keys.Load(), db.bytes.Load(), db.evicted.Load()
+
+	mw.Gauge("store_keys", "Keys held in memory, including deleted keys with history.", Sample{Value: float64(keys)})
+	mw.Gauge("store_bytes", "Bytes of the keys, values and lease names held in memory.", Sample{Value: float64(bytes)})
+	if db.policy == nil {
+		return
+	}
+	labels := []string{"policy", db.eviction.Policy}
+	mw.Gauge("eviction_max_keys", "Keys held before evicting (0 for no limit).", Sample{Labels: labels, Value: float64(db.eviction.MaxKeys)})
+	mw.Gauge("eviction_max_bytes", "Bytes held before evicting (0 for no limit).", Sample{Labels: labels, Value: float64(db.eviction.MaxBytes)})
+	mw.Counter("evictions_total", "Keys evicted to stay within the memory bounds.", Sample{Labels: labels, Value: float64(evicted)})
+}
@@ -0,0 +1,237 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func walkAll(p evictionPolicy) []string {
+	var keys []string
+	p.walk(func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	lru := newLRUPolicy()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		lru.add(key)
+	}
+	lru.touch("a")
+	lru.remove("c")
+	if got, want := walkAll(lru), []string{"b", "d", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("LRU: expected %v, got %v", want, got)
+	}
+
+	lfu := newLFUPolicy()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		lfu.add(key)
+	}
+	lfu.touch("a")
+	lfu.touch("a")
+	lfu.touch("c")
+	lfu.touch("b")
+	lfu.remove("d")
+	lfu.add("e")
+	if got, want := walkAll(lfu), []string{"e", "c", "b", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("LFU: expected %v, got %v", want, got)
+	}
+	if n := lfu.buckets.Len(); n != 3 {
+		t.Errorf("LFU: expected 3 buckets, got %d", n)
+	}
+
+	random := newRandomPolicy()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		random.add(key)
+	}
+	random.remove("b")
+	random.remove("x")
+	got := walkAll(random)
+	if len(got) != 3 || strings.Contains(strings.Join(got, ""), "b") {
+		t.Errorf("Random: expected a, c and d, got %v", got)
+	}
+
+	if _, err := NewInMemoryDB(WithEviction(Eviction{Policy: "mru", MaxKeys: 1})); !errors.Is(err, ErrorInvalidArgument) {
+		t.Errorf("Expected ErrorInvalidArgument for an unknown policy, got %v", err)
+	}
+}
+
+// newEvictingDB returns a DB bounded by e and the logger that evicts from
+// it, writing to a log in a temporary directory.
+func newEvictingDB(t *testing.T, e Eviction) (DB, TransactionLogger) {
+	t.Helper()
+	db, err := NewInMemoryDB(WithEviction(e))
+	if err != nil {
+		t.Fatalf("NewInMemoryDB returned error: %v", err)
+	}
+	logger, err := InitializeFileTransactionLogger(db, filepath.Join(t.TempDir(), "transaction.log"))
+	if err != nil {
+		t.Fatalf("InitializeFileTransactionLogger returned error: %v", err)
+	}
+	return db, logger
+}
+
+func TestInMemoryDB_Eviction(t *testing.T) {
+	db, logger := newEvictingDB(t, Eviction{MaxKeys: 3})
+	logger.WritePut("a", "1")
+	logger.WritePut("b", "2")
+	logger.WritePut("c", "3")
+	db.Get("a")
+	logger.WritePut("d", "4")
+
+	if _, err := db.Get("b"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("Expected the least recently used key to be evicted, got %v", err)
+	}
+	if _, err := db.Peek("c"); err != nil {
+		t.Errorf("Expected to peek at c, got %v", err)
+	}
+	logger.WritePut("e", "5")
+	if _, err := db.Get("c"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("Expected a peek not to count as a use, got %v", err)
+	}
+	if _, err := db.History("b"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("Expected the history of an evicted key to go too, got %v", err)
+	}
+	for _, key := range []string{"a", "d", "e"} {
+		if _, err := db.Get(key); err != nil {
+			t.Errorf("Expected %s to be kept, got %v", key, err)
+		}
+	}
+
+	// Every version retained counts towards the bytes.
+	db, logger = newEvictingDB(t, Eviction{Policy: EvictionLFU, MaxBytes: 90})
+	logger.WritePut("hot", strings.Repeat("x", 30))
+	logger.WritePut("cold", strings.Repeat("y", 30))
+	db.Get("hot")
+	logger.WritePut("hot", strings.Repeat("z", 30))
+	if _, err := db.Get("cold"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("Expected the least frequently used key to be evicted, got %v", err)
+	}
+	if history, _ := db.History("hot"); len(history) != 2 {
+		t.Errorf("Expected hot to keep its history, got %d versions", len(history))
+	}
+
+	m := NewMetrics()
+	m.Register(db.(MetricsCollector))
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`keyvaluestore_store_keys 1`,
+		`keyvaluestore_store_bytes 63`,
+		`keyvaluestore_evictions_total{policy="lfu"} 1`,
+		`keyvaluestore_eviction_max_bytes{policy="lfu"} 90`,
+	} {
+		if !strings.Contains(rr.Body.String(), line+"\n") {
+			t.Errorf("Expected %q in the metrics, got:\n%s", line, rr.Body)
+		}
+	}
+}
+
+func TestInMemoryDB_EvictionConcurrent(t *testing.T) {
+	db, logger := newEvictingDB(t, Eviction{Policy: EvictionLFU, MaxKeys: 50})
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				key := fmt.Sprintf("k%d", (i*7+w)%200)
+				logger.WritePut(key, "v")
+				db.Get(key)
+				db.LookupMany([]string{key, "k0"})
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	all, _ := db.GetAll()
+	if len(all) > 50 {
+		t.Errorf("Expected at most 50 keys, got %d", len(all))
+	}
+}
+
+func TestFileTransactionLogger_LoggedEviction(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "transaction.log")
+	eviction := Eviction{Policy: EvictionLRU, MaxKeys: 2}
+
+	db, _ := NewInMemoryDB(WithEviction(eviction))
+	logger, err := InitializeFileTransactionLogger(db, filename)
+	if err != nil {
+		t.Fatalf("InitializeFileTransactionLogger returned error: %v", err)
+	}
+	logger.WritePut("a", "1")
+	logger.WritePut("b", "2")
+	db.Get("a")
+	seq, err := logger.WriteEvent(Event{EventType: EventPut, Key: "c", Value: "3"})
+	if err != nil || seq != 3 {
+		t.Errorf("Expected sequence 3 for the put, not its eviction, got %d, %v", seq, err)
+	}
+	if _, err := db.Get("b"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("Expected b to be evicted, got %v", err)
+	}
+	logger.WritePut("d", "4")
+	fileLogger := logger.(*FileTransactionLogger)
+	close(fileLogger.events)
+	for writeErr := range fileLogger.errors {
+		t.Fatalf("Got an error from the transaction logger: %v", writeErr)
+	}
+
+	stats, err := InspectTransactionLog(filename)
+	if err != nil || stats.Evictions != 2 || stats.LiveKeys != 2 {
+		t.Errorf("Expected 2 logged evictions and 2 live keys, got %+v, %v", stats, err)
+	}
+
+	// Replay evicts exactly the logged keys, even without eviction bounds.
+	want, _ := db.GetAll()
+	for _, opts := range [][]InMemoryOption{{WithEviction(eviction)}, nil} {
+		replayed, _ := NewInMemoryDB(opts...)
+		if _, err := InitializeFileTransactionLogger(replayed, filename); err != nil {
+			t.Fatalf("Replay returned error: %v", err)
+		}
+		if got, _ := replayed.GetAll(); !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected replay to end with %v, got %v", want, got)
+		}
+	}
+}
+
+func TestFileTransactionLogger_EvictionReplaysUpdates(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "transaction.log")
+	eviction := Eviction{Policy: EvictionLRU, MaxKeys: 2}
+
+	// The read of a, which is not logged, makes b the key to evict, so an
+	// increment of a replayed after evicting a instead would start from 0.
+	db, _ := NewInMemoryDB(WithEviction(eviction))
+	logger, err := InitializeFileTransactionLogger(db, filename)
+	if err != nil {
+		t.Fatalf("InitializeFileTransactionLogger returned error: %v", err)
+	}
+	logger.WritePut("a", "5")
+	logger.WritePut("b", "1")
+	db.Get("a")
+	logger.WritePut("c", "1")
+	if _, err := logger.WriteEvent(Event{EventType: EventIncrement, Key: "a", Value: "1"}); err != nil {
+		t.Fatalf("Increment returned error: %v", err)
+	}
+	fileLogger := logger.(*FileTransactionLogger)
+	close(fileLogger.events)
+	for writeErr := range fileLogger.errors {
+		t.Fatalf("Got an error from the transaction logger: %v", writeErr)
+	}
+
+	replayed, _ := NewInMemoryDB(WithEviction(eviction))
+	if _, err := InitializeFileTransactionLogger(replayed, filename); err != nil {
+		t.Fatalf("Replay returned error: %v", err)
+	}
+	want := map[string]string{"a": "6", "c": "1"}
+	if got, _ := replayed.GetAll(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected replay to end with %v, got %v", want, got)
+	}
+}
@@ -2,63 +2,204 @@ package storage
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"io"
 	"os"
+	"sync"
+	"sync/atomic"
 )
 
+// maxLogLineSize bounds a single record, and therefore a single value, when
+// reading a transaction log.
+const maxLogLineSize = 64 << 20
+
 type FileTransactionLogger struct {
-	events       chan<- Event
+	events       chan<- []Event
 	errors       <-chan error
 	lastSequence uint64
 	file         *os.File
+	filename     string
+	db           DB
+	mu           sync.Mutex
+	index        *offsetIndex
+	codec        logCodec
+	size         atomic.Int64 // bytes of complete records in the file
+	failed       atomic.Bool
+	closed       bool       // set by Close, under mu
+	mark         *writeMark // set by Run
 }
 
 func InitializeTransactionLogger(db DB) (TransactionLogger, error) {
+	return InitializeFileTransactionLogger(db, "transaction.log")
+}
+
+// InitializeFileTransactionLogger opens the named log, replays it into db
+// and starts the logger.
+func InitializeFileTransactionLogger(db DB, filename string, opts ...LogOption) (TransactionLogger, error) {
 	var err error
 
-	logger, err := newFileTransactionLogger("transaction.log")
+	logger, err := newFileTransactionLogger(filename, opts)
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to create event logger: %w", err)
 	}
 
-	events, errors := logger.ReadEvents()
+	err = replayEvents(db, logger)
 
-	e := Event{}
-	ok := true
+	fileLogger := logger.(*FileTransactionLogger)
+	fileLogger.db = db
+	fileLogger.Run()
+	return fileLogger, err
+}
 
-	for ok && err == nil {
-		select {
-		case err, ok = <-errors:
-		case e, ok = <-events:
-			switch e.EventType {
-			case EventDelete:
-				err = db.Delete(e.Key)
-			case EventPut:
-				err = db.Upsert(e.Key, e.Value)
-			}
+// newFileTransactionLogger opens the named log, creating it if needed.
+// The log is only accessible by its owner; the permissions of a log
+// created by an older version are tightened.
+func newFileTransactionLogger(filename string, opts []LogOption) (TransactionLogger, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot open transaction log file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("cannot stat transaction log file: %w", err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		if err := file.Chmod(0600); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("cannot restrict transaction log permissions: %w", err)
 		}
 	}
-	logger.Run()
-	return logger, err
-}
 
-func newFileTransactionLogger(filename string) (TransactionLogger, error) {
-	file, err := os.OpenFile(filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0755)
+	l := &FileTransactionLogger{
+		file:     file,
+		filename: filename,
+		index:    newOffsetIndex(defaultIndexInterval),
+		codec:    newLogCodec(opts),
+	}
+	l.size.Store(info.Size())
+	return l, nil
+}
 
-	if err != nil {
+// OpenFileTransactionLogger opens an existing transaction log for reading,
+// without replaying it or starting the logger.
+func OpenFileTransactionLogger(filename string, opts ...LogOption) (TransactionLogger, error) {
+	if _, err := os.Stat(filename); err != nil {
 		return nil, fmt.Errorf("cannot open transaction log file: %w", err)
 	}
+	return newFileTransactionLogger(filename, opts)
+}
+
+func (l *FileTransactionLogger) WritePut(key, value string) error {
+	_, err := l.WriteEvent(Event{EventType: EventPut, Key: key, Value: value})
+	return err
+}
+
+func (l *FileTransactionLogger) WriteDelete(key string) error {
+	_, err := l.WriteEvent(Event{EventType: EventDelete, Key: key})
+	return err
+}
+
+// WriteEvent assigns e the next sequence number, applies it to the bound DB,
+// if any, and queues it for the log. All three happen under one lock so the
+// DB sees events in the same order as the log. Events the DB rejects are
+// not logged and do not use up a sequence number. Once the logger runs,
+// WriteEvent returns when e is written to the file. Once a write to the
+// file has failed, WriteEvent returns ErrorUnavailable.
+func (l *FileTransactionLogger) WriteEvent(e Event) (uint64, error) {
+	return l.WriteEvents([]Event{e})
+}
+
+// WriteEvents is WriteEvent for a batch of events, which are applied
+// atomically and written as a single record.
+func (l *FileTransactionLogger) WriteEvents(events []Event) (uint64, error) {
+	if len(events) == 0 {
+		return 0, fmt.Errorf("%w: no events to write", ErrorInvalidArgument)
+	}
+
+	seq, err := l.queue(events)
+	if err != nil || l.mark == nil {
+		return seq, err
+	}
+	if !l.mark.wait(seq) {
+		return 0, fmt.Errorf("%w: transaction log write failed", ErrorUnavailable)
+	}
+	return seq, nil
+}
+
+// queue applies events to the bound DB, if any, and queues them for the
+// log. It returns the sequence number of the last of events.
+func (l *FileTransactionLogger) queue(events []Event) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.failed.Load() {
+		return 0, fmt.Errorf("%w: transaction log write failed", ErrorUnavailable)
+	}
+	if l.closed {
+		return 0, fmt.Errorf("%w: transaction log closed", ErrorUnavailable)
+	}
 
-	return &FileTransactionLogger{file: file}, nil
+	numbered := sequenceEvents(events, l.lastSequence)
+	if l.db != nil {
+		applied, err := applyEvents(l.db, numbered)
+		if err != nil {
+			return 0, err
+		}
+		for i := range events {
+			events[i].Result = applied[i].Result
+		}
+		numbered = applied
+	}
+	l.lastSequence = numbered[len(numbered)-1].Sequence
+	l.events <- numbered
+	// Evictions logged after the events are not theirs to report.
+	return numbered[len(events)-1].Sequence, nil
+}
+
+// Close stops the logger, if it runs, once it has written the events
+// queued, and closes the log file. It returns the error of a failed
+// write, if there was one and it was not received from Err. Writes after
+// Close fail with ErrorUnavailable.
+func (l *FileTransactionLogger) Close() error {
+	// Taking mu waits for a write being queued; later ones see closed.
+	l.mu.Lock()
+	closed := l.closed
+	l.closed = true
+	l.mu.Unlock()
+	if closed {
+		return nil
+	}
+
+	var err error
+	if l.events != nil {
+		close(l.events)
+		for writeErr := range l.errors {
+			err = writeErr
+		}
+	}
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
-func (l *FileTransactionLogger) WritePut(key, value string) {
-	l.events <- Event{EventType: EventPut, Key: key, Value: value}
+// waitWritten waits until the events up to seq are written, if the
+// logger runs, and reports whether they were.
+func (l *FileTransactionLogger) waitWritten(seq uint64) bool {
+	if l.mark == nil {
+		return true
+	}
+	return l.mark.wait(seq)
 }
 
-func (l *FileTransactionLogger) WriteDelete(key string) {
-	l.events <- Event{EventType: EventDelete, Key: key}
+// writeFailed reports whether a write to the file has failed.
+func (l *FileTransactionLogger) writeFailed() bool {
+	return l.failed.Load()
 }
 
 func (l *FileTransactionLogger) Err() <-chan error {
@@ -66,52 +207,82 @@ func (l *FileTransactionLogger) Err() <-chan error {
 }
 
 func (l *FileTransactionLogger) Run() {
-	events := make(chan Event, 16)
+	events := make(chan []Event, 16)
 	l.events = events
 
 	errors := make(chan error, 1)
 	l.errors = errors
 
+	mark := newWriteMark(l.lastSequence)
+	l.mark = mark
+
 	go func() {
-		for e := range events {
-			l.lastSequence++
+		defer close(errors)
 
-			_, err := fmt.Fprintf(l.file, "%d\t%d\t%s\t%s\n", l.lastSequence, e.EventType, e.Key, e.Value)
+		for batch := range events {
+			offset := l.size.Load()
+			record, err := l.codec.encode(batch)
+			var n int
+			if err == nil {
+				n, err = io.WriteString(l.file, record)
+			}
 
 			if err != nil {
+				// Keep draining so writers queued behind the failure are
+				// not blocked; new writes are refused by WriteEvent.
+				l.failed.Store(true)
+				mark.fail()
 				errors <- err
+				for range events {
+				}
 				return
 			}
+
+			l.index.add(batch[0].Sequence, offset)
+			l.size.Add(int64(n))
+			mark.advance(batch[len(batch)-1].Sequence)
 		}
+		mark.fail() // the logger was closed
 	}()
 }
 
+// ReadEvents replays the whole log from the start of the file. It is meant
+// to be called once, before Run, and builds the offset index used by
+// ReadEventsSince as it goes.
 func (l *FileTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
-	scanner := bufio.NewScanner(l.file)
+	scanner := newLogScanner(l.file)
 	outEvent := make(chan Event)
 	outError := make(chan error, 1)
 
 	go func() {
-		var e Event
-
 		defer close(outEvent)
 		defer close(outError)
 
+		var offset int64
+		lineNo := 0
+
 		for scanner.Scan() {
 			line := scanner.Text()
+			lineNo++
 
-			if _, err := fmt.Sscanf(line, "%d\t%d\t%s\t%s", &e.Sequence, &e.EventType, &e.Key, &e.Value); err != nil {
-				outError <- fmt.Errorf("input parse error: %w", err)
+			events, err := l.codec.decode(line)
+			if err != nil {
+				outError <- &LogError{Line: lineNo, Offset: offset, Text: line,
+					Err: fmt.Errorf("input parse error: %w", err)}
 				return
 			}
 
-			if l.lastSequence >= e.Sequence {
-				outError <- fmt.Errorf("transaction numbers out of sequence")
-				return
+			l.index.add(events[0].Sequence, offset)
+			for _, e := range events {
+				if l.lastSequence >= e.Sequence {
+					outError <- &LogError{Line: lineNo, Offset: offset, Text: line,
+						Err: fmt.Errorf("transaction numbers out of sequence")}
+					return
+				}
+				l.lastSequence = e.Sequence
+				outEvent <- e
 			}
-
-			l.lastSequence = e.Sequence
-			outEvent <- e
+			offset += int64(len(line)) + 1
 		}
 		if err := scanner.Err(); err != nil {
 			outError <- fmt.Errorf("transaction log read failure: %w", err)
@@ -120,3 +291,85 @@ func (l *FileTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
 	}()
 	return outEvent, outError
 }
+
+// ReadEventsSince streams the events with a sequence number greater than seq,
+// in order. It reads through its own file handle, so it is safe to call
+// while the logger is running; the events written before the call are
+// included, once they reach the file, and those written after it are not.
+// The offset index lets it start close to seq once the log has been
+// replayed with ReadEvents.
+func (l *FileTransactionLogger) ReadEventsSince(ctx context.Context, seq uint64) (<-chan Event, <-chan error) {
+	return l.ReadKeyEventsSince(ctx, "", seq, 0)
+}
+
+// ReadKeyEventsSince is ReadEventsSince for the events of key alone, or
+// of every key if key is empty, stopping after limit events if limit is
+// not zero. The file has no index by key, so the log after seq is read
+// until limit events are found.
+func (l *FileTransactionLogger) ReadKeyEventsSince(ctx context.Context, key string, seq uint64, limit int) (<-chan Event, <-chan error) {
+	outEvent := make(chan Event)
+	outError := make(chan error, 1)
+
+	var last uint64
+	if l.mark != nil {
+		l.mu.Lock()
+		last = l.lastSequence
+		l.mu.Unlock()
+	}
+
+	go func() {
+		defer close(outEvent)
+		defer close(outError)
+
+		if l.mark != nil {
+			l.mark.wait(last)
+		}
+
+		file, err := os.Open(l.filename)
+		if err != nil {
+			outError <- fmt.Errorf("cannot open transaction log file: %w", err)
+			return
+		}
+		defer file.Close()
+
+		start := l.index.seek(seq + 1)
+		end := l.size.Load()
+		if start > end {
+			start = end
+		}
+
+		sent := 0
+		scanner := newLogScanner(io.NewSectionReader(file, start, end-start))
+		for scanner.Scan() {
+			events, err := l.codec.decode(scanner.Text())
+			if err != nil {
+				outError <- fmt.Errorf("input parse error: %w", err)
+				return
+			}
+			for _, e := range events {
+				if e.Sequence <= seq || key != "" && e.Key != key {
+					continue
+				}
+				select {
+				case outEvent <- e:
+				case <-ctx.Done():
+					outError <- ctx.Err()
+					return
+				}
+				if sent++; sent == limit {
+					return
+				}
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			outError <- fmt.Errorf("transaction log read failure: %w", err)
+		}
+	}()
+	return outEvent, outError
+}
+
+func newLogScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLogLineSize)
+	return scanner
+}
@@ -2,11 +2,16 @@ package storage
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestFileTransactionLogger_WriteAndReadEvents(t *testing.T) {
@@ -21,7 +26,7 @@ func TestFileTransactionLogger_WriteAndReadEvents(t *testing.T) {
 	defer os.Remove(tmpFileName)
 
 	// 2. Create a FileTransactionLogger with this temp file
-	logger, err := newFileTransactionLogger(tmpFileName)
+	logger, err := newFileTransactionLogger(tmpFileName, nil)
 	if err != nil {
 		t.Fatalf("failed to create newFileTransactionLogger: %v", err)
 	}
@@ -79,8 +84,7 @@ func TestFileTransactionLogger_WriteAndReadEvents(t *testing.T) {
 	var parsedEvents []Event
 
 	for _, line := range lines {
-		var e Event
-		_, err := fmt.Sscanf(line, "%d\t%d\t%s\t%s", &e.Sequence, &e.EventType, &e.Key, &e.Value)
+		e, err := parseEvent(line)
 		if err != nil {
 			t.Fatalf("Failed to parse log line '%s': %v", line, err)
 		}
@@ -130,11 +134,11 @@ func TestInitializeTransactionLogger_ReplaysIntoDB(t *testing.T) {
 		t.Fatalf("Failed to create inMemoryDB: %v", err)
 	}
 
-	// 4. Now call InitializeTransactionLogger, which should:
+	// 4. Now call InitializeFileTransactionLogger, which should:
 	//    - open the file
 	//    - read & replay the 3 events
 	//    - call Run() so it can accept new events
-	logger, err := InitializeTransactionLogger(db)
+	logger, err := InitializeFileTransactionLogger(db, tmpFileName)
 	if err != nil {
 		t.Fatalf("InitializeTransactionLogger returned an error: %v", err)
 	}
@@ -184,3 +188,285 @@ func TestInitializeTransactionLogger_ReplaysIntoDB(t *testing.T) {
 		t.Error("Expected 'bob' to be deleted, but found it in DB")
 	}
 }
+
+func TestFileTransactionLogger_ReadEventsSince(t *testing.T) {
+	// 1. Create a temp file with ten pre-written puts
+	tmpFile, err := os.CreateTemp("", "transaction_*.log")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	tmpFileName := tmpFile.Name()
+	defer os.Remove(tmpFileName)
+
+	for i := 1; i <= 10; i++ {
+		if _, err := tmpFile.WriteString(fmt.Sprintf("%d\t2\tkey%d\tvalue %d\n", i, i, i)); err != nil {
+			t.Fatalf("Failed writing to temp file: %v", err)
+		}
+	}
+	tmpFile.Close()
+
+	logger, err := newFileTransactionLogger(tmpFileName, nil)
+	if err != nil {
+		t.Fatalf("failed to create newFileTransactionLogger: %v", err)
+	}
+	fileLogger := logger.(*FileTransactionLogger)
+
+	// 2. Use a small index interval so the seek path is exercised
+	fileLogger.index = newOffsetIndex(3)
+
+	// 3. Replay the log to build the index, then append two more events
+	events, errs := fileLogger.ReadEvents()
+	for range events {
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("ReadEvents returned an error: %v", err)
+	}
+
+	fileLogger.Run()
+	fileLogger.WritePut("key11", "value 11")
+	fileLogger.WriteDelete("key1")
+	close(fileLogger.events)
+	for writeErr := range fileLogger.errors {
+		t.Fatalf("Got an error from the transaction logger: %v", writeErr)
+	}
+
+	if offset := fileLogger.index.seek(8); offset == 0 {
+		t.Errorf("Expected the index to seek past the start of the file for sequence 8")
+	}
+
+	// 4. Every event after sequence 7 should come back, in order
+	events, errs = fileLogger.ReadEventsSince(context.Background(), 7)
+
+	var got []Event
+	for e := range events {
+		got = append(got, e)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("ReadEventsSince returned an error: %v", err)
+	}
+
+	expected := []Event{
+		{Sequence: 8, EventType: EventPut, Key: "key8", Value: "value 8"},
+		{Sequence: 9, EventType: EventPut, Key: "key9", Value: "value 9"},
+		{Sequence: 10, EventType: EventPut, Key: "key10", Value: "value 10"},
+		{Sequence: 11, EventType: EventPut, Key: "key11", Value: "value 11"},
+		{Sequence: 12, EventType: EventDelete, Key: "key1", Value: ""},
+	}
+
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Unexpected events.\nGot:      %#v\nExpected: %#v", got, expected)
+	}
+}
+
+func TestFileTransactionLogger_ReadKeyEventsSince(t *testing.T) {
+	db, _ := NewInMemoryDB()
+	logger, err := InitializeFileTransactionLogger(db, filepath.Join(t.TempDir(), "transaction.log"))
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	svc := NewService(db, logger)
+	for i := 0; i < 10; i++ {
+		svc.Put(Caller{}, fmt.Sprint("k", i%2), fmt.Sprint(i))
+	}
+
+	// 1. Only the events of the key after since, up to limit
+	events, errs := logger.ReadKeyEventsSince(context.Background(), "k1", 2, 3)
+	var seqs []uint64
+	for e := range events {
+		seqs = append(seqs, e.Sequence)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("ReadKeyEventsSince returned an error: %v", err)
+	}
+	if !reflect.DeepEqual(seqs, []uint64{4, 6, 8}) {
+		t.Errorf("Expected sequences 4, 6 and 8, got %v", seqs)
+	}
+
+	// 2. A cancelled read stops without being drained
+	ctx, cancel := context.WithCancel(context.Background())
+	events, errs = logger.ReadEventsSince(ctx, 0)
+	<-events
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestFormatEvent_RoundTrip(t *testing.T) {
+	// Keys and values with tabs, newlines and backslashes must survive, and
+	// so must the metadata columns.
+	e := Event{
+		Sequence:  42,
+		EventType: EventPut,
+		Key:       "tab\tkey",
+		Value:     "line one\nline two\\n\r",
+		Timestamp: time.Date(2025, 3, 21, 10, 30, 0, 123, time.UTC),
+		RequestID: "req-1",
+		Principal: "10.0.0.1",
+		ExpiresAt: time.Date(2025, 3, 21, 11, 30, 0, 0, time.UTC),
+		Flags:     7,
+		Lease:     "cron\tjob",
+	}
+
+	line := formatEvent(e)
+	if strings.Count(line, "\n") != 1 || !strings.HasSuffix(line, "\n") {
+		t.Fatalf("Expected a single line record, got %q", line)
+	}
+
+	parsed, err := parseEvent(strings.TrimSuffix(line, "\n"))
+	if err != nil {
+		t.Fatalf("Failed to parse record %q: %v", line, err)
+	}
+	if !reflect.DeepEqual(parsed, e) {
+		t.Errorf("Round trip mismatch.\nGot:      %#v\nExpected: %#v", parsed, e)
+	}
+
+	// An optional field is kept when an earlier one is not set
+	e.ExpiresAt = time.Time{}
+	parsed, err = parseEvent(strings.TrimSuffix(formatEvent(e), "\n"))
+	if err != nil || !reflect.DeepEqual(parsed, e) {
+		t.Errorf("Round trip without expiry mismatch.\nGot:      %#v (%v)\nExpected: %#v", parsed, err, e)
+	}
+	e.Flags = 0
+	parsed, err = parseEvent(strings.TrimSuffix(formatEvent(e), "\n"))
+	if err != nil || !reflect.DeepEqual(parsed, e) {
+		t.Errorf("Round trip without flags mismatch.\nGot:      %#v (%v)\nExpected: %#v", parsed, err, e)
+	}
+
+	// Records written before the metadata columns existed still parse
+	legacy, err := parseEvent("7\t2\tfoo\tHello, key-value store!")
+	if err != nil {
+		t.Fatalf("Failed to parse legacy record: %v", err)
+	}
+	expected := Event{Sequence: 7, EventType: EventPut, Key: "foo", Value: "Hello, key-value store!"}
+	if !reflect.DeepEqual(legacy, expected) {
+		t.Errorf("Legacy record mismatch.\nGot:      %#v\nExpected: %#v", legacy, expected)
+	}
+}
+
+func TestFileTransactionLogger_WriteEventsIsAtomic(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "transaction.log")
+
+	db, _ := NewInMemoryDB()
+	logger, err := InitializeFileTransactionLogger(db, filename)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	// 1. A batch is applied as a whole and written as a single record
+	seq, err := logger.WriteEvents([]Event{
+		{EventType: EventPut, Key: "a", Value: "1"},
+		{EventType: EventPut, Key: "b", Value: "two\nlines"},
+		{EventType: EventDelete, Key: "a"},
+	})
+	if err != nil || seq != 3 {
+		t.Fatalf("WriteEvents returned %d, %v; expected 3", seq, err)
+	}
+
+	// 2. A batch the DB rejects changes nothing
+	_, err = logger.WriteEvents([]Event{
+		{EventType: EventPut, Key: "c", Value: "3"},
+		{EventType: EventDelete, Key: "missing"},
+	})
+	if !errors.Is(err, ErrorNoSuchKey) {
+		t.Fatalf("Expected ErrorNoSuchKey, got %v", err)
+	}
+	if _, err := db.Get("c"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("Expected the rejected batch to leave no trace, got %v", err)
+	}
+	if seq, _ := logger.WriteEvent(Event{EventType: EventPut, Key: "d", Value: "4"}); seq != 4 {
+		t.Errorf("Expected the rejected batch not to use sequence numbers, got %d", seq)
+	}
+
+	fileLogger := logger.(*FileTransactionLogger)
+	close(fileLogger.events)
+	for writeErr := range fileLogger.errors {
+		t.Fatalf("Got an error from the transaction logger: %v", writeErr)
+	}
+
+	b, _ := os.ReadFile(filename)
+	if lines := strings.Count(string(b), "\n"); lines != 2 {
+		t.Errorf("Expected a batch record and a plain record, got %d lines: %q", lines, b)
+	}
+
+	// 3. Replay and ReadEventsSince see the events of the batch
+	replayed, _ := NewInMemoryDB()
+	if _, err := InitializeFileTransactionLogger(replayed, filename); err != nil {
+		t.Fatalf("Failed to replay: %v", err)
+	}
+	all, _ := replayed.GetAll()
+	expected := map[string]string{"b": "two\nlines", "d": "4"}
+	if !reflect.DeepEqual(all, expected) {
+		t.Errorf("Replayed data mismatch.\nGot:      %#v\nExpected: %#v", all, expected)
+	}
+
+	events, errs := logger.ReadEventsSince(context.Background(), 1)
+	var seqs []uint64
+	for e := range events {
+		seqs = append(seqs, e.Sequence)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("ReadEventsSince returned an error: %v", err)
+	}
+	if !reflect.DeepEqual(seqs, []uint64{2, 3, 4}) {
+		t.Errorf("Expected sequences 2, 3 and 4, got %v", seqs)
+	}
+}
+
+func TestFileTransactionLogger_WriteFailure(t *testing.T) {
+	db, _ := NewInMemoryDB()
+	logger, err := InitializeFileTransactionLogger(db, filepath.Join(t.TempDir(), "transaction.log"))
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	svc := NewService(db, logger)
+	if _, err := svc.Put(Caller{}, "a", "1"); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+
+	// 1. A write is only acknowledged once it is in the file
+	logger.(*FileTransactionLogger).file.Close()
+	if _, err := svc.Put(Caller{}, "b", "2"); !errors.Is(err, ErrorUnavailable) {
+		t.Errorf("Expected ErrorUnavailable for a write that was not logged, got %v", err)
+	}
+	<-logger.Err()
+
+	// 2. The DB holds b, which is not in the log, so reads are refused
+	if _, err := svc.Get("a"); !errors.Is(err, ErrorUnavailable) {
+		t.Errorf("Expected reads to be refused after a failed write, got %v", err)
+	}
+	if _, err := svc.Put(Caller{}, "c", "3"); !errors.Is(err, ErrorUnavailable) {
+		t.Errorf("Expected further writes to be refused, got %v", err)
+	}
+}
+
+func TestFileTransactionLogger_CloseWhileWriting(t *testing.T) {
+	db, _ := NewInMemoryDB()
+	logger, err := InitializeFileTransactionLogger(db, filepath.Join(t.TempDir(), "transaction.log"))
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	svc := NewService(db, logger)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := svc.Put(Caller{}, fmt.Sprint("k", i), "v"); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond)
+	if err := logger.(*FileTransactionLogger).Close(); err != nil {
+		t.Errorf("Close returned error: %v", err)
+	}
+	wg.Wait()
+
+	if _, err := svc.Put(Caller{}, "after", "v"); !errors.Is(err, ErrorUnavailable) {
+		t.Errorf("Expected ErrorUnavailable for a write after Close, got %v", err)
+	}
+}
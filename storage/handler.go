@@ -1,84 +1,295 @@
 package storage
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
+// Handler serves the HTTP API of a Service.
 type Handler struct {
-	db     DB
-	logger TransactionLogger
+	svc         *Service
+	idempotency *IdempotencyCache
 }
 
-func NewHandler(db DB, logger TransactionLogger) (Handler, error) {
-	return Handler{db: db, logger: logger}, nil
+// NewHandler returns a Handler for a new Service that reads from db and
+// writes through logger; see NewService.
+func NewHandler(db DB, logger TransactionLogger, opts ...HandlerOption) (Handler, error) {
+	return NewServiceHandler(NewService(db, logger, opts...)), nil
 }
 
+// NewServiceHandler returns a Handler for svc, which may be shared with
+// other front-ends.
+func NewServiceHandler(svc *Service) Handler {
+	return Handler{
+		svc:         svc,
+		idempotency: NewIdempotencyCache(defaultIdempotencyTTL, defaultIdempotencyKeys),
+	}
+}
+
+// GetHandler returns the current value of a key, or with ?at= its value as
+// of a sequence number or an RFC 3339 timestamp. A current value stored
+// compressed is sent as it is, with Content-Encoding, to clients whose
+// Accept-Encoding allows it.
 func (h *Handler) GetHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	key := vars["key"]
+	key := keyVar(r)
 
-	value, err := h.db.Get(key)
-	if errors.Is(err, ErrorNoSuchKey) {
-		http.Error(w, err.Error(), http.StatusNotFound)
-		return
+	var value string
+	var err error
+
+	w.Header().Add("Vary", "Accept-Encoding")
+	if at := r.URL.Query().Get("at"); at != "" {
+		if seq, perr := strconv.ParseUint(at, 10, 64); perr == nil {
+			value, err = h.svc.GetAt(key, seq)
+		} else if t, perr := time.Parse(time.RFC3339Nano, at); perr == nil {
+			value, err = h.svc.GetAtTime(key, t)
+		} else {
+			err = fmt.Errorf("%w: at must be a sequence number or an RFC 3339 timestamp", ErrorInvalidArgument)
+		}
+	} else {
+		var v Version
+		if v, err = h.svc.LookupRaw(key); err == nil && v.Encoding != "" && acceptsEncoding(r, v.Encoding) {
+			w.Header().Set("Content-Encoding", v.Encoding)
+			io.WriteString(w, v.Value)
+			return
+		}
+		if err == nil {
+			v, err = v.decoded()
+			value = v.Value
+		}
 	}
+
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
 	fmt.Fprint(w, value)
 }
 
+// acceptsEncoding reports whether the Accept-Encoding header of r allows
+// a response compressed with encoding.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(header, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			if name != encoding && name != "*" {
+				continue
+			}
+			q := strings.TrimSpace(params)
+			if v, ok := strings.CutPrefix(q, "q="); ok {
+				if weight, err := strconv.ParseFloat(v, 64); err == nil && weight == 0 {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// HistoryHandler lists the retained versions of a key, oldest first.
+func (h *Handler) HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	key := keyVar(r)
+
+	history, err := h.svc.History(key)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+// GetAllHandler lists the store, or with ?prefix= the keys with that
+// prefix. Clients that accept application/json get a JSON object.
 func (h *Handler) GetAllHandler(w http.ResponseWriter, r *http.Request) {
-	value, err := h.db.GetAll()
+	value, err := h.svc.List(r.URL.Query().Get("prefix"))
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
+		return
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(value)
 		return
 	}
 
 	fmt.Fprint(w, value)
 }
 
+// UpsertHandler sets a key to the request body. With ?lease= the key is
+// attached to that lock and vanishes when it ends; ?token= then requires
+// the lock to still have that fencing token.
 func (h *Handler) UpsertHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	key := vars["key"]
+	key := keyVar(r)
 
-	value, err := io.ReadAll(r.Body)
+	if h.svc.readOnly {
+		writeError(w, r, ErrorReadOnly)
+		return
+	}
+
+	value, err := h.readValue(w, r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
+		return
+	}
+
+	q := r.URL.Query()
+	op := Op{Type: EventPut, Key: key, Value: value, Lease: q.Get("lease")}
+	if q.Has("token") {
+		if op.If.LeaseToken, err = strconv.ParseUint(q.Get("token"), 10, 64); err != nil || op.If.LeaseToken == 0 {
+			writeError(w, r, fmt.Errorf("%w: token must be a fencing token", ErrorInvalidArgument))
+			return
+		}
 	}
 
-	defer r.Body.Close()
-	h.db.Upsert(key, string(value))
+	if _, err = h.svc.Txn(caller(r), []Op{op}); err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
+
+func (h *Handler) DeleteHandler(w http.ResponseWriter, r *http.Request) {
+	key := keyVar(r)
 
+	if _, err := h.svc.Delete(caller(r), key); err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
+
+// IncrementHandler adds ?delta=, 1 by default, to the integer value of a
+// key and responds with the new value.
+func (h *Handler) IncrementHandler(w http.ResponseWriter, r *http.Request) {
+	key := keyVar(r)
+
+	delta := int64(1)
+	if d := r.URL.Query().Get("delta"); d != "" {
+		var err error
+		if delta, err = strconv.ParseInt(d, 10, 64); err != nil {
+			writeError(w, r, fmt.Errorf("%w: delta must be an integer", ErrorInvalidArgument))
+			return
+		}
+	}
+
+	n, err := h.svc.Increment(caller(r), key, delta)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	h.logger.WritePut(key, string(value))
+	fmt.Fprint(w, n)
 }
 
-func (h *Handler) DeleteHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	key := vars["key"]
+// AppendHandler adds the request body to the end of the value of a key and
+// responds with the new value.
+func (h *Handler) AppendHandler(w http.ResponseWriter, r *http.Request) {
+	key := keyVar(r)
+
+	if h.svc.readOnly {
+		writeError(w, r, ErrorReadOnly)
+		return
+	}
+
+	suffix, err := h.readValue(w, r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	value, err := h.svc.Append(caller(r), key, suffix)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-	err := h.db.Delete(key)
-	if errors.Is(err, ErrorNoSuchKey) {
-		http.Error(w, err.Error(), http.StatusNotFound)
+	fmt.Fprint(w, value)
+}
+
+// PatchHandler applies the request body to the JSON value of a key and
+// responds with the new value. The Content-Type of the request says what
+// the body is: application/json-patch+json for an RFC 6902 JSON Patch, or
+// application/merge-patch+json for an RFC 7386 merge patch.
+func (h *Handler) PatchHandler(w http.ResponseWriter, r *http.Request) {
+	key := keyVar(r)
+
+	if h.svc.readOnly {
+		writeError(w, r, ErrorReadOnly)
+		return
+	}
+
+	contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		writeError(w, r, fmt.Errorf("%w: patches must be %s or %s",
+			ErrorInvalidArgument, ContentTypeJSONPatch, ContentTypeMergePatch))
 		return
 	}
+
+	patch, err := h.readValue(w, r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	h.logger.WriteDelete(key)
+	value, err := h.svc.Patch(caller(r), key, contentType, patch)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, value)
+}
+
+// keyVar returns the {key} route variable.
+func keyVar(r *http.Request) string {
+	return routeVar(r, "key")
+}
+
+// routeVar returns the route variable called name. Routes match the
+// escaped path, so the variable is unescaped here.
+func routeVar(r *http.Request, name string) string {
+	v := mux.Vars(r)[name]
+	if unescaped, err := url.PathUnescape(v); err == nil {
+		return unescaped
+	}
+	return v
+}
+
+// readValue reads the request body, enforcing the configured size limit.
+func (h *Handler) readValue(w http.ResponseWriter, r *http.Request) (string, error) {
+	body := r.Body
+	if h.svc.maxValueSize > 0 {
+		body = http.MaxBytesReader(w, r.Body, h.svc.maxValueSize)
+	}
+	defer body.Close()
+
+	value, err := io.ReadAll(body)
+
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return "", fmt.Errorf("%w: values are limited to %d bytes", ErrorTooLarge, maxErr.Limit)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: cannot read request body: %v", ErrorInvalidArgument, err)
+	}
+	return string(value), nil
+}
+
+// caller identifies who made r, for the events it causes.
+func caller(r *http.Request) Caller {
+	return Caller{RequestID: RequestID(r), Principal: principal(r)}
 }
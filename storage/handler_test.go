@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// newTestRouter starts a file-backed Handler on a temporary log.
+func newTestRouter(t *testing.T, opts ...HandlerOption) *mux.Router {
+	t.Helper()
+
+	tmpFile, err := os.CreateTemp(t.TempDir(), "transaction_*.log")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	tmpFile.Close()
+
+	db, err := NewInMemoryDB()
+	if err != nil {
+		t.Fatalf("Failed to create inMemoryDB: %v", err)
+	}
+	logger, err := InitializeFileTransactionLogger(db, tmpFile.Name())
+	if err != nil {
+		t.Fatalf("InitializeFileTransactionLogger returned an error: %v", err)
+	}
+	handler, err := NewHandler(db, logger, opts...)
+	if err != nil {
+		t.Fatalf("NewHandler returned an error: %v", err)
+	}
+
+	return NewRouter(&handler)
+}
+
+func TestHandler_ErrorResponses(t *testing.T) {
+	router := newTestRouter(t, WithMaxValueSize(4))
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		code   string
+	}{
+		{"get missing key", "GET", "/v1/key/missing", "", http.StatusNotFound, CodeNotFound},
+		{"delete missing key", "DELETE", "/v1/key/missing", "", http.StatusNotFound, CodeNotFound},
+		{"value too large", "PUT", "/v1/key/big", "too large", http.StatusRequestEntityTooLarge, CodeTooLarge},
+		{"invalid at", "GET", "/v1/key/missing?at=yesterday", "", http.StatusBadRequest, CodeInvalidArgument},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set(RequestIDHeader, "req-42")
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d: %s", tt.status, rec.Code, rec.Body)
+			}
+
+			var body ErrorResponse
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatalf("Failed to decode error body: %v", err)
+			}
+			if body.Code != tt.code {
+				t.Errorf("Expected code %q, got %q", tt.code, body.Code)
+			}
+			if body.RequestID != "req-42" {
+				t.Errorf("Expected request ID 'req-42', got %q", body.RequestID)
+			}
+		})
+	}
+}
+
+func TestHandler_ReadOnly(t *testing.T) {
+	router := newTestRouter(t, WithReadOnly())
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("PUT", "/v1/key/k", strings.NewReader("v")))
+
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("Expected status %d, got %d", http.StatusForbidden, rec.Code)
+	}
+	if code, _ := ErrorCode(ErrorReadOnly); !strings.Contains(rec.Body.String(), code) {
+		t.Errorf("Expected a %q error body, got %s", code, rec.Body)
+	}
+}
+
+func TestHandler_IncrementAndAppend(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "transaction.log")
+	db, err := NewInMemoryDB()
+	if err != nil {
+		t.Fatalf("Failed to create inMemoryDB: %v", err)
+	}
+	logger, err := InitializeFileTransactionLogger(db, filename)
+	if err != nil {
+		t.Fatalf("InitializeFileTransactionLogger returned an error: %v", err)
+	}
+	handler, _ := NewHandler(db, logger, WithMaxValueSize(4))
+	router := NewRouter(&handler)
+
+	do := func(path, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		return rr
+	}
+
+	for _, tt := range []struct {
+		path, body string
+		code       int
+		want       string
+	}{
+		{"/v1/key/n/incr", "", http.StatusOK, "1"},
+		{"/v1/key/n/incr?delta=-10", "", http.StatusOK, "-9"},
+		{"/v1/key/n/incr?delta=x", "", http.StatusBadRequest, ""},
+		{"/v1/key/s/append", "ab", http.StatusOK, "ab"},
+		{"/v1/key/s/append", "cd", http.StatusOK, "abcd"},
+		{"/v1/key/s/append", "e", http.StatusRequestEntityTooLarge, ""},
+		{"/v1/key/s/incr", "", http.StatusBadRequest, ""},
+	} {
+		rr := do(tt.path, tt.body)
+		if rr.Code != tt.code {
+			t.Errorf("%s: expected status %d, got %d: %s", tt.path, tt.code, rr.Code, rr.Body)
+		} else if tt.want != "" && rr.Body.String() != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.path, tt.want, rr.Body)
+		}
+	}
+
+	// The operations are logged as such, and replay to the same values.
+	fileLogger := logger.(*FileTransactionLogger)
+	close(fileLogger.events)
+	for writeErr := range fileLogger.errors {
+		t.Fatalf("Got an error from the transaction logger: %v", writeErr)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Failed to read log: %v", err)
+	}
+	if !strings.HasPrefix(string(data), "1\t3\tn\t1\t") {
+		t.Errorf("Expected the log to start with an increment, got %q", data)
+	}
+
+	replayed, _ := NewInMemoryDB()
+	if _, err := InitializeFileTransactionLogger(replayed, filename); err != nil {
+		t.Fatalf("Replay returned an error: %v", err)
+	}
+	if all, _ := replayed.GetAll(); !reflect.DeepEqual(all, map[string]string{"n": "-9", "s": "abcd"}) {
+		t.Errorf("Expected replay to restore n and s, got %v", all)
+	}
+}
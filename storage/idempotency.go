@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdempotencyKeyHeader lets a client retry a write safely: a repeated
+// request with the same key gets the response of the first one instead of
+// being applied again.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+const (
+	defaultIdempotencyTTL  = 10 * time.Minute
+	defaultIdempotencyKeys = 10000
+)
+
+// IdempotencyCache remembers the responses to writes made with an
+// idempotency key, for a limited time and up to a limited number of keys.
+type IdempotencyCache struct {
+	mu      sync.Mutex
+	entries map[string]*idempotentResponse
+	order   *list.List // oldest first
+	ttl     time.Duration
+	max     int
+}
+
+type idempotentResponse struct {
+	key     string
+	request string // method and path the key was first used with
+	done    chan struct{}
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+	elem    *list.Element
+}
+
+func NewIdempotencyCache(ttl time.Duration, max int) *IdempotencyCache {
+	return &IdempotencyCache{
+		entries: make(map[string]*idempotentResponse),
+		order:   list.New(),
+		ttl:     ttl,
+		max:     max,
+	}
+}
+
+// Middleware replays the stored response for writes that repeat an
+// idempotency key, and waits for the first request if it is still running.
+// Keys are scoped to the principal making the request. Responses with a
+// 5xx status are not stored, so the client's retry is attempted again.
+func (c *IdempotencyCache) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" || r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key = principal(r) + "\x00" + key
+		request := r.Method + " " + r.URL.Path
+
+		entry, first := c.claim(key, request)
+		if !first {
+			<-entry.done
+			if entry.request != request {
+				writeError(w, r, fmt.Errorf("%w: idempotency key was used for %s", ErrorConflict, entry.request))
+				return
+			}
+			if entry.status == 0 {
+				// The first attempt failed and was forgotten; run this one.
+				next.ServeHTTP(w, r)
+				return
+			}
+			replay(w, entry)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		c.complete(entry, rec)
+	})
+}
+
+// claim returns the entry for key, creating it if needed. first reports
+// whether the caller created it and must therefore complete it.
+func (c *IdempotencyCache) claim(key, request string) (*idempotentResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for e := c.order.Front(); e != nil; e = c.order.Front() {
+		old := e.Value.(*idempotentResponse)
+		if now.Before(old.expires) && c.order.Len() <= c.max {
+			break
+		}
+		c.order.Remove(e)
+		delete(c.entries, old.key)
+	}
+
+	if entry, ok := c.entries[key]; ok {
+		return entry, false
+	}
+
+	entry := &idempotentResponse{key: key, request: request, done: make(chan struct{}), expires: now.Add(c.ttl)}
+	entry.elem = c.order.PushBack(entry)
+	c.entries[key] = entry
+	return entry, true
+}
+
+func (c *IdempotencyCache) complete(entry *idempotentResponse, rec *responseRecorder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if rec.status >= 500 {
+		c.order.Remove(entry.elem)
+		if c.entries[entry.key] == entry {
+			delete(c.entries, entry.key)
+		}
+	} else {
+		entry.status = rec.status
+		entry.header = rec.Header().Clone()
+		entry.body = rec.body.Bytes()
+	}
+	close(entry.done)
+}
+
+func replay(w http.ResponseWriter, entry *idempotentResponse) {
+	for k, v := range entry.header {
+		if k != http.CanonicalHeaderKey(RequestIDHeader) {
+			w.Header()[k] = v
+		}
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(entry.status)
+	w.Write(entry.body)
+}
+
+// responseRecorder passes a response through while keeping a copy.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
@@ -1,65 +1,989 @@
 package storage
 
 import (
-	"errors"
+	"fmt"
+	"hash/maphash"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// sentinel error
-var ErrorNoSuchKey = errors.New("no such key")
+const (
+	defaultMaxVersions = 10
+	defaultShards      = 32
 
+	// sweepInterval is how many writes happen between sweeps for history
+	// that has outlived its maximum age.
+	sweepInterval = 1024
+
+	// deletedRetention is how many events the history of a deleted key is
+	// kept for, without a maximum age, before the key is forgotten.
+	deletedRetention = 1024
+)
+
+// Version is one value a key has held. A delete is recorded as a version
+// with Deleted set. If Encoding is set, Value is compressed with it; only
+// LookupRaw returns such versions.
+type Version struct {
+	Sequence  uint64    `json:"sequence"`
+	Timestamp time.Time `json:"timestamp"`
+	Value     string    `json:"value,omitempty"`
+	Deleted   bool      `json:"deleted,omitempty"`
+	ExpiresAt time.Time `json:"-"`
+	Flags     uint32    `json:"-"`
+	Lease     string    `json:"lease,omitempty"`
+	Encoding  string    `json:"-"`
+}
+
+// Entry is a key and a version of it.
+type Entry struct {
+	Key string
+	Version
+}
+
+// visibleAt reports whether v is a value that has not expired at t.
+func (v Version) visibleAt(t time.Time) bool {
+	return !v.Deleted && (v.ExpiresAt.IsZero() || t.Before(v.ExpiresAt))
+}
+
+// decoded returns v with its value decompressed.
+func (v Version) decoded() (Version, error) {
+	if v.Encoding == "" {
+		return v, nil
+	}
+	value, err := decompress(v.Value, v.Encoding)
+	if err != nil {
+		return v, err
+	}
+	v.Value, v.Encoding = value, ""
+	return v, nil
+}
+
+// versionChain holds the retained versions of a key, oldest first.
+// truncated is set once older versions have been dropped. size is the
+// bytes of the key and its versions, as counted for eviction.
+type versionChain struct {
+	versions  []Version
+	truncated bool
+	size      int64
+}
+
+func (c *versionChain) current() Version {
+	return c.versions[len(c.versions)-1]
+}
+
+// at returns the newest version written at or before the event with
+// sequence seq, if it is retained.
+func (c *versionChain) at(seq uint64) (Version, bool) {
+	i := sort.Search(len(c.versions), func(i int) bool { return c.versions[i].Sequence > seq })
+	if i == 0 {
+		return Version{}, false
+	}
+	return c.versions[i-1], true
+}
+
+// InMemoryOption configures the DB returned by NewInMemoryDB.
+type InMemoryOption func(*inMemoryDB)
+
+// WithHistoryRetention bounds the history kept for each key to at most
+// maxVersions versions, and drops versions older than maxAge once they are
+// no longer current. A maxAge of zero keeps versions regardless of age,
+// but forgets a deleted key, with its history, once deletedRetention more
+// events have been applied. The current value of a key is always kept.
+func WithHistoryRetention(maxVersions int, maxAge time.Duration) InMemoryOption {
+	return func(db *inMemoryDB) {
+		if maxVersions < 1 {
+			maxVersions = 1
+		}
+		db.maxVersions = maxVersions
+		db.maxAge = maxAge
+	}
+}
+
+// WithBroker publishes every applied event to b.
+func WithBroker(b *Broker) InMemoryOption {
+	return func(db *inMemoryDB) {
+		db.broker = b
+	}
+}
+
+// WithCompression keeps the values c compresses compressed in memory.
+// They are decompressed when read, except by LookupRaw.
+func WithCompression(c *Compressor) InMemoryOption {
+	return func(db *inMemoryDB) {
+		db.compressor = c
+	}
+}
+
+// WithShards splits the keys into n shards, each with a lock of its own.
+// More shards let more readers and the writer work at once, at the cost of
+// scans visiting more maps.
+func WithShards(n int) InMemoryOption {
+	return func(db *inMemoryDB) {
+		db.shards = make([]*shard, max(n, 1))
+	}
+}
+
+// shard holds the keys whose hash falls to it. Readers take its read
+// lock; the writer takes its write lock only to change it, so readers of
+// other shards never wait for a write.
+type shard struct {
+	mu    sync.RWMutex
+	store map[string]*versionChain
+}
+
+// inMemoryDB keeps the versions of its keys in lock-striped shards.
+// Writers are serialised by writeMu, as the log orders them anyway, and
+// work out a batch before locking the shards it changes. A shard's map is
+// only changed by the writer, so the writer reads it without the shard
+// lock.
+//
+// Scans do not lock the DB as a whole. They read the shards one at a time
+// as of the last applied event: every version has the sequence number of
+// its event, so a scan takes the newest version of each key at or before
+// that event, and pins it so that pruning keeps those versions until the
+// scan is done.
 type inMemoryDB struct {
-	store map[string]string
-	lck   sync.RWMutex
+	shards  []*shard
+	seed    maphash.Seed
+	writeMu sync.Mutex
+
+	leases  map[string]*leaseState
+	leaseMu sync.RWMutex
+
+	// indexes is only changed by the writer, under indexMu, as are the
+	// indexes themselves.
+	indexes map[string]*secondaryIndex
+	indexMu sync.RWMutex
+
+	// pins counts the scans in progress by the sequence number they read
+	// at.
+	pins  map[uint64]int
+	pinMu sync.Mutex
+
+	broker     *Broker
+	compressor *Compressor
+
+	// policy chooses the keys to evict; it is nil without eviction bounds.
+	// As reads update it under shard read locks, it has a lock of its own,
+	// always taken after them.
+	eviction Eviction
+	policyMu sync.Mutex
+	policy   evictionPolicy
+	keys     atomic.Int64
+	bytes    atomic.Int64
+	evicted  atomic.Uint64
+
+	lastSequence uint64
+	maxVersions  int
+	maxAge       time.Duration
+	writes       int
+	deleted      []deletion
+}
+
+// deletion is the delete of a key by the event with sequence number seq.
+// Without a maximum age, a DB keeps its deletions in order, to forget the
+// keys once their history has been kept for deletedRetention events.
+type deletion struct {
+	key string
+	seq uint64
+}
+
+func NewInMemoryDB(opts ...InMemoryOption) (DB, error) {
+	db := &inMemoryDB{
+		shards:      make([]*shard, defaultShards),
+		seed:        maphash.MakeSeed(),
+		leases:      make(map[string]*leaseState),
+		indexes:     make(map[string]*secondaryIndex),
+		pins:        make(map[uint64]int),
+		maxVersions: defaultMaxVersions,
+	}
+	for _, opt := range opts {
+		opt(db)
+	}
+	for i := range db.shards {
+		db.shards[i] = &shard{store: make(map[string]*versionChain)}
+	}
+
+	if e := db.eviction; e.MaxKeys < 0 || e.MaxBytes < 0 {
+		return nil, fmt.Errorf("%w: eviction bounds must not be negative", ErrorInvalidArgument)
+	} else if e.MaxKeys > 0 || e.MaxBytes > 0 {
+		if db.eviction.Policy == "" {
+			db.eviction.Policy = EvictionLRU
+		}
+		policy, err := newEvictionPolicy(db.eviction.Policy)
+		if err != nil {
+			return nil, err
+		}
+		db.policy = policy
+	}
+	return db, nil
 }
 
-func NewInMemoryDB() (DB, error) {
-	return &inMemoryDB{store: make(map[string]string, 0)}, nil
+// shardIndex returns the index of the shard holding key.
+func (db *inMemoryDB) shardIndex(key string) int {
+	return int(maphash.String(db.seed, key) % uint64(len(db.shards)))
+}
+
+func (db *inMemoryDB) shardFor(key string) *shard {
+	return db.shards[db.shardIndex(key)]
+}
+
+// chain returns the versions of key. Only the writer may call it, as it
+// reads the shard without its lock.
+func (db *inMemoryDB) chain(key string) (*versionChain, bool) {
+	c, ok := db.shardFor(key).store[key]
+	return c, ok
+}
+
+// lockShards locks the shards with the given indexes, for writing or for
+// reading, in order so that lockers cannot deadlock, and returns a
+// function unlocking them.
+func (db *inMemoryDB) lockShards(indexes map[int]bool, write bool) func() {
+	sorted := make([]int, 0, len(indexes))
+	for i := range indexes {
+		sorted = append(sorted, i)
+	}
+	sort.Ints(sorted)
+	for _, i := range sorted {
+		if write {
+			db.shards[i].mu.Lock()
+		} else {
+			db.shards[i].mu.RLock()
+		}
+	}
+	return func() {
+		for _, i := range sorted {
+			if write {
+				db.shards[i].mu.Unlock()
+			} else {
+				db.shards[i].mu.RUnlock()
+			}
+		}
+	}
+}
+
+// pin keeps the versions current at the last applied event from being
+// pruned until the returned function is called, and returns the sequence
+// number of that event.
+func (db *inMemoryDB) pin() (uint64, func()) {
+	db.writeMu.Lock()
+	seq := db.lastSequence
+	db.pinMu.Lock()
+	db.pins[seq]++
+	db.pinMu.Unlock()
+	db.writeMu.Unlock()
+
+	return seq, func() {
+		db.pinMu.Lock()
+		defer db.pinMu.Unlock()
+		if db.pins[seq]--; db.pins[seq] == 0 {
+			delete(db.pins, seq)
+		}
+	}
+}
+
+// oldestPin returns the sequence number of the oldest scan in progress, or
+// the largest sequence number if there is none.
+func (db *inMemoryDB) oldestPin() uint64 {
+	db.pinMu.Lock()
+	defer db.pinMu.Unlock()
+	oldest := uint64(math.MaxUint64)
+	for seq := range db.pins {
+		oldest = min(oldest, seq)
+	}
+	return oldest
+}
+
+// scan returns the versions of the keys with prefix that are visible as of
+// the last applied event, and the sequence number of that event. Values
+// are left as they are stored.
+func (db *inMemoryDB) scan(prefix string) ([]Entry, uint64) {
+	seq, unpin := db.pin()
+	defer unpin()
+
+	now := time.Now()
+	var entries []Entry
+	for _, s := range db.shards {
+		s.mu.RLock()
+		for k, c := range s.store {
+			if !strings.HasPrefix(k, prefix) {
+				continue
+			}
+			if v, ok := c.at(seq); ok && v.visibleAt(now) {
+				entries = append(entries, Entry{Key: k, Version: v})
+			}
+		}
+		s.mu.RUnlock()
+	}
+	return entries, seq
 }
 
 // GetAll returns a copy of the underlying store to avoid race conditions.
+// Like Snapshot, it does not hold up writers while it copies.
 func (db *inMemoryDB) GetAll() (map[string]string, error) {
-	db.lck.RLock()
-	defer db.lck.RUnlock()
-
-	copyStore := make(map[string]string, len(db.store))
-	for k, v := range db.store {
-		copyStore[k] = v
+	entries, _ := db.scan("")
+	copyStore := make(map[string]string, len(entries))
+	for _, e := range entries {
+		v, err := e.Version.decoded()
+		if err != nil {
+			return nil, err
+		}
+		copyStore[e.Key] = v.Value
 	}
 	return copyStore, nil
 }
 
 // Get returns the value for a given key if it exists; otherwise, it returns an error.
 func (db *inMemoryDB) Get(key string) (*string, error) {
-	db.lck.RLock()
-	defer db.lck.RUnlock()
+	s := db.shardFor(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	value, ok := db.store[key]
-	if !ok {
+	c, ok := s.store[key]
+	if !ok || !c.current().visibleAt(time.Now()) {
 		return nil, ErrorNoSuchKey
 	}
+	db.touch(key)
 	// Return a pointer to a copy of the value.
-	val := value
-	return &val, nil
+	v, err := c.current().decoded()
+	if err != nil {
+		return nil, err
+	}
+	return &v.Value, nil
+}
+
+// Lookup returns the current version of key, if it has a value.
+func (db *inMemoryDB) Lookup(key string) (Version, error) {
+	v, err := db.LookupRaw(key)
+	if err != nil {
+		return v, err
+	}
+	return v.decoded()
+}
+
+// LookupRaw is Lookup without decompressing the value.
+func (db *inMemoryDB) LookupRaw(key string) (Version, error) {
+	s := db.shardFor(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	c, ok := s.store[key]
+	if !ok || !c.current().visibleAt(time.Now()) {
+		return Version{}, ErrorNoSuchKey
+	}
+	db.touch(key)
+	return c.current(), nil
+}
+
+// Peek is Lookup without touching key for the eviction policy, for reads
+// the store makes on its own behalf.
+func (db *inMemoryDB) Peek(key string) (Version, error) {
+	s := db.shardFor(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	c, ok := s.store[key]
+	if !ok || !c.current().visibleAt(time.Now()) {
+		return Version{}, ErrorNoSuchKey
+	}
+	return c.current().decoded()
+}
+
+// LookupMany returns the current versions of those keys that have a value,
+// holding the read locks of their shards together so that it sees every
+// batch whole.
+func (db *inMemoryDB) LookupMany(keys []string) (map[string]Version, error) {
+	indexes := make(map[int]bool)
+	for _, key := range keys {
+		indexes[db.shardIndex(key)] = true
+	}
+	unlock := db.lockShards(indexes, false)
+	defer unlock()
+
+	now := time.Now()
+	versions := make(map[string]Version, len(keys))
+	for _, key := range keys {
+		if c, ok := db.shardFor(key).store[key]; ok && c.current().visibleAt(now) {
+			v, err := c.current().decoded()
+			if err != nil {
+				return nil, err
+			}
+			db.touch(key)
+			versions[key] = v
+		}
+	}
+	return versions, nil
+}
+
+// Snapshot copies the current versions of the keys with prefix as of the
+// last applied event, whose sequence number it returns, without blocking
+// writers. Keys evicted while it runs may be missing. The values
+// themselves are shared, not copied, and are decompressed after the copy.
+func (db *inMemoryDB) Snapshot(prefix string) ([]Entry, uint64, error) {
+	entries, seq := db.scan(prefix)
+	for i := range entries {
+		v, err := entries[i].Version.decoded()
+		if err != nil {
+			return nil, 0, err
+		}
+		entries[i].Version = v
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries, seq, nil
 }
 
 // Set stores the key/value pair and returns a pointer to the value.
 func (db *inMemoryDB) Upsert(key string, value string) error {
-	db.lck.Lock()
-	defer db.lck.Unlock()
-
-	db.store[key] = value
-	return nil
+	return db.Apply(Event{EventType: EventPut, Key: key, Value: value, Timestamp: time.Now().UTC()})
 }
 
 // Delete removes a key from the store if it exists, otherwise it returns an error.
 func (db *inMemoryDB) Delete(key string) error {
-	db.lck.Lock()
-	defer db.lck.Unlock()
+	return db.Apply(Event{EventType: EventDelete, Key: key, Timestamp: time.Now().UTC()})
+}
 
-	if _, exists := db.store[key]; !exists {
-		return errors.New("key not found")
+// Increment adds delta to the integer value of key, treating a missing key
+// as 0, and returns the new value. It fails with ErrorInvalidArgument if
+// the value is not a decimal integer or the result would overflow.
+func (db *inMemoryDB) Increment(key string, delta int64) (int64, error) {
+	events := []Event{{EventType: EventIncrement, Key: key, Value: strconv.FormatInt(delta, 10), Timestamp: time.Now().UTC()}}
+	if err := db.ApplyBatch(events); err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(events[0].Result, 10, 64)
+}
+
+// Append adds suffix to the end of the value of key, treating a missing
+// key as empty, and returns the new value.
+func (db *inMemoryDB) Append(key, suffix string) (string, error) {
+	return db.update(EventAppend, key, suffix)
+}
+
+// MergePatch applies the RFC 7386 merge patch patch to the JSON value of
+// key, treating a missing key as null, and returns the new value.
+func (db *inMemoryDB) MergePatch(key, patch string) (string, error) {
+	return db.update(EventMergePatch, key, patch)
+}
+
+// JSONPatch applies the RFC 6902 JSON Patch patch to the JSON value of
+// key and returns the new value.
+func (db *inMemoryDB) JSONPatch(key, patch string) (string, error) {
+	return db.update(EventJSONPatch, key, patch)
+}
+
+// update applies an update event of type t and returns the new value of
+// key.
+func (db *inMemoryDB) update(t EventType, key, value string) (string, error) {
+	events := []Event{{EventType: t, Key: key, Value: value, Timestamp: time.Now().UTC()}}
+	if err := db.ApplyBatch(events); err != nil {
+		return "", err
+	}
+	return events[0].Result, nil
+}
+
+// Apply records e as the newest version of its key. Events without a
+// sequence number are given the next one after the last applied event.
+// Events without a timestamp, such as those from logs written before
+// timestamps were recorded, are treated as older than any point in time.
+func (db *inMemoryDB) Apply(e Event) error {
+	return db.ApplyBatch([]Event{e})
+}
+
+// ApplyBatch applies events in order as a single change: if any of them
+// cannot be applied, none is, and readers never see some applied without
+// the others. Sequence numbers are assigned as by Apply. The Result of
+// each update event in events, such as an increment or a patch, is set to
+// the key's new value, and that of each acquire and renewal to the lease's
+// fencing token.
+//
+// The batch is worked out under writeMu alone; only then are the shards it
+// changes locked, together, to apply it.
+func (db *inMemoryDB) ApplyBatch(events []Event) error {
+	// Values of puts are compressed before taking any lock.
+	type storedValue struct{ value, encoding string }
+	var compressed []storedValue
+	if db.compressor != nil {
+		compressed = make([]storedValue, len(events))
+		for i, e := range events {
+			if e.EventType == EventPut {
+				compressed[i].value, compressed[i].encoding = db.compressor.compress(e.Value, compressedInMemory)
+			}
+		}
+	}
+
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+
+	applied := append([]Event(nil), events...)
+
+	// Work out every new version, lease and index before changing
+	// anything, on top of those the batch itself creates.
+	last := db.lastSequence
+	staged := make(map[string]Version)
+	stagedLeases := make(map[string]Lease)
+	stagedIndexes := make(map[string]*IndexDefinition)
+	changes := make([]change, len(applied))
+	lease := func(name string) Lease {
+		if l, ok := stagedLeases[name]; ok {
+			return l
+		}
+		if st, ok := db.leases[name]; ok {
+			return st.Lease
+		}
+		return Lease{}
+	}
+	index := func(name string) *IndexDefinition {
+		if def, ok := stagedIndexes[name]; ok {
+			return def
+		}
+		if ix, ok := db.indexes[name]; ok {
+			return &ix.IndexDefinition
+		}
+		return nil
+	}
+	for i := range applied {
+		e := &applied[i]
+		if e.Sequence == 0 {
+			e.Sequence = last + 1
+		}
+		if e.Sequence <= last {
+			return fmt.Errorf("%w: event %d applied after event %d", ErrorConflict, e.Sequence, last)
+		}
+		last = e.Sequence
+
+		if e.EventType.isLease() {
+			l, err := nextLease(*e, lease(e.Key))
+			if err != nil {
+				return err
+			}
+			stagedLeases[e.Key] = l
+			changes[i].lease = l
+			if e.EventType != EventRelease {
+				e.Result = strconv.FormatUint(l.Token, 10)
+			}
+			continue
+		}
+		if e.EventType.isIndex() {
+			def, err := nextIndex(*e, index(e.Key))
+			if err != nil {
+				return err
+			}
+			stagedIndexes[e.Key] = def
+			changes[i].index = def
+			continue
+		}
+		if e.EventType == EventEvict {
+			staged[e.Key] = Version{Deleted: true}
+			continue
+		}
+		if e.EventType == EventMark {
+			continue
+		}
+
+		cur, seen := staged[e.Key]
+		if !seen {
+			cur = Version{Deleted: true}
+			if c, ok := db.chain(e.Key); ok {
+				cur = c.current()
+			}
+		}
+		if e.EventType.isUpdate() {
+			var err error
+			if cur, err = cur.decoded(); err != nil {
+				return err
+			}
+		}
+		if cur.Lease != "" {
+			// The batch may already have renewed or released the lease.
+			if l := lease(cur.Lease); l.Token != 0 && cur.Sequence > l.Token {
+				cur.ExpiresAt = l.ExpiresAt
+			}
+		}
+
+		v, err := nextVersion(*e, cur)
+		if err != nil {
+			return err
+		}
+		if e.EventType == EventPut && e.Lease != "" {
+			l := lease(e.Lease)
+			if !l.heldAt(e.Timestamp) {
+				return fmt.Errorf("%w: lock %q is not held", ErrorNoSuchKey, e.Lease)
+			}
+			v.Lease, v.ExpiresAt = e.Lease, l.ExpiresAt
+		}
+		if e.EventType.isUpdate() {
+			e.Result = v.Value
+			v.Value, v.Encoding = db.compressor.compress(v.Value, compressedInMemory)
+		} else if compressed != nil && e.EventType == EventPut {
+			v.Value, v.Encoding = compressed[i].value, compressed[i].encoding
+		}
+		staged[e.Key] = v
+		changes[i].version = v
+	}
+
+	// A lease event moves the expiry of the keys attached to the lease,
+	// which may be in any shard.
+	locked := make(map[int]bool)
+	changesLeases := false
+	for _, e := range applied {
+		if e.EventType.isLease() {
+			changesLeases = true
+		} else if e.EventType.keyed() {
+			locked[db.shardIndex(e.Key)] = true
+		}
+	}
+	if changesLeases {
+		for i := range db.shards {
+			locked[i] = true
+		}
+		db.leaseMu.Lock()
+	}
+	unlock := db.lockShards(locked, true)
+	keep := db.oldestPin()
+	for i, e := range applied {
+		db.apply(e, changes[i], keep)
+		events[i].Result = e.Result
+	}
+	unlock()
+	if changesLeases {
+		db.leaseMu.Unlock()
+	}
+	db.forgetDeleted(keep)
+
+	before := db.writes
+	db.writes += len(applied)
+	if db.maxAge > 0 && db.writes/sweepInterval != before/sweepInterval {
+		db.sweep(time.Now())
 	}
-	delete(db.store, key)
 	return nil
 }
+
+// nextVersion returns the version of e.Key after e, given its current
+// version cur, which has Deleted set if the key has never been written.
+// Whether the key exists, and what an update starts from, is judged at
+// the time of the event, so that replaying the log later reaches the same
+// decisions.
+func nextVersion(e Event, cur Version) (Version, error) {
+	v := Version{Sequence: e.Sequence, Timestamp: e.Timestamp}
+	exists := cur.visibleAt(e.Timestamp)
+
+	switch e.EventType {
+	case EventPut:
+		v.Value, v.ExpiresAt, v.Flags = e.Value, e.ExpiresAt, e.Flags
+	case EventDelete:
+		if !exists {
+			return v, fmt.Errorf("%w: cannot delete %q", ErrorNoSuchKey, e.Key)
+		}
+		v.Deleted = true
+	case EventIncrement:
+		delta, err := strconv.ParseInt(e.Value, 10, 64)
+		if err != nil {
+			return v, fmt.Errorf("%w: invalid increment %q", ErrorInvalidArgument, e.Value)
+		}
+		var n int64
+		if exists {
+			if n, err = strconv.ParseInt(cur.Value, 10, 64); err != nil {
+				return v, fmt.Errorf("%w: value of %q is not an integer", ErrorInvalidArgument, e.Key)
+			}
+			v.ExpiresAt, v.Flags, v.Lease = cur.ExpiresAt, cur.Flags, cur.Lease
+		}
+		if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+			return v, fmt.Errorf("%w: increment of %q would overflow", ErrorInvalidArgument, e.Key)
+		}
+		v.Value = strconv.FormatInt(n+delta, 10)
+	case EventAppend:
+		if exists {
+			v.Value = cur.Value
+			v.ExpiresAt, v.Flags, v.Lease = cur.ExpiresAt, cur.Flags, cur.Lease
+		}
+		v.Value += e.Value
+	case EventMergePatch, EventJSONPatch:
+		if exists {
+			v.ExpiresAt, v.Flags, v.Lease = cur.ExpiresAt, cur.Flags, cur.Lease
+		}
+		var err error
+		if v.Value, err = patchValue(e, cur.Value, exists); err != nil {
+			return v, err
+		}
+	default:
+		return v, fmt.Errorf("%w: cannot apply event type %v", ErrorInvalidArgument, e.EventType)
+	}
+	return v, nil
+}
+
+// change is the effect of an event, worked out by ApplyBatch: the version
+// it produces for its key, or the lease or index definition it produces.
+// The index definition of an EventDropIndex is nil.
+type change struct {
+	version Version
+	lease   Lease
+	index   *IndexDefinition
+}
+
+// apply records ch, the effect of e. Versions a scan reading at keep or
+// later needs are kept. The caller must hold writeMu and the write locks
+// of the shards e changes.
+func (db *inMemoryDB) apply(e Event, ch change, keep uint64) {
+	switch {
+	case e.EventType.isLease():
+		db.applyLease(e, ch.lease)
+	case e.EventType.isIndex():
+		db.applyIndex(e.Key, ch.index)
+	case e.EventType == EventEvict:
+		db.evict(e.Key)
+	case e.EventType == EventMark:
+		// Only the sequence number moves on.
+	default:
+		db.applyVersion(e.Key, ch.version, keep)
+	}
+	db.lastSequence = e.Sequence
+
+	if db.broker != nil {
+		db.broker.Publish(e)
+	}
+}
+
+// applyVersion records v as the newest version of key, attaching key to
+// the lease v names. A version belongs to the lease acquired most recently
+// before it, whose token is the largest below its sequence number.
+func (db *inMemoryDB) applyVersion(key string, v Version, keep uint64) {
+	if st, ok := db.leases[v.Lease]; ok && v.Sequence > st.Token {
+		st.keys[key] = struct{}{}
+		v.ExpiresAt = st.ExpiresAt
+	}
+
+	s := db.shardFor(key)
+	c, exists := s.store[key]
+	if !exists {
+		c = &versionChain{size: int64(len(key))}
+		s.store[key] = c
+		db.keys.Add(1)
+		db.bytes.Add(c.size)
+		if db.policy != nil {
+			db.policyMu.Lock()
+			db.policy.add(key)
+			db.policyMu.Unlock()
+		}
+	} else {
+		db.touch(key)
+	}
+	c.versions = append(c.versions, v)
+	c.size += versionSize(v)
+	if v.Deleted && db.maxAge == 0 {
+		db.deleted = append(db.deleted, deletion{key: key, seq: v.Sequence})
+	}
+	db.bytes.Add(versionSize(v))
+	db.reindex(key, v)
+
+	db.prune(key, c, time.Now(), keep)
+}
+
+// applyLease records l and moves the expiry of the keys still attached to
+// it to that of the lease. The current versions of those keys are updated
+// in place: a lease can only be extended while it is held, so a key is
+// visible from when it was attached until the lease finally ends.
+func (db *inMemoryDB) applyLease(e Event, l Lease) {
+	st, ok := db.leases[l.Name]
+	if !ok || st.Token != l.Token {
+		st = &leaseState{keys: make(map[string]struct{})}
+		db.leases[l.Name] = st
+	}
+	st.Lease = l
+
+	for key := range st.keys {
+		c, ok := db.chain(key)
+		if !ok {
+			continue
+		}
+		if v := &c.versions[len(c.versions)-1]; v.Lease == l.Name && v.Sequence > l.Token {
+			v.ExpiresAt = l.ExpiresAt
+		}
+	}
+
+	if e.EventType == EventRelease {
+		delete(db.leases, l.Name)
+	}
+}
+
+// LookupLease returns the lease called name, if it is held.
+func (db *inMemoryDB) LookupLease(name string) (Lease, error) {
+	db.leaseMu.RLock()
+	defer db.leaseMu.RUnlock()
+
+	st, ok := db.leases[name]
+	if !ok || !st.heldAt(time.Now()) {
+		return Lease{}, fmt.Errorf("%w: lock %q is not held", ErrorNoSuchKey, name)
+	}
+	return st.Lease, nil
+}
+
+// Leases returns the leases that are held, sorted by name.
+func (db *inMemoryDB) Leases() ([]Lease, error) {
+	db.leaseMu.RLock()
+	now := time.Now()
+	var leases []Lease
+	for _, st := range db.leases {
+		if st.heldAt(now) {
+			leases = append(leases, st.Lease)
+		}
+	}
+	db.leaseMu.RUnlock()
+
+	sort.Slice(leases, func(i, j int) bool { return leases[i].Name < leases[j].Name })
+	return leases, nil
+}
+
+// GetAt returns the value key held just after the event with sequence seq,
+// regardless of its expiry.
+func (db *inMemoryDB) GetAt(key string, seq uint64) (*string, error) {
+	return db.getWhere(key, func(v Version) bool { return v.Sequence <= seq }, time.Time{})
+}
+
+// GetAtTime returns the value key held at time t.
+func (db *inMemoryDB) GetAtTime(key string, t time.Time) (*string, error) {
+	return db.getWhere(key, func(v Version) bool { return !v.Timestamp.After(t) }, t)
+}
+
+// getWhere returns the value of the newest version of key for which
+// visible reports true, unless it had expired at t. visible must hold for
+// a prefix of the chain. A zero t ignores expiry.
+func (db *inMemoryDB) getWhere(key string, visible func(Version) bool, t time.Time) (*string, error) {
+	s := db.shardFor(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	c, ok := s.store[key]
+	if !ok {
+		return nil, ErrorNoSuchKey
+	}
+
+	i := sort.Search(len(c.versions), func(i int) bool { return !visible(c.versions[i]) })
+	if i == 0 {
+		if c.truncated {
+			return nil, ErrorHistoryUnavailable
+		}
+		return nil, ErrorNoSuchKey
+	}
+
+	v := c.versions[i-1]
+	if v.Deleted || (!t.IsZero() && !v.visibleAt(t)) {
+		return nil, ErrorNoSuchKey
+	}
+	v, err := v.decoded()
+	if err != nil {
+		return nil, err
+	}
+	return &v.Value, nil
+}
+
+// History returns the retained versions of key, oldest first.
+func (db *inMemoryDB) History(key string) ([]Version, error) {
+	s := db.shardFor(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	c, ok := s.store[key]
+	if !ok {
+		return nil, ErrorNoSuchKey
+	}
+
+	history := make([]Version, len(c.versions))
+	for i, v := range c.versions {
+		v, err := v.decoded()
+		if err != nil {
+			return nil, err
+		}
+		history[i] = v
+	}
+	return history, nil
+}
+
+// prune drops the versions of c that fall outside the retention policy and
+// forgets the key entirely once only an expired delete remains. Versions a
+// scan reading at keep or later needs are kept: those whose successor came
+// after keep. The caller must hold writeMu and the write lock of the
+// key's shard.
+func (db *inMemoryDB) prune(key string, c *versionChain, now time.Time, keep uint64) {
+	drop := max(len(c.versions)-db.maxVersions, 0)
+	if db.maxAge > 0 {
+		cutoff := now.Add(-db.maxAge)
+		// A version stops being relevant once its successor was written.
+		for drop < len(c.versions)-1 && c.versions[drop+1].Timestamp.Before(cutoff) {
+			drop++
+		}
+		cur := c.current()
+		if ((cur.Deleted && cur.Timestamp.Before(cutoff)) ||
+			(!cur.ExpiresAt.IsZero() && cur.ExpiresAt.Before(cutoff))) && cur.Sequence <= keep {
+			db.forget(key, c)
+			return
+		}
+	}
+	for drop > 0 && c.versions[drop].Sequence > keep {
+		drop--
+	}
+	if drop == 0 {
+		return
+	}
+
+	for _, v := range c.versions[:drop] {
+		c.size -= versionSize(v)
+		db.bytes.Add(-versionSize(v))
+	}
+	c.versions = append([]Version(nil), c.versions[drop:]...)
+	c.truncated = true
+}
+
+// forgetDeleted forgets the keys deleted deletedRetention events ago or
+// more and not written since, unless a scan reading at keep or later
+// needs them, so that the history of deleted keys does not pile up. The
+// caller must hold writeMu.
+func (db *inMemoryDB) forgetDeleted(keep uint64) {
+	n := 0
+	for _, d := range db.deleted {
+		if d.seq+deletedRetention > db.lastSequence || d.seq > keep {
+			break
+		}
+		n++
+		s := db.shardFor(d.key)
+		s.mu.Lock()
+		if c, ok := s.store[d.key]; ok && c.current().Sequence == d.seq {
+			db.forget(d.key, c)
+		}
+		s.mu.Unlock()
+	}
+	clear(db.deleted[:n])
+	db.deleted = db.deleted[n:]
+}
+
+// forget drops key, whose versions are c, entirely. The caller must hold
+// writeMu and the write lock of the key's shard.
+func (db *inMemoryDB) forget(key string, c *versionChain) {
+	delete(db.shardFor(key).store, key)
+	db.keys.Add(-1)
+	db.bytes.Add(-c.size)
+	db.reindex(key, Version{Deleted: true})
+	if db.policy != nil {
+		db.policyMu.Lock()
+		db.policy.remove(key)
+		db.policyMu.Unlock()
+	}
+}
+
+// sweep prunes every key, so that history of keys that are no longer
+// written also ages out. It locks one shard at a time. The caller must
+// hold writeMu.
+func (db *inMemoryDB) sweep(now time.Time) {
+	keep := db.oldestPin()
+	for _, s := range db.shards {
+		s.mu.Lock()
+		for k, c := range s.store {
+			db.prune(k, c, now, keep)
+		}
+		s.mu.Unlock()
+	}
+}
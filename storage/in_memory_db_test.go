@@ -1,8 +1,16 @@
 package storage
 
 import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
 	"reflect"
+	"sort"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 )
 
 // TestInMemoryDB_GetAll tests that GetAll() returns a copy of the store,
@@ -142,8 +150,8 @@ func TestInMemoryDB_Delete(t *testing.T) {
 	if err == nil {
 		t.Error("Expected an error when deleting a non-existent key, but got none")
 	}
-	if err.Error() != "key not found" {
-		t.Errorf("Expected 'key not found' error, got '%v'", err)
+	if !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("Expected ErrorNoSuchKey, got '%v'", err)
 	}
 
 	// Confirm that 'delKey' is really gone
@@ -155,3 +163,362 @@ func TestInMemoryDB_Delete(t *testing.T) {
 		t.Errorf("Expected ErrorNoSuchKey for deleted key, got '%v'", getErr)
 	}
 }
+
+// TestInMemoryDB_History tests that every write is kept as a version and
+// that point-in-time reads see the value as of the requested sequence.
+func TestInMemoryDB_History(t *testing.T) {
+	db, err := NewInMemoryDB()
+	if err != nil {
+		t.Fatalf("Failed to create inMemoryDB: %v", err)
+	}
+
+	ts := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	events := []Event{
+		{Sequence: 3, EventType: EventPut, Key: "k", Value: "v1", Timestamp: ts},
+		{Sequence: 5, EventType: EventPut, Key: "k", Value: "v2", Timestamp: ts.Add(time.Minute)},
+		{Sequence: 8, EventType: EventDelete, Key: "k", Timestamp: ts.Add(2 * time.Minute)},
+	}
+	for _, e := range events {
+		if err := db.Apply(e); err != nil {
+			t.Fatalf("Apply(%v) returned error: %v", e, err)
+		}
+	}
+
+	history, err := db.History("k")
+	if err != nil {
+		t.Fatalf("History returned error: %v", err)
+	}
+	expected := []Version{
+		{Sequence: 3, Timestamp: ts, Value: "v1"},
+		{Sequence: 5, Timestamp: ts.Add(time.Minute), Value: "v2"},
+		{Sequence: 8, Timestamp: ts.Add(2 * time.Minute), Deleted: true},
+	}
+	if !reflect.DeepEqual(history, expected) {
+		t.Errorf("History mismatch.\nGot:      %#v\nExpected: %#v", history, expected)
+	}
+
+	// Reads by sequence
+	if _, err := db.GetAt("k", 2); err != ErrorNoSuchKey {
+		t.Errorf("Expected ErrorNoSuchKey before the first write, got %v", err)
+	}
+	for seq, want := range map[uint64]string{3: "v1", 4: "v1", 5: "v2", 7: "v2"} {
+		value, err := db.GetAt("k", seq)
+		if err != nil {
+			t.Fatalf("GetAt(%d) returned error: %v", seq, err)
+		}
+		if *value != want {
+			t.Errorf("GetAt(%d): expected %q, got %q", seq, want, *value)
+		}
+	}
+	if _, err := db.GetAt("k", 8); err != ErrorNoSuchKey {
+		t.Errorf("Expected ErrorNoSuchKey after the delete, got %v", err)
+	}
+
+	// Reads by time
+	value, err := db.GetAtTime("k", ts.Add(90*time.Second))
+	if err != nil {
+		t.Fatalf("GetAtTime returned error: %v", err)
+	}
+	if *value != "v2" {
+		t.Errorf("GetAtTime: expected 'v2', got %q", *value)
+	}
+}
+
+// TestInMemoryDB_HistoryRetention tests that old versions are dropped and
+// that reads before the retained history say so.
+func TestInMemoryDB_HistoryRetention(t *testing.T) {
+	db, err := NewInMemoryDB(WithHistoryRetention(2, 0))
+	if err != nil {
+		t.Fatalf("Failed to create inMemoryDB: %v", err)
+	}
+
+	for _, v := range []string{"a", "b", "c", "d"} {
+		if err := db.Upsert("k", v); err != nil {
+			t.Fatalf("Upsert returned error: %v", err)
+		}
+	}
+
+	history, err := db.History("k")
+	if err != nil {
+		t.Fatalf("History returned error: %v", err)
+	}
+	if len(history) != 2 || history[0].Value != "c" || history[1].Value != "d" {
+		t.Errorf("Expected versions 'c' and 'd' to be retained, got %#v", history)
+	}
+
+	if _, err := db.GetAt("k", 1); err != ErrorHistoryUnavailable {
+		t.Errorf("Expected ErrorHistoryUnavailable for a pruned version, got %v", err)
+	}
+}
+
+func TestInMemoryDB_Expiry(t *testing.T) {
+	db, err := NewInMemoryDB()
+	if err != nil {
+		t.Fatalf("Failed to create inMemoryDB: %v", err)
+	}
+
+	written := time.Now().Add(-time.Hour)
+	expiry := written.Add(time.Minute)
+	err = db.Apply(Event{Sequence: 1, EventType: EventPut, Key: "k", Value: "v", Timestamp: written, ExpiresAt: expiry})
+	if err != nil {
+		t.Fatalf("Apply returned error: %v", err)
+	}
+
+	if _, err := db.Get("k"); err != ErrorNoSuchKey {
+		t.Errorf("Expected ErrorNoSuchKey for an expired key, got %v", err)
+	}
+	if _, err := db.Lookup("k"); err != ErrorNoSuchKey {
+		t.Errorf("Expected Lookup to return ErrorNoSuchKey for an expired key, got %v", err)
+	}
+	if all, _ := db.GetAll(); len(all) != 0 {
+		t.Errorf("Expected GetAll to leave out the expired key, got %v", all)
+	}
+	if v, err := db.GetAtTime("k", written.Add(time.Second)); err != nil || *v != "v" {
+		t.Errorf("Expected the value before it expired, got %v, %v", v, err)
+	}
+	if _, err := db.GetAtTime("k", expiry); err != ErrorNoSuchKey {
+		t.Errorf("Expected ErrorNoSuchKey once expired, got %v", err)
+	}
+
+	// Whether a key exists for a delete is judged at the time of the
+	// event, so that replaying a log reaches the same result.
+	err = db.Apply(Event{Sequence: 2, EventType: EventDelete, Key: "k", Timestamp: expiry.Add(time.Second)})
+	if !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("Expected deleting an expired key to fail, got %v", err)
+	}
+	err = db.Apply(Event{Sequence: 2, EventType: EventDelete, Key: "k", Timestamp: written.Add(time.Second)})
+	if err != nil {
+		t.Errorf("Expected deleting a key before it expired to succeed, got %v", err)
+	}
+}
+
+func TestInMemoryDB_IncrementAndAppend(t *testing.T) {
+	db, err := NewInMemoryDB()
+	if err != nil {
+		t.Fatalf("Failed to create inMemoryDB: %v", err)
+	}
+
+	if n, err := db.Increment("n", 5); err != nil || n != 5 {
+		t.Errorf("Expected a missing key to count from 0, got %d, %v", n, err)
+	}
+	if n, err := db.Increment("n", -7); err != nil || n != -2 {
+		t.Errorf("Expected -2, got %d, %v", n, err)
+	}
+	if _, err := db.Increment("n", math.MinInt64); !errors.Is(err, ErrorInvalidArgument) {
+		t.Errorf("Expected ErrorInvalidArgument on overflow, got %v", err)
+	}
+
+	if s, err := db.Append("s", "ab"); err != nil || s != "ab" {
+		t.Errorf("Expected \"ab\", got %q, %v", s, err)
+	}
+	if s, err := db.Append("s", "cd"); err != nil || s != "abcd" {
+		t.Errorf("Expected \"abcd\", got %q, %v", s, err)
+	}
+	if _, err := db.Increment("s", 1); !errors.Is(err, ErrorInvalidArgument) {
+		t.Errorf("Expected ErrorInvalidArgument for a non-integer value, got %v", err)
+	}
+
+	// An increment or append keeps the expiry and flags of the key.
+	expiry := time.Now().Add(time.Hour).UTC()
+	if err := db.Apply(Event{EventType: EventPut, Key: "e", Value: "1", Timestamp: time.Now(), ExpiresAt: expiry, Flags: 3}); err != nil {
+		t.Fatalf("Apply returned error: %v", err)
+	}
+	db.Increment("e", 1)
+	if v, err := db.Lookup("e"); err != nil || v.Value != "2" || !v.ExpiresAt.Equal(expiry) || v.Flags != 3 {
+		t.Errorf("Expected 2 with its expiry and flags, got %+v, %v", v, err)
+	}
+
+	// Within a batch, each event sees the ones before it.
+	events := []Event{
+		{EventType: EventIncrement, Key: "b", Value: "2"},
+		{EventType: EventIncrement, Key: "b", Value: "3"},
+		{EventType: EventAppend, Key: "b", Value: "0"},
+	}
+	if err := db.ApplyBatch(events); err != nil {
+		t.Fatalf("ApplyBatch returned error: %v", err)
+	}
+	results := []string{events[0].Result, events[1].Result, events[2].Result}
+	if !reflect.DeepEqual(results, []string{"2", "5", "50"}) {
+		t.Errorf("Unexpected results %q", results)
+	}
+}
+
+// TestInMemoryDB_ScanKeepsPinnedVersions tests that a scan reads the
+// versions current when it started, even if they are superseded and would
+// otherwise be pruned while it runs.
+func TestInMemoryDB_ScanKeepsPinnedVersions(t *testing.T) {
+	opened, _ := NewInMemoryDB(WithHistoryRetention(1, 0), WithShards(4))
+	db := opened.(*inMemoryDB)
+	db.Upsert("a", "1")
+	db.Upsert("b", "1")
+
+	seq, unpin := db.pin()
+	db.Upsert("a", "2")
+	db.Upsert("a", "3")
+	db.Delete("b")
+	db.Upsert("c", "1")
+
+	var found []string
+	for _, s := range db.shards {
+		for k, c := range s.store {
+			if v, ok := c.at(seq); ok && !v.Deleted {
+				found = append(found, k+"="+v.Value)
+			}
+		}
+	}
+	sort.Strings(found)
+	if !reflect.DeepEqual(found, []string{"a=1", "b=1"}) {
+		t.Errorf("Expected the versions at the pinned sequence to be kept, got %v", found)
+	}
+
+	entries, at := db.scan("")
+	if at != 6 || len(entries) != 2 || entries[0].Value+entries[1].Value != "31" && entries[0].Value+entries[1].Value != "13" {
+		t.Errorf("Expected a=3 and c=1 at sequence 6, got %+v at %d", entries, at)
+	}
+
+	// Once unpinned, the old versions go with the next write.
+	unpin()
+	db.Upsert("a", "4")
+	if n := len(db.shardFor("a").store["a"].versions); n != 1 {
+		t.Errorf("Expected a single version of a once unpinned, got %d", n)
+	}
+}
+
+// TestInMemoryDB_SnapshotSeesWholeBatches tests that snapshots taken while
+// batches are written never see part of a batch.
+func TestInMemoryDB_SnapshotSeesWholeBatches(t *testing.T) {
+	db, _ := NewInMemoryDB(WithHistoryRetention(1, 0))
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2000; i++ {
+			events := make([]Event, len(keys))
+			for j, key := range keys {
+				events[j] = Event{EventType: EventPut, Key: key, Value: strconv.Itoa(i)}
+			}
+			if err := db.ApplyBatch(events); err != nil {
+				t.Errorf("ApplyBatch returned error: %v", err)
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		entries, _, err := db.Snapshot("")
+		if err != nil {
+			t.Fatalf("Snapshot returned error: %v", err)
+		}
+		for _, e := range entries {
+			if e.Value != entries[0].Value || len(entries) != len(keys) && len(entries) != 0 {
+				t.Fatalf("Expected a whole batch, got %+v", entries)
+			}
+		}
+		if values, _ := db.LookupMany(keys); len(values) == len(keys) && values["a"].Value != values["h"].Value {
+			t.Fatalf("Expected LookupMany to see a whole batch, got %s and %s", values["a"].Value, values["h"].Value)
+		}
+	}
+}
+
+// benchmarkMixed measures throughput under a mixed load: each operation is
+// a write with probability writeRatio, and otherwise a read.
+func benchmarkMixed(b *testing.B, shards int, writeRatio float64) {
+	db, _ := NewInMemoryDB(WithShards(shards))
+	const keys = 10000
+	for i := 0; i < keys; i++ {
+		db.Upsert("key"+strconv.Itoa(i), "value")
+	}
+
+	var mu sync.Mutex // serialises writers, as the transaction log does
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewPCG(rand.Uint64(), 0))
+		for pb.Next() {
+			key := "key" + strconv.Itoa(r.IntN(keys))
+			if r.Float64() < writeRatio {
+				mu.Lock()
+				db.Upsert(key, "value")
+				mu.Unlock()
+			} else {
+				db.Get(key)
+			}
+		}
+	})
+}
+
+func BenchmarkInMemoryDB_Mixed(b *testing.B) {
+	for _, shards := range []int{1, 32} {
+		for _, writeRatio := range []float64{0.1, 0.5} {
+			b.Run(fmt.Sprintf("shards=%d/writes=%.0f%%", shards, writeRatio*100), func(b *testing.B) {
+				benchmarkMixed(b, shards, writeRatio)
+			})
+		}
+	}
+}
+
+// BenchmarkInMemoryDB_WritesDuringSnapshots measures writes while another
+// goroutine takes snapshots of the whole store back to back.
+func BenchmarkInMemoryDB_WritesDuringSnapshots(b *testing.B) {
+	for _, shards := range []int{1, 32} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			db, _ := NewInMemoryDB(WithShards(shards))
+			for i := 0; i < 100000; i++ {
+				db.Upsert("key"+strconv.Itoa(i), "value")
+			}
+
+			stop := make(chan struct{})
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+						db.GetAll()
+					}
+				}
+			}()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				db.Upsert("key"+strconv.Itoa(i%100000), "value")
+			}
+			b.StopTimer()
+			close(stop)
+			wg.Wait()
+		})
+	}
+}
+
+// TestInMemoryDB_ForgetsDeletedKeys tests that deleting unique keys does
+// not grow the DB without bound when history has no maximum age.
+func TestInMemoryDB_ForgetsDeletedKeys(t *testing.T) {
+	db, err := NewInMemoryDB()
+	if err != nil {
+		t.Fatalf("Failed to create inMemoryDB: %v", err)
+	}
+
+	for i := 0; i < 3*deletedRetention; i++ {
+		key := fmt.Sprintf("k%d", i)
+		db.Upsert(key, "v")
+		db.Delete(key)
+	}
+
+	if _, err := db.History("k0"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("Expected the first deleted key to be forgotten, got %v", err)
+	}
+	if history, err := db.History(fmt.Sprintf("k%d", 3*deletedRetention-1)); err != nil || len(history) != 2 {
+		t.Errorf("Expected the history of a recently deleted key, got %v, %v", history, err)
+	}
+	if keys := db.(*inMemoryDB).keys.Load(); keys > deletedRetention/2+1 {
+		t.Errorf("Expected at most %d deleted keys to be kept, got %d", deletedRetention/2+1, keys)
+	}
+}
@@ -0,0 +1,443 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IndexDefinition declares a secondary index over the JSON values of the
+// keys with Prefix: the index maps the value found at Path in each value
+// to the keys holding it. Path is a dotted list of object fields, and of
+// array positions such as "items.0.name", with an optional leading "$.".
+// Strings are indexed as they are, and numbers, booleans and null as they
+// are written in JSON; objects, arrays, missing fields and values that are
+// not JSON are not indexed.
+//
+// Definitions are logged, so indexes are rebuilt on replay. Sequence is
+// the sequence number of the event that created the index.
+type IndexDefinition struct {
+	Name      string    `json:"name"`
+	Prefix    string    `json:"prefix"`
+	Path      string    `json:"path"`
+	Sequence  uint64    `json:"sequence,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// indexSpec is the Value of an EventCreateIndex.
+type indexSpec struct {
+	Prefix string `json:"prefix"`
+	Path   string `json:"path"`
+}
+
+// event returns the EventCreateIndex that creates def.
+func (def IndexDefinition) event() Event {
+	spec, _ := json.Marshal(indexSpec{Prefix: def.Prefix, Path: def.Path})
+	return Event{
+		Sequence:  def.Sequence,
+		EventType: EventCreateIndex,
+		Key:       def.Name,
+		Value:     string(spec),
+		Timestamp: def.CreatedAt,
+	}
+}
+
+// parseIndexPath splits an index path into its fields.
+func parseIndexPath(path string) ([]string, error) {
+	p := strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if p == "" {
+		return nil, fmt.Errorf("%w: index path must name a field", ErrorInvalidArgument)
+	}
+	fields := strings.Split(p, ".")
+	for _, f := range fields {
+		if f == "" {
+			return nil, fmt.Errorf("%w: index path %q has an empty field", ErrorInvalidArgument, path)
+		}
+	}
+	return fields, nil
+}
+
+// nextIndex returns the definition of the index named by e.Key after the
+// index event e, given the current one cur, which is nil if there is none.
+// The definition after an EventDropIndex is nil.
+func nextIndex(e Event, cur *IndexDefinition) (*IndexDefinition, error) {
+	switch e.EventType {
+	case EventCreateIndex:
+		if e.Key == "" {
+			return nil, fmt.Errorf("%w: index name must not be empty", ErrorInvalidArgument)
+		}
+		if cur != nil {
+			return nil, fmt.Errorf("%w: index %q already exists", ErrorConflict, e.Key)
+		}
+		var spec indexSpec
+		if err := json.Unmarshal([]byte(e.Value), &spec); err != nil {
+			return nil, fmt.Errorf("%w: invalid index definition: %v", ErrorInvalidArgument, err)
+		}
+		if _, err := parseIndexPath(spec.Path); err != nil {
+			return nil, err
+		}
+		return &IndexDefinition{
+			Name:      e.Key,
+			Prefix:    spec.Prefix,
+			Path:      spec.Path,
+			Sequence:  e.Sequence,
+			CreatedAt: e.Timestamp,
+		}, nil
+	case EventDropIndex:
+		if cur == nil {
+			return nil, fmt.Errorf("%w: no index %q", ErrorNoSuchKey, e.Key)
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("%w: cannot apply event type %v to an index", ErrorInvalidArgument, e.EventType)
+}
+
+// parseDocument returns the JSON document held by v, or nil if v is a
+// delete or does not hold JSON.
+func parseDocument(v Version) any {
+	if v.Deleted {
+		return nil
+	}
+	v, err := v.decoded()
+	if err != nil {
+		return nil
+	}
+	dec := json.NewDecoder(strings.NewReader(v.Value))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil
+	}
+	return doc
+}
+
+// lookupPath returns the indexed form of the value at path in doc, if it
+// is a scalar.
+func lookupPath(doc any, path []string) (string, bool) {
+	node := doc
+	for _, field := range path {
+		switch n := node.(type) {
+		case map[string]any:
+			node = n[field]
+			if node == nil {
+				if _, ok := n[field]; !ok {
+					return "", false
+				}
+			}
+		case []any:
+			i, err := strconv.Atoi(field)
+			if err != nil || i < 0 || i >= len(n) {
+				return "", false
+			}
+			node = n[i]
+		default:
+			return "", false
+		}
+	}
+
+	switch n := node.(type) {
+	case string:
+		return n, true
+	case json.Number:
+		return n.String(), true
+	case bool:
+		if n {
+			return "true", true
+		}
+		return "false", true
+	case nil:
+		return "null", true
+	}
+	return "", false
+}
+
+// secondaryIndex maps the indexed values of the keys under an index's
+// prefix to those keys.
+type secondaryIndex struct {
+	IndexDefinition
+	path   []string
+	keys   map[string]map[string]struct{} // keys by indexed value
+	values map[string]string              // indexed value by key
+}
+
+func newSecondaryIndex(def IndexDefinition) *secondaryIndex {
+	path, _ := parseIndexPath(def.Path) // checked by nextIndex
+	return &secondaryIndex{
+		IndexDefinition: def,
+		path:            path,
+		keys:            make(map[string]map[string]struct{}),
+		values:          make(map[string]string),
+	}
+}
+
+// set records that key has the indexed value, or none if ok is false.
+func (ix *secondaryIndex) set(key, value string, ok bool) {
+	if old, had := ix.values[key]; had {
+		if ok && old == value {
+			return
+		}
+		delete(ix.keys[old], key)
+		if len(ix.keys[old]) == 0 {
+			delete(ix.keys, old)
+		}
+		delete(ix.values, key)
+	}
+	if !ok {
+		return
+	}
+	if ix.keys[value] == nil {
+		ix.keys[value] = make(map[string]struct{})
+	}
+	ix.keys[value][key] = struct{}{}
+	ix.values[key] = value
+}
+
+// applyIndex creates the index name from the current values of its keys,
+// or drops it if def is nil. The caller must hold writeMu.
+func (db *inMemoryDB) applyIndex(name string, def *IndexDefinition) {
+	if def == nil {
+		db.indexMu.Lock()
+		delete(db.indexes, name)
+		db.indexMu.Unlock()
+		return
+	}
+
+	ix := newSecondaryIndex(*def)
+	for _, s := range db.shards {
+		for key, c := range s.store {
+			if strings.HasPrefix(key, def.Prefix) {
+				value, ok := lookupPath(parseDocument(c.current()), ix.path)
+				ix.set(key, value, ok)
+			}
+		}
+	}
+	db.indexMu.Lock()
+	db.indexes[name] = ix
+	db.indexMu.Unlock()
+}
+
+// reindex updates the indexes over key, whose current version is now v.
+// The caller must hold writeMu.
+func (db *inMemoryDB) reindex(key string, v Version) {
+	var doc any
+	parsed := false
+	for _, ix := range db.indexes {
+		if !strings.HasPrefix(key, ix.Prefix) {
+			continue
+		}
+		if !parsed {
+			doc, parsed = parseDocument(v), true
+		}
+		value, ok := lookupPath(doc, ix.path)
+		db.indexMu.Lock()
+		ix.set(key, value, ok)
+		db.indexMu.Unlock()
+	}
+}
+
+// Indexes returns the definitions of the secondary indexes, sorted by name.
+func (db *inMemoryDB) Indexes() ([]IndexDefinition, error) {
+	db.indexMu.RLock()
+	defs := make([]IndexDefinition, 0, len(db.indexes))
+	for _, ix := range db.indexes {
+		defs = append(defs, ix.IndexDefinition)
+	}
+	db.indexMu.RUnlock()
+
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Name < defs[j].Name })
+	return defs, nil
+}
+
+// IndexLookup returns the keys the index called name maps value to,
+// sorted.
+func (db *inMemoryDB) IndexLookup(name, value string) ([]string, error) {
+	db.indexMu.RLock()
+	ix, ok := db.indexes[name]
+	if !ok {
+		db.indexMu.RUnlock()
+		return nil, fmt.Errorf("%w: no index %q", ErrorNoSuchKey, name)
+	}
+	keys := make([]string, 0, len(ix.keys[value]))
+	for key := range ix.keys[value] {
+		keys = append(keys, key)
+	}
+	db.indexMu.RUnlock()
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// CreateIndex creates the secondary index def.Name, and returns its
+// definition. Creating an index that exists with the same prefix and path
+// does nothing; with another, it fails with ErrorConflict.
+func (s *Service) CreateIndex(c Caller, def IndexDefinition) (IndexDefinition, error) {
+	if s.readOnly {
+		return IndexDefinition{}, ErrorReadOnly
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cur, err := s.index(def.Name); err == nil && cur.Prefix == def.Prefix && cur.Path == def.Path {
+		return cur, nil
+	}
+
+	def.CreatedAt = time.Now().UTC()
+	e := def.event()
+	e.RequestID, e.Principal = c.RequestID, c.Principal
+	seq, err := s.logger.WriteEvents([]Event{e})
+	if err != nil {
+		return IndexDefinition{}, err
+	}
+	def.Sequence = seq
+	return def, nil
+}
+
+// DropIndex drops the secondary index called name.
+func (s *Service) DropIndex(c Caller, name string) error {
+	if s.readOnly {
+		return ErrorReadOnly
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.logger.WriteEvents([]Event{{
+		EventType: EventDropIndex,
+		Key:       name,
+		Timestamp: time.Now().UTC(),
+		RequestID: c.RequestID,
+		Principal: c.Principal,
+	}})
+	return err
+}
+
+// Indexes returns the definitions of the secondary indexes, sorted by
+// name.
+func (s *Service) Indexes() ([]IndexDefinition, error) {
+	if err := s.checkRead(); err != nil {
+		return nil, err
+	}
+	return s.db.Indexes()
+}
+
+func (s *Service) index(name string) (IndexDefinition, error) {
+	defs, err := s.db.Indexes()
+	if err != nil {
+		return IndexDefinition{}, err
+	}
+	for _, def := range defs {
+		if def.Name == name {
+			return def, nil
+		}
+	}
+	return IndexDefinition{}, fmt.Errorf("%w: no index %q", ErrorNoSuchKey, name)
+}
+
+// QueryIndex returns the current versions of the keys whose indexed value
+// in the index called name is value, sorted by key.
+func (s *Service) QueryIndex(name, value string) ([]Entry, error) {
+	if err := s.checkRead(); err != nil {
+		return nil, err
+	}
+	def, err := s.index(name)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := s.db.IndexLookup(name, value)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := s.db.LookupMany(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	// A key may have changed since the index was read.
+	path, _ := parseIndexPath(def.Path)
+	entries := make([]Entry, 0, len(keys))
+	for _, key := range keys {
+		v, ok := versions[key]
+		if !ok {
+			continue
+		}
+		if indexed, ok := lookupPath(parseDocument(v), path); ok && indexed == value {
+			entries = append(entries, Entry{Key: key, Version: v})
+		}
+	}
+	return entries, nil
+}
+
+// IndexQueryResponse is the reply to GET /v1/index/{name}.
+type IndexQueryResponse struct {
+	Records []Record `json:"records"`
+}
+
+// ListIndexesHandler responds with the IndexDefinitions of the secondary
+// indexes, sorted by name.
+func (h *Handler) ListIndexesHandler(w http.ResponseWriter, r *http.Request) {
+	defs, err := h.svc.Indexes()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(defs)
+}
+
+// CreateIndexHandler creates the secondary index {name} with the prefix
+// and path of the IndexDefinition in the request body, and responds with
+// the definition.
+func (h *Handler) CreateIndexHandler(w http.ResponseWriter, r *http.Request) {
+	var def IndexDefinition
+	if err := json.NewDecoder(r.Body).Decode(&def); err != nil {
+		writeError(w, r, fmt.Errorf("%w: invalid index definition: %v", ErrorInvalidArgument, err))
+		return
+	}
+	def.Name = routeVar(r, "name")
+
+	def, err := h.svc.CreateIndex(caller(r), def)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(def)
+}
+
+// DropIndexHandler drops the secondary index {name}.
+func (h *Handler) DropIndexHandler(w http.ResponseWriter, r *http.Request) {
+	if err := h.svc.DropIndex(caller(r), routeVar(r, "name")); err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
+
+// QueryIndexHandler responds with the Records of the keys whose value the
+// secondary index {name} maps to ?eq=.
+func (h *Handler) QueryIndexHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if !q.Has("eq") {
+		writeError(w, r, fmt.Errorf("%w: an index query needs ?eq=", ErrorInvalidArgument))
+		return
+	}
+
+	entries, err := h.svc.QueryIndex(routeVar(r, "name"), q.Get("eq"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	resp := IndexQueryResponse{Records: make([]Record, len(entries))}
+	for i, e := range entries {
+		resp.Records[i] = newRecord(e.Key, e.Version)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLookupPath(t *testing.T) {
+	doc := parseDocument(Version{Value: `{"status": "failed", "tries": 3, "ok": false, "owner": null,
+		"meta": {"items": [{"name": "a"}, {"name": 1.50}]}, "tags": ["x"]}`})
+
+	for path, want := range map[string]string{
+		"status":            "failed",
+		"$.tries":           "3",
+		"ok":                "false",
+		"owner":             "null",
+		"meta.items.0.name": "a",
+		"meta.items.1.name": "1.50",
+	} {
+		fields, err := parseIndexPath(path)
+		if err != nil {
+			t.Fatalf("parseIndexPath(%q) returned error: %v", path, err)
+		}
+		if got, ok := lookupPath(doc, fields); !ok || got != want {
+			t.Errorf("%s: expected %q, got %q, %v", path, want, got, ok)
+		}
+	}
+	for _, path := range []string{"tags", "meta", "missing", "meta.items.2.name", "status.x"} {
+		fields, _ := parseIndexPath(path)
+		if got, ok := lookupPath(doc, fields); ok {
+			t.Errorf("%s: expected nothing to be indexed, got %q", path, got)
+		}
+	}
+	for _, path := range []string{"", "$", "a..b"} {
+		if _, err := parseIndexPath(path); !errors.Is(err, ErrorInvalidArgument) {
+			t.Errorf("parseIndexPath(%q): expected ErrorInvalidArgument, got %v", path, err)
+		}
+	}
+}
+
+func TestInMemoryDB_Index(t *testing.T) {
+	db, _ := NewInMemoryDB()
+	db.Upsert("jobs/1", `{"status": "failed"}`)
+	db.Upsert("jobs/2", `{"status": "done"}`)
+	db.Upsert("other/1", `{"status": "failed"}`)
+
+	def := IndexDefinition{Name: "status", Prefix: "jobs/", Path: "status"}
+	if err := db.Apply(def.event()); err != nil {
+		t.Fatalf("Apply returned error: %v", err)
+	}
+	lookup := func(value string) []string {
+		t.Helper()
+		keys, err := db.IndexLookup("status", value)
+		if err != nil {
+			t.Fatalf("IndexLookup returned error: %v", err)
+		}
+		return keys
+	}
+	if keys := lookup("failed"); !reflect.DeepEqual(keys, []string{"jobs/1"}) {
+		t.Errorf("Expected the index to be built from existing keys, got %v", keys)
+	}
+
+	db.Upsert("jobs/3", `{"status": "failed"}`)
+	db.Upsert("jobs/1", `{"status": "done"}`)
+	db.Upsert("jobs/2", `not json`)
+	if keys := lookup("failed"); !reflect.DeepEqual(keys, []string{"jobs/3"}) {
+		t.Errorf("Expected jobs/3 to be failed, got %v", keys)
+	}
+	if keys := lookup("done"); !reflect.DeepEqual(keys, []string{"jobs/1"}) {
+		t.Errorf("Expected jobs/1 to be done, got %v", keys)
+	}
+	db.Delete("jobs/3")
+	if keys := lookup("failed"); len(keys) != 0 {
+		t.Errorf("Expected a deleted key to leave the index, got %v", keys)
+	}
+
+	if err := db.Apply(def.event()); !errors.Is(err, ErrorConflict) {
+		t.Errorf("Expected ErrorConflict creating the index again, got %v", err)
+	}
+	if err := db.Apply(Event{EventType: EventDropIndex, Key: "status"}); err != nil {
+		t.Fatalf("Apply returned error: %v", err)
+	}
+	if _, err := db.IndexLookup("status", "done"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("Expected ErrorNoSuchKey for a dropped index, got %v", err)
+	}
+}
+
+func TestFileTransactionLogger_IndexReplay(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "transaction.log")
+	db, _ := NewInMemoryDB()
+	logger, err := InitializeFileTransactionLogger(db, filename)
+	if err != nil {
+		t.Fatalf("InitializeFileTransactionLogger returned error: %v", err)
+	}
+	svc := NewService(db, logger)
+
+	logger.WritePut("jobs/1", `{"status": "failed"}`)
+	if _, err := svc.CreateIndex(Caller{}, IndexDefinition{Name: "status", Prefix: "jobs/", Path: "status"}); err != nil {
+		t.Fatalf("CreateIndex returned error: %v", err)
+	}
+	logger.WritePut("jobs/2", `{"status": "failed"}`)
+	fileLogger := logger.(*FileTransactionLogger)
+	close(fileLogger.events)
+	for writeErr := range fileLogger.errors {
+		t.Fatalf("Got an error from the transaction logger: %v", writeErr)
+	}
+
+	compacted := filepath.Join(t.TempDir(), "compacted.log")
+	if err := WriteCompactedLog(db, compacted); err != nil {
+		t.Fatalf("WriteCompactedLog returned error: %v", err)
+	}
+
+	for _, name := range []string{filename, compacted} {
+		replayed, _ := NewInMemoryDB()
+		if _, err := InitializeFileTransactionLogger(replayed, name); err != nil {
+			t.Fatalf("Replay returned error: %v", err)
+		}
+		defs, _ := replayed.Indexes()
+		if len(defs) != 1 || defs[0].Sequence != 2 || defs[0].Path != "status" {
+			t.Errorf("%s: expected the index definition to be replayed, got %+v", filepath.Base(name), defs)
+		}
+		keys, err := replayed.IndexLookup("status", "failed")
+		if err != nil || !reflect.DeepEqual(keys, []string{"jobs/1", "jobs/2"}) {
+			t.Errorf("%s: expected the index to be rebuilt, got %v, %v", filepath.Base(name), keys, err)
+		}
+	}
+}
+
+func TestHandler_Index(t *testing.T) {
+	router := newTestRouter(t)
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rr
+	}
+
+	rr := do("PUT", "/v1/index/by-status", `{"prefix": "jobs/", "path": "$.status"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 creating the index, got %d: %s", rr.Code, rr.Body)
+	}
+	var def IndexDefinition
+	json.NewDecoder(rr.Body).Decode(&def)
+	if def.Name != "by-status" || def.Sequence != 1 || time.Since(def.CreatedAt) > time.Minute {
+		t.Errorf("Unexpected index definition %+v", def)
+	}
+	if rr := do("PUT", "/v1/index/by-status", `{"prefix": "jobs/", "path": "$.status"}`); rr.Code != http.StatusOK {
+		t.Errorf("Expected creating the same index again to succeed, got %d", rr.Code)
+	}
+	if rr := do("PUT", "/v1/index/by-status", `{"prefix": "jobs/", "path": "state"}`); rr.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 redefining the index, got %d", rr.Code)
+	}
+	if rr := do("PUT", "/v1/index/bad", `{"path": ""}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an empty path, got %d", rr.Code)
+	}
+
+	do("PUT", "/v1/key/jobs%2F1", `{"status": "failed", "tries": 3}`)
+	do("PUT", "/v1/key/jobs%2F2", `{"status": "done"}`)
+	do("PUT", "/v1/key/jobs%2F3", `{"status": "failed"}`)
+
+	rr = do("GET", "/v1/index/by-status?eq=failed", "")
+	var resp IndexQueryResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("Expected an index query response, got %d, %v", rr.Code, err)
+	}
+	if len(resp.Records) != 2 || resp.Records[0].Key != "jobs/1" || resp.Records[1].Key != "jobs/3" {
+		t.Errorf("Expected jobs/1 and jobs/3, got %+v", resp.Records)
+	}
+
+	if rr := do("GET", "/v1/index/by-status", ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without eq, got %d", rr.Code)
+	}
+	if rr := do("GET", "/v1/index/missing?eq=x", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for an unknown index, got %d", rr.Code)
+	}
+	if rr := do("GET", "/v1/index", ""); !strings.Contains(rr.Body.String(), `"name":"by-status"`) {
+		t.Errorf("Expected the index to be listed, got %s", rr.Body)
+	}
+	if rr := do("DELETE", "/v1/index/by-status", ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected status 200 dropping the index, got %d", rr.Code)
+	}
+	if rr := do("DELETE", "/v1/index/by-status", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 dropping it again, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,211 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Lease is a named lock held by an owner until it expires or is released.
+// Keys attached to a lease by a put vanish when it ends.
+//
+// Token is the fencing token of the lease: the sequence number of the
+// event that acquired it. It stays the same while the owner renews the
+// lease, and is larger for every later holder, so a resource guarded by
+// the lease can refuse writes carrying an older token.
+type Lease struct {
+	Name       string    `json:"name"`
+	Owner      string    `json:"owner"`
+	Token      uint64    `json:"token"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// heldAt reports whether l is held at t.
+func (l Lease) heldAt(t time.Time) bool {
+	return l.Token != 0 && t.Before(l.ExpiresAt)
+}
+
+// leaseState is a lease and the keys attached to it since it was acquired.
+type leaseState struct {
+	Lease
+	keys map[string]struct{}
+}
+
+// nextLease returns the lease named by e.Key after the lease event e,
+// given the current lease cur, which is zero if there is none. Like
+// nextVersion, it judges whether the lease is held at the time of the
+// event. A released lease is returned with its ExpiresAt set to the time
+// of the release.
+func nextLease(e Event, cur Lease) (Lease, error) {
+	held := cur.heldAt(e.Timestamp)
+	if held && cur.Owner != e.Value {
+		return cur, fmt.Errorf("%w: lock %q is held by another owner", ErrorConflict, e.Key)
+	}
+
+	switch e.EventType {
+	case EventAcquire:
+		if !held {
+			cur = Lease{Name: e.Key, Owner: e.Value, Token: e.Sequence, AcquiredAt: e.Timestamp}
+		}
+		cur.ExpiresAt = e.ExpiresAt
+	case EventRenew, EventRelease:
+		if !held {
+			return cur, fmt.Errorf("%w: lock %q is not held", ErrorNoSuchKey, e.Key)
+		}
+		cur.ExpiresAt = e.ExpiresAt
+		if e.EventType == EventRelease {
+			cur.ExpiresAt = e.Timestamp
+		}
+	default:
+		return cur, fmt.Errorf("%w: cannot apply event type %v to a lease", ErrorInvalidArgument, e.EventType)
+	}
+
+	if !cur.ExpiresAt.After(e.Timestamp) && e.EventType != EventRelease {
+		return cur, fmt.Errorf("%w: lease of %q must expire after it is taken", ErrorInvalidArgument, e.Key)
+	}
+	return cur, nil
+}
+
+// Acquire takes the lease called name for owner until ttl from now, or
+// extends it if owner already holds it. It fails with ErrorConflict if
+// another owner holds it.
+func (s *Service) Acquire(c Caller, name, owner string, ttl time.Duration) (Lease, error) {
+	return s.writeLease(c, EventAcquire, name, owner, ttl)
+}
+
+// Renew extends the lease called name, held by owner, until ttl from now.
+// It fails with ErrorNoSuchKey if the lease is not held, and ErrorConflict
+// if another owner holds it.
+func (s *Service) Renew(c Caller, name, owner string, ttl time.Duration) (Lease, error) {
+	return s.writeLease(c, EventRenew, name, owner, ttl)
+}
+
+// Release ends the lease called name, held by owner, and with it the keys
+// attached to it. It fails like Renew.
+func (s *Service) Release(c Caller, name, owner string) error {
+	_, err := s.writeLease(c, EventRelease, name, owner, 0)
+	return err
+}
+
+// Lease returns the lease called name, if it is held.
+func (s *Service) Lease(name string) (Lease, error) {
+	if err := s.checkRead(); err != nil {
+		return Lease{}, err
+	}
+	return s.db.LookupLease(name)
+}
+
+func (s *Service) writeLease(c Caller, t EventType, name, owner string, ttl time.Duration) (Lease, error) {
+	switch {
+	case s.readOnly:
+		return Lease{}, ErrorReadOnly
+	case name == "":
+		return Lease{}, fmt.Errorf("%w: lock name must not be empty", ErrorInvalidArgument)
+	case owner == "":
+		return Lease{}, fmt.Errorf("%w: owner must not be empty", ErrorInvalidArgument)
+	case t != EventRelease && ttl <= 0:
+		return Lease{}, fmt.Errorf("%w: ttl must be positive", ErrorInvalidArgument)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, _ := s.db.LookupLease(name)
+
+	now := time.Now().UTC()
+	e := Event{
+		EventType: t,
+		Key:       name,
+		Value:     owner,
+		Timestamp: now,
+		RequestID: c.RequestID,
+		Principal: c.Principal,
+	}
+	if t != EventRelease {
+		e.ExpiresAt = now.Add(ttl)
+	}
+	events := []Event{e}
+	if _, err := s.logger.WriteEvents(events); err != nil {
+		return Lease{}, err
+	}
+	if t == EventRelease {
+		return Lease{}, nil
+	}
+
+	token, err := strconv.ParseUint(events[0].Result, 10, 64)
+	if err != nil {
+		return Lease{}, err
+	}
+	l := Lease{Name: name, Owner: owner, Token: token, AcquiredAt: now, ExpiresAt: e.ExpiresAt}
+	if prev.Token == token {
+		l.AcquiredAt = prev.AcquiredAt
+	}
+	return l, nil
+}
+
+// LockRequest is the body of a request to acquire or renew a lock. TTL is
+// a duration such as "30s".
+type LockRequest struct {
+	Owner string `json:"owner"`
+	TTL   string `json:"ttl"`
+}
+
+// AcquireLockHandler takes the lock {name} for the owner in the request,
+// or extends it if the owner already holds it, and responds with the
+// Lease. A lock held by another owner is a conflict.
+func (h *Handler) AcquireLockHandler(w http.ResponseWriter, r *http.Request) {
+	h.lockHandler(w, r, h.svc.Acquire)
+}
+
+// RenewLockHandler extends the lock {name} held by the owner in the
+// request, and responds with the Lease.
+func (h *Handler) RenewLockHandler(w http.ResponseWriter, r *http.Request) {
+	h.lockHandler(w, r, h.svc.Renew)
+}
+
+func (h *Handler) lockHandler(w http.ResponseWriter, r *http.Request,
+	write func(c Caller, name, owner string, ttl time.Duration) (Lease, error)) {
+	var req LockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, fmt.Errorf("%w: invalid lock request: %v", ErrorInvalidArgument, err))
+		return
+	}
+	ttl, err := time.ParseDuration(req.TTL)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("%w: invalid ttl: %v", ErrorInvalidArgument, err))
+		return
+	}
+
+	l, err := write(caller(r), routeVar(r, "name"), req.Owner, ttl)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l)
+}
+
+// ReleaseLockHandler releases the lock {name} held by ?owner=.
+func (h *Handler) ReleaseLockHandler(w http.ResponseWriter, r *http.Request) {
+	err := h.svc.Release(caller(r), routeVar(r, "name"), r.URL.Query().Get("owner"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
+
+// GetLockHandler responds with the Lease of the lock {name}, if it is held.
+func (h *Handler) GetLockHandler(w http.ResponseWriter, r *http.Request) {
+	l, err := h.svc.Lease(routeVar(r, "name"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l)
+}
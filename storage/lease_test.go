@@ -0,0 +1,249 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInMemoryDB_Leases(t *testing.T) {
+	db, err := NewInMemoryDB()
+	if err != nil {
+		t.Fatalf("Failed to create inMemoryDB: %v", err)
+	}
+	now := time.Now().UTC()
+	apply := db.Apply
+
+	acquire := Event{EventType: EventAcquire, Key: "job", Value: "a", Timestamp: now.Add(-30 * time.Second), ExpiresAt: now.Add(time.Minute)}
+	if err := apply(acquire); err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+	l, err := db.LookupLease("job")
+	if err != nil || l.Owner != "a" || l.Token != 1 {
+		t.Fatalf("Expected job held by a with token 1, got %+v, %v", l, err)
+	}
+
+	err = apply(Event{EventType: EventAcquire, Key: "job", Value: "b", Timestamp: now.Add(-25 * time.Second), ExpiresAt: now.Add(time.Minute)})
+	if !errors.Is(err, ErrorConflict) {
+		t.Errorf("Expected ErrorConflict for a lock held by another owner, got %v", err)
+	}
+	err = apply(Event{EventType: EventPut, Key: "k", Value: "v", Lease: "other", Timestamp: now.Add(-20 * time.Second)})
+	if !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("Expected ErrorNoSuchKey attaching a key to a lock that is not held, got %v", err)
+	}
+
+	// An attached key follows the lease through renewals and its release.
+	if err := apply(Event{EventType: EventPut, Key: "k", Value: "v", Lease: "job", Timestamp: now.Add(-20 * time.Second)}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := apply(Event{EventType: EventRenew, Key: "job", Value: "a", Timestamp: now.Add(-10 * time.Second), ExpiresAt: now.Add(time.Hour)}); err != nil {
+		t.Fatalf("Renew failed: %v", err)
+	}
+	if v, err := db.Lookup("k"); err != nil || !v.ExpiresAt.Equal(now.Add(time.Hour)) || v.Lease != "job" {
+		t.Errorf("Expected k to expire with the renewed lease, got %+v, %v", v, err)
+	}
+	if l, _ := db.LookupLease("job"); l.Token != 1 {
+		t.Errorf("Expected a renewal to keep token 1, got %d", l.Token)
+	}
+
+	if err := apply(Event{EventType: EventRelease, Key: "job", Value: "b", Timestamp: now.Add(-5 * time.Second)}); !errors.Is(err, ErrorConflict) {
+		t.Errorf("Expected ErrorConflict releasing another owner's lock, got %v", err)
+	}
+	if err := apply(Event{EventType: EventRelease, Key: "job", Value: "a", Timestamp: now.Add(-5 * time.Second)}); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if _, err := db.Lookup("k"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("Expected k to vanish with its lease, got %v", err)
+	}
+	if v, err := db.GetAtTime("k", now.Add(-7*time.Second)); err != nil || *v != "v" {
+		t.Errorf("Expected k before the release, got %v, %v", v, err)
+	}
+
+	// The next holder gets a larger token, and keys attached before are
+	// not revived.
+	if err := apply(Event{EventType: EventAcquire, Key: "job", Value: "b", Timestamp: now.Add(-4 * time.Second), ExpiresAt: now.Add(time.Hour)}); err != nil {
+		t.Fatalf("Acquire by b failed: %v", err)
+	}
+	if l, _ := db.LookupLease("job"); l.Owner != "b" || l.Token <= 1 {
+		t.Errorf("Expected job held by b with a larger token, got %+v", l)
+	}
+	if _, err := db.Lookup("k"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("Expected k to stay gone, got %v", err)
+	}
+
+	// A lease that expires is free for anyone.
+	expired := Event{EventType: EventAcquire, Key: "old", Value: "a", Timestamp: now.Add(-2 * time.Minute), ExpiresAt: now.Add(-time.Minute)}
+	if err := apply(expired); err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+	if _, err := db.LookupLease("old"); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("Expected an expired lease not to be held, got %v", err)
+	}
+	if err := apply(Event{EventType: EventRenew, Key: "old", Value: "a", Timestamp: now, ExpiresAt: now.Add(time.Hour)}); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("Expected renewing an expired lease to fail, got %v", err)
+	}
+	if err := apply(Event{EventType: EventAcquire, Key: "old", Value: "b", Timestamp: now, ExpiresAt: now.Add(time.Hour)}); err != nil {
+		t.Errorf("Expected an expired lease to be free, got %v", err)
+	}
+}
+
+func TestHandler_Locks(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "transaction.log")
+	db, err := NewInMemoryDB()
+	if err != nil {
+		t.Fatalf("Failed to create inMemoryDB: %v", err)
+	}
+	logger, err := InitializeFileTransactionLogger(db, filename)
+	if err != nil {
+		t.Fatalf("InitializeFileTransactionLogger returned an error: %v", err)
+	}
+	handler, _ := NewHandler(db, logger)
+	router := NewRouter(&handler)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rr
+	}
+
+	do("PUT", "/v1/key/other", "x")
+	rr := do("POST", "/v1/lock/cron", `{"owner": "worker-1", "ttl": "1h"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body)
+	}
+	var l Lease
+	if err := json.Unmarshal(rr.Body.Bytes(), &l); err != nil || l.Owner != "worker-1" || l.Token != 2 {
+		t.Fatalf("Expected worker-1 to hold the lock with token 2, got %s", rr.Body)
+	}
+	token := l.Token
+
+	for _, tt := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{"POST", "/v1/lock/cron", `{"owner": "worker-2", "ttl": "1h"}`, http.StatusConflict},
+		{"POST", "/v1/lock/cron", `{"owner": "worker-2", "ttl": "soon"}`, http.StatusBadRequest},
+		{"POST", "/v1/lock/cron/renew", `{"owner": "worker-1", "ttl": "2h"}`, http.StatusOK},
+		{"POST", "/v1/lock/idle/renew", `{"owner": "worker-1", "ttl": "2h"}`, http.StatusNotFound},
+		{"PUT", "/v1/key/cron%2Fstate?lease=cron&token=" + strconv.FormatUint(token, 10), "running", http.StatusOK},
+		{"PUT", "/v1/key/cron%2Fstate?lease=cron&token=" + strconv.FormatUint(token-1, 10), "stale", http.StatusConflict},
+		{"DELETE", "/v1/lock/cron?owner=worker-2", "", http.StatusConflict},
+		{"GET", "/v1/lock/idle", "", http.StatusNotFound},
+	} {
+		if rr := do(tt.method, tt.path, tt.body); rr.Code != tt.code {
+			t.Errorf("%s %s: expected status %d, got %d: %s", tt.method, tt.path, tt.code, rr.Code, rr.Body)
+		}
+	}
+
+	rr = do("GET", "/v1/lock/cron", "")
+	if err := json.Unmarshal(rr.Body.Bytes(), &l); err != nil || l.Token != token {
+		t.Errorf("Expected the renewed lock to keep token %d, got %s", token, rr.Body)
+	}
+
+	// The lease and its key survive a restart.
+	fileLogger := logger.(*FileTransactionLogger)
+	close(fileLogger.events)
+	for writeErr := range fileLogger.errors {
+		t.Fatalf("Got an error from the transaction logger: %v", writeErr)
+	}
+	replayed, _ := NewInMemoryDB()
+	logger, err = InitializeFileTransactionLogger(replayed, filename)
+	if err != nil {
+		t.Fatalf("Replay returned an error: %v", err)
+	}
+	if l, err := replayed.LookupLease("cron"); err != nil || l.Token != token || l.Owner != "worker-1" {
+		t.Errorf("Expected the lease to be replayed with token %d, got %+v, %v", token, l, err)
+	}
+	if v, err := replayed.Get("cron/state"); err != nil || *v != "running" {
+		t.Errorf("Expected the attached key to be replayed, got %v, %v", v, err)
+	}
+
+	// Releasing the lock removes its key.
+	handler, _ = NewHandler(replayed, logger)
+	router = NewRouter(&handler)
+	if rr := do("DELETE", "/v1/lock/cron?owner=worker-1", ""); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 releasing the lock, got %d: %s", rr.Code, rr.Body)
+	}
+	if rr := do("GET", "/v1/key/cron%2Fstate", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected the attached key to vanish, got status %d", rr.Code)
+	}
+}
+
+func TestWriteCompactedLog_KeepsLeases(t *testing.T) {
+	db, _ := NewInMemoryDB()
+	now := time.Now().UTC()
+	events := []Event{
+		{EventType: EventPut, Key: "plain", Value: "1", Timestamp: now},
+		{EventType: EventAcquire, Key: "job", Value: "a", Timestamp: now, ExpiresAt: now.Add(time.Minute)},
+		{EventType: EventPut, Key: "k", Value: "v", Lease: "job", Timestamp: now},
+		{EventType: EventRenew, Key: "job", Value: "a", Timestamp: now, ExpiresAt: now.Add(time.Hour)},
+	}
+	for _, e := range events {
+		if err := db.Apply(e); err != nil {
+			t.Fatalf("Apply returned error: %v", err)
+		}
+	}
+
+	filename := filepath.Join(t.TempDir(), "compacted.log")
+	if err := WriteCompactedLog(db, filename); err != nil {
+		t.Fatalf("WriteCompactedLog returned error: %v", err)
+	}
+
+	restored, _ := NewInMemoryDB()
+	if _, err := InitializeFileTransactionLogger(restored, filename); err != nil {
+		t.Fatalf("Replay returned an error: %v", err)
+	}
+	if l, err := restored.LookupLease("job"); err != nil || l.Token != 2 || !l.ExpiresAt.Equal(now.Add(time.Hour)) {
+		t.Errorf("Expected the lease with token 2 and its renewed expiry, got %+v, %v", l, err)
+	}
+	if v, err := restored.Lookup("k"); err != nil || v.Lease != "job" || !v.ExpiresAt.Equal(now.Add(time.Hour)) {
+		t.Errorf("Expected k attached to job, got %+v, %v", v, err)
+	}
+}
+
+func TestCompactTransactionLog_KeepsTokensIncreasing(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "transaction.log")
+
+	db, _ := NewInMemoryDB()
+	logger, err := InitializeFileTransactionLogger(db, filename)
+	if err != nil {
+		t.Fatalf("InitializeFileTransactionLogger returned error: %v", err)
+	}
+	now := time.Now().UTC()
+	old, err := logger.WriteEvent(Event{EventType: EventAcquire, Key: "job", Value: "a", Timestamp: now, ExpiresAt: now.Add(time.Minute)})
+	if err != nil {
+		t.Fatalf("Acquire returned error: %v", err)
+	}
+	if _, err := logger.WriteEvent(Event{EventType: EventRelease, Key: "job", Value: "a", Timestamp: now}); err != nil {
+		t.Fatalf("Release returned error: %v", err)
+	}
+	fileLogger := logger.(*FileTransactionLogger)
+	close(fileLogger.events)
+	for writeErr := range fileLogger.errors {
+		t.Fatalf("Got an error from the transaction logger: %v", writeErr)
+	}
+
+	// The released lease leaves nothing to keep in the compacted log.
+	if err := CompactTransactionLog(filename, filename); err != nil {
+		t.Fatalf("CompactTransactionLog returned error: %v", err)
+	}
+
+	reopened, _ := NewInMemoryDB()
+	logger, err = InitializeFileTransactionLogger(reopened, filename)
+	if err != nil {
+		t.Fatalf("Replay returned error: %v", err)
+	}
+	token, err := logger.WriteEvent(Event{EventType: EventAcquire, Key: "job", Value: "b", Timestamp: now, ExpiresAt: now.Add(time.Minute)})
+	if err != nil {
+		t.Fatalf("Acquire returned error: %v", err)
+	}
+	if token <= old {
+		t.Errorf("Expected a token greater than %d after compaction, got %d", old, token)
+	}
+}
@@ -0,0 +1,324 @@
+package storage
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A transaction log record is one line of tab-separated fields:
+//
+//	<sequence> <eventType> <key> <value> <timestamp> <requestID> <principal>
+//
+// Text fields are escaped so they cannot contain tabs or newlines, and the
+// timestamp is RFC 3339 in UTC, or empty if unknown. Logs written before
+// the metadata columns existed have only the first four fields, unescaped;
+// they are still accepted.
+//
+// Optional fields follow the principal, and are only written when set:
+//
+//	<expiresAt> <flags> <lease> <encoding> <result>
+//
+// expiresAt is when a put or lease stops being visible, in the same form
+// as the timestamp, flags is the decimal Flags of a put, and lease the
+// escaped name of the lease a put attaches its key to. encoding is set in
+// logs written WithLogCompression if the value is compressed: it is gzip
+// or zstd, and the value field holds the base64 of the compressed value.
+// result is the escaped Result of an update, the value it gave its key,
+// so that readers of the log need not replay it; it is never compressed.
+// An optional field that is not set is written empty if a later one is
+// set.
+//
+// Events written together by WriteEvents share one batch record, so that
+// a torn write cannot leave part of a batch in the log. Its type is
+// batchRecordType, its key the number of events, and its value the
+// records of the events, escaped; its sequence number is that of the
+// first event.
+//
+// A log written WithEncryption holds encrypted records instead:
+//
+//	!<keyID> <data>
+//
+// separated by a tab, where data is the base64 of the AES-GCM encryption
+// of the record, without its newline, with the key ID as additional data.
+// Plain records, written before encryption was enabled, may precede them.
+const (
+	legacyRecordFields = 4
+	recordFields       = 7
+	maxRecordFields    = 12
+
+	batchRecordType = 255
+
+	encryptedRecordPrefix = "!"
+)
+
+var (
+	fieldEscaper   = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+	fieldUnescaper = strings.NewReplacer(`\\`, `\`, `\t`, "\t", `\n`, "\n", `\r`, "\r")
+)
+
+// LogOption configures how a transaction log file is read and written.
+type LogOption func(*logCodec)
+
+// WithEncryption encrypts each record written to the log with the current
+// key of keys, and decrypts records with the key they name.
+func WithEncryption(keys KeyProvider) LogOption {
+	return func(c *logCodec) {
+		c.keys = keys
+	}
+}
+
+// WithLogCompression compresses the values c compresses in each record
+// written to the log. Compressed values are read back whatever the options.
+func WithLogCompression(c *Compressor) LogOption {
+	return func(lc *logCodec) {
+		lc.compressor = c
+	}
+}
+
+// logCodec encodes and decodes the records of a log file, compressing
+// their values if it has a compressor and encrypting them if it has keys.
+type logCodec struct {
+	keys       KeyProvider
+	compressor *Compressor
+}
+
+func newLogCodec(opts []LogOption) logCodec {
+	var c logCodec
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// encode is formatRecord, compressed and encrypted as configured.
+func (c logCodec) encode(events []Event) (string, error) {
+	if c.compressor != nil {
+		events = append([]Event(nil), events...)
+		for i := range events {
+			e := &events[i]
+			e.Value, e.encoding = c.compressor.compress(e.Value, compressedInLog)
+		}
+	}
+
+	record := formatRecord(events)
+	if c.keys == nil {
+		return record, nil
+	}
+
+	id, key, err := c.keys.CurrentKey()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := seal(key, []byte(strings.TrimSuffix(record, "\n")), []byte(id))
+	if err != nil {
+		return "", fmt.Errorf("cannot encrypt record: %w", err)
+	}
+	return encryptedRecordPrefix + id + "\t" + base64.StdEncoding.EncodeToString(sealed) + "\n", nil
+}
+
+// decode is parseRecord for a record that may be encrypted.
+func (c logCodec) decode(line string) ([]Event, error) {
+	if !strings.HasPrefix(line, encryptedRecordPrefix) {
+		return parseRecord(line)
+	}
+	if c.keys == nil {
+		return nil, errors.New("record is encrypted, and no key file was given")
+	}
+
+	id, data, ok := strings.Cut(line[len(encryptedRecordPrefix):], "\t")
+	if !ok {
+		return nil, errors.New("encrypted record has no key ID")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encrypted record: %w", err)
+	}
+	key, err := c.keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := unseal(key, sealed, []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt record with key %q: %w", id, err)
+	}
+	return parseRecord(string(plain))
+}
+
+// formatEvent encodes e as a log record, including the trailing newline.
+func formatEvent(e Event) string {
+	var ts string
+	if !e.Timestamp.IsZero() {
+		ts = e.Timestamp.UTC().Format(time.RFC3339Nano)
+	}
+
+	value := fieldEscaper.Replace(e.Value)
+	var optional string
+	if e.EventType.isUpdate() && e.Result != "" {
+		optional = "\t" + fieldEscaper.Replace(e.Result)
+	}
+	if e.encoding != "" || optional != "" {
+		var encoding string
+		if e.encoding != "" {
+			value = base64.StdEncoding.EncodeToString([]byte(e.Value))
+			encoding = e.encoding
+		}
+		optional = "\t" + encoding + optional
+	}
+	if e.Lease != "" || optional != "" {
+		optional = "\t" + fieldEscaper.Replace(e.Lease) + optional
+	}
+	if e.Flags != 0 || optional != "" {
+		var flags string
+		if e.Flags != 0 {
+			flags = strconv.FormatUint(uint64(e.Flags), 10)
+		}
+		optional = "\t" + flags + optional
+	}
+	if !e.ExpiresAt.IsZero() || optional != "" {
+		var expiresAt string
+		if !e.ExpiresAt.IsZero() {
+			expiresAt = e.ExpiresAt.UTC().Format(time.RFC3339Nano)
+		}
+		optional = "\t" + expiresAt + optional
+	}
+
+	return fmt.Sprintf("%d\t%d\t%s\t%s\t%s\t%s\t%s%s\n",
+		e.Sequence, e.EventType,
+		fieldEscaper.Replace(e.Key), value,
+		ts, fieldEscaper.Replace(e.RequestID), fieldEscaper.Replace(e.Principal),
+		optional)
+}
+
+// formatRecord encodes events as a log record: a plain record for a single
+// event, and a batch record otherwise.
+func formatRecord(events []Event) string {
+	if len(events) == 1 {
+		return formatEvent(events[0])
+	}
+
+	var inner strings.Builder
+	for _, e := range events {
+		inner.WriteString(formatEvent(e))
+	}
+
+	first := events[0]
+	return formatEvent(Event{
+		Sequence:  first.Sequence,
+		EventType: batchRecordType,
+		Key:       strconv.Itoa(len(events)),
+		Value:     inner.String(),
+		Timestamp: first.Timestamp,
+		RequestID: first.RequestID,
+		Principal: first.Principal,
+	})
+}
+
+// parseRecord decodes a log record without its trailing newline into the
+// events it holds.
+func parseRecord(line string) ([]Event, error) {
+	e, err := parseEvent(line)
+	if err != nil {
+		return nil, err
+	}
+	if e.EventType != batchRecordType {
+		return []Event{e}, nil
+	}
+
+	n, err := strconv.Atoi(e.Key)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid batch size %q", e.Key)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(e.Value, "\n"), "\n")
+	if len(lines) != n {
+		return nil, fmt.Errorf("batch of %d events holds %d records", n, len(lines))
+	}
+
+	events := make([]Event, n)
+	for i, l := range lines {
+		if events[i], err = parseEvent(l); err != nil {
+			return nil, fmt.Errorf("batch record %d: %w", i+1, err)
+		}
+		if events[i].EventType == batchRecordType {
+			return nil, fmt.Errorf("batch record %d: nested batch", i+1)
+		}
+	}
+	if events[0].Sequence != e.Sequence {
+		return nil, fmt.Errorf("batch starts at sequence %d, not %d", events[0].Sequence, e.Sequence)
+	}
+	return events, nil
+}
+
+// parseEvent decodes a single log record without its trailing newline.
+func parseEvent(line string) (Event, error) {
+	var e Event
+
+	fields := strings.Split(line, "\t")
+	if len(fields) != legacyRecordFields && (len(fields) < recordFields || len(fields) > maxRecordFields) {
+		return e, fmt.Errorf("expected %d fields, got %d", recordFields, len(fields))
+	}
+
+	seq, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return e, fmt.Errorf("invalid sequence: %w", err)
+	}
+
+	eventType, err := strconv.ParseUint(fields[1], 10, 8)
+	if err != nil {
+		return e, fmt.Errorf("invalid event type: %w", err)
+	}
+
+	e.Sequence = seq
+	e.EventType = EventType(eventType)
+
+	if len(fields) == legacyRecordFields {
+		e.Key = fields[2]
+		e.Value = fields[3]
+		return e, nil
+	}
+
+	e.Key = fieldUnescaper.Replace(fields[2])
+	e.Value = fieldUnescaper.Replace(fields[3])
+
+	if fields[4] != "" {
+		if e.Timestamp, err = time.Parse(time.RFC3339Nano, fields[4]); err != nil {
+			return e, fmt.Errorf("invalid timestamp: %w", err)
+		}
+	}
+
+	e.RequestID = fieldUnescaper.Replace(fields[5])
+	e.Principal = fieldUnescaper.Replace(fields[6])
+
+	if len(fields) > 7 && fields[7] != "" {
+		if e.ExpiresAt, err = time.Parse(time.RFC3339Nano, fields[7]); err != nil {
+			return e, fmt.Errorf("invalid expiry: %w", err)
+		}
+	}
+	if len(fields) > 8 && fields[8] != "" {
+		flags, err := strconv.ParseUint(fields[8], 10, 32)
+		if err != nil {
+			return e, fmt.Errorf("invalid flags: %w", err)
+		}
+		e.Flags = uint32(flags)
+	}
+	if len(fields) > 9 {
+		e.Lease = fieldUnescaper.Replace(fields[9])
+	}
+	if len(fields) > 10 && fields[10] != "" {
+		compressed, err := base64.StdEncoding.DecodeString(fields[3])
+		if err != nil {
+			return e, fmt.Errorf("invalid compressed value: %w", err)
+		}
+		if e.Value, err = decompress(string(compressed), fields[10]); err != nil {
+			return e, err
+		}
+	}
+	if len(fields) > 11 {
+		e.Result = fieldUnescaper.Replace(fields[11])
+	}
+	return e, nil
+}
@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+)
+
+// defaultIndexInterval is how many records the file logger writes between
+// entries of its offset index.
+const defaultIndexInterval = 1024
+
+type indexEntry struct {
+	sequence uint64
+	offset   int64
+}
+
+// offsetIndex is a sparse, in-memory index from sequence numbers to byte
+// offsets in a transaction log. It records the offset of roughly every
+// interval-th record, so a reader can seek to within interval records of
+// any sequence instead of scanning from the start of the file.
+type offsetIndex struct {
+	mu       sync.RWMutex
+	entries  []indexEntry
+	interval uint64
+}
+
+func newOffsetIndex(interval uint64) *offsetIndex {
+	if interval == 0 {
+		interval = defaultIndexInterval
+	}
+	return &offsetIndex{interval: interval}
+}
+
+// add records the offset of the record with the given sequence if at least
+// interval records have been written since the last entry. Sequences must
+// be added in ascending order.
+func (ix *offsetIndex) add(sequence uint64, offset int64) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	if n := len(ix.entries); n > 0 && sequence < ix.entries[n-1].sequence+ix.interval {
+		return
+	}
+	ix.entries = append(ix.entries, indexEntry{sequence: sequence, offset: offset})
+}
+
+// seek returns the offset of the last indexed record whose sequence is at
+// most sequence, or 0 if there is none.
+func (ix *offsetIndex) seek(sequence uint64) int64 {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	i := sort.Search(len(ix.entries), func(i int) bool {
+		return ix.entries[i].sequence > sequence
+	})
+	if i == 0 {
+		return 0
+	}
+	return ix.entries[i-1].offset
+}
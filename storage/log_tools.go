@@ -0,0 +1,463 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// LogRecord is an event of a transaction log file and where it was found.
+// The events of a batch record share its line.
+type LogRecord struct {
+	Event  Event
+	Value  string // value of the key after the event; empty for a delete or lease event
+	Line   int    // 1-based line number
+	Offset int64  // byte offset of the start of the line
+}
+
+// LogError describes a record that cannot be parsed or is out of sequence.
+type LogError struct {
+	Line   int
+	Offset int64
+	Text   string
+	Err    error
+}
+
+func (e *LogError) Error() string {
+	return fmt.Sprintf("line %d (offset %d): %v", e.Line, e.Offset, e.Err)
+}
+
+func (e *LogError) Unwrap() error { return e.Err }
+
+// ScanTransactionLog reads the transaction log in filename without opening
+// it for writing, and calls fn for every record in order. It stops at the
+// first record that would stop the log from being replayed, returning a
+// *LogError, or at the first error from fn.
+func ScanTransactionLog(filename string, fn func(LogRecord) error, opts ...LogOption) error {
+	return scanLog(filename, newLogCodec(opts), func(rec LogRecord, problem *LogError) error {
+		if problem != nil {
+			return problem
+		}
+		return fn(rec)
+	})
+}
+
+// scanLog reads every line of the log in filename and calls fn with each
+// record, or with the problem that would stop it from being replayed. A
+// line is checked against the good records before it, so a record that is
+// only bad because of an earlier bad one is reported too.
+func scanLog(filename string, codec logCodec, fn func(LogRecord, *LogError) error) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("cannot open transaction log file: %w", err)
+	}
+	defer file.Close()
+
+	r := bufio.NewReaderSize(file, 64*1024)
+	// The good records are replayed, so that each is checked exactly as
+	// the server would apply it.
+	state, err := NewInMemoryDB(WithHistoryRetention(1, 0))
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	var last uint64
+	line := 0
+
+	for {
+		raw, err := readRawLine(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("transaction log read failure after line %d: %w", line, err)
+		}
+
+		line++
+		start := offset
+		offset += raw.size
+
+		events, problem := checkRecord(raw, codec, last, state)
+		if problem != nil {
+			err = fn(LogRecord{Line: line, Offset: start},
+				&LogError{Line: line, Offset: start, Text: raw.text, Err: problem})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		for _, e := range events {
+			last = e.Sequence
+			var value string
+			switch e.EventType {
+			case EventPut:
+				value = e.Value
+			case EventIncrement, EventAppend, EventMergePatch, EventJSONPatch:
+				value = e.Result
+			}
+			if err = fn(LogRecord{Event: e, Value: value, Line: line, Offset: start}, nil); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// checkRecord parses raw and reports why replaying its events after the
+// event with sequence last would fail. Otherwise it applies them to state,
+// a DB holding the good records before raw, and returns them. The events
+// of a batch record are checked together, as they are replayed.
+func checkRecord(raw rawLine, codec logCodec, last uint64, state DB) ([]Event, error) {
+	switch {
+	case raw.tooLong:
+		return nil, fmt.Errorf("record longer than %d bytes", maxLogLineSize)
+	case !raw.complete:
+		return nil, fmt.Errorf("incomplete final record")
+	}
+
+	events, err := codec.decode(raw.text)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range events {
+		if !e.EventType.valid() {
+			return nil, fmt.Errorf("unknown event type %d", e.EventType)
+		}
+		if e.Sequence <= last {
+			return nil, fmt.Errorf("sequence %d does not follow %d", e.Sequence, last)
+		}
+		last = e.Sequence
+	}
+
+	if err := state.ApplyBatch(events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// rawLine is a line of a transaction log as read by readRawLine.
+type rawLine struct {
+	text     string // the line without its newline, empty if tooLong
+	size     int64  // bytes read, including the newline
+	complete bool   // the line ended with a newline
+	tooLong  bool   // the line is longer than maxLogLineSize
+}
+
+// readRawLine reads the next line from r. Unlike a bufio.Scanner it gets
+// past lines that are too long, so they can be reported and skipped.
+func readRawLine(r *bufio.Reader) (rawLine, error) {
+	var l rawLine
+	var buf []byte
+
+	for {
+		chunk, err := r.ReadSlice('\n')
+		l.size += int64(len(chunk))
+		if !l.tooLong {
+			if len(buf)+len(chunk) > maxLogLineSize+1 {
+				l.tooLong = true
+				buf = nil
+			} else {
+				buf = append(buf, chunk...)
+			}
+		}
+
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err == io.EOF && l.size > 0:
+			l.text = string(buf)
+			return l, nil
+		case err != nil:
+			return l, err
+		}
+
+		l.complete = true
+		if !l.tooLong {
+			l.text = string(buf[:len(buf)-1])
+		}
+		return l, nil
+	}
+}
+
+// LogReport describes the records of a transaction log read by
+// ValidateTransactionLog or SalvageTransactionLog.
+type LogReport struct {
+	Records      int         // good events read, or copied by a salvage
+	LastSequence uint64      // sequence number of the last good record
+	Problems     []*LogError // bad records, in order
+	Dropped      int         // lines a salvage did not copy
+}
+
+// ValidateTransactionLog reads the whole log in filename and reports every
+// record that would stop the server from replaying it. The log is valid
+// if the report lists no problems.
+func ValidateTransactionLog(filename string, opts ...LogOption) (LogReport, error) {
+	var report LogReport
+	err := scanLog(filename, newLogCodec(opts), func(rec LogRecord, problem *LogError) error {
+		if problem != nil {
+			report.Problems = append(report.Problems, problem)
+			return nil
+		}
+		report.Records++
+		report.LastSequence = rec.Event.Sequence
+		return nil
+	})
+	return report, err
+}
+
+// SalvageMode selects what SalvageTransactionLog does with bad records.
+type SalvageMode int
+
+const (
+	// SalvageTruncate keeps the records before the first bad one. The
+	// result is the log as of a moment in the past, as if the server had
+	// stopped just before the damage.
+	SalvageTruncate SalvageMode = iota
+
+	// SalvageSkip keeps every good record. The result may combine changes
+	// on either side of a lost one.
+	SalvageSkip
+)
+
+// SalvageTransactionLog writes the good records of the log in src to dst
+// as a log the server can replay, following mode. src and dst may be the
+// same file, which is replaced atomically; the server must not be running
+// on it.
+func SalvageTransactionLog(src, dst string, mode SalvageMode, opts ...LogOption) (LogReport, error) {
+	var report LogReport
+	codec := newLogCodec(opts)
+
+	// The events of each kept line, so that batches stay batches.
+	var records [][]Event
+	lastLine := 0
+	err := scanLog(src, codec, func(rec LogRecord, problem *LogError) error {
+		switch {
+		case problem == nil && (mode == SalvageSkip || len(report.Problems) == 0):
+			if rec.Line == lastLine {
+				records[len(records)-1] = append(records[len(records)-1], rec.Event)
+			} else {
+				records = append(records, []Event{rec.Event})
+			}
+			report.Records++
+			report.LastSequence = rec.Event.Sequence
+		case problem != nil:
+			report.Problems = append(report.Problems, problem)
+			report.Dropped++
+		case rec.Line != lastLine:
+			report.Dropped++
+		}
+		lastLine = rec.Line
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	err = writeLogFile(dst, codec, func(w recordWriter) error {
+		for _, events := range records {
+			if err := w.write(events...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return report, err
+}
+
+// WriteTransactionLog copies the events of src, with their sequence numbers,
+// to a new transaction log in filename. The log is written under a
+// temporary name and renamed into place once all of src has been read.
+func WriteTransactionLog(filename string, src TransactionLogger, opts ...LogOption) (int, error) {
+	events, errs := src.ReadEvents()
+
+	var n int
+	var last uint64
+	err := writeLogFile(filename, newLogCodec(opts), func(w recordWriter) error {
+		var err error
+		for e := range events {
+			if err != nil {
+				continue // keep draining so the reader can finish
+			}
+			if e.Sequence <= last {
+				err = fmt.Errorf("sequence %d does not follow %d", e.Sequence, last)
+				continue
+			}
+			if err = w.write(e); err == nil {
+				last = e.Sequence
+				n++
+			}
+		}
+		if readErr := <-errs; readErr != nil {
+			return readErr
+		}
+		return err
+	})
+	return n, err
+}
+
+// recordWriter writes the records of a log file, encoded by codec.
+type recordWriter struct {
+	w     *bufio.Writer
+	codec logCodec
+}
+
+// write writes events as a single record.
+func (rw recordWriter) write(events ...Event) error {
+	record, err := rw.codec.encode(events)
+	if err != nil {
+		return err
+	}
+	_, err = rw.w.WriteString(record)
+	return err
+}
+
+// writeLogFile writes a transaction log to filename with write. The file is
+// written under a temporary name, synced and renamed into place, so a
+// partially written log is never left at filename.
+func writeLogFile(filename string, codec logCodec, write func(w recordWriter) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("cannot create transaction log: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	w := bufio.NewWriter(tmp)
+	if err := write(recordWriter{w: w, codec: codec}); err != nil {
+		return fmt.Errorf("cannot write transaction log: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("cannot write transaction log: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("cannot sync transaction log: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("cannot close transaction log: %w", err)
+	}
+
+	return os.Rename(tmp.Name(), filename)
+}
+
+// writeFileAtomic replaces filename with data, written under a temporary
+// name that is synced and renamed into place.
+func writeFileAtomic(filename string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if _, err := tmp.Write(data); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// LogStats summarises a transaction log.
+type LogStats struct {
+	Size           int64
+	Records        int
+	Puts           int
+	Deletes        int
+	Evictions      int // keys evicted by a DB with logged evictions
+	Updates        int // increments, appends and patches
+	LockOps        int // lease acquires, renewals and releases
+	IndexOps       int // index creations and drops
+	FirstSequence  uint64
+	LastSequence   uint64
+	FirstTimestamp time.Time
+	LastTimestamp  time.Time
+	LiveKeys       int
+	LiveBytes      int64 // size of the live keys and values
+}
+
+// InspectTransactionLog reads the log in filename and summarises it. The
+// returned error is a *LogError if the log is damaged; the stats then
+// describe the records before the damage.
+func InspectTransactionLog(filename string, opts ...LogOption) (LogStats, error) {
+	var stats LogStats
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		return stats, fmt.Errorf("cannot open transaction log file: %w", err)
+	}
+	stats.Size = info.Size()
+
+	live := make(map[string]int)
+	err = ScanTransactionLog(filename, func(rec LogRecord) error {
+		e := rec.Event
+
+		stats.Records++
+		if stats.FirstSequence == 0 {
+			stats.FirstSequence = e.Sequence
+		}
+		stats.LastSequence = e.Sequence
+
+		if !e.Timestamp.IsZero() {
+			if stats.FirstTimestamp.IsZero() {
+				stats.FirstTimestamp = e.Timestamp
+			}
+			stats.LastTimestamp = e.Timestamp
+		}
+
+		switch e.EventType {
+		case EventPut:
+			stats.Puts++
+		case EventDelete:
+			stats.Deletes++
+		case EventEvict:
+			stats.Evictions++
+		case EventIncrement, EventAppend, EventMergePatch, EventJSONPatch:
+			stats.Updates++
+		case EventCreateIndex, EventDropIndex:
+			stats.IndexOps++
+			return nil
+		case EventMark:
+			return nil
+		default:
+			stats.LockOps++
+			return nil
+		}
+		if e.EventType == EventDelete || e.EventType == EventEvict {
+			delete(live, e.Key)
+		} else {
+			live[e.Key] = len(e.Key) + len(rec.Value)
+		}
+		return nil
+	}, opts...)
+
+	stats.LiveKeys = len(live)
+	for _, n := range live {
+		stats.LiveBytes += int64(n)
+	}
+	return stats, err
+}
+
+// CompactTransactionLog rewrites the log in src as a compacted log in dst
+// holding one put per live key. src and dst may be the same file, which
+// is replaced atomically; the server must not be running on it.
+func CompactTransactionLog(src, dst string, opts ...LogOption) error {
+	logger, err := OpenFileTransactionLogger(src, opts...)
+	if err != nil {
+		return err
+	}
+
+	db, err := Restore(logger, RestoreOptions{})
+	logger.(*FileTransactionLogger).Close()
+	if err != nil {
+		return err
+	}
+	return WriteCompactedLog(db, dst, opts...)
+}
@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeTestLog(t *testing.T, lines ...string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "transaction.log")
+	if err := os.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatalf("Failed writing log: %v", err)
+	}
+	return filename
+}
+
+func TestInspectTransactionLog(t *testing.T) {
+	filename := writeTestLog(t,
+		"1\t2\ta\t1\t2025-01-01T00:00:00Z\t\t",
+		"2\t2\tb\t22\t2025-01-01T00:01:00Z\t\t",
+		"3\t2\ta\t333\t2025-01-01T00:02:00Z\t\t",
+		"4\t1\tb\t\t2025-01-01T00:03:00Z\t\t",
+	)
+
+	stats, err := InspectTransactionLog(filename)
+	if err != nil {
+		t.Fatalf("InspectTransactionLog returned error: %v", err)
+	}
+
+	if stats.Records != 4 || stats.Puts != 3 || stats.Deletes != 1 {
+		t.Errorf("Unexpected record counts: %+v", stats)
+	}
+	if stats.FirstSequence != 1 || stats.LastSequence != 4 {
+		t.Errorf("Unexpected sequence range: %+v", stats)
+	}
+	if stats.LiveKeys != 1 || stats.LiveBytes != 4 {
+		t.Errorf("Expected one live key of 4 bytes, got %+v", stats)
+	}
+	if stats.LastTimestamp.Format("15:04") != "00:03" {
+		t.Errorf("Unexpected last timestamp: %v", stats.LastTimestamp)
+	}
+}
+
+func TestScanTransactionLog_ReportsDamage(t *testing.T) {
+	filename := writeTestLog(t,
+		"1\t2\ta\t1\t2025-01-01T00:00:00Z\t\t",
+		"2\t2\tb\t2\t2025-01-01T00:01:00Z\t\t",
+		"not a record",
+		"3\t2\tc\t3\t2025-01-01T00:02:00Z\t\t",
+	)
+
+	var seen int
+	err := ScanTransactionLog(filename, func(LogRecord) error {
+		seen++
+		return nil
+	})
+
+	var logErr *LogError
+	if !errors.As(err, &logErr) {
+		t.Fatalf("Expected a *LogError, got %v", err)
+	}
+	if logErr.Line != 3 {
+		t.Errorf("Expected damage on line 3, got %d", logErr.Line)
+	}
+	expectedOffset := int64(len("1\t2\ta\t1\t2025-01-01T00:00:00Z\t\t\n") * 2)
+	if logErr.Offset != expectedOffset {
+		t.Errorf("Expected offset %d, got %d", expectedOffset, logErr.Offset)
+	}
+	if seen != 2 {
+		t.Errorf("Expected 2 records before the damage, got %d", seen)
+	}
+
+	// Sequence numbers that go backwards are damage too
+	filename = writeTestLog(t,
+		"2\t2\ta\t1\t2025-01-01T00:00:00Z\t\t",
+		"1\t2\tb\t2\t2025-01-01T00:01:00Z\t\t",
+	)
+	err = ScanTransactionLog(filename, func(LogRecord) error { return nil })
+	if !errors.As(err, &logErr) || logErr.Line != 2 {
+		t.Errorf("Expected out-of-order damage on line 2, got %v", err)
+	}
+}
+
+func TestCompactTransactionLog_InPlace(t *testing.T) {
+	filename := writeTestLog(t,
+		"1\t2\ta\t1\t2025-01-01T00:00:00Z\t\t",
+		"2\t2\tb\t2\t2025-01-01T00:01:00Z\t\t",
+		"3\t2\ta\t3\t2025-01-01T00:02:00Z\t\t",
+		"4\t1\tb\t\t2025-01-01T00:03:00Z\t\t",
+	)
+
+	if err := CompactTransactionLog(filename, filename); err != nil {
+		t.Fatalf("CompactTransactionLog returned error: %v", err)
+	}
+
+	stats, err := InspectTransactionLog(filename)
+	if err != nil {
+		t.Fatalf("InspectTransactionLog returned error: %v", err)
+	}
+	if stats.Records != 2 || stats.Puts != 1 || stats.FirstSequence != 3 || stats.LastSequence != 4 || stats.LiveKeys != 1 {
+		t.Errorf("Expected a put of a at sequence 3 and a mark at 4, got %+v", stats)
+	}
+}
+
+func TestValidateTransactionLog(t *testing.T) {
+	good := "1\t2\ta\t1\t2025-01-01T00:00:00Z\t\t"
+	filename := writeTestLog(t,
+		good,
+		"2\t2\tb\t2\t2025-01-01T00:01:00Z",     // missing fields
+		"2\t1\tb\t\t2025-01-01T00:02:00Z\t\t",  // b was never written
+		"1\t2\tc\t3\t2025-01-01T00:03:00Z\t\t", // out of sequence
+		"3\t9\tc\t3\t2025-01-01T00:04:00Z\t\t", // unknown type
+		"4\t2\tc\t4\t2025-01-01T00:05:00Z\t\t",
+	)
+	// A torn final write without its newline
+	f, _ := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0600)
+	f.WriteString("5\t2\td\t5\t2025")
+	f.Close()
+
+	report, err := ValidateTransactionLog(filename)
+	if err != nil {
+		t.Fatalf("ValidateTransactionLog returned error: %v", err)
+	}
+
+	if report.Records != 2 || report.LastSequence != 4 {
+		t.Errorf("Expected 2 good records up to sequence 4, got %+v", report)
+	}
+
+	var lines []int
+	for _, p := range report.Problems {
+		lines = append(lines, p.Line)
+	}
+	expected := []int{2, 3, 4, 5, 7}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Fatalf("Expected problems on lines %v, got %v", expected, lines)
+	}
+	if report.Problems[1].Offset != int64(len(good)+1+len("2\t2\tb\t2\t2025-01-01T00:01:00Z")+1) {
+		t.Errorf("Unexpected offset for line 3: %d", report.Problems[1].Offset)
+	}
+
+	// The server reports where replay stopped too
+	db, _ := NewInMemoryDB()
+	_, err = InitializeFileTransactionLogger(db, filename)
+	var logErr *LogError
+	if !errors.As(err, &logErr) || logErr.Line != 2 {
+		t.Errorf("Expected replay to fail on line 2, got %v", err)
+	}
+}
+
+func TestSalvageTransactionLog(t *testing.T) {
+	filename := writeTestLog(t,
+		"1\t2\ta\t1\t2025-01-01T00:00:00Z\t\t",
+		"2\t2\tb\t2\t2025-01-01T00:01:00Z\t\t",
+		"garbage",
+		"3\t2\tc\t3\t2025-01-01T00:02:00Z\t\t",
+		"4\t1\ta\t\t2025-01-01T00:03:00Z\t\t",
+	)
+
+	tests := []struct {
+		mode     SalvageMode
+		expected map[string]string
+		dropped  int
+	}{
+		{SalvageTruncate, map[string]string{"a": "1", "b": "2"}, 3},
+		{SalvageSkip, map[string]string{"b": "2", "c": "3"}, 1},
+	}
+
+	for _, tt := range tests {
+		out := filepath.Join(t.TempDir(), "repaired.log")
+		report, err := SalvageTransactionLog(filename, out, tt.mode)
+		if err != nil {
+			t.Fatalf("SalvageTransactionLog(%d) returned error: %v", tt.mode, err)
+		}
+		if report.Dropped != tt.dropped || len(report.Problems) != 1 || report.Problems[0].Line != 3 {
+			t.Errorf("Mode %d: unexpected report %+v", tt.mode, report)
+		}
+
+		// The repaired log must start a server
+		db, _ := NewInMemoryDB()
+		if _, err := InitializeFileTransactionLogger(db, out); err != nil {
+			t.Fatalf("Mode %d: repaired log does not replay: %v", tt.mode, err)
+		}
+		all, _ := db.GetAll()
+		if !reflect.DeepEqual(all, tt.expected) {
+			t.Errorf("Mode %d: replayed data mismatch.\nGot:      %#v\nExpected: %#v", tt.mode, all, tt.expected)
+		}
+	}
+}
+
+func TestWriteTransactionLog_KeepsSequencesAndMetadata(t *testing.T) {
+	lines := []string{
+		"5\t2\ta\tx\\ty\t2025-01-01T00:00:00Z\treq-1\talice",
+		"9\t1\ta\t\t2025-01-01T00:01:00Z\treq-2\tbob",
+	}
+	source := writeTestLog(t, lines...)
+
+	src, err := OpenFileTransactionLogger(source)
+	if err != nil {
+		t.Fatalf("OpenFileTransactionLogger returned error: %v", err)
+	}
+
+	out := filepath.Join(t.TempDir(), "copy.log")
+	n, err := WriteTransactionLog(out, src)
+	if err != nil || n != 2 {
+		t.Fatalf("WriteTransactionLog returned %d, %v", n, err)
+	}
+
+	b, _ := os.ReadFile(out)
+	if string(b) != strings.Join(lines, "\n")+"\n" {
+		t.Errorf("Copy mismatch.\nGot:      %q\nExpected: %q", b, strings.Join(lines, "\n")+"\n")
+	}
+}
+
+func TestValidateTransactionLog_ResolvesUpdates(t *testing.T) {
+	filename := writeTestLog(t,
+		"1\t3\tn\t5\t2025-01-01T00:00:00Z\t\t",
+		"2\t4\tn\t0\t2025-01-01T00:01:00Z\t\t",
+		"3\t3\tn\t1\t2025-01-01T00:02:00Z\t\t", // n is now 51
+		"4\t4\ts\tx\t2025-01-01T00:03:00Z\t\t",
+		"5\t3\ts\t1\t2025-01-01T00:04:00Z\t\t", // s is not an integer
+	)
+
+	report, err := ValidateTransactionLog(filename)
+	if err != nil {
+		t.Fatalf("ValidateTransactionLog returned error: %v", err)
+	}
+	if len(report.Problems) != 1 || report.Problems[0].Line != 5 {
+		t.Errorf("Expected a problem on line 5, got %+v", report.Problems)
+	}
+
+	stats, _ := InspectTransactionLog(filename)
+	if stats.Updates != 4 || stats.LiveKeys != 2 || stats.LiveBytes != int64(len("n51")+len("sx")) {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
@@ -1,18 +1,80 @@
 package storage
 
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
 type EventType byte
 
 const (
 	_                     = iota
 	EventDelete EventType = iota
 	EventPut
+	// EventIncrement adds its Value, a decimal integer, to the integer
+	// value of its key, or to 0 if the key has no value.
+	EventIncrement
+	// EventAppend adds its Value to the end of the value of its key.
+	EventAppend
+	// EventAcquire takes the lease named by its Key for the owner in its
+	// Value until its ExpiresAt, if no other owner holds it.
+	EventAcquire
+	// EventRenew moves the expiry of a lease held by its Value to its
+	// ExpiresAt.
+	EventRenew
+	// EventRelease ends a lease held by its Value.
+	EventRelease
+	// EventEvict drops its key with all its history, if the key exists.
+	// It is logged for each key evicted by a DB with logged evictions.
+	EventEvict
+	// EventCreateIndex creates the secondary index named by its Key, with
+	// the IndexDefinition JSON-encoded in its Value.
+	EventCreateIndex
+	// EventDropIndex drops the secondary index named by its Key.
+	EventDropIndex
+	// EventMergePatch applies its Value, an RFC 7386 merge patch, to the
+	// JSON value of its key, or to null if the key has no value.
+	EventMergePatch
+	// EventJSONPatch applies its Value, an RFC 6902 JSON Patch, to the JSON
+	// value of its key, which must exist.
+	EventJSONPatch
+	// EventMark changes nothing. A compacted log ends with one numbered
+	// like the last event of the log it was compacted from, so that the
+	// events logged after it, and the fencing tokens of leases, are
+	// numbered after every event of the original log.
+	EventMark
 )
 
 type TransactionLogger interface {
-	WritePut(key, value string)
-	WriteDelete(key string)
+	// WritePut and WriteDelete are WriteEvent for a put or a delete,
+	// without metadata.
+	WritePut(key, value string) error
+	WriteDelete(key string) error
+	// WriteEvent assigns e the next sequence number, applies it to the bound
+	// DB and logs it. It returns the assigned sequence number once e is
+	// written to the log, or the DB's error, in which case nothing is
+	// logged. Readers of the DB see e as soon as it is applied, before it
+	// is written; should the write fail, WriteEvent returns
+	// ErrorUnavailable and e stays in the DB but not in the log.
+	WriteEvent(e Event) (uint64, error)
+	// WriteEvents is WriteEvent for a batch of events, which are assigned
+	// consecutive sequence numbers and applied and logged atomically: all
+	// of them, or none if the DB rejects any. It returns the sequence
+	// number of the last event, and sets the Result of each event in events
+	// that has one.
+	WriteEvents(events []Event) (uint64, error)
 	Err() <-chan error
 	ReadEvents() (<-chan Event, <-chan error)
+	// ReadEventsSince streams, in sequence order, the events whose sequence
+	// number is greater than seq. It stops, with ctx's error, once ctx is
+	// done, so a reader that has seen enough cancels ctx rather than
+	// draining the events.
+	ReadEventsSince(ctx context.Context, seq uint64) (<-chan Event, <-chan error)
+	// ReadKeyEventsSince is ReadEventsSince for the events of key alone,
+	// stopping after limit events if limit is not zero.
+	ReadKeyEventsSince(ctx context.Context, key string, seq uint64, limit int) (<-chan Event, <-chan error)
 	Run()
 }
 
@@ -21,4 +83,214 @@ type Event struct {
 	EventType EventType
 	Key       string
 	Value     string
+	Timestamp time.Time // server time the change was accepted
+	RequestID string    // ID of the request that made the change
+	Principal string    // authenticated client, or its address
+	ExpiresAt time.Time // when a put stops being visible; zero for never
+	Flags     uint32    // opaque to the store, kept with a put's value
+	Lease     string    // lease a put attaches its key to
+
+	// Result is the value of the key after an update, such as an
+	// increment or a patch, or the fencing token of the lease after an
+	// acquire or renewal, set when the event is applied. The Result of an
+	// update is logged with it, so that readers of the log see the value
+	// without replaying it; that of a lease event is not.
+	Result string
+
+	// encoding is the compression of Value while the event is formatted
+	// for a log written WithLogCompression.
+	encoding string
+}
+
+func (t EventType) String() string {
+	switch t {
+	case EventDelete:
+		return "delete"
+	case EventPut:
+		return "put"
+	case EventIncrement:
+		return "increment"
+	case EventAppend:
+		return "append"
+	case EventAcquire:
+		return "acquire"
+	case EventRenew:
+		return "renew"
+	case EventRelease:
+		return "release"
+	case EventEvict:
+		return "evict"
+	case EventCreateIndex:
+		return "create-index"
+	case EventDropIndex:
+		return "drop-index"
+	case EventMergePatch:
+		return "merge-patch"
+	case EventJSONPatch:
+		return "json-patch"
+	case EventMark:
+		return "mark"
+	}
+	return fmt.Sprintf("EventType(%d)", byte(t))
+}
+
+// valid reports whether t is an event type the DB can apply.
+func (t EventType) valid() bool {
+	switch t {
+	case EventDelete, EventPut, EventIncrement, EventAppend, EventAcquire, EventRenew, EventRelease, EventEvict,
+		EventCreateIndex, EventDropIndex, EventMergePatch, EventJSONPatch, EventMark:
+		return true
+	}
+	return false
+}
+
+// isUpdate reports whether t changes the value of a key from its current
+// value, which the DB reads when it applies the event. The new value is
+// set as the Result of the event.
+func (t EventType) isUpdate() bool {
+	switch t {
+	case EventIncrement, EventAppend, EventMergePatch, EventJSONPatch:
+		return true
+	}
+	return false
+}
+
+// isLease reports whether t changes a lease rather than a key. The Key of
+// such an event is the name of the lease.
+func (t EventType) isLease() bool {
+	return t == EventAcquire || t == EventRenew || t == EventRelease
+}
+
+// isIndex reports whether t changes a secondary index. The Key of such an
+// event is the name of the index.
+func (t EventType) isIndex() bool {
+	return t == EventCreateIndex || t == EventDropIndex
+}
+
+// keyed reports whether the Key of an event of type t is a key of the
+// store, rather than the name of a lease or an index, or unused.
+func (t EventType) keyed() bool {
+	return !t.isLease() && !t.isIndex() && t != EventMark
+}
+
+// sequenceEvents returns a copy of events numbered consecutively after last.
+func sequenceEvents(events []Event, last uint64) []Event {
+	numbered := make([]Event, len(events))
+	for i, e := range events {
+		e.Sequence = last + uint64(i) + 1
+		numbered[i] = e
+	}
+	return numbered
+}
+
+// evictor is a DB that evicts keys through the transaction logger, which
+// logs the evictions so that replay ends in the same state.
+type evictor interface {
+	evictions() []string
+}
+
+// applyEvents applies numbered to db as a single change. If db then has
+// keys to evict through the logger, it evicts them as a second change, with
+// EventEvict events numbered after numbered. It returns the events to log.
+// Should the evictions fail, they are left for the next write.
+func applyEvents(db DB, numbered []Event) ([]Event, error) {
+	if err := db.ApplyBatch(numbered); err != nil {
+		return nil, err
+	}
+	ev, ok := db.(evictor)
+	if !ok {
+		return numbered, nil
+	}
+	keys := ev.evictions()
+	if len(keys) == 0 {
+		return numbered, nil
+	}
+
+	last := numbered[len(numbered)-1]
+	evictions := make([]Event, len(keys))
+	for i, key := range keys {
+		evictions[i] = Event{EventType: EventEvict, Key: key, Timestamp: last.Timestamp}
+	}
+	evictions = sequenceEvents(evictions, last.Sequence)
+	if err := db.ApplyBatch(evictions); err != nil {
+		return numbered, nil
+	}
+	return append(numbered, evictions...), nil
+}
+
+// writeMark tracks how far a running logger has written the events queued
+// for its log, so that a reader can wait for the events sequenced before
+// it started, which the DB has already applied and published.
+type writeMark struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	written uint64
+	failed  bool
+}
+
+func newWriteMark(written uint64) *writeMark {
+	m := &writeMark{written: written}
+	m.cond = sync.NewCond(&m.mu)
+	return m
+}
+
+// advance records that the events up to seq have been written.
+func (m *writeMark) advance(seq uint64) {
+	m.mu.Lock()
+	m.written = seq
+	m.mu.Unlock()
+	m.cond.Broadcast()
+}
+
+// fail records that no more events will be written.
+func (m *writeMark) fail() {
+	m.mu.Lock()
+	m.failed = true
+	m.mu.Unlock()
+	m.cond.Broadcast()
+}
+
+// wait waits until the events up to seq have been written, or writing has
+// failed, and reports whether they were written.
+func (m *writeMark) wait(seq uint64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for m.written < seq && !m.failed {
+		m.cond.Wait()
+	}
+	return m.written >= seq
+}
+
+// writeFailer is a logger that can tell whether a write to its log has
+// failed, after which the DB may hold changes the log does not.
+type writeFailer interface {
+	writeFailed() bool
+}
+
+// writeWaiter is a logger that can wait for the events it has queued, which
+// the DB has already applied and published, to be written to its log.
+type writeWaiter interface {
+	// waitWritten waits until the events up to seq are written, and
+	// reports whether they were.
+	waitWritten(seq uint64) bool
+}
+
+// replayEvents reads every event from logger and applies it to db, stopping
+// at the first error.
+func replayEvents(db DB, logger TransactionLogger) error {
+	events, errs := logger.ReadEvents()
+
+	var err error
+	for e := range events {
+		if err != nil {
+			continue // keep draining so the reader can finish
+		}
+		if err = db.Apply(e); err != nil {
+			err = fmt.Errorf("failed to replay event %d: %w", e.Sequence, err)
+		}
+	}
+	if readErr := <-errs; readErr != nil && err == nil {
+		err = readErr
+	}
+	return err
 }
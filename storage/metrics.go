@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"bufio"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metricPrefix is the prefix of the names of all metrics.
+const metricPrefix = "keyvaluestore_"
+
+// MetricsCollector is a part of the server that reports metrics.
+type MetricsCollector interface {
+	// CollectMetrics writes the current metrics of the collector to w.
+	CollectMetrics(w *MetricWriter)
+}
+
+// Metrics serves the metrics of its collectors in the Prometheus text
+// exposition format. It is served on /metrics by a router whose Service
+// was created WithMetrics.
+type Metrics struct {
+	mu         sync.Mutex
+	collectors []MetricsCollector
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+// Register adds c to the collectors of m.
+func (m *Metrics) Register(c MetricsCollector) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.collectors = append(m.collectors, c)
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	collectors := append([]MetricsCollector(nil), m.collectors...)
+	m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	mw := &MetricWriter{w: bufio.NewWriter(w)}
+	for _, c := range collectors {
+		c.CollectMetrics(mw)
+	}
+	mw.w.Flush()
+}
+
+// MetricWriter writes metrics in the Prometheus text exposition format.
+type MetricWriter struct {
+	w *bufio.Writer
+}
+
+// Sample is one value of a metric. Labels holds label names and values,
+// alternating.
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+// Counter writes the counter name, which is prefixed with keyvaluestore_.
+func (mw *MetricWriter) Counter(name, help string, samples ...Sample) {
+	mw.write(name, "counter", help, samples)
+}
+
+// Gauge writes the gauge name, which is prefixed with keyvaluestore_.
+func (mw *MetricWriter) Gauge(name, help string, samples ...Sample) {
+	mw.write(name, "gauge", help, samples)
+}
+
+func (mw *MetricWriter) write(name, kind, help string, samples []Sample) {
+	name = metricPrefix + name
+	mw.w.WriteString("# HELP " + name + " " + help + "\n")
+	mw.w.WriteString("# TYPE " + name + " " + kind + "\n")
+	for _, s := range samples {
+		mw.w.WriteString(name)
+		if len(s.Labels) > 0 {
+			mw.w.WriteByte('{')
+			for i := 0; i+1 < len(s.Labels); i += 2 {
+				if i > 0 {
+					mw.w.WriteByte(',')
+				}
+				mw.w.WriteString(s.Labels[i] + `="` + labelEscaper.Replace(s.Labels[i+1]) + `"`)
+			}
+			mw.w.WriteByte('}')
+		}
+		mw.w.WriteString(" " + strconv.FormatFloat(s.Value, 'g', -1, 64) + "\n")
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
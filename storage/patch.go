@@ -0,0 +1,414 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Media types of the patch documents accepted by Service.Patch.
+const (
+	// ContentTypeJSONPatch is an RFC 6902 JSON Patch: a list of operations
+	// applied in order, all or none.
+	ContentTypeJSONPatch = "application/json-patch+json"
+	// ContentTypeMergePatch is an RFC 7386 merge patch: a document whose
+	// fields replace those of the value, with null removing a field.
+	ContentTypeMergePatch = "application/merge-patch+json"
+)
+
+// patchEventType returns the event type of a patch of media type
+// contentType.
+func patchEventType(contentType string) (EventType, error) {
+	switch contentType {
+	case ContentTypeJSONPatch:
+		return EventJSONPatch, nil
+	case ContentTypeMergePatch:
+		return EventMergePatch, nil
+	}
+	return 0, fmt.Errorf("%w: patches must be %s or %s, not %q",
+		ErrorInvalidArgument, ContentTypeJSONPatch, ContentTypeMergePatch, contentType)
+}
+
+// patchValue returns the value of a key after the patch event e, given the
+// key's current value cur, if it exists. A merge patch treats a missing
+// key as null, so it creates the key; a JSON Patch needs the key to exist.
+// The result is encoded compactly, with the fields of objects sorted.
+func patchValue(e Event, cur string, exists bool) (string, error) {
+	patch, err := decodeJSON(e.Value)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid patch: %v", ErrorInvalidArgument, err)
+	}
+
+	var doc any
+	if exists {
+		if doc, err = decodeJSON(cur); err != nil {
+			return "", fmt.Errorf("%w: value of %q is not a JSON document", ErrorInvalidArgument, e.Key)
+		}
+	} else if e.EventType == EventJSONPatch {
+		return "", fmt.Errorf("%w: cannot patch %q", ErrorNoSuchKey, e.Key)
+	}
+
+	if e.EventType == EventMergePatch {
+		doc = mergePatch(doc, patch)
+	} else if doc, err = jsonPatch(doc, patch); err != nil {
+		return "", fmt.Errorf("cannot patch %q: %w", e.Key, err)
+	}
+	return encodeJSON(doc)
+}
+
+// decodeJSON parses s, which must hold exactly one JSON value, keeping
+// numbers as they are written.
+func decodeJSON(s string) (any, error) {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after the JSON value")
+	}
+	return v, nil
+}
+
+// encodeJSON encodes v without escaping HTML characters.
+func encodeJSON(v any) (string, error) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+// mergePatch applies the merge patch patch to target, as RFC 7386
+// describes. It may modify target.
+func mergePatch(target, patch any) any {
+	fields, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	obj, ok := target.(map[string]any)
+	if !ok {
+		obj = make(map[string]any)
+	}
+	for name, value := range fields {
+		if value == nil {
+			delete(obj, name)
+		} else {
+			obj[name] = mergePatch(obj[name], value)
+		}
+	}
+	return obj
+}
+
+// jsonPatch applies the operations of the JSON Patch patch to doc in
+// order, as RFC 6902 describes. It fails with ErrorInvalidArgument if the
+// patch is malformed, ErrorConflict if an operation does not fit the
+// document, and ErrorPreconditionFailed if a test fails. It may modify
+// doc.
+func jsonPatch(doc, patch any) (any, error) {
+	ops, ok := patch.([]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: a JSON Patch must be an array of operations", ErrorInvalidArgument)
+	}
+	for i, raw := range ops {
+		op, ok := raw.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%w: operation %d is not an object", ErrorInvalidArgument, i)
+		}
+		var err error
+		if doc, err = applyPatchOp(doc, op); err != nil {
+			return nil, fmt.Errorf("operation %d: %w", i, err)
+		}
+	}
+	return doc, nil
+}
+
+// applyPatchOp applies a single JSON Patch operation to doc.
+func applyPatchOp(doc any, op map[string]any) (any, error) {
+	member := func(name string) (string, error) {
+		s, ok := op[name].(string)
+		if !ok {
+			return "", fmt.Errorf("%w: %q must be a string", ErrorInvalidArgument, name)
+		}
+		return s, nil
+	}
+	name, err := member("op")
+	if err != nil {
+		return nil, err
+	}
+	p, err := member("path")
+	if err != nil {
+		return nil, err
+	}
+	path, err := parsePointer(p)
+	if err != nil {
+		return nil, err
+	}
+	value, hasValue := op["value"]
+	if !hasValue && (name == "add" || name == "replace" || name == "test") {
+		return nil, fmt.Errorf("%w: %s needs a value", ErrorInvalidArgument, name)
+	}
+
+	switch name {
+	case "add":
+		return addValue(doc, path, value)
+	case "remove":
+		doc, _, err := removeValue(doc, path)
+		return doc, err
+	case "replace":
+		if doc, _, err = removeValue(doc, path); err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, value)
+	case "move", "copy":
+		f, err := member("from")
+		if err != nil {
+			return nil, err
+		}
+		from, err := parsePointer(f)
+		if err != nil {
+			return nil, err
+		}
+		var moved any
+		if name == "move" {
+			if len(from) < len(path) && isPrefix(from, path) {
+				return nil, fmt.Errorf("%w: cannot move %s into itself", ErrorConflict, f)
+			}
+			doc, moved, err = removeValue(doc, from)
+		} else if moved, err = getValue(doc, from); err == nil {
+			moved = copyJSON(moved)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, moved)
+	case "test":
+		cur, err := getValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !jsonEqual(cur, value) {
+			return nil, fmt.Errorf("%w: test of %s failed", ErrorPreconditionFailed, p)
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("%w: unknown operation %q", ErrorInvalidArgument, name)
+}
+
+// copyJSON returns a deep copy of v, a value produced by decodeJSON.
+func copyJSON(v any) any {
+	switch x := v.(type) {
+	case map[string]any:
+		obj := make(map[string]any, len(x))
+		for name, value := range x {
+			obj[name] = copyJSON(value)
+		}
+		return obj
+	case []any:
+		arr := make([]any, len(x))
+		for i, value := range x {
+			arr[i] = copyJSON(value)
+		}
+		return arr
+	}
+	return v
+}
+
+var (
+	pointerUnescaper = strings.NewReplacer("~1", "/", "~0", "~")
+	pointerEscaper   = strings.NewReplacer("~", "~0", "/", "~1")
+)
+
+// parsePointer splits an RFC 6901 JSON Pointer into its unescaped
+// reference tokens. The empty pointer refers to the whole document.
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(p, "/") {
+		return nil, fmt.Errorf("%w: JSON Pointer %q must start with /", ErrorInvalidArgument, p)
+	}
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = pointerUnescaper.Replace(t)
+	}
+	return tokens, nil
+}
+
+// formatPointer is the inverse of parsePointer.
+func formatPointer(tokens []string) string {
+	var b strings.Builder
+	for _, t := range tokens {
+		b.WriteString("/")
+		b.WriteString(pointerEscaper.Replace(t))
+	}
+	return b.String()
+}
+
+func isPrefix(prefix, path []string) bool {
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// arrayIndex parses token as an index into arr. With end, "-" and the
+// length of arr, which refer to the position after the last element, are
+// accepted too.
+func arrayIndex(arr []any, token string, end bool) (int, bool) {
+	if end && token == "-" {
+		return len(arr), true
+	}
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, false
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > len(arr) || (i == len(arr) && !end) {
+		return 0, false
+	}
+	return i, true
+}
+
+// getValue returns the value path refers to in doc.
+func getValue(doc any, path []string) (any, error) {
+	node := doc
+	for i, token := range path {
+		switch n := node.(type) {
+		case map[string]any:
+			v, ok := n[token]
+			if !ok {
+				return nil, fmt.Errorf("%w: %s does not exist", ErrorConflict, formatPointer(path[:i+1]))
+			}
+			node = v
+		case []any:
+			j, ok := arrayIndex(n, token, false)
+			if !ok {
+				return nil, fmt.Errorf("%w: %s does not exist", ErrorConflict, formatPointer(path[:i+1]))
+			}
+			node = n[j]
+		default:
+			return nil, fmt.Errorf("%w: %s is not an object or an array", ErrorConflict, formatPointer(path[:i]))
+		}
+	}
+	return node, nil
+}
+
+// addValue adds value to doc at path, replacing the member of an object
+// and inserting into an array, and returns the new document.
+func addValue(doc any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := getValue(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	token := path[len(path)-1]
+	switch p := parent.(type) {
+	case map[string]any:
+		p[token] = value
+		return doc, nil
+	case []any:
+		i, ok := arrayIndex(p, token, true)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s is out of range", ErrorConflict, formatPointer(path))
+		}
+		arr := append(p[:i:i], value)
+		arr = append(arr, p[i:]...)
+		return setValue(doc, path[:len(path)-1], arr), nil
+	}
+	return nil, fmt.Errorf("%w: %s is not an object or an array", ErrorConflict, formatPointer(path[:len(path)-1]))
+}
+
+// removeValue removes the value at path from doc, and returns the new
+// document and the value removed.
+func removeValue(doc any, path []string) (any, any, error) {
+	old, err := getValue(doc, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(path) == 0 {
+		return nil, old, nil
+	}
+	parent, _ := getValue(doc, path[:len(path)-1])
+	token := path[len(path)-1]
+	switch p := parent.(type) {
+	case map[string]any:
+		delete(p, token)
+	case []any:
+		i, _ := arrayIndex(p, token, false)
+		arr := append(p[:i:i], p[i+1:]...)
+		doc = setValue(doc, path[:len(path)-1], arr)
+	}
+	return doc, old, nil
+}
+
+// setValue replaces the value at path, which exists, with value, and
+// returns the new document. It is how arrays, which are resized by
+// copying, are put back into their parent.
+func setValue(doc any, path []string, value any) any {
+	if len(path) == 0 {
+		return value
+	}
+	parent, _ := getValue(doc, path[:len(path)-1])
+	token := path[len(path)-1]
+	switch p := parent.(type) {
+	case map[string]any:
+		p[token] = value
+	case []any:
+		i, _ := arrayIndex(p, token, false)
+		p[i] = value
+	}
+	return doc
+}
+
+// jsonEqual reports whether a and b, values produced by decodeJSON, are
+// equal as JSON values: numbers are compared by value, and objects
+// regardless of the order of their fields.
+func jsonEqual(a, b any) bool {
+	switch x := a.(type) {
+	case map[string]any:
+		y, ok := b.(map[string]any)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for name, v := range x {
+			w, ok := y[name]
+			if !ok || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		y, ok := b.([]any)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !jsonEqual(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		if x == y {
+			return true
+		}
+		fx, errx := x.Float64()
+		fy, erry := y.Float64()
+		return errx == nil && erry == nil && fx == fy
+	}
+	return a == b
+}
@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMergePatch(t *testing.T) {
+	// The examples of RFC 7386, appendix A.
+	for _, tc := range []struct{ target, patch, want string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	} {
+		got, err := patchValue(Event{EventType: EventMergePatch, Key: "k", Value: tc.patch}, tc.target, true)
+		if err != nil || got != tc.want {
+			t.Errorf("merge %s into %s: expected %s, got %s, %v", tc.patch, tc.target, tc.want, got, err)
+		}
+	}
+
+	if got, err := patchValue(Event{EventType: EventMergePatch, Key: "k", Value: `{"a":1.50}`}, "", false); err != nil || got != `{"a":1.50}` {
+		t.Errorf("Expected a merge patch to create a missing key, got %s, %v", got, err)
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	// Mostly the examples of RFC 6902, appendix A.
+	for _, tc := range []struct{ doc, patch, want string }{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			`[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			`{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{`{"baz":"qux","foo":["a",2,"c"]}`,
+			`[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2.0}]`,
+			`{"baz":"qux","foo":["a",2,"c"]}`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`, `{"child":{"grandchild":{}},"foo":"bar"}`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, `{"foo":["bar",["abc","def"]]}`},
+		{`{"/":1,"~":2}`, `[{"op":"copy","from":"/~1","path":"/~0x"}]`, `{"/":1,"~":2,"~x":1}`},
+		{`{"a":{"b":[1]}}`, `[{"op":"copy","from":"/a","path":"/c"},{"op":"add","path":"/c/b/0","value":0}]`, `{"a":{"b":[1]},"c":{"b":[0,1]}}`},
+		{`{"a":1}`, `[{"op":"replace","path":"","value":[true]}]`, `[true]`},
+		{`{"a":1}`, `[]`, `{"a":1}`},
+	} {
+		got, err := patchValue(Event{EventType: EventJSONPatch, Key: "k", Value: tc.patch}, tc.doc, true)
+		if err != nil || got != tc.want {
+			t.Errorf("patch %s with %s: expected %s, got %s, %v", tc.doc, tc.patch, tc.want, got, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		doc, patch string
+		want       error
+	}{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`, ErrorConflict},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/2","value":1}]`, ErrorConflict},
+		{`{"foo":["bar"]}`, `[{"op":"remove","path":"/foo/01"}]`, ErrorConflict},
+		{`{"foo":"bar"}`, `[{"op":"replace","path":"/baz","value":1}]`, ErrorConflict},
+		{`{"a":{"b":1}}`, `[{"op":"move","from":"/a","path":"/a/c"}]`, ErrorConflict},
+		{`{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`, ErrorPreconditionFailed},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/a","value":1},{"op":"test","path":"/foo","value":1}]`, ErrorPreconditionFailed},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz"}]`, ErrorInvalidArgument},
+		{`{"foo":"bar"}`, `[{"op":"frob","path":"/baz"}]`, ErrorInvalidArgument},
+		{`{"foo":"bar"}`, `[{"op":"remove","path":"baz"}]`, ErrorInvalidArgument},
+		{`{"foo":"bar"}`, `{"op":"remove","path":"/foo"}`, ErrorInvalidArgument},
+		{`{"foo":"bar"}`, `[{"op":"remove","path":"/foo"}] x`, ErrorInvalidArgument},
+		{`not json`, `[]`, ErrorInvalidArgument},
+	} {
+		if _, err := patchValue(Event{EventType: EventJSONPatch, Key: "k", Value: tc.patch}, tc.doc, true); !errors.Is(err, tc.want) {
+			t.Errorf("patch %s with %s: expected %v, got %v", tc.doc, tc.patch, tc.want, err)
+		}
+	}
+	if _, err := patchValue(Event{EventType: EventJSONPatch, Key: "k", Value: `[]`}, "", false); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("Expected ErrorNoSuchKey patching a missing key, got %v", err)
+	}
+}
+
+func TestInMemoryDB_PatchConcurrent(t *testing.T) {
+	db, _ := NewInMemoryDB()
+	db.Upsert("doc", `{"n":{},"list0":[],"list1":[]}`)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				if _, err := db.MergePatch("doc", fmt.Sprintf(`{"n":{"w%d-%d":true}}`, w, i)); err != nil {
+					t.Errorf("MergePatch returned error: %v", err)
+					return
+				}
+				if _, err := db.JSONPatch("doc", fmt.Sprintf(`[{"op":"add","path":"/list%d/-","value":%d}]`, w%2, i)); err != nil {
+					t.Errorf("JSONPatch returned error: %v", err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	v, _ := db.Get("doc")
+	doc, err := decodeJSON(*v)
+	if err != nil {
+		t.Fatalf("Expected a JSON document, got %v", err)
+	}
+	fields := doc.(map[string]any)
+	if n := len(fields["n"].(map[string]any)); n != 400 {
+		t.Errorf("Expected every merge patch to be kept, got %d fields", n)
+	}
+	if n := len(fields["list0"].([]any)) + len(fields["list1"].([]any)); n != 400 {
+		t.Errorf("Expected every JSON Patch to be kept, got %d items", n)
+	}
+}
+
+func TestFileTransactionLogger_PatchReplay(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "transaction.log")
+	db, _ := NewInMemoryDB()
+	logger, err := InitializeFileTransactionLogger(db, filename)
+	if err != nil {
+		t.Fatalf("InitializeFileTransactionLogger returned error: %v", err)
+	}
+	svc := NewService(db, logger)
+	svc.Patch(Caller{}, "doc", ContentTypeMergePatch, `{"a":1,"b":{"c":2}}`)
+	value, err := svc.Patch(Caller{}, "doc", ContentTypeJSONPatch, `[{"op":"move","from":"/b/c","path":"/c"}]`)
+	if err != nil || value != `{"a":1,"b":{},"c":2}` {
+		t.Errorf("Expected the patched document, got %s, %v", value, err)
+	}
+	fileLogger := logger.(*FileTransactionLogger)
+	close(fileLogger.events)
+	for writeErr := range fileLogger.errors {
+		t.Fatalf("Got an error from the transaction logger: %v", writeErr)
+	}
+
+	stats, err := InspectTransactionLog(filename)
+	if err != nil || stats.Updates != 2 {
+		t.Errorf("Expected 2 updates in the log, got %+v, %v", stats, err)
+	}
+	replayed, _ := NewInMemoryDB()
+	if _, err := InitializeFileTransactionLogger(replayed, filename); err != nil {
+		t.Fatalf("Replay returned error: %v", err)
+	}
+	if v, err := replayed.Get("doc"); err != nil || *v != value {
+		t.Errorf("Expected replay to patch doc again, got %v", err)
+	}
+}
+
+func TestHandler_Patch(t *testing.T) {
+	schema, err := ParseSchema([]byte(`{
+		"type": "object",
+		"required": ["name"],
+		"properties": {"name": {"type": "string"}, "age": {"type": "integer", "minimum": 0}}
+	}`))
+	if err != nil {
+		t.Fatalf("ParseSchema returned error: %v", err)
+	}
+	router := newTestRouter(t, WithSchema("people/", schema))
+	do := func(method, path, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := do("PUT", "/v1/key/people%2Fann", "", `{"name": "Ann", "age": 40}`); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 for a valid document, got %d: %s", rr.Code, rr.Body)
+	}
+	rr := do("PATCH", "/v1/key/people%2Fann", ContentTypeMergePatch+"; charset=utf-8", `{"age": 41, "city": "Oslo"}`)
+	if rr.Code != http.StatusOK || rr.Body.String() != `{"age":41,"city":"Oslo","name":"Ann"}` {
+		t.Errorf("Expected the merged document, got %d: %s", rr.Code, rr.Body)
+	}
+	rr = do("PATCH", "/v1/key/people%2Fann", ContentTypeJSONPatch, `[{"op":"test","path":"/age","value":41},{"op":"remove","path":"/city"}]`)
+	if rr.Code != http.StatusOK || rr.Body.String() != `{"age":41,"name":"Ann"}` {
+		t.Errorf("Expected the patched document, got %d: %s", rr.Code, rr.Body)
+	}
+
+	for _, tc := range []struct {
+		method, key, contentType, body string
+		want                           int
+	}{
+		{"PUT", "people%2Fbob", "", `{"age": 3}`, http.StatusBadRequest},
+		{"PUT", "people%2Fbob", "", `not json`, http.StatusBadRequest},
+		{"PATCH", "people%2Fann", ContentTypeMergePatch, `{"name": null}`, http.StatusBadRequest},
+		{"PATCH", "people%2Fann", ContentTypeJSONPatch, `[{"op":"replace","path":"/age","value":-1}]`, http.StatusBadRequest},
+		{"PATCH", "people%2Fann", ContentTypeJSONPatch, `[{"op":"test","path":"/age","value":40}]`, http.StatusPreconditionFailed},
+		{"PATCH", "people%2Fann", ContentTypeJSONPatch, `[{"op":"remove","path":"/city"}]`, http.StatusConflict},
+		{"PATCH", "people%2Fann", "application/json", `{"age": 1}`, http.StatusBadRequest},
+		{"PATCH", "people%2Fann", "", `{"age": 1}`, http.StatusBadRequest},
+		{"PATCH", "missing", ContentTypeJSONPatch, `[]`, http.StatusNotFound},
+		{"PUT", "other", "", `not json`, http.StatusOK},
+	} {
+		if rr := do(tc.method, "/v1/key/"+tc.key, tc.contentType, tc.body); rr.Code != tc.want {
+			t.Errorf("%s %s %s: expected status %d, got %d: %s", tc.method, tc.key, tc.body, tc.want, rr.Code, rr.Body)
+		}
+	}
+	if rr := do("GET", "/v1/key/people%2Fann", "", ""); rr.Body.String() != `{"age":41,"name":"Ann"}` {
+		t.Errorf("Expected refused writes to leave the document alone, got %s", rr.Body)
+	}
+}
@@ -1,8 +1,58 @@
 package storage
 
+const (
+	defaultPostgresSchema = "public"
+	defaultPostgresTable  = "transactions"
+)
+
 type PostgresConfig struct {
 	dbName   string
 	host     string
 	user     string
 	password string
+	schema   string
+	table    string
+	keys     KeyProvider
+}
+
+// NewPostgresConfig returns a config for the given connection parameters
+// using the default public.transactions table.
+func NewPostgresConfig(host, dbName, user, password string) PostgresConfig {
+	return PostgresConfig{host: host, dbName: dbName, user: user, password: password}
+}
+
+// WithSchema returns a copy of the config that stores events in the given schema.
+func (c PostgresConfig) WithSchema(schema string) PostgresConfig {
+	c.schema = schema
+	return c
+}
+
+// WithTable returns a copy of the config that stores events in the given table.
+func (c PostgresConfig) WithTable(table string) PostgresConfig {
+	c.table = table
+	return c
+}
+
+// WithEncryption returns a copy of the config that encrypts the value of
+// every event with the current key of keys before inserting it, so that
+// values cannot be read by whoever operates the database. Keys, sequence
+// numbers and metadata stay in the clear. Rows inserted before encryption
+// was enabled are still read.
+func (c PostgresConfig) WithEncryption(keys KeyProvider) PostgresConfig {
+	c.keys = keys
+	return c
+}
+
+func (c PostgresConfig) schemaName() string {
+	if c.schema == "" {
+		return defaultPostgresSchema
+	}
+	return c.schema
+}
+
+func (c PostgresConfig) tableName() string {
+	if c.table == "" {
+		return defaultPostgresTable
+	}
+	return c.table
 }
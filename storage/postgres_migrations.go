@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// migration is a single forward step of the transactions table schema.
+// Statements receive the unquoted schema and table names so the same
+// migration can be applied to any configured table.
+type migration struct {
+	version     int
+	description string
+	statements  func(schema, table string) []string
+}
+
+// migrations must be kept in ascending version order. Never edit a
+// migration that has been released; append a new one instead.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create transactions table",
+		statements: func(schema, table string) []string {
+			return []string{
+				fmt.Sprintf(`CREATE SCHEMA IF NOT EXISTS %s`, pq.QuoteIdentifier(schema)),
+				fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+					sequence      BIGSERIAL PRIMARY KEY,
+					event_type    SMALLINT,
+					key           TEXT,
+					value         TEXT
+				)`, qualifiedName(schema, table)),
+			}
+		},
+	},
+	{
+		// Replay from a sequence number is served by the primary key; this
+		// index covers replaying or auditing a single key from a sequence.
+		version:     2,
+		description: "index transactions by key and sequence",
+		statements: func(schema, table string) []string {
+			return []string{
+				fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s ON %s (key, sequence)`,
+					pq.QuoteIdentifier(table+"_key_sequence_idx"), qualifiedName(schema, table)),
+			}
+		},
+	},
+	{
+		version:     3,
+		description: "add event metadata columns",
+		statements: func(schema, table string) []string {
+			return []string{
+				fmt.Sprintf(`ALTER TABLE %s
+					ADD COLUMN IF NOT EXISTS event_time TIMESTAMPTZ,
+					ADD COLUMN IF NOT EXISTS request_id TEXT,
+					ADD COLUMN IF NOT EXISTS principal  TEXT`, qualifiedName(schema, table)),
+			}
+		},
+	},
+	{
+		version:     4,
+		description: "add expiry column",
+		statements: func(schema, table string) []string {
+			return []string{
+				fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ`,
+					qualifiedName(schema, table)),
+			}
+		},
+	},
+	{
+		// BIGINT, as Postgres has no unsigned 32-bit type.
+		version:     5,
+		description: "add flags column",
+		statements: func(schema, table string) []string {
+			return []string{
+				fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS flags BIGINT NOT NULL DEFAULT 0`,
+					qualifiedName(schema, table)),
+			}
+		},
+	},
+	{
+		version:     6,
+		description: "add lease column",
+		statements: func(schema, table string) []string {
+			return []string{
+				fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS lease TEXT NOT NULL DEFAULT ''`,
+					qualifiedName(schema, table)),
+			}
+		},
+	},
+	{
+		// The ID of the key a value is encrypted with, or empty if it is
+		// stored in the clear.
+		version:     7,
+		description: "add value key ID column",
+		statements: func(schema, table string) []string {
+			return []string{
+				fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS key_id TEXT NOT NULL DEFAULT ''`,
+					qualifiedName(schema, table)),
+			}
+		},
+	},
+	{
+		// The value an update gave its key, encrypted like the value.
+		version:     8,
+		description: "add result column",
+		statements: func(schema, table string) []string {
+			return []string{
+				fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS result TEXT NOT NULL DEFAULT ''`,
+					qualifiedName(schema, table)),
+			}
+		},
+	},
+}
+
+// latestSchemaVersion is the schema version this binary migrates to.
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+func qualifiedName(schema, table string) string {
+	return pq.QuoteIdentifier(schema) + "." + pq.QuoteIdentifier(table)
+}
+
+// migrate brings the transactions table up to latestSchemaVersion. The
+// applied version is tracked in a <table>_schema_migrations table, and an
+// advisory lock keeps concurrently starting servers from racing each other.
+func (l *PostgresTransactionLogger) migrate() error {
+	ctx := context.Background()
+
+	// Advisory locks belong to a session, so every statement has to go
+	// through the same connection.
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	defer conn.Close()
+
+	lockKey := "keyvaluestore:" + l.schema + "." + l.table
+	if _, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock(hashtext($1))", lockKey); err != nil {
+		return fmt.Errorf("failed to take migration lock: %w", err)
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock(hashtext($1))", lockKey)
+
+	versions := qualifiedName(l.schema, l.table+"_schema_migrations")
+
+	_, err = conn.ExecContext(ctx, fmt.Sprintf(`CREATE SCHEMA IF NOT EXISTS %s`, pq.QuoteIdentifier(l.schema)))
+	if err != nil {
+		return fmt.Errorf("failed to create schema: %w", err)
+	}
+
+	_, err = conn.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		version       INTEGER PRIMARY KEY,
+		description   TEXT NOT NULL,
+		applied_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`, versions))
+	if err != nil {
+		return fmt.Errorf("failed to create migrations table: %w", err)
+	}
+
+	var current int
+	row := conn.QueryRowContext(ctx, fmt.Sprintf(`SELECT COALESCE(MAX(version), 0) FROM %s`, versions))
+	if err = row.Scan(&current); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	if current > latestSchemaVersion() {
+		return fmt.Errorf("schema version %d of %s is newer than supported version %d",
+			current, qualifiedName(l.schema, l.table), latestSchemaVersion())
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err = applyMigration(ctx, conn, m, l.schema, l.table, versions); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.description, err)
+		}
+	}
+
+	return nil
+}
+
+func applyMigration(ctx context.Context, conn *sql.Conn, m migration, schema, table, versions string) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range m.statements(schema, table) {
+		if _, err = tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx,
+		fmt.Sprintf(`INSERT INTO %s (version, description) VALUES ($1, $2)`, versions),
+		m.version, m.description)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
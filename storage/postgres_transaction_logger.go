@@ -1,18 +1,48 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
+	"encoding/base64"
 	"fmt"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	_ "github.com/lib/pq"
 )
 
 type PostgresTransactionLogger struct {
-	events chan<- Event
+	events chan<- []Event
 	errors <-chan error
 	db     *sql.DB
 	wg     *sync.WaitGroup
+	schema string
+	table  string
+	store  DB
+	keys   KeyProvider
+	mu     sync.Mutex
+
+	lastSequence uint64
+	failed       atomic.Bool
+	mark         *writeMark // set by Run
+}
+
+// InitializePostgresTransactionLogger connects to Postgres, replays the
+// transactions table into db and starts the logger.
+func InitializePostgresTransactionLogger(db DB, param PostgresConfig) (TransactionLogger, error) {
+	logger, err := NewPostgresTransactionLogger(param)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create event logger: %w", err)
+	}
+
+	err = replayEvents(db, logger)
+
+	pgLogger := logger.(*PostgresTransactionLogger)
+	pgLogger.store = db
+	pgLogger.Run()
+	return pgLogger, err
 }
 
 func NewPostgresTransactionLogger(param PostgresConfig) (TransactionLogger, error) {
@@ -29,27 +59,103 @@ func NewPostgresTransactionLogger(param PostgresConfig) (TransactionLogger, erro
 		return nil, fmt.Errorf("failed to opendb connection: %w", err)
 	}
 
-	tl := &PostgresTransactionLogger{db: db, wg: &sync.WaitGroup{}}
+	tl := &PostgresTransactionLogger{
+		db:     db,
+		wg:     &sync.WaitGroup{},
+		schema: param.schemaName(),
+		table:  param.tableName(),
+		keys:   param.keys,
+	}
 
-	exists, err := tl.verifyTableExists()
-	if err != nil {
-		return nil, fmt.Errorf("failed to verify table exists: %w", err)
+	if err = tl.migrate(); err != nil {
+		return nil, fmt.Errorf("failed to migrate table: %w", err)
 	}
-	if !exists {
-		if err = tl.createTable(); err != nil {
-			return nil, fmt.Errorf("failed to create table: %w", err)
-		}
+
+	// Sequence numbers are assigned here rather than by the BIGSERIAL, so
+	// that they are known before the row is inserted.
+	row := db.QueryRow(fmt.Sprintf("SELECT COALESCE(MAX(sequence), 0) FROM %s", tl.qualifiedTable()))
+	if err = row.Scan(&tl.lastSequence); err != nil {
+		return nil, fmt.Errorf("failed to read last sequence: %w", err)
 	}
 
 	return tl, nil
 }
 
-func (l *PostgresTransactionLogger) WritePut(key, value string) {
-	l.events <- Event{EventType: EventPut, Key: key, Value: value}
+func (l *PostgresTransactionLogger) WritePut(key, value string) error {
+	_, err := l.WriteEvent(Event{EventType: EventPut, Key: key, Value: value})
+	return err
+}
+
+func (l *PostgresTransactionLogger) WriteDelete(key string) error {
+	_, err := l.WriteEvent(Event{EventType: EventDelete, Key: key})
+	return err
+}
+
+// WriteEvent assigns e the next sequence number, applies it to the bound DB,
+// if any, and queues it for insertion. Once the logger runs, WriteEvent
+// returns when e is inserted. Once an insert has failed, WriteEvent returns
+// ErrorUnavailable.
+func (l *PostgresTransactionLogger) WriteEvent(e Event) (uint64, error) {
+	return l.WriteEvents([]Event{e})
+}
+
+// WriteEvents is WriteEvent for a batch of events, which are applied
+// atomically and inserted in a single transaction.
+func (l *PostgresTransactionLogger) WriteEvents(events []Event) (uint64, error) {
+	if len(events) == 0 {
+		return 0, fmt.Errorf("%w: no events to write", ErrorInvalidArgument)
+	}
+
+	seq, err := l.queue(events)
+	if err != nil || l.mark == nil {
+		return seq, err
+	}
+	if !l.mark.wait(seq) {
+		return 0, fmt.Errorf("%w: transaction log insert failed", ErrorUnavailable)
+	}
+	return seq, nil
+}
+
+// queue applies events to the bound DB, if any, and queues them for the
+// log. It returns the sequence number of the last of events.
+func (l *PostgresTransactionLogger) queue(events []Event) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.failed.Load() {
+		return 0, fmt.Errorf("%w: transaction log insert failed", ErrorUnavailable)
+	}
+
+	numbered := sequenceEvents(events, l.lastSequence)
+	if l.store != nil {
+		applied, err := applyEvents(l.store, numbered)
+		if err != nil {
+			return 0, err
+		}
+		for i := range events {
+			events[i].Result = applied[i].Result
+		}
+		numbered = applied
+	}
+	l.lastSequence = numbered[len(numbered)-1].Sequence
+	l.wg.Add(1)
+	l.events <- numbered
+	// Evictions logged after the events are not theirs to report.
+	return numbered[len(events)-1].Sequence, nil
+}
+
+// waitWritten waits until the events up to seq are written, if the
+// logger runs, and reports whether they were.
+func (l *PostgresTransactionLogger) waitWritten(seq uint64) bool {
+	if l.mark == nil {
+		return true
+	}
+	return l.mark.wait(seq)
 }
 
-func (l *PostgresTransactionLogger) WriteDelete(key string) {
-	l.events <- Event{EventType: EventDelete, Key: key}
+// writeFailed reports whether an insert has failed.
+func (l *PostgresTransactionLogger) writeFailed() bool {
+	return l.failed.Load()
 }
 
 func (l *PostgresTransactionLogger) Err() <-chan error {
@@ -57,24 +163,31 @@ func (l *PostgresTransactionLogger) Err() <-chan error {
 }
 
 func (l *PostgresTransactionLogger) Run() {
-	events := make(chan Event, 16) // Make an events channel
+	events := make(chan []Event, 16) // Make an events channel
 	l.events = events
 
 	errors := make(chan error, 1) // Make an errors channel
 	l.errors = errors
 
+	mark := newWriteMark(l.lastSequence)
+	l.mark = mark
+
 	go func() { // The INSERT query
-		query := `INSERT INTO transactions
-			(event_type, key, value)
-			VALUES ($1, $2, $3)`
+		defer close(errors)
+		defer mark.fail()
 
-		for e := range events { // Retrieve the next Event
-			_, err := l.db.Exec( // Execute the INSERT query
-				query,
-				e.EventType, e.Key, e.Value)
+		for batch := range events { // Retrieve the next batch
+			if l.failed.Load() {
+				l.wg.Done() // Drain without inserting after a failure
+				continue
+			}
 
-			if err != nil {
+			if err := l.insert(batch); err != nil {
+				l.failed.Store(true)
+				mark.fail()
 				errors <- err
+			} else {
+				mark.advance(batch[len(batch)-1].Sequence)
 			}
 
 			l.wg.Done()
@@ -82,17 +195,246 @@ func (l *PostgresTransactionLogger) Run() {
 	}()
 }
 
+// insert inserts a batch of events, in a transaction if there are several.
+func (l *PostgresTransactionLogger) insert(batch []Event) error {
+	if len(batch) == 1 {
+		return l.insertEvent(l.db, l.insertQuery(), batch[0])
+	}
+
+	tx, err := l.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := l.insertQuery()
+	for _, e := range batch {
+		if err := l.insertEvent(tx, query, e); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// execer is implemented by *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func (l *PostgresTransactionLogger) insertEvent(db execer, query string, e Event) error {
+	args, err := l.insertArgs(e)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(query, args...) // Execute the INSERT query
+	return err
+}
+
+// insertArgs returns the arguments of insertQuery for e, with its value
+// encrypted if the logger has keys.
+func (l *PostgresTransactionLogger) insertArgs(e Event) ([]any, error) {
+	var result string
+	if e.EventType.isUpdate() {
+		result = e.Result
+	}
+	value, result, keyID, err := l.encryptValue(e.Sequence, e.Key, e.Value, result)
+	if err != nil {
+		return nil, err
+	}
+	return []any{
+		e.Sequence, e.EventType, e.Key, value,
+		sql.NullTime{Time: e.Timestamp, Valid: !e.Timestamp.IsZero()},
+		e.RequestID, e.Principal,
+		sql.NullTime{Time: e.ExpiresAt, Valid: !e.ExpiresAt.IsZero()},
+		int64(e.Flags), e.Lease, keyID, result,
+	}, nil
+}
+
+// encryptValue returns the value and result of the event with sequence
+// seq on key as they are stored, and the ID of the key they are encrypted
+// with. They are encrypted with the sequence number and key of their event
+// as associated data, so that they cannot be moved to another row, nor
+// swapped. Empty fields are stored as they are.
+func (l *PostgresTransactionLogger) encryptValue(seq uint64, key, value, result string) (string, string, string, error) {
+	if l.keys == nil || (value == "" && result == "") {
+		return value, result, "", nil
+	}
+	keyID, secret, err := l.keys.CurrentKey()
+	if err != nil {
+		return "", "", "", fmt.Errorf("cannot get encryption key: %w", err)
+	}
+	if value, err = sealField(secret, value, valueAAD(keyID, seq, key)); err != nil {
+		return "", "", "", fmt.Errorf("cannot encrypt value: %w", err)
+	}
+	if result, err = sealField(secret, result, resultAAD(keyID, seq, key)); err != nil {
+		return "", "", "", fmt.Errorf("cannot encrypt result: %w", err)
+	}
+	return value, result, keyID, nil
+}
+
+// decryptValue reverses encryptValue for the row of e, setting its Value
+// and Result.
+func (l *PostgresTransactionLogger) decryptValue(e *Event, keyID string) error {
+	if keyID == "" {
+		return nil
+	}
+	if l.keys == nil {
+		return fmt.Errorf("value of sequence %d is encrypted, and no key file was given", e.Sequence)
+	}
+	secret, err := l.keys.Key(keyID)
+	if err == nil {
+		e.Value, err = openField(secret, e.Value, valueAAD(keyID, e.Sequence, e.Key))
+	}
+	if err == nil {
+		e.Result, err = openField(secret, e.Result, resultAAD(keyID, e.Sequence, e.Key))
+	}
+	if err != nil {
+		return fmt.Errorf("cannot decrypt value of sequence %d: %w", e.Sequence, err)
+	}
+	return nil
+}
+
+// sealField encrypts plaintext, unless it is empty, and encodes it as
+// base64.
+func sealField(secret []byte, plaintext string, aad []byte) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+	sealed, err := seal(secret, []byte(plaintext), aad)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openField reverses sealField.
+func openField(secret []byte, field string, aad []byte) (string, error) {
+	if field == "" {
+		return "", nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(field)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := unseal(secret, sealed, aad)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+func valueAAD(keyID string, seq uint64, key string) []byte {
+	return []byte(keyID + "\x00" + strconv.FormatUint(seq, 10) + "\x00" + key)
+}
+
+func resultAAD(keyID string, seq uint64, key string) []byte {
+	return append(valueAAD(keyID, seq, key), "\x00result"...)
+}
+
+// ImportEvents inserts the events read from src, keeping their sequence
+// numbers, in a single transaction, so either all of src is imported or
+// none of it is. The events must follow the last one in the table. It is
+// meant for offline conversion and must not be called once Run has been.
+func (l *PostgresTransactionLogger) ImportEvents(src TransactionLogger) (int, error) {
+	tx, err := l.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin import: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(l.insertQuery())
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare import: %w", err)
+	}
+	defer stmt.Close()
+
+	events, errs := src.ReadEvents()
+
+	n := 0
+	last := l.lastSequence
+	for e := range events {
+		if err != nil {
+			continue // keep draining so the reader can finish
+		}
+		if e.Sequence <= last {
+			err = fmt.Errorf("sequence %d does not follow %d", e.Sequence, last)
+			continue
+		}
+
+		var args []any
+		if args, err = l.insertArgs(e); err == nil {
+			_, err = stmt.Exec(args...)
+		}
+		if err == nil {
+			last = e.Sequence
+			n++
+		}
+	}
+	if readErr := <-errs; readErr != nil {
+		return 0, readErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to import event: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit import: %w", err)
+	}
+	l.lastSequence = last
+	return n, nil
+}
+
 func (l *PostgresTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
+	return l.ReadEventsSince(context.Background(), 0)
+}
+
+// ReadEventsSince streams the events with a sequence number greater than
+// seq. The range scan is served by the primary key index on sequence. The
+// events written before the call are included, once they are inserted.
+func (l *PostgresTransactionLogger) ReadEventsSince(ctx context.Context, seq uint64) (<-chan Event, <-chan error) {
+	return l.ReadKeyEventsSince(ctx, "", seq, 0)
+}
+
+// ReadKeyEventsSince is ReadEventsSince for the events of key alone, or
+// of every key if key is empty, stopping after limit events if limit is
+// not zero. The scan of a key is served by the index on (key, sequence).
+func (l *PostgresTransactionLogger) ReadKeyEventsSince(ctx context.Context, key string, seq uint64, limit int) (<-chan Event, <-chan error) {
 	outEvent := make(chan Event)    // An unbuffered events channel
 	outError := make(chan error, 1) // A buffered errors channel
 
-	query := "SELECT sequence, event_type, key, value FROM transactions"
+	where, args := "sequence > $1", []any{seq}
+	if key != "" {
+		args = append(args, key)
+		where += fmt.Sprintf(" AND key = $%d", len(args))
+	}
+	var limitClause string
+	if limit > 0 {
+		args = append(args, limit)
+		limitClause = fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	query := fmt.Sprintf(`SELECT sequence, event_type, key, value,
+			event_time, COALESCE(request_id, ''), COALESCE(principal, ''),
+			expires_at, flags, lease, key_id, result
+		FROM %s
+		WHERE %s
+		ORDER BY sequence%s`, l.qualifiedTable(), where, limitClause)
+
+	var last uint64
+	if l.mark != nil {
+		l.mu.Lock()
+		last = l.lastSequence
+		l.mu.Unlock()
+	}
 
 	go func() {
 		defer close(outEvent) // Close the channels when the
 		defer close(outError) // goroutine ends
 
-		rows, err := l.db.Query(query) // Run query; get result set
+		if l.mark != nil {
+			l.mark.wait(last)
+		}
+
+		rows, err := l.db.QueryContext(ctx, query, args...) // Run query; get result set
 		if err != nil {
 			outError <- fmt.Errorf("sql query error: %w", err)
 			return
@@ -101,19 +443,41 @@ func (l *PostgresTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
 		defer rows.Close() // This is important!
 
 		var e Event // Create an empty Event
+		var ts, expiresAt sql.NullTime
+		var keyID string
 
 		for rows.Next() { // Iterate over the rows
 
 			err = rows.Scan( // Read the values from the
 				&e.Sequence, &e.EventType, // row into the Event.
-				&e.Key, &e.Value)
+				&e.Key, &e.Value,
+				&ts, &e.RequestID, &e.Principal,
+				&expiresAt, &e.Flags, &e.Lease, &keyID, &e.Result)
 
 			if err != nil {
 				outError <- err
 				return
 			}
 
-			outEvent <- e // Send e to the channel
+			e.Timestamp = time.Time{}
+			if ts.Valid {
+				e.Timestamp = ts.Time
+			}
+			e.ExpiresAt = time.Time{}
+			if expiresAt.Valid {
+				e.ExpiresAt = expiresAt.Time
+			}
+			if err = l.decryptValue(&e, keyID); err != nil {
+				outError <- err
+				return
+			}
+
+			select {
+			case outEvent <- e: // Send e to the channel
+			case <-ctx.Done():
+				outError <- ctx.Err()
+				return
+			}
 		}
 
 		err = rows.Err()
@@ -129,38 +493,12 @@ func (l *PostgresTransactionLogger) Wait() {
 	l.wg.Wait()
 }
 
-func (l *PostgresTransactionLogger) verifyTableExists() (bool, error) {
-	const table = "transactions"
-
-	var result string
-
-	rows, err := l.db.Query(fmt.Sprintf("SELECT to_regclass('public.%s');", table))
-	if err != nil {
-		return false, err
-	}
-	defer rows.Close()
-
-	for rows.Next() && result != table {
-		rows.Scan(&result)
-	}
-
-	return result == table, rows.Err()
+func (l *PostgresTransactionLogger) insertQuery() string {
+	return fmt.Sprintf(`INSERT INTO %s
+		(sequence, event_type, key, value, event_time, request_id, principal, expires_at, flags, lease, key_id, result)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`, l.qualifiedTable())
 }
 
-func (l *PostgresTransactionLogger) createTable() error {
-	var err error
-
-	createQuery := `CREATE TABLE transactions (
-		sequence      BIGSERIAL PRIMARY KEY,
-		event_type    SMALLINT,
-		key 		  TEXT,
-		value         TEXT
-	  );`
-
-	_, err = l.db.Exec(createQuery)
-	if err != nil {
-		return err
-	}
-
-	return nil
+func (l *PostgresTransactionLogger) qualifiedTable() string {
+	return qualifiedName(l.schema, l.table)
 }
@@ -0,0 +1,280 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// rateLimitSweepInterval is how often buckets that have refilled are
+// dropped, so that clients that went away are forgotten.
+const rateLimitSweepInterval = time.Minute
+
+// RateLimit is the request budget of every client for the keys starting
+// with Prefix. Reads and writes are budgeted separately: a client may make
+// Rate requests a second on average, and up to Burst at once. A zero Rate
+// leaves that kind of request unlimited.
+type RateLimit struct {
+	Prefix     string
+	ReadRate   float64
+	ReadBurst  int
+	WriteRate  float64
+	WriteBurst int
+}
+
+// ParseRateLimit parses a RateLimit written as comma-separated settings,
+// such as "prefix=app/,read=100,write=10,burst=20". The settings are
+// prefix, read and write, the rates per second, and burst, read-burst and
+// write-burst. A burst defaults to the rate, rounded up.
+func ParseRateLimit(spec string) (RateLimit, error) {
+	var l RateLimit
+	for _, setting := range strings.Split(spec, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(setting), "=")
+		if !ok {
+			return l, fmt.Errorf("%w: rate limit setting %q is not name=value", ErrorInvalidArgument, setting)
+		}
+		if name == "prefix" {
+			l.Prefix = value
+			continue
+		}
+
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil || n < 0 || math.IsInf(n, 0) {
+			return l, fmt.Errorf("%w: rate limit setting %s must be a non-negative number", ErrorInvalidArgument, name)
+		}
+		switch name {
+		case "read":
+			l.ReadRate = n
+		case "write":
+			l.WriteRate = n
+		case "burst":
+			l.ReadBurst, l.WriteBurst = int(n), int(n)
+		case "read-burst":
+			l.ReadBurst = int(n)
+		case "write-burst":
+			l.WriteBurst = int(n)
+		default:
+			return l, fmt.Errorf("%w: unknown rate limit setting %q", ErrorInvalidArgument, name)
+		}
+	}
+
+	if l.ReadBurst == 0 {
+		l.ReadBurst = int(math.Ceil(l.ReadRate))
+	}
+	if l.WriteBurst == 0 {
+		l.WriteBurst = int(math.Ceil(l.WriteRate))
+	}
+	return l, nil
+}
+
+// RateLimiter limits the requests of each client with token buckets, one
+// per client, limit and kind of request. A client is identified by its
+// principal: the common name of its certificate, or its IP address.
+type RateLimiter struct {
+	limits []RateLimit // longest prefix first
+	now    func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[bucketKey]*tokenBucket
+	counts    map[rateCountKey]uint64
+	lastSweep time.Time
+}
+
+type bucketKey struct {
+	client string
+	prefix string
+	write  bool
+}
+
+type rateCountKey struct {
+	prefix  string
+	write   bool
+	limited bool
+}
+
+// tokenBucket holds up to burst tokens and gains rate tokens a second. A
+// request takes a token.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter enforcing limits. A request is
+// subject to the limit with the longest prefix of its key; requests not
+// about a single key, such as batches, fall under the limit with an empty
+// prefix, if there is one, and requests no limit applies to are not
+// limited.
+func NewRateLimiter(limits ...RateLimit) (*RateLimiter, error) {
+	seen := make(map[string]bool)
+	for _, l := range limits {
+		if seen[l.Prefix] {
+			return nil, fmt.Errorf("%w: more than one rate limit for prefix %q", ErrorInvalidArgument, l.Prefix)
+		}
+		seen[l.Prefix] = true
+		if (l.ReadRate > 0 && l.ReadBurst < 1) || (l.WriteRate > 0 && l.WriteBurst < 1) {
+			return nil, fmt.Errorf("%w: rate limit for prefix %q needs a burst of at least 1", ErrorInvalidArgument, l.Prefix)
+		}
+	}
+
+	sorted := append([]RateLimit(nil), limits...)
+	sort.SliceStable(sorted, func(i, j int) bool { return len(sorted[i].Prefix) > len(sorted[j].Prefix) })
+	return &RateLimiter{
+		limits:  sorted,
+		now:     time.Now,
+		buckets: make(map[bucketKey]*tokenBucket),
+		counts:  make(map[rateCountKey]uint64),
+	}, nil
+}
+
+// limitFor returns the limit key falls under.
+func (rl *RateLimiter) limitFor(key string) (RateLimit, bool) {
+	for _, l := range rl.limits {
+		if strings.HasPrefix(key, l.Prefix) {
+			return l, true
+		}
+	}
+	return RateLimit{}, false
+}
+
+// Allow takes a token for a read or write of key by client. If the
+// client's budget is used up, it returns false and how long until a token
+// is available.
+func (rl *RateLimiter) Allow(client, key string, write bool) (bool, time.Duration) {
+	l, ok := rl.limitFor(key)
+	if !ok {
+		return true, 0
+	}
+	rate, burst := l.ReadRate, float64(l.ReadBurst)
+	if write {
+		rate, burst = l.WriteRate, float64(l.WriteBurst)
+	}
+	if rate == 0 {
+		return true, 0
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	if now.Sub(rl.lastSweep) >= rateLimitSweepInterval {
+		rl.sweep(now)
+	}
+
+	k := bucketKey{client: client, prefix: l.Prefix, write: write}
+	b, ok := rl.buckets[k]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		rl.buckets[k] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	allowed := b.tokens >= 1
+	rl.counts[rateCountKey{prefix: l.Prefix, write: write, limited: !allowed}]++
+	if !allowed {
+		wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep drops the buckets that have refilled, as they are no different
+// from new ones.
+func (rl *RateLimiter) sweep(now time.Time) {
+	rl.lastSweep = now
+	for k, b := range rl.buckets {
+		l, _ := rl.limitFor(k.prefix)
+		rate, burst := l.ReadRate, float64(l.ReadBurst)
+		if k.write {
+			rate, burst = l.WriteRate, float64(l.WriteBurst)
+		}
+		if b.tokens+now.Sub(b.last).Seconds()*rate >= burst {
+			delete(rl.buckets, k)
+		}
+	}
+}
+
+// Middleware refuses requests over the client's budget with status 429
+// and a Retry-After header giving the seconds until the next request can
+// be made. GET requests and batch gets are reads; other requests are
+// writes. It must run after the route is matched, as the key of the
+// request is taken from the route, or from ?prefix= for listings.
+func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/metrics" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := keyVar(r)
+		if key == "" {
+			key = r.URL.Query().Get("prefix")
+		}
+
+		write := r.Method != http.MethodGet && r.Method != http.MethodHead
+		if route := mux.CurrentRoute(r); route != nil {
+			if tmpl, _ := route.GetPathTemplate(); tmpl == "/v1/batch/get" {
+				write = false
+			}
+		}
+
+		ok, wait := rl.Allow(principal(r), key, write)
+		if !ok {
+			seconds := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+			kind := "read"
+			if write {
+				kind = "write"
+			}
+			writeError(w, r, fmt.Errorf("%w: %s budget used up, retry in %ds", ErrorRateLimited, kind, max(seconds, 1)))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (rl *RateLimiter) CollectMetrics(mw *MetricWriter) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	var rates, bursts, requests, clients []Sample
+	tracked := make(map[rateCountKey]int)
+	for k := range rl.buckets {
+		tracked[rateCountKey{prefix: k.prefix, write: k.write}]++
+	}
+
+	for i := len(rl.limits) - 1; i >= 0; i-- {
+		l := rl.limits[i]
+		for _, write := range []bool{false, true} {
+			kind, rate, burst := "read", l.ReadRate, l.ReadBurst
+			if write {
+				kind, rate, burst = "write", l.WriteRate, l.WriteBurst
+			}
+			labels := []string{"prefix", l.Prefix, "kind", kind}
+			rates = append(rates, Sample{Labels: labels, Value: rate})
+			bursts = append(bursts, Sample{Labels: labels, Value: float64(burst)})
+			clients = append(clients, Sample{Labels: labels, Value: float64(tracked[rateCountKey{prefix: l.Prefix, write: write}])})
+			for _, limited := range []bool{false, true} {
+				result := "allowed"
+				if limited {
+					result = "limited"
+				}
+				n := rl.counts[rateCountKey{prefix: l.Prefix, write: write, limited: limited}]
+				requests = append(requests, Sample{Labels: append(labels[:4:4], "result", result), Value: float64(n)})
+			}
+		}
+	}
+
+	mw.Gauge("ratelimit_rate", "Requests a second each client may make (0 for no limit).", rates...)
+	mw.Gauge("ratelimit_burst", "Requests each client may make at once.", bursts...)
+	mw.Gauge("ratelimit_clients", "Clients whose budget is not full.", clients...)
+	mw.Counter("ratelimit_requests_total", "Requests checked against a rate limit, by result.", requests...)
+}
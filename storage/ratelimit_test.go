@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	l, err := ParseRateLimit("prefix=app/,read=100,write=2.5,write-burst=10")
+	if err != nil {
+		t.Fatalf("ParseRateLimit returned error: %v", err)
+	}
+	want := RateLimit{Prefix: "app/", ReadRate: 100, ReadBurst: 100, WriteRate: 2.5, WriteBurst: 10}
+	if l != want {
+		t.Errorf("Expected %+v, got %+v", want, l)
+	}
+
+	for _, spec := range []string{"read", "read=-1", "speed=3", "write=fast"} {
+		if _, err := ParseRateLimit(spec); !errors.Is(err, ErrorInvalidArgument) {
+			t.Errorf("ParseRateLimit(%q): expected ErrorInvalidArgument, got %v", spec, err)
+		}
+	}
+}
+
+func TestRateLimiter_Allow(t *testing.T) {
+	rl, err := NewRateLimiter(
+		RateLimit{ReadRate: 10, ReadBurst: 2, WriteRate: 1, WriteBurst: 1},
+		RateLimit{Prefix: "jobs/", WriteRate: 100, WriteBurst: 100},
+	)
+	if err != nil {
+		t.Fatalf("NewRateLimiter returned error: %v", err)
+	}
+	now := time.Now()
+	rl.now = func() time.Time { return now }
+
+	if ok, _ := rl.Allow("a", "k", true); !ok {
+		t.Fatal("Expected the first write to be allowed")
+	}
+	ok, wait := rl.Allow("a", "k", true)
+	if ok || wait != time.Second {
+		t.Errorf("Expected the second write to wait 1s, got %v, %v", ok, wait)
+	}
+	if ok, _ := rl.Allow("b", "k", true); !ok {
+		t.Error("Expected another client to have its own budget")
+	}
+	if ok, _ := rl.Allow("a", "k", false); !ok {
+		t.Error("Expected reads to have their own budget")
+	}
+	if ok, _ := rl.Allow("a", "jobs/1", true); !ok {
+		t.Error("Expected writes under jobs/ to have their own budget")
+	}
+	for i := 0; i < 10; i++ {
+		if ok, _ := rl.Allow("a", "jobs/1", false); !ok {
+			t.Fatal("Expected reads under jobs/ to be unlimited")
+		}
+	}
+
+	now = now.Add(time.Second)
+	if ok, _ := rl.Allow("a", "k", true); !ok {
+		t.Error("Expected a write to be allowed once a token is back")
+	}
+
+	// Refilled buckets are forgotten.
+	now = now.Add(rateLimitSweepInterval)
+	rl.Allow("c", "k", false)
+	if n := len(rl.buckets); n != 1 {
+		t.Errorf("Expected only the bucket of c after a sweep, got %d", n)
+	}
+
+	if _, err := NewRateLimiter(RateLimit{}, RateLimit{}); !errors.Is(err, ErrorInvalidArgument) {
+		t.Errorf("Expected ErrorInvalidArgument for a repeated prefix, got %v", err)
+	}
+}
+
+func TestHandler_RateLimit(t *testing.T) {
+	rl, _ := NewRateLimiter(RateLimit{ReadRate: 1, ReadBurst: 2, WriteRate: 0.1, WriteBurst: 1})
+	metrics := NewMetrics()
+	metrics.Register(rl)
+	router := newTestRouter(t, WithRateLimiter(rl), WithMetrics(metrics))
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rr
+	}
+
+	if rr := do("PUT", "/v1/key/a", "1"); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rr.Code)
+	}
+	rr := do("PUT", "/v1/key/a", "2")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "10" {
+		t.Errorf("Expected status 429 with Retry-After 10, got %d, %q", rr.Code, rr.Header().Get("Retry-After"))
+	}
+	if !strings.Contains(rr.Body.String(), CodeRateLimited) {
+		t.Errorf("Expected the rate_limited code, got %s", rr.Body)
+	}
+
+	// A batch get is a read.
+	if rr := do("POST", "/v1/batch/get", `{"keys": ["a"]}`); rr.Code != http.StatusOK {
+		t.Errorf("Expected a batch get to use the read budget, got %d", rr.Code)
+	}
+
+	rr = do("GET", "/metrics", "")
+	for _, line := range []string{
+		`keyvaluestore_ratelimit_requests_total{prefix="",kind="write",result="limited"} 1`,
+		`keyvaluestore_ratelimit_requests_total{prefix="",kind="read",result="allowed"} 1`,
+		`keyvaluestore_ratelimit_rate{prefix="",kind="write"} 0.1`,
+		`keyvaluestore_ratelimit_clients{prefix="",kind="write"} 1`,
+	} {
+		if !strings.Contains(rr.Body.String(), line+"\n") {
+			t.Errorf("Expected %q in the metrics, got:\n%s", line, rr.Body)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"net/http"
+)
+
+// RequestIDHeader carries the request ID in both directions. A client may
+// supply its own; otherwise the server generates one.
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// RequestIDMiddleware makes sure every request has an ID, stores it in the
+// request context and echoes it in the response.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" {
+			id = NewRequestID()
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// RequestID returns the ID assigned by RequestIDMiddleware, falling back to
+// the request header when the middleware is not installed.
+func RequestID(r *http.Request) string {
+	if id, ok := r.Context().Value(requestIDKey{}).(string); ok {
+		return id
+	}
+	return r.Header.Get(RequestIDHeader)
+}
+
+// NewRequestID returns a random request ID.
+func NewRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// principal identifies who made a request: the common name of a verified
+// client certificate if there is one, and the client's address otherwise.
+func principal(r *http.Request) string {
+	return Principal(r.TLS, r.RemoteAddr)
+}
+
+// Principal identifies the client of a connection with TLS state state,
+// which may be nil, from remote address addr. It is the common name of a
+// verified client certificate if there is one, and the client's host
+// otherwise.
+func Principal(state *tls.ConnectionState, addr string) string {
+	if state != nil && len(state.VerifiedChains) > 0 {
+		if cn := state.PeerCertificates[0].Subject.CommonName; cn != "" {
+			return cn
+		}
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RestoreOptions selects the events replayed by Restore. Zero fields do
+// not restrict anything.
+type RestoreOptions struct {
+	ToSequence uint64    // replay events up to and including this sequence
+	ToTime     time.Time // replay events at or before this time
+	Prefix     string    // only replay keys with this prefix; leases and indexes are always replayed
+}
+
+func (o RestoreOptions) includes(e Event) bool {
+	switch {
+	case o.ToSequence != 0 && e.Sequence > o.ToSequence:
+		return false
+	case !o.ToTime.IsZero() && e.Timestamp.After(o.ToTime):
+		return false
+	case e.EventType.keyed() && !strings.HasPrefix(e.Key, o.Prefix):
+		return false
+	}
+	return true
+}
+
+// Restore rebuilds a DB by replaying the events read from logger that are
+// selected by opts. Events without a timestamp, written before timestamps
+// were recorded, are treated as older than any ToTime. The DB ends with an
+// EventMark numbered like the last event read, selected or not, so that
+// a log written from it numbers its events after every event of logger.
+func Restore(logger TransactionLogger, opts RestoreOptions) (DB, error) {
+	db, err := NewInMemoryDB(WithHistoryRetention(1, 0))
+	if err != nil {
+		return nil, err
+	}
+
+	events, errs := logger.ReadEvents()
+
+	var (
+		applyErr       error
+		last, restored uint64
+	)
+	for e := range events {
+		last = e.Sequence
+		if applyErr != nil || !opts.includes(e) {
+			continue // keep draining so the reader can finish
+		}
+		if e.EventType == EventDelete {
+			if _, err := db.Get(e.Key); err != nil {
+				continue // deleted a key outside the restored range
+			}
+		}
+		if err := db.Apply(e); err != nil {
+			applyErr = fmt.Errorf("failed to apply event %d: %w", e.Sequence, err)
+		}
+		restored = e.Sequence
+	}
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+	if applyErr != nil {
+		return nil, applyErr
+	}
+	if last > restored {
+		if err := db.Apply(Event{Sequence: last, EventType: EventMark}); err != nil {
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// WriteCompactedLog writes the live keys of db to filename as a transaction
+// log holding a single put per key, an acquire per held lease and the
+// creation of each index, in sequence order. Each record keeps the
+// sequence number and timestamp of the write that produced it, so an
+// acquire keeps the fencing token of its lease. The log ends with an
+// EventMark numbered like the last event applied to db, so a server
+// started from it continues numbering where db left off. The file is
+// written under a temporary name and renamed into place, so a partially
+// written log is never left at filename.
+func WriteCompactedLog(db DB, filename string, opts ...LogOption) error {
+	entries, last, err := db.Snapshot("")
+	if err != nil {
+		return err
+	}
+
+	leases, err := db.Leases()
+	if err != nil {
+		return err
+	}
+	indexes, err := db.Indexes()
+	if err != nil {
+		return err
+	}
+
+	records := make([]Event, 0, len(entries)+len(leases)+len(indexes))
+	for _, def := range indexes {
+		records = append(records, def.event())
+	}
+	for _, l := range leases {
+		records = append(records, Event{
+			Sequence:  l.Token,
+			EventType: EventAcquire,
+			Key:       l.Name,
+			Value:     l.Owner,
+			Timestamp: l.AcquiredAt,
+			ExpiresAt: l.ExpiresAt,
+		})
+	}
+	for _, cur := range entries {
+		e := Event{
+			Sequence:  cur.Sequence,
+			EventType: EventPut,
+			Key:       cur.Key,
+			Value:     cur.Value,
+			Timestamp: cur.Timestamp,
+			ExpiresAt: cur.ExpiresAt,
+			Flags:     cur.Flags,
+			Lease:     cur.Lease,
+		}
+		if e.Lease != "" {
+			e.ExpiresAt = time.Time{} // taken from the lease on replay
+		}
+		records = append(records, e)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Sequence < records[j].Sequence })
+	if len(records) == 0 || records[len(records)-1].Sequence < last {
+		records = append(records, Event{Sequence: last, EventType: EventMark})
+	}
+
+	return writeLogFile(filename, newLogCodec(opts), func(w recordWriter) error {
+		for _, e := range records {
+			if err := w.write(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
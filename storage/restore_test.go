@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRestore_ToSequenceWithPrefix(t *testing.T) {
+	// 1. Write a log where "app/" keys are bulk-deleted by mistake at the end
+	dir := t.TempDir()
+	source := filepath.Join(dir, "transaction.log")
+
+	lines := []string{
+		"1\t2\tapp/a\t1\t2025-01-01T00:00:00Z\t\t",
+		"2\t2\tapp/b\t2\t2025-01-01T00:01:00Z\t\t",
+		"3\t2\tother\tx\t2025-01-01T00:02:00Z\t\t",
+		"4\t2\tapp/a\t10\t2025-01-01T00:03:00Z\t\t",
+		"5\t1\tapp/a\t\t2025-01-01T00:04:00Z\t\t",
+		"6\t1\tapp/b\t\t2025-01-01T00:05:00Z\t\t",
+	}
+	if err := os.WriteFile(source, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatalf("Failed writing log: %v", err)
+	}
+
+	logger, err := OpenFileTransactionLogger(source)
+	if err != nil {
+		t.Fatalf("OpenFileTransactionLogger returned error: %v", err)
+	}
+
+	// 2. Restore the "app/" keys as they were just before the deletes
+	db, err := Restore(logger, RestoreOptions{ToSequence: 4, Prefix: "app/"})
+	if err != nil {
+		t.Fatalf("Restore returned error: %v", err)
+	}
+
+	all, _ := db.GetAll()
+	expected := map[string]string{"app/a": "10", "app/b": "2"}
+	if !reflect.DeepEqual(all, expected) {
+		t.Errorf("Restored data mismatch.\nGot:      %#v\nExpected: %#v", all, expected)
+	}
+
+	// 3. Write the compacted log and make sure a server could start from it
+	out := filepath.Join(dir, "restored.log")
+	if err := WriteCompactedLog(db, out); err != nil {
+		t.Fatalf("WriteCompactedLog returned error: %v", err)
+	}
+
+	replayed, _ := NewInMemoryDB()
+	restoredLogger, err := InitializeFileTransactionLogger(replayed, out)
+	if err != nil {
+		t.Fatalf("Failed to start from the compacted log: %v", err)
+	}
+
+	all, _ = replayed.GetAll()
+	if !reflect.DeepEqual(all, expected) {
+		t.Errorf("Replayed data mismatch.\nGot:      %#v\nExpected: %#v", all, expected)
+	}
+
+	// New writes continue after the last sequence of the source log, even
+	// though the events after 4 were not restored
+	seq, err := restoredLogger.WriteEvent(Event{EventType: EventPut, Key: "app/c", Value: "3"})
+	if err != nil {
+		t.Fatalf("WriteEvent returned error: %v", err)
+	}
+	if seq != 7 {
+		t.Errorf("Expected the next sequence to be 7, got %d", seq)
+	}
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"github.com/gorilla/mux"
+)
+
+// NewRouter returns a router serving the HTTP API of h. Routes match the
+// escaped path, so keys may contain slashes encoded as %2F.
+func NewRouter(h *Handler) *mux.Router {
+	router := mux.NewRouter().UseEncodedPath()
+	router.Use(RequestIDMiddleware)
+	if h.svc.limiter != nil {
+		router.Use(h.svc.limiter.Middleware)
+	}
+	router.Use(h.idempotency.Middleware)
+	router.HandleFunc("/v1/key", h.GetAllHandler).Methods("GET")
+	router.HandleFunc("/v1/key/{key}", h.GetHandler).Methods("GET")
+	router.HandleFunc("/v1/key/{key}/history", h.HistoryHandler).Methods("GET")
+	router.HandleFunc("/v1/key/{key}", h.UpsertHandler).Methods("PUT")
+	router.HandleFunc("/v1/key/{key}", h.DeleteHandler).Methods("DELETE")
+	router.HandleFunc("/v1/key/{key}", h.PatchHandler).Methods("PATCH")
+	router.HandleFunc("/v1/key/{key}/incr", h.IncrementHandler).Methods("POST")
+	router.HandleFunc("/v1/key/{key}/append", h.AppendHandler).Methods("POST")
+	router.HandleFunc("/v1/lock/{name}", h.GetLockHandler).Methods("GET")
+	router.HandleFunc("/v1/lock/{name}", h.AcquireLockHandler).Methods("POST")
+	router.HandleFunc("/v1/lock/{name}/renew", h.RenewLockHandler).Methods("POST")
+	router.HandleFunc("/v1/lock/{name}", h.ReleaseLockHandler).Methods("DELETE")
+	router.HandleFunc("/v1/index", h.ListIndexesHandler).Methods("GET")
+	router.HandleFunc("/v1/index/{name}", h.QueryIndexHandler).Methods("GET")
+	router.HandleFunc("/v1/index/{name}", h.CreateIndexHandler).Methods("PUT")
+	router.HandleFunc("/v1/index/{name}", h.DropIndexHandler).Methods("DELETE")
+	router.HandleFunc("/v1/batch/get", h.BatchGetHandler).Methods("POST")
+	router.HandleFunc("/v1/batch/put", h.BatchPutHandler).Methods("POST")
+	router.HandleFunc("/v1/export", h.ExportHandler).Methods("GET")
+	router.HandleFunc("/v1/import", h.ImportHandler).Methods("POST")
+	router.HandleFunc("/v1/audit", h.AuditHandler).Methods("GET")
+	router.HandleFunc("/v1/watch", h.WatchHandler).Methods("GET")
+	if h.svc.webhooks != nil {
+		router.HandleFunc("/v1/webhook", h.ListWebhooksHandler).Methods("GET")
+		router.HandleFunc("/v1/webhook", h.RegisterWebhookHandler).Methods("POST")
+		router.HandleFunc("/v1/webhook/{id}", h.GetWebhookHandler).Methods("GET")
+		router.HandleFunc("/v1/webhook/{id}", h.DeleteWebhookHandler).Methods("DELETE")
+	}
+	if h.svc.metrics != nil {
+		router.Handle("/metrics", h.svc.metrics).Methods("GET")
+	}
+	return router
+}
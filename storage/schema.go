@@ -0,0 +1,457 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Schema is a compiled JSON Schema that the values of the keys with a
+// prefix must match; see WithSchema. It supports the validation keywords
+// of JSON Schema (draft 2020-12) that need no references:
+//
+//	type, enum, const
+//	properties, required, additionalProperties, minProperties, maxProperties
+//	items, minItems, maxItems, uniqueItems
+//	minimum, maximum, exclusiveMinimum, exclusiveMaximum, multipleOf
+//	minLength, maxLength, pattern
+//	allOf, anyOf, oneOf, not
+//
+// Annotations such as title and description are ignored, and any other
+// keyword, such as $ref, is refused when the schema is compiled, rather
+// than silently not enforced. A schema may also be true or false.
+type Schema struct {
+	reject bool // the false schema
+
+	types       []string
+	enum        []any
+	constant    any
+	hasConst    bool
+	properties  map[string]*Schema
+	required    []string
+	additional  *Schema
+	items       *Schema
+	allOf       []*Schema
+	anyOf       []*Schema
+	oneOf       []*Schema
+	not         *Schema
+	pattern     *regexp.Regexp
+	uniqueItems bool
+
+	// Bounds, which are NaN or -1 when not set.
+	minimum, maximum, exclusiveMinimum, exclusiveMaximum, multipleOf       float64
+	minLength, maxLength, minItems, maxItems, minProperties, maxProperties int
+}
+
+// schemaAnnotations are the keywords a Schema accepts and ignores.
+var schemaAnnotations = map[string]bool{
+	"$schema": true, "$id": true, "$comment": true, "title": true, "description": true,
+	"default": true, "examples": true, "deprecated": true, "readOnly": true, "writeOnly": true,
+	"format": true,
+}
+
+// schemaTypes are the values of the type keyword.
+var schemaTypes = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true,
+	"number": true, "integer": true, "string": true,
+}
+
+// ParseSchema compiles the JSON Schema in data. It fails with
+// ErrorInvalidArgument if data is not a schema it supports.
+func ParseSchema(data []byte) (*Schema, error) {
+	doc, err := decodeJSON(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid schema: %v", ErrorInvalidArgument, err)
+	}
+	s, err := compileSchema(doc, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid schema: %v", ErrorInvalidArgument, err)
+	}
+	return s, nil
+}
+
+// LoadSchema compiles the JSON Schema in the file filename.
+func LoadSchema(filename string) (*Schema, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read schema: %w", err)
+	}
+	return ParseSchema(data)
+}
+
+// newSchema returns a Schema that matches everything.
+func newSchema() *Schema {
+	nan := math.NaN()
+	return &Schema{
+		minimum: nan, maximum: nan, exclusiveMinimum: nan, exclusiveMaximum: nan, multipleOf: nan,
+		minLength: -1, maxLength: -1, minItems: -1, maxItems: -1, minProperties: -1, maxProperties: -1,
+	}
+}
+
+// compileSchema compiles doc, the schema at path in the whole schema.
+func compileSchema(doc any, path []string) (*Schema, error) {
+	where := formatPointer(path)
+	if where == "" {
+		where = "/"
+	}
+	s := newSchema()
+	if b, ok := doc.(bool); ok {
+		s.reject = !b
+		return s, nil
+	}
+	obj, ok := doc.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: a schema must be an object or a boolean", where)
+	}
+
+	sub := func(keyword string, v any) (*Schema, error) {
+		return compileSchema(v, append(append([]string(nil), path...), keyword))
+	}
+	list := func(keyword string, v any) ([]*Schema, error) {
+		items, ok := v.([]any)
+		if !ok || len(items) == 0 {
+			return nil, fmt.Errorf("%s: %s must be a non-empty array of schemas", where, keyword)
+		}
+		schemas := make([]*Schema, len(items))
+		for i, item := range items {
+			var err error
+			if schemas[i], err = compileSchema(item, append(append([]string(nil), path...), keyword, fmt.Sprint(i))); err != nil {
+				return nil, err
+			}
+		}
+		return schemas, nil
+	}
+	number := func(keyword string, v any) (float64, error) {
+		if n, ok := v.(json.Number); ok {
+			if f, err := n.Float64(); err == nil {
+				return f, nil
+			}
+		}
+		return 0, fmt.Errorf("%s: %s must be a number", where, keyword)
+	}
+	count := func(keyword string, v any) (int, error) {
+		f, err := number(keyword, v)
+		if err != nil || f < 0 || f != math.Trunc(f) || f > math.MaxInt32 {
+			return 0, fmt.Errorf("%s: %s must be a non-negative integer", where, keyword)
+		}
+		return int(f), nil
+	}
+
+	keywords := make([]string, 0, len(obj))
+	for k := range obj {
+		keywords = append(keywords, k)
+	}
+	sort.Strings(keywords)
+
+	var err error
+	for _, keyword := range keywords {
+		v := obj[keyword]
+		switch keyword {
+		case "type":
+			switch t := v.(type) {
+			case string:
+				s.types = []string{t}
+			case []any:
+				for _, name := range t {
+					if name, ok := name.(string); ok {
+						s.types = append(s.types, name)
+					}
+				}
+				if len(s.types) != len(t) {
+					s.types = nil
+				}
+			}
+			if len(s.types) == 0 {
+				return nil, fmt.Errorf("%s: type must be a type name or an array of them", where)
+			}
+			for _, name := range s.types {
+				if !schemaTypes[name] {
+					return nil, fmt.Errorf("%s: unknown type %q", where, name)
+				}
+			}
+		case "enum":
+			if s.enum, ok = v.([]any); !ok {
+				return nil, fmt.Errorf("%s: enum must be an array", where)
+			}
+		case "const":
+			s.constant, s.hasConst = v, true
+		case "properties":
+			props, ok := v.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("%s: properties must be an object", where)
+			}
+			s.properties = make(map[string]*Schema, len(props))
+			for name, prop := range props {
+				if s.properties[name], err = compileSchema(prop, append(append([]string(nil), path...), keyword, name)); err != nil {
+					return nil, err
+				}
+			}
+		case "required":
+			names, ok := v.([]any)
+			for _, name := range names {
+				if name, isString := name.(string); isString {
+					s.required = append(s.required, name)
+				}
+			}
+			if !ok || len(s.required) != len(names) {
+				return nil, fmt.Errorf("%s: required must be an array of strings", where)
+			}
+		case "additionalProperties":
+			s.additional, err = sub(keyword, v)
+		case "items":
+			s.items, err = sub(keyword, v)
+		case "not":
+			s.not, err = sub(keyword, v)
+		case "allOf":
+			s.allOf, err = list(keyword, v)
+		case "anyOf":
+			s.anyOf, err = list(keyword, v)
+		case "oneOf":
+			s.oneOf, err = list(keyword, v)
+		case "minimum":
+			s.minimum, err = number(keyword, v)
+		case "maximum":
+			s.maximum, err = number(keyword, v)
+		case "exclusiveMinimum":
+			s.exclusiveMinimum, err = number(keyword, v)
+		case "exclusiveMaximum":
+			s.exclusiveMaximum, err = number(keyword, v)
+		case "multipleOf":
+			if s.multipleOf, err = number(keyword, v); err == nil && s.multipleOf <= 0 {
+				err = fmt.Errorf("%s: multipleOf must be greater than 0", where)
+			}
+		case "minLength":
+			s.minLength, err = count(keyword, v)
+		case "maxLength":
+			s.maxLength, err = count(keyword, v)
+		case "minItems":
+			s.minItems, err = count(keyword, v)
+		case "maxItems":
+			s.maxItems, err = count(keyword, v)
+		case "minProperties":
+			s.minProperties, err = count(keyword, v)
+		case "maxProperties":
+			s.maxProperties, err = count(keyword, v)
+		case "uniqueItems":
+			if s.uniqueItems, ok = v.(bool); !ok {
+				err = fmt.Errorf("%s: uniqueItems must be a boolean", where)
+			}
+		case "pattern":
+			p, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: pattern must be a string", where)
+			}
+			if s.pattern, err = regexp.Compile(p); err != nil {
+				err = fmt.Errorf("%s: invalid pattern: %v", where, err)
+			}
+		default:
+			if !schemaAnnotations[keyword] {
+				return nil, fmt.Errorf("%s: unsupported keyword %q", where, keyword)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Validate checks that value is a JSON document matching s. It fails with
+// ErrorInvalidArgument, naming the first part of the document that does
+// not match.
+func (s *Schema) Validate(value string) error {
+	doc, err := decodeJSON(value)
+	if err != nil {
+		return fmt.Errorf("%w: value is not a JSON document", ErrorInvalidArgument)
+	}
+	if problem := s.check(doc, nil); problem != "" {
+		return fmt.Errorf("%w: value does not match the schema: %s", ErrorInvalidArgument, problem)
+	}
+	return nil
+}
+
+// check returns why v, at path in the document, does not match s, or ""
+// if it does.
+func (s *Schema) check(v any, path []string) string {
+	fail := func(format string, args ...any) string {
+		where := formatPointer(path)
+		if where == "" {
+			where = "/"
+		}
+		return where + ": " + fmt.Sprintf(format, args...)
+	}
+	if s.reject {
+		return fail("no value is allowed")
+	}
+
+	if len(s.types) > 0 {
+		matched := false
+		for _, t := range s.types {
+			if jsonType(v) == t || (t == "number" && jsonType(v) == "integer") {
+				matched = true
+			}
+		}
+		if !matched {
+			return fail("expected %s, got %s", strings.Join(s.types, " or "), jsonType(v))
+		}
+	}
+	if s.enum != nil {
+		found := false
+		for _, allowed := range s.enum {
+			found = found || jsonEqual(v, allowed)
+		}
+		if !found {
+			return fail("value is not one of the allowed values")
+		}
+	}
+	if s.hasConst && !jsonEqual(v, s.constant) {
+		return fail("value is not the allowed value")
+	}
+
+	switch x := v.(type) {
+	case json.Number:
+		if problem := s.checkNumber(x); problem != "" {
+			return fail("%s", problem)
+		}
+	case string:
+		n := utf8.RuneCountInString(x)
+		switch {
+		case s.minLength >= 0 && n < s.minLength:
+			return fail("string is shorter than %d characters", s.minLength)
+		case s.maxLength >= 0 && n > s.maxLength:
+			return fail("string is longer than %d characters", s.maxLength)
+		case s.pattern != nil && !s.pattern.MatchString(x):
+			return fail("string does not match %q", s.pattern)
+		}
+	case []any:
+		switch {
+		case s.minItems >= 0 && len(x) < s.minItems:
+			return fail("array has fewer than %d items", s.minItems)
+		case s.maxItems >= 0 && len(x) > s.maxItems:
+			return fail("array has more than %d items", s.maxItems)
+		}
+		for i, item := range x {
+			if s.uniqueItems {
+				for j := 0; j < i; j++ {
+					if jsonEqual(x[j], item) {
+						return fail("items %d and %d are equal", j, i)
+					}
+				}
+			}
+			if s.items != nil {
+				if problem := s.items.check(item, append(path, fmt.Sprint(i))); problem != "" {
+					return problem
+				}
+			}
+		}
+	case map[string]any:
+		switch {
+		case s.minProperties >= 0 && len(x) < s.minProperties:
+			return fail("object has fewer than %d properties", s.minProperties)
+		case s.maxProperties >= 0 && len(x) > s.maxProperties:
+			return fail("object has more than %d properties", s.maxProperties)
+		}
+		for _, name := range s.required {
+			if _, ok := x[name]; !ok {
+				return fail("missing required property %q", name)
+			}
+		}
+		names := make([]string, 0, len(x))
+		for name := range x {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			prop, ok := s.properties[name]
+			if !ok {
+				prop = s.additional
+			}
+			if prop != nil {
+				if problem := prop.check(x[name], append(path, name)); problem != "" {
+					return problem
+				}
+			}
+		}
+	}
+
+	for _, sub := range s.allOf {
+		if problem := sub.check(v, path); problem != "" {
+			return problem
+		}
+	}
+	if s.anyOf != nil {
+		matched := false
+		for _, sub := range s.anyOf {
+			matched = matched || sub.check(v, path) == ""
+		}
+		if !matched {
+			return fail("value matches none of anyOf")
+		}
+	}
+	if s.oneOf != nil {
+		matches := 0
+		for _, sub := range s.oneOf {
+			if sub.check(v, path) == "" {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fail("value matches %d of oneOf, not exactly one", matches)
+		}
+	}
+	if s.not != nil && s.not.check(v, path) == "" {
+		return fail("value matches the schema of not")
+	}
+	return ""
+}
+
+// checkNumber returns why n breaks the numeric bounds of s, or "".
+func (s *Schema) checkNumber(n json.Number) string {
+	f, err := n.Float64()
+	if err != nil {
+		return "number is out of range"
+	}
+	switch {
+	case f < s.minimum:
+		return fmt.Sprintf("number is less than %v", s.minimum)
+	case f > s.maximum:
+		return fmt.Sprintf("number is greater than %v", s.maximum)
+	case f <= s.exclusiveMinimum:
+		return fmt.Sprintf("number is not greater than %v", s.exclusiveMinimum)
+	case f >= s.exclusiveMaximum:
+		return fmt.Sprintf("number is not less than %v", s.exclusiveMaximum)
+	case s.multipleOf > 0:
+		if q := f / s.multipleOf; math.Abs(q-math.Round(q)) > 1e-9 {
+			return fmt.Sprintf("number is not a multiple of %v", s.multipleOf)
+		}
+	}
+	return ""
+}
+
+// jsonType returns the JSON Schema type of v, a value produced by
+// decodeJSON. Numbers without a fractional part are integers.
+func jsonType(v any) string {
+	switch x := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	case json.Number:
+		if f, err := x.Float64(); err == nil && f == math.Trunc(f) && !math.IsInf(f, 0) {
+			return "integer"
+		}
+		return "number"
+	}
+	return fmt.Sprintf("%T", v)
+}
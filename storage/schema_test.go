@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSchema(t *testing.T) {
+	schema, err := ParseSchema([]byte(`{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"title": "order",
+		"type": "object",
+		"required": ["id", "items"],
+		"additionalProperties": false,
+		"properties": {
+			"id": {"type": "string", "pattern": "^o-[0-9]+$"},
+			"status": {"enum": ["open", "paid"]},
+			"total": {"type": "number", "exclusiveMinimum": 0, "multipleOf": 0.01},
+			"items": {
+				"type": "array", "minItems": 1, "uniqueItems": true,
+				"items": {"type": "object", "required": ["sku"], "properties": {"qty": {"type": "integer", "minimum": 1}}}
+			},
+			"note": {"anyOf": [{"type": "string", "maxLength": 5}, {"type": "null"}]},
+			"kind": {"oneOf": [{"const": "a"}, {"type": "string", "minLength": 2}]},
+			"tag": {"not": {"const": "x"}}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("ParseSchema returned error: %v", err)
+	}
+
+	for _, doc := range []string{
+		`{"id": "o-1", "items": [{"sku": "a"}]}`,
+		`{"id": "o-2", "status": "paid", "total": 10.25, "items": [{"sku": "a", "qty": 2.0}, {"sku": "b"}],
+			"note": null, "kind": "bb", "tag": "y"}`,
+	} {
+		if err := schema.Validate(doc); err != nil {
+			t.Errorf("Expected %s to be valid, got %v", doc, err)
+		}
+	}
+
+	for _, tc := range []struct{ doc, problem string }{
+		{`[]`, "/: expected object, got array"},
+		{`{"id": "o-1"}`, `/: missing required property "items"`},
+		{`{"id": "x", "items": [{"sku": "a"}]}`, "/id: string does not match"},
+		{`{"id": "o-1", "items": [], "extra": 1}`, "/extra: no value is allowed"},
+		{`{"id": "o-1", "items": []}`, "/items: array has fewer than 1 items"},
+		{`{"id": "o-1", "items": [{"sku": "a"}, {"sku": "a"}]}`, "/items: items 0 and 1 are equal"},
+		{`{"id": "o-1", "items": [{"sku": "a", "qty": 1.5}]}`, "/items/0/qty: expected integer, got number"},
+		{`{"id": "o-1", "items": [{"qty": 1}]}`, `/items/0: missing required property "sku"`},
+		{`{"id": "o-1", "items": [{"sku": "a"}], "status": "lost"}`, "/status: value is not one of the allowed values"},
+		{`{"id": "o-1", "items": [{"sku": "a"}], "total": 0}`, "/total: number is not greater than 0"},
+		{`{"id": "o-1", "items": [{"sku": "a"}], "total": 1.001}`, "/total: number is not a multiple of 0.01"},
+		{`{"id": "o-1", "items": [{"sku": "a"}], "note": "too long"}`, "/note: value matches none of anyOf"},
+		{`{"id": "o-1", "items": [{"sku": "a"}], "kind": "b"}`, "/kind: value matches 0 of oneOf"},
+		{`{"id": "o-1", "items": [{"sku": "a"}], "tag": "x"}`, "/tag: value matches the schema of not"},
+		{`{"id": "o-1", "items": [{"sku": "a"}]} {}`, "not a JSON document"},
+	} {
+		err := schema.Validate(tc.doc)
+		if !errors.Is(err, ErrorInvalidArgument) || !strings.Contains(err.Error(), tc.problem) {
+			t.Errorf("%s: expected %q, got %v", tc.doc, tc.problem, err)
+		}
+	}
+
+	for _, bad := range []string{
+		`[]`,
+		`{"type": "float"}`,
+		`{"$ref": "#/$defs/x"}`,
+		`{"properties": {"a": {"minLength": -1}}}`,
+		`{"pattern": "("}`,
+		`{"anyOf": []}`,
+	} {
+		if _, err := ParseSchema([]byte(bad)); !errors.Is(err, ErrorInvalidArgument) {
+			t.Errorf("%s: expected ErrorInvalidArgument, got %v", bad, err)
+		}
+	}
+	if s, err := ParseSchema([]byte(`false`)); err != nil || s.Validate(`1`) == nil {
+		t.Errorf("Expected the false schema to refuse everything, got %v", err)
+	}
+}
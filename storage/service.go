@@ -0,0 +1,572 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Service carries out the operations of the store for its front-ends, the
+// HTTP Handler and the gRPC server, so that they behave the same. It reads
+// from a DB and writes through the TransactionLogger bound to it.
+type Service struct {
+	db     DB
+	logger TransactionLogger
+
+	// mu serializes writes, so that a read-modify-write such as Increment
+	// sees no other write between its read and its write.
+	mu sync.Mutex
+
+	readOnly     bool
+	maxValueSize int64
+	schemas      map[string]*Schema
+	broker       *Broker
+	limiter      *RateLimiter
+	metrics      *Metrics
+	webhooks     *Webhooks
+}
+
+// ServiceOption configures the Service returned by NewService.
+type ServiceOption func(*Service)
+
+// HandlerOption configures the Service of the Handler returned by
+// NewHandler.
+type HandlerOption = ServiceOption
+
+// WithReadOnly makes the Service refuse every write with ErrorReadOnly.
+func WithReadOnly() ServiceOption {
+	return func(s *Service) {
+		s.readOnly = true
+	}
+}
+
+// WithMaxValueSize makes the Service refuse values larger than n bytes with
+// ErrorTooLarge.
+func WithMaxValueSize(n int64) ServiceOption {
+	return func(s *Service) {
+		s.maxValueSize = n
+	}
+}
+
+// WithSchema makes the Service refuse, with ErrorInvalidArgument, writes
+// that would leave a key with prefix holding a value that is not a JSON
+// document matching schema. Writes are checked against the schema of the
+// longest prefix of their key that has one. Values written before the
+// schema was set are not checked until they are next written.
+func WithSchema(prefix string, schema *Schema) ServiceOption {
+	return func(s *Service) {
+		if s.schemas == nil {
+			s.schemas = make(map[string]*Schema)
+		}
+		s.schemas[prefix] = schema
+	}
+}
+
+// WithWatch enables Watch, which streams the events published to b. b
+// should be the broker the DB publishes to.
+func WithWatch(b *Broker) ServiceOption {
+	return func(s *Service) {
+		s.broker = b
+	}
+}
+
+// WithRateLimiter limits the requests each client makes to the HTTP API
+// with l.
+func WithRateLimiter(l *RateLimiter) ServiceOption {
+	return func(s *Service) {
+		s.limiter = l
+	}
+}
+
+// WithMetrics serves the metrics of m on /metrics of the HTTP API.
+func WithMetrics(m *Metrics) ServiceOption {
+	return func(s *Service) {
+		s.metrics = m
+	}
+}
+
+// WithWebhooks serves the webhooks of w on /v1/webhook of the HTTP API.
+// w delivers nothing until it is started with the Service.
+func WithWebhooks(w *Webhooks) ServiceOption {
+	return func(s *Service) {
+		s.webhooks = w
+	}
+}
+
+// NewService returns a Service that reads from db and writes through
+// logger. The logger must be bound to db by InitializeTransactionLogger or
+// one of its siblings, which apply each write to db before logging it.
+func NewService(db DB, logger TransactionLogger, opts ...ServiceOption) *Service {
+	s := &Service{db: db, logger: logger}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Caller identifies who made a request. It is recorded with the events
+// the request causes.
+type Caller struct {
+	RequestID string
+	Principal string
+}
+
+// Op is one write of a transaction: a put of Value to Key, or a delete of
+// Key. A put with a non-zero ExpiresAt is visible until then, and keeps
+// Flags with its value. A put with a Lease attaches Key to that lease,
+// which must be held, and is visible until the lease ends instead. The op
+// is only applied if If holds.
+type Op struct {
+	Type      EventType
+	Key       string
+	Value     string
+	ExpiresAt time.Time
+	Flags     uint32
+	Lease     string
+	If        Condition
+}
+
+// Condition is a precondition of an Op, checked against the store as it
+// was before the transaction. The zero Condition always holds.
+type Condition struct {
+	// Exists requires the key to have a value; ErrorNoSuchKey if not.
+	Exists bool
+	// Missing requires the key to have no value; ErrorPreconditionFailed
+	// if it has one.
+	Missing bool
+	// Sequence, if not zero, requires the key's value to have been
+	// written by the event with this sequence number: ErrorNoSuchKey if
+	// the key has no value, ErrorPreconditionFailed if another wrote it.
+	Sequence uint64
+	// LeaseToken, if not zero, requires the op's Lease to have this
+	// fencing token: ErrorNoSuchKey if the lease is not held, ErrorConflict
+	// if another holder has taken it since.
+	LeaseToken uint64
+}
+
+// Get returns the current value of key.
+func (s *Service) Get(key string) (string, error) {
+	if err := s.checkRead(); err != nil {
+		return "", err
+	}
+	value, err := s.db.Get(key)
+	if err != nil {
+		return "", err
+	}
+	return *value, nil
+}
+
+// GetAt returns the value key held just after the event with sequence seq.
+func (s *Service) GetAt(key string, seq uint64) (string, error) {
+	if err := s.checkRead(); err != nil {
+		return "", err
+	}
+	value, err := s.db.GetAt(key, seq)
+	if err != nil {
+		return "", err
+	}
+	return *value, nil
+}
+
+// GetAtTime returns the value key held at time t.
+func (s *Service) GetAtTime(key string, t time.Time) (string, error) {
+	if err := s.checkRead(); err != nil {
+		return "", err
+	}
+	value, err := s.db.GetAtTime(key, t)
+	if err != nil {
+		return "", err
+	}
+	return *value, nil
+}
+
+// Lookup returns the current version of key, including its expiry and
+// flags.
+func (s *Service) Lookup(key string) (Version, error) {
+	if err := s.checkRead(); err != nil {
+		return Version{}, err
+	}
+	return s.db.Lookup(key)
+}
+
+// LookupRaw returns the current version of key, with its value compressed
+// if it is stored compressed; see Version.
+func (s *Service) LookupRaw(key string) (Version, error) {
+	if err := s.checkRead(); err != nil {
+		return Version{}, err
+	}
+	return s.db.LookupRaw(key)
+}
+
+// LookupMany returns the current versions of those keys that have a value,
+// all as of a single moment.
+func (s *Service) LookupMany(keys []string) (map[string]Version, error) {
+	if err := s.checkRead(); err != nil {
+		return nil, err
+	}
+	return s.db.LookupMany(keys)
+}
+
+// Snapshot returns the current versions of the keys with prefix, sorted by
+// key, and the sequence number of the last change they reflect.
+func (s *Service) Snapshot(prefix string) ([]Entry, uint64, error) {
+	if err := s.checkRead(); err != nil {
+		return nil, 0, err
+	}
+	return s.db.Snapshot(prefix)
+}
+
+// History returns the retained versions of key, oldest first.
+func (s *Service) History(key string) ([]Version, error) {
+	if err := s.checkRead(); err != nil {
+		return nil, err
+	}
+	return s.db.History(key)
+}
+
+// List returns the keys with prefix and their values. An empty prefix
+// lists the whole store.
+func (s *Service) List(prefix string) (map[string]string, error) {
+	if err := s.checkRead(); err != nil {
+		return nil, err
+	}
+	all, err := s.db.GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	if prefix != "" {
+		for k := range all {
+			if !strings.HasPrefix(k, prefix) {
+				delete(all, k)
+			}
+		}
+	}
+	return all, nil
+}
+
+// Put sets key to value and returns the sequence number of the change.
+func (s *Service) Put(c Caller, key, value string) (uint64, error) {
+	return s.Txn(c, []Op{{Type: EventPut, Key: key, Value: value}})
+}
+
+// Delete removes key and returns the sequence number of the change.
+func (s *Service) Delete(c Caller, key string) (uint64, error) {
+	return s.Txn(c, []Op{{Type: EventDelete, Key: key}})
+}
+
+// Txn applies ops in order as a single change: either all of them take
+// effect, or none does, for example because one deletes a missing key.
+// It returns the sequence number of the last op.
+func (s *Service) Txn(c Caller, ops []Op) (uint64, error) {
+	if s.readOnly {
+		return 0, ErrorReadOnly
+	}
+	if len(ops) == 0 {
+		return 0, fmt.Errorf("%w: a transaction needs at least one operation", ErrorInvalidArgument)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.txn(c, ops)
+}
+
+func (s *Service) txn(c Caller, ops []Op) (uint64, error) {
+	now := time.Now().UTC()
+	events := make([]Event, len(ops))
+	for i, op := range ops {
+		if err := s.checkOp(op); err != nil {
+			return 0, err
+		}
+		if err := s.checkCondition(op); err != nil {
+			return 0, err
+		}
+		events[i] = Event{
+			EventType: op.Type,
+			Key:       op.Key,
+			Value:     op.Value,
+			ExpiresAt: op.ExpiresAt,
+			Flags:     op.Flags,
+			Lease:     op.Lease,
+			Timestamp: now,
+			RequestID: c.RequestID,
+			Principal: c.Principal,
+		}
+	}
+	return s.logger.WriteEvents(events)
+}
+
+// Increment adds delta to the integer value of key, treating a missing key
+// as 0, and returns the new value. The key keeps its expiry and flags. It
+// fails with ErrorInvalidArgument if the value is not a decimal integer or
+// the result would overflow.
+func (s *Service) Increment(c Caller, key string, delta int64) (int64, error) {
+	result, err := s.update(c, EventIncrement, key, strconv.FormatInt(delta, 10))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(result, 10, 64)
+}
+
+// Append adds suffix to the end of the value of key, treating a missing
+// key as empty, and returns the new value. The key keeps its expiry and
+// flags.
+func (s *Service) Append(c Caller, key, suffix string) (string, error) {
+	return s.update(c, EventAppend, key, suffix)
+}
+
+// Patch applies patch, a document of media type contentType, to the JSON
+// value of key, and returns the new value. contentType is
+// ContentTypeMergePatch, for an RFC 7386 merge patch, which treats a
+// missing key as null, or ContentTypeJSONPatch, for an RFC 6902 JSON
+// Patch, which needs the key to exist. The key keeps its expiry and flags.
+//
+// It fails with ErrorInvalidArgument if the patch is malformed or the
+// value is not JSON, ErrorConflict if the patch does not fit the value,
+// and ErrorPreconditionFailed if a test operation fails.
+func (s *Service) Patch(c Caller, key, contentType, patch string) (string, error) {
+	t, err := patchEventType(contentType)
+	if err != nil {
+		return "", err
+	}
+	return s.update(c, t, key, patch)
+}
+
+// update writes an update event, which the DB resolves against the current
+// value of key, and returns the key's new value.
+func (s *Service) update(c Caller, t EventType, key, value string) (string, error) {
+	if s.readOnly {
+		return "", ErrorReadOnly
+	}
+	if key == "" {
+		return "", fmt.Errorf("%w: key must not be empty", ErrorInvalidArgument)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := []Event{{
+		EventType: t,
+		Key:       key,
+		Value:     value,
+		Timestamp: time.Now().UTC(),
+		RequestID: c.RequestID,
+		Principal: c.Principal,
+	}}
+	if err := s.checkUpdate(events[0]); err != nil {
+		return "", err
+	}
+	if _, err := s.logger.WriteEvents(events); err != nil {
+		return "", err
+	}
+	return events[0].Result, nil
+}
+
+// checkRead fails with ErrorUnavailable once a write to the log has
+// failed, since the DB may then hold a change that was never logged and
+// would be lost on a restart.
+func (s *Service) checkRead() error {
+	if f, ok := s.logger.(writeFailer); ok && f.writeFailed() {
+		return fmt.Errorf("%w: transaction log write failed", ErrorUnavailable)
+	}
+	return nil
+}
+
+func (s *Service) checkOp(op Op) error {
+	switch {
+	case op.Key == "":
+		return fmt.Errorf("%w: key must not be empty", ErrorInvalidArgument)
+	case op.Type != EventPut && op.Type != EventDelete:
+		return fmt.Errorf("%w: unknown operation %v", ErrorInvalidArgument, op.Type)
+	case op.Lease != "" && op.Type != EventPut:
+		return fmt.Errorf("%w: only a put can attach a key to a lease", ErrorInvalidArgument)
+	case op.If.LeaseToken != 0 && op.Lease == "":
+		return fmt.Errorf("%w: a fencing token needs a lease", ErrorInvalidArgument)
+	case op.Type == EventPut:
+		return s.checkValue(op.Key, op.Value)
+	}
+	return nil
+}
+
+// checkValue checks that value fits the size limit and the schema of key.
+func (s *Service) checkValue(key, value string) error {
+	if s.maxValueSize > 0 && int64(len(value)) > s.maxValueSize {
+		return fmt.Errorf("%w: values are limited to %d bytes", ErrorTooLarge, s.maxValueSize)
+	}
+	if schema := s.schema(key); schema != nil {
+		if err := schema.Validate(value); err != nil {
+			return fmt.Errorf("cannot write %q: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// checkUpdate works out the value the update e will give its key, as the
+// DB will, and checks it with checkValue. Since the DB only reads the
+// current value when it applies e, the caller must hold s.mu, so that no
+// other write comes between. An update the DB would refuse fails with the
+// error the DB would give. The key is read with Peek, so that the check
+// does not count as a use for eviction.
+func (s *Service) checkUpdate(e Event) error {
+	if s.maxValueSize <= 0 && s.schema(e.Key) == nil {
+		return nil
+	}
+	cur, err := s.db.Peek(e.Key)
+	if errors.Is(err, ErrorNoSuchKey) {
+		cur, err = Version{Deleted: true}, nil
+	}
+	if err != nil {
+		return err
+	}
+	v, err := nextVersion(e, cur)
+	if err != nil {
+		return err
+	}
+	return s.checkValue(e.Key, v.Value)
+}
+
+// schema returns the schema the values of key must match, if any: that of
+// the longest prefix of key.
+func (s *Service) schema(key string) *Schema {
+	var schema *Schema
+	longest := -1
+	for prefix, sch := range s.schemas {
+		if strings.HasPrefix(key, prefix) && len(prefix) > longest {
+			schema, longest = sch, len(prefix)
+		}
+	}
+	return schema
+}
+
+// checkCondition checks op.If. The caller must hold s.mu.
+func (s *Service) checkCondition(op Op) error {
+	if op.If.LeaseToken != 0 {
+		l, err := s.db.LookupLease(op.Lease)
+		if err != nil {
+			return err
+		}
+		if l.Token != op.If.LeaseToken {
+			return fmt.Errorf("%w: lock %q has fencing token %d, not %d",
+				ErrorConflict, op.Lease, l.Token, op.If.LeaseToken)
+		}
+	}
+	if op.If == (Condition{LeaseToken: op.If.LeaseToken}) {
+		return nil
+	}
+
+	cur, err := s.db.Lookup(op.Key)
+	exists := err == nil
+	if err != nil && !errors.Is(err, ErrorNoSuchKey) {
+		return err
+	}
+
+	switch {
+	case (op.If.Exists || op.If.Sequence != 0) && !exists:
+		return fmt.Errorf("%w: %q", ErrorNoSuchKey, op.Key)
+	case op.If.Missing && exists:
+		return fmt.Errorf("%w: %q already exists", ErrorPreconditionFailed, op.Key)
+	case op.If.Sequence != 0 && cur.Sequence != op.If.Sequence:
+		return fmt.Errorf("%w: %q was last written by event %d, not %d",
+			ErrorPreconditionFailed, op.Key, cur.Sequence, op.If.Sequence)
+	}
+	return nil
+}
+
+// Events streams the logged events after sequence number since, in order,
+// until ctx is done.
+func (s *Service) Events(ctx context.Context, since uint64) (<-chan Event, <-chan error) {
+	return s.logger.ReadEventsSince(ctx, since)
+}
+
+// KeyEvents is Events for the events of key alone, stopping after limit
+// events if limit is not zero.
+func (s *Service) KeyEvents(ctx context.Context, key string, since uint64, limit int) (<-chan Event, <-chan error) {
+	return s.logger.ReadKeyEventsSince(ctx, key, since, limit)
+}
+
+// errWatcherBehind is returned by Watch when the watcher falls too far
+// behind the changes published.
+var errWatcherBehind = fmt.Errorf("%w: watcher fell behind", ErrorUnavailable)
+
+// Watch calls send with each change to keys with prefix, in sequence order,
+// until ctx is done or send fails. With catchUp it starts with the logged
+// changes after sequence number since; otherwise with the next change.
+// A change is only sent once it is written to the log. idle, if not nil,
+// is called whenever no further change is waiting, which is when a
+// front-end that buffers should flush. Watch fails with ErrorUnavailable
+// if the watcher falls too far behind, in which case it should start
+// again from the last sequence number it saw, or if a write to the log
+// fails.
+func (s *Service) Watch(ctx context.Context, prefix string, since uint64, catchUp bool,
+	send func(Event) error, idle func() error) error {
+	if s.broker == nil {
+		return fmt.Errorf("%w: watch is not enabled", ErrorUnavailable)
+	}
+	if idle == nil {
+		idle = func() error { return nil }
+	}
+
+	// Subscribe before reading the log, so that nothing written while the
+	// log is read is missed. Events seen twice are skipped by sequence.
+	sub := s.broker.Subscribe(prefix)
+	defer sub.Close()
+
+	last := since
+	deliver := func(e Event) error {
+		if e.Sequence <= last || !e.EventType.keyed() || !strings.HasPrefix(e.Key, prefix) {
+			return nil
+		}
+		if err := s.checkRead(); err != nil {
+			return err
+		}
+		if w, ok := s.logger.(writeWaiter); ok && !w.waitWritten(e.Sequence) {
+			return fmt.Errorf("%w: transaction log write failed", ErrorUnavailable)
+		}
+		last = e.Sequence
+		return send(e)
+	}
+
+	if catchUp {
+		readCtx, cancel := context.WithCancel(ctx)
+		events, errs := s.Events(readCtx, since)
+		var err error
+		for e := range events {
+			if err = deliver(e); err != nil {
+				break
+			}
+		}
+		cancel() // stops the reader if delivery failed
+		if err == nil {
+			err = <-errs
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := idle(); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e, ok := <-sub.C:
+			if !ok {
+				return errWatcherBehind
+			}
+			if err := deliver(e); err != nil {
+				return err
+			}
+			if len(sub.C) == 0 {
+				if err := idle(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
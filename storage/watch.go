@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// WatchHandler streams changes to keys with ?prefix= as newline-delimited
+// JSON AuditRecords. With ?since=<seq> it first replays the logged events
+// after that sequence number, so a client that reconnects with the last
+// sequence it saw misses nothing. The stream ends if the client falls too
+// far behind; it should then reconnect the same way.
+func (h *Handler) WatchHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	prefix := q.Get("prefix")
+
+	var since uint64
+	catchUp := q.Has("since")
+	if catchUp {
+		var err error
+		if since, err = strconv.ParseUint(q.Get("since"), 10, 64); err != nil {
+			writeError(w, r, fmt.Errorf("%w: invalid since: %v", ErrorInvalidArgument, err))
+			return
+		}
+	}
+
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	// The header is written once the watch has started, so that a watch
+	// that cannot start gets an error response instead.
+	started := false
+	start := func() {
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+	}
+
+	send := func(e Event) error {
+		start()
+		return enc.Encode(NewAuditRecord(e))
+	}
+	idle := func() error {
+		start()
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	err := h.svc.Watch(r.Context(), prefix, since, catchUp, send, idle)
+	if err != nil && !started {
+		writeError(w, r, err)
+	}
+}
@@ -0,0 +1,602 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	mathrand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Headers of a webhook delivery. The signature is "sha256=" and the hex
+// HMAC-SHA256, keyed with the webhook's secret, of the timestamp, a dot
+// and the body; see SignWebhook.
+const (
+	WebhookIDHeader        = "X-Webhook-Id"
+	WebhookDeliveryHeader  = "X-Webhook-Delivery" // <webhook ID>-<sequence>, the same for every attempt
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	WebhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// States of a WebhookDelivery.
+const (
+	DeliveryPending   = "pending"   // being attempted, or waiting to be retried
+	DeliveryDelivered = "delivered" // the receiver responded with a 2xx status
+	DeliveryFailed    = "failed"    // given up on after the last attempt
+)
+
+const (
+	defaultWebhookAttempts   = 10
+	defaultWebhookBackoff    = time.Second
+	defaultWebhookMaxBackoff = 5 * time.Minute
+	defaultWebhookTimeout    = 10 * time.Second
+
+	// webhookDeliveriesKept is how many of its latest deliveries the status
+	// of a webhook lists.
+	webhookDeliveriesKept = 50
+)
+
+// Webhook is a callback URL that is sent each change to the keys with
+// Prefix, as an AuditRecord in a POST, starting with the first change
+// after the event with sequence number Since. Secret keys the signature
+// of each delivery; it is only returned when the webhook is registered.
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Prefix    string    `json:"prefix"`
+	Secret    string    `json:"secret,omitempty"`
+	Since     uint64    `json:"since"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookDelivery is the delivery of the change with sequence number
+// Sequence to a webhook. Status and Error are those of the last attempt.
+type WebhookDelivery struct {
+	Sequence    uint64     `json:"sequence"`
+	Key         string     `json:"key"`
+	State       string     `json:"state"`
+	Attempts    int        `json:"attempts"`
+	Status      int        `json:"status,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	LastAttempt time.Time  `json:"last_attempt"`
+	NextAttempt *time.Time `json:"next_attempt,omitempty"`
+}
+
+// WebhookStatus is a Webhook, without its secret, with the state of its
+// deliveries. Delivered is the sequence number of the last change it has
+// been sent, or given up on; the changes after it are still to be sent.
+type WebhookStatus struct {
+	Webhook
+	Delivered  uint64            `json:"delivered"`
+	Succeeded  uint64            `json:"succeeded"`
+	Failed     uint64            `json:"failed"`
+	Deliveries []WebhookDelivery `json:"deliveries"` // the latest, newest first
+}
+
+// WebhookOption configures the Webhooks returned by OpenWebhooks.
+type WebhookOption func(*Webhooks)
+
+// WithWebhookRetries makes each change be sent up to attempts times, the
+// retries after a random delay of up to backoff, doubled after each
+// attempt up to maxBackoff, or after the delay the receiver asks for with
+// Retry-After. A change is given up on after the last attempt.
+func WithWebhookRetries(attempts int, backoff, maxBackoff time.Duration) WebhookOption {
+	return func(w *Webhooks) {
+		w.attempts, w.backoff, w.maxBackoff = attempts, backoff, maxBackoff
+	}
+}
+
+// WithWebhookClient sends deliveries with c, which should have a timeout,
+// instead of a client with a timeout of 10 seconds.
+func WithWebhookClient(c *http.Client) WebhookOption {
+	return func(w *Webhooks) {
+		w.client = c
+	}
+}
+
+// Webhooks delivers the changes to the store to registered webhooks. Each
+// webhook is sent the changes in sequence order, one at a time, at least
+// once: a change is retried until the receiver accepts it or the attempts
+// run out, and a receiver should use the X-Webhook-Delivery header to
+// ignore repeats.
+//
+// The outbox of a webhook is the transaction log itself. The webhooks and
+// the sequence number each has delivered up to are kept in a file,
+// rewritten whenever they change, so that after a restart each webhook
+// resumes with the first change it had not been sent.
+type Webhooks struct {
+	filename   string
+	client     *http.Client
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	mu      sync.Mutex
+	hooks   map[string]*webhookState
+	svc     *Service
+	ctx     context.Context
+	stop    context.CancelFunc
+	retries uint64
+}
+
+// webhookState is a webhook and its deliveries, as kept in the file.
+type webhookState struct {
+	Webhook
+	Delivered  uint64            `json:"delivered"`
+	Succeeded  uint64            `json:"succeeded"`
+	Failed     uint64            `json:"failed"`
+	Deliveries []WebhookDelivery `json:"deliveries,omitempty"`
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// OpenWebhooks returns Webhooks kept in filename, loading those registered
+// before; an empty filename keeps them in memory only. Nothing is
+// delivered until Start is called.
+func OpenWebhooks(filename string, opts ...WebhookOption) (*Webhooks, error) {
+	w := &Webhooks{
+		filename:   filename,
+		client:     &http.Client{Timeout: defaultWebhookTimeout},
+		attempts:   defaultWebhookAttempts,
+		backoff:    defaultWebhookBackoff,
+		maxBackoff: defaultWebhookMaxBackoff,
+		hooks:      make(map[string]*webhookState),
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	if w.attempts < 1 {
+		return nil, fmt.Errorf("%w: webhooks need at least one attempt", ErrorInvalidArgument)
+	}
+	if filename == "" {
+		return w, nil
+	}
+
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return w, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read webhooks: %w", err)
+	}
+	var states []*webhookState
+	if err := json.Unmarshal(data, &states); err != nil {
+		return nil, fmt.Errorf("cannot read webhooks from %s: %w", filename, err)
+	}
+	for _, st := range states {
+		w.hooks[st.ID] = st
+	}
+	return w, nil
+}
+
+// Start delivers the changes made through svc, which must have watch
+// enabled, to the webhooks until Close is called.
+func (w *Webhooks) Start(svc *Service) error {
+	if svc.broker == nil {
+		return fmt.Errorf("%w: webhooks need watch to be enabled", ErrorInvalidArgument)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.svc = svc
+	w.ctx, w.stop = context.WithCancel(context.Background())
+	for _, st := range w.hooks {
+		w.run(st)
+	}
+	return nil
+}
+
+// Close stops delivering and waits for deliveries in progress to stop.
+// Changes not yet delivered are sent after the next Start.
+func (w *Webhooks) Close() {
+	w.mu.Lock()
+	if w.stop != nil {
+		w.stop()
+	}
+	var done []chan struct{}
+	for _, st := range w.hooks {
+		if st.done != nil {
+			done = append(done, st.done)
+		}
+	}
+	w.mu.Unlock()
+
+	for _, d := range done {
+		<-d
+	}
+}
+
+// Register adds the webhook with the URL, Prefix and Secret of hook, and
+// returns it with its ID. If hook has no secret, a random one is made. If
+// hook.Since is zero, the webhook is sent the changes made after it is
+// registered.
+func (w *Webhooks) Register(hook Webhook) (Webhook, error) {
+	u, err := url.Parse(hook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return Webhook{}, fmt.Errorf("%w: a webhook needs an http or https URL", ErrorInvalidArgument)
+	}
+	if hook.Secret == "" {
+		hook.Secret = NewRequestID() + NewRequestID()
+	}
+	hook.ID = NewRequestID()[:16]
+	hook.CreatedAt = time.Now().UTC()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.svc == nil {
+		return Webhook{}, fmt.Errorf("%w: webhooks are not started", ErrorUnavailable)
+	}
+	if hook.Since == 0 {
+		if _, hook.Since, err = w.svc.Snapshot(hook.Prefix); err != nil {
+			return Webhook{}, err
+		}
+	}
+
+	st := &webhookState{Webhook: hook, Delivered: hook.Since}
+	w.hooks[hook.ID] = st
+	if err := w.save(); err != nil {
+		delete(w.hooks, hook.ID)
+		return Webhook{}, err
+	}
+	w.run(st)
+	return hook, nil
+}
+
+// Delete removes the webhook with id, waiting for a delivery to it in
+// progress to stop.
+func (w *Webhooks) Delete(id string) error {
+	w.mu.Lock()
+	st, ok := w.hooks[id]
+	if !ok {
+		w.mu.Unlock()
+		return fmt.Errorf("%w: no webhook %q", ErrorNoSuchKey, id)
+	}
+	delete(w.hooks, id)
+	err := w.save()
+	if err != nil {
+		w.hooks[id] = st
+	} else if st.cancel != nil {
+		st.cancel()
+	}
+	w.mu.Unlock()
+
+	if err == nil && st.done != nil {
+		<-st.done
+	}
+	return err
+}
+
+// Status returns the status of the webhook with id.
+func (w *Webhooks) Status(id string) (WebhookStatus, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	st, ok := w.hooks[id]
+	if !ok {
+		return WebhookStatus{}, fmt.Errorf("%w: no webhook %q", ErrorNoSuchKey, id)
+	}
+	return st.status(), nil
+}
+
+// List returns the status of every webhook, oldest first.
+func (w *Webhooks) List() []WebhookStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	statuses := make([]WebhookStatus, 0, len(w.hooks))
+	for _, st := range w.hooks {
+		statuses = append(statuses, st.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if !statuses[i].CreatedAt.Equal(statuses[j].CreatedAt) {
+			return statuses[i].CreatedAt.Before(statuses[j].CreatedAt)
+		}
+		return statuses[i].ID < statuses[j].ID
+	})
+	return statuses
+}
+
+func (st *webhookState) status() WebhookStatus {
+	s := WebhookStatus{
+		Webhook:    st.Webhook,
+		Delivered:  st.Delivered,
+		Succeeded:  st.Succeeded,
+		Failed:     st.Failed,
+		Deliveries: append([]WebhookDelivery{}, st.Deliveries...),
+	}
+	s.Secret = ""
+	return s
+}
+
+// save writes the webhooks to the file, atomically. The caller must hold
+// w.mu.
+func (w *Webhooks) save() error {
+	if w.filename == "" {
+		return nil
+	}
+	states := make([]*webhookState, 0, len(w.hooks))
+	for _, st := range w.hooks {
+		states = append(states, st)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].ID < states[j].ID })
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(w.filename, data); err != nil {
+		return fmt.Errorf("cannot save webhooks: %w", err)
+	}
+	return nil
+}
+
+// run starts delivering to st, if w is started. The caller must hold w.mu.
+func (w *Webhooks) run(st *webhookState) {
+	if w.ctx == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(w.ctx)
+	st.cancel, st.done = cancel, make(chan struct{})
+
+	go func() {
+		defer close(st.done)
+		failures := 0
+		for {
+			w.mu.Lock()
+			since := st.Delivered
+			w.mu.Unlock()
+
+			err := w.svc.Watch(ctx, st.Prefix, since, true, func(e Event) error {
+				failures = 0
+				return w.deliver(ctx, st, e)
+			}, nil)
+			if ctx.Err() != nil {
+				return
+			}
+			// A webhook that fell behind catches up from the log at once;
+			// one that cannot be sent changes because the log failed
+			// waits like after any other error.
+			if errors.Is(err, errWatcherBehind) {
+				continue
+			}
+			log.Printf("webhook %s: %v", st.ID, err)
+			if !sleepContext(ctx, w.delay(failures, 0)) {
+				return
+			}
+			failures++
+		}
+	}()
+}
+
+// deliver sends e to st until the receiver accepts it or the attempts run
+// out. It fails only if st is stopped or its progress cannot be saved, in
+// which case e is sent again later.
+func (w *Webhooks) deliver(ctx context.Context, st *webhookState, e Event) error {
+	body, err := json.Marshal(NewAuditRecord(e))
+	if err != nil {
+		return err
+	}
+
+	d := WebhookDelivery{Sequence: e.Sequence, Key: e.Key, State: DeliveryPending}
+	w.mu.Lock()
+	if len(st.Deliveries) > 0 && st.Deliveries[0].Sequence == e.Sequence {
+		d.Attempts = st.Deliveries[0].Attempts // attempts made before a restart
+	}
+	w.mu.Unlock()
+
+	for {
+		status, retryAfter, err := w.post(ctx, st.Webhook, e.Sequence, body)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		d.Attempts++
+		d.Status, d.Error, d.LastAttempt, d.NextAttempt = status, "", time.Now().UTC(), nil
+		switch {
+		case err == nil:
+			d.State = DeliveryDelivered
+			return w.record(st, d)
+		case d.Attempts >= w.attempts:
+			d.State, d.Error = DeliveryFailed, err.Error()
+			return w.record(st, d)
+		}
+
+		d.Error = err.Error()
+		delay := w.delay(d.Attempts-1, retryAfter)
+		next := d.LastAttempt.Add(delay)
+		d.NextAttempt = &next
+		if err := w.record(st, d); err != nil {
+			return err
+		}
+		if !sleepContext(ctx, delay) {
+			return ctx.Err()
+		}
+	}
+}
+
+// record saves d as the latest delivery to st, and the change it delivers
+// as delivered unless d is still pending.
+func (w *Webhooks) record(st *webhookState, d WebhookDelivery) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.hooks[st.ID] != st {
+		return fmt.Errorf("%w: webhook %s was deleted", ErrorNoSuchKey, st.ID)
+	}
+
+	if len(st.Deliveries) > 0 && st.Deliveries[0].Sequence == d.Sequence {
+		st.Deliveries[0] = d
+	} else {
+		st.Deliveries = append([]WebhookDelivery{d}, st.Deliveries...)
+		if len(st.Deliveries) > webhookDeliveriesKept {
+			st.Deliveries = st.Deliveries[:webhookDeliveriesKept]
+		}
+	}
+	switch d.State {
+	case DeliveryDelivered:
+		st.Delivered = d.Sequence
+		st.Succeeded++
+	case DeliveryFailed:
+		st.Delivered = d.Sequence
+		st.Failed++
+	default:
+		w.retries++
+	}
+	return w.save()
+}
+
+// post makes one attempt to send body, the change with sequence number
+// seq, to hook. It returns the status of the response and the delay it
+// asks for before a retry, if any.
+func (w *Webhooks) post(ctx context.Context, hook Webhook, seq uint64, body []byte) (int, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookIDHeader, hook.ID)
+	req.Header.Set(WebhookDeliveryHeader, fmt.Sprintf("%s-%d", hook.ID, seq))
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(hook.Secret, timestamp, body))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		retryAfter, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return resp.StatusCode, time.Duration(retryAfter) * time.Second,
+			fmt.Errorf("receiver responded %s", resp.Status)
+	}
+	return resp.StatusCode, 0, nil
+}
+
+// delay returns how long to wait before retrying after attempt failures,
+// counting from 0, or retryAfter if the receiver asked for it.
+func (w *Webhooks) delay(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return min(retryAfter, w.maxBackoff)
+	}
+	return backoffDelay(attempt, w.backoff, w.maxBackoff)
+}
+
+// backoffDelay returns a random delay of up to backoff, doubled for each
+// of attempt failures before, up to maxBackoff. Full jitter spreads out
+// the retries of clients that failed together.
+func backoffDelay(attempt int, backoff, maxBackoff time.Duration) time.Duration {
+	d := time.Duration(float64(backoff) * math.Pow(2, float64(attempt)))
+	if d > maxBackoff || d <= 0 {
+		d = maxBackoff
+	}
+	return time.Duration(mathrand.Int64N(int64(d) + 1))
+}
+
+// sleepContext waits for d, and reports whether ctx was still not done
+// by then.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// SignWebhook returns the signature of a delivery of body made at
+// timestamp, in Unix seconds, to a webhook with secret.
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook reports whether signature is the signature of a delivery
+// of body made at timestamp to a webhook with secret. Receivers should
+// also refuse deliveries whose timestamp is too old, to stop replays.
+func VerifyWebhook(secret, timestamp, signature string, body []byte) bool {
+	return hmac.Equal([]byte(signature), []byte(SignWebhook(secret, timestamp, body)))
+}
+
+func (w *Webhooks) CollectMetrics(mw *MetricWriter) {
+	w.mu.Lock()
+	hooks := len(w.hooks)
+	var succeeded, failed uint64
+	for _, st := range w.hooks {
+		succeeded += st.Succeeded
+		failed += st.Failed
+	}
+	retries := w.retries
+	w.mu.Unlock()
+
+	mw.Gauge("webhooks", "Registered webhooks.", Sample{Value: float64(hooks)})
+	mw.Counter("webhook_deliveries_total", "Changes sent to webhooks, by whether the receiver accepted them.",
+		Sample{Labels: []string{"result", DeliveryDelivered}, Value: float64(succeeded)},
+		Sample{Labels: []string{"result", DeliveryFailed}, Value: float64(failed)})
+	mw.Counter("webhook_retries_total", "Attempts to send a change to a webhook that failed and will be retried.",
+		Sample{Value: float64(retries)})
+}
+
+// ListWebhooksHandler responds with the WebhookStatus of every webhook.
+func (h *Handler) ListWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.svc.webhooks.List())
+}
+
+// RegisterWebhookHandler registers the Webhook in the request body, of
+// which url is required and prefix and secret are optional, and responds
+// with it, including its secret, and status 201.
+func (h *Handler) RegisterWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var hook Webhook
+	if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+		writeError(w, r, fmt.Errorf("%w: invalid webhook: %v", ErrorInvalidArgument, err))
+		return
+	}
+
+	hook, err := h.svc.webhooks.Register(hook)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(hook)
+}
+
+// GetWebhookHandler responds with the WebhookStatus of the webhook {id},
+// including its latest deliveries.
+func (h *Handler) GetWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	status, err := h.svc.webhooks.Status(routeVar(r, "id"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// DeleteWebhookHandler removes the webhook {id}.
+func (h *Handler) DeleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if err := h.svc.webhooks.Delete(routeVar(r, "id")); err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver is a local webhook receiver that checks signatures and
+// records the changes it accepts. It refuses the first failures requests.
+type webhookReceiver struct {
+	t      *testing.T
+	secret string
+
+	mu       sync.Mutex
+	failures int
+	requests int
+	records  []AuditRecord
+	ids      []string
+}
+
+func (rcv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if !VerifyWebhook(rcv.secret, r.Header.Get(WebhookTimestampHeader), r.Header.Get(WebhookSignatureHeader), body) {
+		rcv.t.Errorf("Delivery with a bad signature: %s", body)
+		http.Error(w, "bad signature", http.StatusUnauthorized)
+		return
+	}
+
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	rcv.requests++
+	if rcv.failures > 0 {
+		rcv.failures--
+		http.Error(w, "try again", http.StatusServiceUnavailable)
+		return
+	}
+	var rec AuditRecord
+	json.Unmarshal(body, &rec)
+	rcv.records = append(rcv.records, rec)
+	rcv.ids = append(rcv.ids, r.Header.Get(WebhookDeliveryHeader))
+}
+
+func (rcv *webhookReceiver) keys() []string {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	var keys []string
+	for _, rec := range rcv.records {
+		keys = append(keys, rec.Key)
+	}
+	return keys
+}
+
+// waitFor fails the test unless cond holds within a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// newWebhookService returns a Service with watch enabled, writing to a log
+// in dir, and webhooks kept in dir, started with it.
+func newWebhookService(t *testing.T, dir string, opts ...WebhookOption) (*Service, *Webhooks) {
+	t.Helper()
+	broker := NewBroker()
+	db, _ := NewInMemoryDB(WithBroker(broker))
+	logger, err := InitializeFileTransactionLogger(db, filepath.Join(dir, "transaction.log"))
+	if err != nil {
+		t.Fatalf("InitializeFileTransactionLogger returned error: %v", err)
+	}
+	webhooks, err := OpenWebhooks(filepath.Join(dir, "webhooks.json"), opts...)
+	if err != nil {
+		t.Fatalf("OpenWebhooks returned error: %v", err)
+	}
+	svc := NewService(db, logger, WithWatch(broker), WithWebhooks(webhooks))
+	if err := webhooks.Start(svc); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	t.Cleanup(webhooks.Close)
+	return svc, webhooks
+}
+
+func TestWebhooks_Delivery(t *testing.T) {
+	rcv := &webhookReceiver{t: t, secret: "s3cret", failures: 2}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	svc, webhooks := newWebhookService(t, t.TempDir(), WithWebhookRetries(5, time.Millisecond, 10*time.Millisecond))
+	svc.Put(Caller{}, "app/before", "x")
+	hook, err := webhooks.Register(Webhook{URL: server.URL, Prefix: "app/", Secret: "s3cret"})
+	if err != nil || hook.Since != 1 {
+		t.Fatalf("Expected the webhook to start after event 1, got %+v, %v", hook, err)
+	}
+
+	svc.Put(Caller{Principal: "alice"}, "app/a", "1")
+	svc.Put(Caller{}, "other/b", "2")
+	svc.Increment(Caller{}, "app/n", 5)
+	svc.Delete(Caller{}, "app/a")
+
+	waitFor(t, "three deliveries", func() bool { return len(rcv.keys()) == 3 })
+	if keys := strings.Join(rcv.keys(), " "); keys != "app/a app/n app/a" {
+		t.Errorf("Expected the changes under app/ in order, got %s", keys)
+	}
+	rec := rcv.records[0]
+	if rec.Sequence != 2 || rec.Type != "put" || rec.Value != "1" || rec.Principal != "alice" {
+		t.Errorf("Unexpected change %+v", rec)
+	}
+	if rcv.ids[0] != hook.ID+"-2" || rcv.requests != 5 {
+		t.Errorf("Expected delivery %s-2 after 2 refusals, got %s after %d requests", hook.ID, rcv.ids[0], rcv.requests)
+	}
+
+	waitFor(t, "the status to catch up", func() bool {
+		status, _ := webhooks.Status(hook.ID)
+		return status.Delivered == 5
+	})
+	status, _ := webhooks.Status(hook.ID)
+	first := status.Deliveries[len(status.Deliveries)-1]
+	if status.Secret != "" || status.Succeeded != 3 || first.Attempts != 3 || first.State != DeliveryDelivered || first.Status != 200 {
+		t.Errorf("Unexpected status %+v", status)
+	}
+}
+
+func TestWebhooks_LogFailure(t *testing.T) {
+	rcv := &webhookReceiver{t: t, secret: "s"}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	svc, webhooks := newWebhookService(t, t.TempDir(), WithWebhookRetries(5, time.Millisecond, 10*time.Millisecond))
+	if _, err := webhooks.Register(Webhook{URL: server.URL, Secret: "s"}); err != nil {
+		t.Fatalf("Register returned error: %v", err)
+	}
+	svc.Put(Caller{}, "a", "1")
+	waitFor(t, "the first delivery", func() bool { return len(rcv.keys()) == 1 })
+
+	// 1. A change that is published but not yet logged is held back
+	svc.broker.Publish(Event{Sequence: 2, EventType: EventPut, Key: "b", Value: "2"})
+	time.Sleep(50 * time.Millisecond)
+	if keys := strings.Join(rcv.keys(), " "); keys != "a" {
+		t.Errorf("Expected a change that is not logged to be held back, got %s", keys)
+	}
+
+	// 2. Once the write fails it is never delivered
+	svc.logger.(*FileTransactionLogger).file.Close()
+	if _, err := svc.Put(Caller{}, "c", "3"); err == nil {
+		t.Fatal("Expected the write to fail")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if keys := strings.Join(rcv.keys(), " "); keys != "a" {
+		t.Errorf("Expected only the logged change to be delivered, got %s", keys)
+	}
+}
+
+func TestWebhooks_GiveUp(t *testing.T) {
+	rcv := &webhookReceiver{t: t, secret: "s", failures: 3}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	svc, webhooks := newWebhookService(t, t.TempDir(), WithWebhookRetries(3, time.Millisecond, time.Millisecond))
+	hook, _ := webhooks.Register(Webhook{URL: server.URL, Secret: "s"})
+	svc.Put(Caller{}, "a", "1")
+	svc.Put(Caller{}, "b", "2")
+
+	waitFor(t, "the second change", func() bool {
+		status, _ := webhooks.Status(hook.ID)
+		return status.Delivered == 2
+	})
+	status, _ := webhooks.Status(hook.ID)
+	if rcv.keys()[0] != "b" || status.Failed != 1 || status.Deliveries[1].State != DeliveryFailed ||
+		!strings.Contains(status.Deliveries[1].Error, "503") {
+		t.Errorf("Expected a to be given up on and b delivered, got %v, %+v", rcv.keys(), status)
+	}
+}
+
+func TestWebhooks_Restart(t *testing.T) {
+	dir := t.TempDir()
+	rcv := &webhookReceiver{t: t, secret: "s"}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	svc, webhooks := newWebhookService(t, dir)
+	hook, _ := webhooks.Register(Webhook{URL: server.URL, Secret: "s"})
+	svc.Put(Caller{}, "a", "1")
+	waitFor(t, "the first change", func() bool { return len(rcv.keys()) == 1 })
+	waitFor(t, "the progress to be saved", func() bool {
+		status, _ := webhooks.Status(hook.ID)
+		return status.Delivered == 1
+	})
+
+	// Changes made while deliveries are stopped are sent after a restart,
+	// from the log.
+	webhooks.Close()
+	svc.Put(Caller{}, "b", "2")
+	svc.Put(Caller{}, "c", "3")
+	fileLogger := svc.logger.(*FileTransactionLogger)
+	close(fileLogger.events)
+	for writeErr := range fileLogger.errors {
+		t.Fatalf("Got an error from the transaction logger: %v", writeErr)
+	}
+
+	newWebhookService(t, dir)
+	waitFor(t, "the changes made while stopped", func() bool { return len(rcv.keys()) == 3 })
+	if keys := strings.Join(rcv.keys(), " "); keys != "a b c" {
+		t.Errorf("Expected each change once, in order, got %s", keys)
+	}
+}
+
+func TestHandler_Webhooks(t *testing.T) {
+	_, webhooks := newWebhookService(t, t.TempDir())
+	handler := NewServiceHandler(webhooks.svc)
+	router := NewRouter(&handler)
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rr
+	}
+
+	rr := do("POST", "/v1/webhook", `{"url": "http://localhost:1/hook", "prefix": "jobs/"}`)
+	var hook Webhook
+	json.NewDecoder(rr.Body).Decode(&hook)
+	if rr.Code != http.StatusCreated || hook.ID == "" || len(hook.Secret) != 64 || hook.Prefix != "jobs/" {
+		t.Fatalf("Expected the webhook with a secret, got %d: %+v", rr.Code, hook)
+	}
+	if rr := do("POST", "/v1/webhook", `{"url": "ftp://example.com"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a non-HTTP URL, got %d", rr.Code)
+	}
+
+	rr = do("GET", "/v1/webhook", "")
+	var statuses []WebhookStatus
+	json.NewDecoder(rr.Body).Decode(&statuses)
+	if len(statuses) != 1 || statuses[0].ID != hook.ID || strings.Contains(rr.Body.String(), hook.Secret) {
+		t.Errorf("Expected the webhook to be listed without its secret, got %s", rr.Body)
+	}
+	if rr := do("GET", "/v1/webhook/"+hook.ID, ""); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"deliveries":[]`) {
+		t.Errorf("Expected the status of the webhook, got %d: %s", rr.Code, rr.Body)
+	}
+	if rr := do("DELETE", "/v1/webhook/"+hook.ID, ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected status 200 deleting the webhook, got %d", rr.Code)
+	}
+	if rr := do("GET", "/v1/webhook/"+hook.ID, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a deleted webhook, got %d", rr.Code)
+	}
+}
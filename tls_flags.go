@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"keyvaluestore/tlsconfig"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	devCertFile = "dev-cert.pem"
+	devKeyFile  = "dev-key.pem"
+
+	// devCertValidity is how long a generated development certificate is
+	// valid for; an expired one is replaced at the next start.
+	devCertValidity = 365 * 24 * time.Hour
+
+	// certCheckInterval is how often the certificate files are checked for
+	// changes.
+	certCheckInterval = 10 * time.Second
+)
+
+// tlsFlags are the flags that configure TLS for the HTTP and gRPC APIs.
+type tlsFlags struct {
+	certFile     *string
+	keyFile      *string
+	clientCAFile *string
+	plainHTTP    *bool
+}
+
+func registerTLSFlags(fs *flag.FlagSet) tlsFlags {
+	return tlsFlags{
+		certFile:     fs.String("tls-cert", "", "PEM certificate of the HTTP and gRPC APIs, reloaded when it changes or on SIGHUP (empty for a self-signed "+devCertFile+")"),
+		keyFile:      fs.String("tls-key", "", "PEM key of -tls-cert"),
+		clientCAFile: fs.String("tls-client-ca", "", "PEM file of CAs that client certificates must be signed by; when set, clients must present one"),
+		plainHTTP:    fs.Bool("plain-http", false, "serve the HTTP and gRPC APIs without TLS, for local development only"),
+	}
+}
+
+// serverConfig returns the TLS configuration of the APIs, or nil with
+// -plain-http. Without -tls-cert, it uses a self-signed development
+// certificate, generating it if there is none or it has expired. The
+// certificate is watched for changes until the process exits.
+func (f tlsFlags) serverConfig() (*tls.Config, error) {
+	if *f.plainHTTP {
+		log.Printf("serving without TLS (-plain-http)")
+		return nil, nil
+	}
+
+	certFile, keyFile := *f.certFile, *f.keyFile
+	if certFile == "" {
+		certFile, keyFile = devCertFile, devKeyFile
+		if err := ensureDevCert(certFile, keyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	reloader, err := tlsconfig.NewReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	go reloader.Watch(certCheckInterval, nil)
+
+	return tlsconfig.ServerConfig(reloader, *f.clientCAFile)
+}
+
+// ensureDevCert generates a self-signed certificate in certFile and
+// keyFile unless a valid one is already there.
+func ensureDevCert(certFile, keyFile string) error {
+	if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil && time.Now().Before(cert.Leaf.NotAfter) {
+		return nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	hosts := tlsconfig.DevHosts()
+	if err := tlsconfig.GenerateSelfSigned(certFile, keyFile, hosts, devCertValidity); err != nil {
+		return err
+	}
+	log.Printf("generated a self-signed development certificate for %v in %s; clients must trust it, e.g. kvctl -ca %s",
+		hosts, certFile, certFile)
+	return nil
+}
@@ -0,0 +1,160 @@
+// Package tlsconfig builds the TLS configuration of the server: a
+// certificate that is reloaded when its files change, a self-signed
+// certificate for development, and verification of client certificates
+// for mutual TLS.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Reloader holds a certificate loaded from a certificate and key file, and
+// serves it through GetCertificate, so that a renewed certificate is used
+// for new connections without restarting the server.
+type Reloader struct {
+	certFile string
+	keyFile  string
+
+	mu    sync.RWMutex
+	cert  *tls.Certificate
+	stamp fileStamp
+}
+
+// fileStamp identifies the contents of the certificate and key files by
+// their size and modification time.
+type fileStamp struct {
+	certSize, keySize int64
+	certTime, keyTime time.Time
+}
+
+// NewReloader loads the certificate in certFile and its key in keyFile.
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the certificate and key files again. If they cannot be
+// loaded, the current certificate is kept.
+func (r *Reloader) Reload() error {
+	stamp, err := r.statFiles()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("cannot load certificate: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.stamp = stamp
+	return nil
+}
+
+// GetCertificate returns the current certificate. It is meant for
+// tls.Config.GetCertificate.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Watch reloads the certificate whenever either file changes, checking
+// every interval, and whenever the process receives SIGHUP, until stop is
+// closed. Failed reloads are logged and retried at the next check; the
+// current certificate is served meanwhile, so a certificate and key that
+// are replaced one after the other are picked up once both are in place.
+func (r *Reloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hup:
+			if err := r.Reload(); err != nil {
+				log.Printf("tls: reload on SIGHUP failed, keeping the current certificate: %v", err)
+			} else {
+				log.Printf("tls: reloaded %s on SIGHUP", r.certFile)
+			}
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+			if err := r.Reload(); err != nil {
+				log.Printf("tls: reload failed, keeping the current certificate: %v", err)
+			} else {
+				log.Printf("tls: reloaded %s", r.certFile)
+			}
+		}
+	}
+}
+
+// changed reports whether the files differ from those last loaded.
+func (r *Reloader) changed() bool {
+	stamp, err := r.statFiles()
+	if err != nil {
+		return false // being replaced; look again at the next check
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return stamp != r.stamp
+}
+
+func (r *Reloader) statFiles() (fileStamp, error) {
+	cert, err := os.Stat(r.certFile)
+	if err != nil {
+		return fileStamp{}, fmt.Errorf("cannot load certificate: %w", err)
+	}
+	key, err := os.Stat(r.keyFile)
+	if err != nil {
+		return fileStamp{}, fmt.Errorf("cannot load certificate key: %w", err)
+	}
+	return fileStamp{
+		certSize: cert.Size(), keySize: key.Size(),
+		certTime: cert.ModTime(), keyTime: key.ModTime(),
+	}, nil
+}
+
+// ServerConfig returns the TLS configuration of a server presenting the
+// certificate of r. If clientCAFile is not empty, clients must present a
+// certificate signed by one of the CAs in it, whose common name becomes
+// the principal of their requests.
+func ServerConfig(r *Reloader, clientCAFile string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		GetCertificate: r.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if clientCAFile == "" {
+		return cfg, nil
+	}
+
+	pem, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read client CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	return cfg, nil
+}
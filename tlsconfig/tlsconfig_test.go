@@ -0,0 +1,159 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func generateTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := GenerateSelfSigned(certFile, keyFile, DevHosts(), time.Hour); err != nil {
+		t.Fatalf("GenerateSelfSigned returned error: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func startTestServer(t *testing.T, cfg *tls.Config) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = cfg
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// serverCert connects to srv as a client trusting certFile, with the
+// client certificate in clientCert, if any, and returns the certificate
+// the server presented.
+func serverCert(t *testing.T, srv *httptest.Server, certFile string, clientCert *tls.Certificate) (*x509.Certificate, error) {
+	t.Helper()
+	pem, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(pem)
+
+	cfg := &tls.Config{RootCAs: pool, ServerName: "localhost"}
+	if clientCert != nil {
+		cfg.Certificates = []tls.Certificate{*clientCert}
+	}
+	conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.Handshake(); err != nil {
+		return nil, err
+	}
+	return conn.ConnectionState().PeerCertificates[0], nil
+}
+
+func TestGenerateSelfSigned(t *testing.T) {
+	certFile, keyFile := generateTestCert(t, t.TempDir())
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("LoadX509KeyPair returned error: %v", err)
+	}
+	for _, host := range []string{"localhost", "127.0.0.1", "::1"} {
+		if err := cert.Leaf.VerifyHostname(host); err != nil {
+			t.Errorf("Expected the certificate to be valid for %s: %v", host, err)
+		}
+	}
+	if info, err := os.Stat(keyFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the key to have mode 0600, got %v, %v", info.Mode(), err)
+	}
+}
+
+func TestReloader_Reload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := generateTestCert(t, dir)
+
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewReloader returned error: %v", err)
+	}
+	cfg, err := ServerConfig(r, "")
+	if err != nil {
+		t.Fatalf("ServerConfig returned error: %v", err)
+	}
+	srv := startTestServer(t, cfg)
+
+	first, err := serverCert(t, srv, certFile, nil)
+	if err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+
+	// A broken certificate is not loaded, and the current one is kept.
+	os.WriteFile(keyFile, []byte("not a key"), 0600)
+	if err := r.Reload(); err == nil {
+		t.Error("Expected Reload to fail with a broken key")
+	}
+	if _, err := serverCert(t, srv, certFile, nil); err != nil {
+		t.Errorf("Expected the current certificate to be kept, got %v", err)
+	}
+
+	generateTestCert(t, dir)
+	if !r.changed() {
+		t.Error("Expected the replaced files to be noticed")
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload returned error: %v", err)
+	}
+	second, err := serverCert(t, srv, certFile, nil)
+	if err != nil {
+		t.Fatalf("Handshake after reload failed: %v", err)
+	}
+	if first.SerialNumber.Cmp(second.SerialNumber) == 0 {
+		t.Error("Expected the new certificate after a reload")
+	}
+	if r.changed() {
+		t.Error("Expected no change after a reload")
+	}
+}
+
+func TestServerConfig_ClientCA(t *testing.T) {
+	certFile, keyFile := generateTestCert(t, t.TempDir())
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewReloader returned error: %v", err)
+	}
+
+	// The development certificate is its own CA, so it can be the client
+	// certificate as well.
+	cfg, err := ServerConfig(r, certFile)
+	if err != nil {
+		t.Fatalf("ServerConfig returned error: %v", err)
+	}
+	srv := startTestServer(t, cfg)
+
+	clientCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := serverCert(t, srv, certFile, &clientCert); err != nil {
+		t.Errorf("Expected a client certificate signed by the CA to be accepted, got %v", err)
+	}
+
+	// TLS 1.3 reports a rejected client certificate on the first read.
+	conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err == nil {
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	if err == nil {
+		t.Error("Expected a client without a certificate to be refused")
+	}
+
+	if _, err := ServerConfig(r, keyFile); err == nil {
+		t.Error("Expected an error for a client CA file without certificates")
+	}
+}